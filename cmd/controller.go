@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/tumblr/k8s-config-projector/internal/pkg/conf"
+	"github.com/tumblr/k8s-config-projector/pkg/controller"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// runController reconciles ConfigProjection resources in the cluster until we are signalled to stop.
+// It returns the exit code for the process.
+func runController(c conf.Config) int {
+	// with no kubeconfig, this falls back to the in-cluster config
+	restConfig, err := clientcmd.BuildConfigFromFlags("", c.Kubeconfig())
+	if err != nil {
+		log.Printf("unable to load kubeconfig: %s", err.Error())
+		return 1
+	}
+	ctl, err := controller.NewForConfig(projectorOptions(c), c.SecretScanMode(), c.ResyncPeriod(), restConfig)
+	if err != nil {
+		log.Printf("unable to create controller: %s", err.Error())
+		return 1
+	}
+
+	stopCh := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-sigs
+		log.Printf("Received %s, shutting down", s)
+		close(stopCh)
+	}()
+	ctl.Run(stopCh)
+	return 0
+}
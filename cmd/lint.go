@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+
+	"github.com/tumblr/k8s-config-projector/internal/pkg/conf"
+	"github.com/tumblr/k8s-config-projector/pkg/lint"
+	"github.com/tumblr/k8s-config-projector/pkg/report"
+)
+
+// lintManifests loads every manifest, reporting the problems validation finds along with the
+// findings of the lint rules. Only errors fail the run. It returns the exit code for the process.
+func lintManifests(c conf.Config) int {
+	p, err := newProjector(c)
+	if err != nil {
+		log.Printf("%s", err.Error())
+		return 1
+	}
+	var config *lint.Config
+	if c.LintConfigPath() != "" {
+		if config, err = lint.Load(c.LintConfigPath()); err != nil {
+			log.Printf("%s", err.Error())
+			return 1
+		}
+	}
+	rep := report.New()
+	manifests, err := p.LoadDir(c.ManifestDir(), rep)
+	if err != nil {
+		log.Printf("error loading projection manifests: %s", err.Error())
+		return 1
+	}
+	lint.New(config, p.SourceRoot()).Lint(manifests, rep)
+
+	if err := writeReport(c, rep); err != nil {
+		log.Printf("unable to write report: %s", err.Error())
+		return 1
+	}
+	if !rep.OK() {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/tumblr/k8s-config-projector/internal/pkg/conf"
+	"github.com/tumblr/k8s-config-projector/pkg/lsp"
+)
+
+// serveLSP serves the language server over stdio until the editor exits. Logs go to stderr, as
+// stdout is the protocol. It returns the exit code for the process.
+func serveLSP(c conf.Config) int {
+	p, err := newProjector(c)
+	if err != nil {
+		log.Printf("%s", err.Error())
+		return 1
+	}
+	if err := lsp.New(p).Serve(os.Stdin, os.Stdout); err != nil {
+		log.Printf("language server failed: %s", err.Error())
+		return 1
+	}
+	return 0
+}
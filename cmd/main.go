@@ -1,34 +1,25 @@
 package main
 
 import (
-	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"runtime"
-	"strings"
 	"time"
 
 	"github.com/tumblr/k8s-config-projector/internal/pkg/conf"
 	"github.com/tumblr/k8s-config-projector/internal/pkg/version"
 	"github.com/tumblr/k8s-config-projector/pkg/output"
+	"github.com/tumblr/k8s-config-projector/pkg/projector"
+	"github.com/tumblr/k8s-config-projector/pkg/report"
+	"github.com/tumblr/k8s-config-projector/pkg/scan"
+	"github.com/tumblr/k8s-config-projector/pkg/summary"
+	"github.com/tumblr/k8s-config-projector/pkg/targets"
 	"github.com/tumblr/k8s-config-projector/pkg/types/v1/manifest"
 )
 
-const (
-	// ConfigMapSizeLimit is the max size of a ConfigMap we support (in string format).
-	// This is pretty rough, but it is intended to avoid the 1M etcd max
-	// There are a few limits:
-	// * ConfigMaps cannot be over 1M.  This is etcd's limitation.
-	// * Internally, `kubectl apply` creates annotations, which has a size limit of 256K. This translates to a ConfigMap that can't be over ~512K.
-	// For reference, these are size limits discussions:
-	// * https://github.com/coreos/prometheus-operator/issues/535#issuecomment-319659063
-	// * https://github.com/kubernetes/kubernetes/issues/15878#issuecomment-149728026
-	ConfigMapSizeLimit = 500000 // 500k max!
-)
-
 //
 // this program assumes the config repos are cloned into local directories
 // the repo-to-directory mappings are read from repos yaml file, which is passed by cli
@@ -42,73 +33,263 @@ func main() {
 	log.Printf("Starting up. version=%s commit=%s branch=%s built=%s runtime=%s", version.Version, version.Commit, version.Branch, version.BuildDate, runtime.Version())
 	if c.Debug() {
 		log.Printf("config base path: %s\n", c.ConfigDir())
+		if commit := c.ConfigCommit(); commit != "" {
+			log.Printf("config commit: %s\n", commit)
+		}
 		log.Printf("manifest directory: %s\n", c.ManifestDir())
 		log.Printf("output directory: %s\n", c.OutputDir())
 	}
 
-	manifests, err := loadManifests(c)
+	if c.Command() == conf.CommandValidate {
+		os.Exit(validate(c))
+	}
+	if c.Command() == conf.CommandController {
+		os.Exit(runController(c))
+	}
+	if c.Command() == conf.CommandServe {
+		os.Exit(serve(c))
+	}
+	if c.Command() == conf.CommandMigrate {
+		os.Exit(migrateManifests(c))
+	}
+	if c.Command() == conf.CommandSchema {
+		os.Exit(writeSchema())
+	}
+	if c.Command() == conf.CommandLSP {
+		os.Exit(serveLSP(c))
+	}
+	if c.Command() == conf.CommandQuery {
+		os.Exit(query(c))
+	}
+	if c.Command() == conf.CommandLint {
+		os.Exit(lintManifests(c))
+	}
+
+	p, err := newProjector(c)
+	if err != nil {
+		log.Fatalf("%s\n", err.Error())
+	}
+
+	// when keeping going, problems are collected here and reported at the end instead of aborting.
+	// With --report, they are collected too, so the report is written even when aborting
+	var rep *report.Report
+	keepGoing := c.KeepGoing() || c.Watch()
+	if keepGoing || c.ReportPath() != "" {
+		rep = report.New()
+	}
+
+	manifests, err := p.LoadDir(c.ManifestDir(), rep)
 	if err != nil {
-		log.Fatal("error loading projection manifests: " + err.Error())
+		abort(c, rep, "error loading projection manifests: %s", err.Error())
+	}
+	if !keepGoing && rep != nil && !rep.OK() {
+		abort(c, rep, "unable to load projection manifests: %s", rep.Problems[0].String())
 	}
 
-	if len(manifests) == 0 {
-		log.Fatal("No manifest loaded! Aborting\n")
+	if len(manifests) == 0 && (rep == nil || rep.OK()) {
+		abort(c, rep, "No manifest loaded! Aborting\n")
 	}
 
 	// timestamp
 	tUnix := time.Now().Unix()
 
-	// project each config file into a separate ConfigMap
-	for _, m := range manifests {
-		fname := filepath.Join(c.OutputDir(), output.BuildFileOutputName(m.GetNamespace(), m.GetName(), tUnix))
-		log.Printf("Writing ConfigMap %s/%s to %s", m.GetNamespace(), m.GetName(), fname)
-		cfgString, err := m.ProjectConfigMapAsYAML()
-		if err != nil {
-			log.Fatalf("unable to project %s/%s: %s", m.GetNamespace(), m.GetName(), err.Error())
+	// the resources written are summarized here, when asked to
+	var sum *summary.Summary
+	if c.SummaryPath() != "" || c.SummaryMarkdownPath() != "" {
+		sum = summary.New(c.Generation(), p.Options().SizeLimit, c.SummaryKey())
+	}
+
+	if c.Watch() {
+		os.Exit(watchManifests(c, p, manifests, rep, tUnix))
+	}
+
+	if len(c.Targets()) == 0 {
+		// project each config file into a separate ConfigMap
+		for _, key := range manifests.Keys() {
+			m := manifests[key]
+			projectAndWrite(c, p, rep, sum, key, m, nil, c.OutputDir(), tUnix)
+		}
+	}
+	// or, for each target, every manifest that selects it into the target's own directory
+	for _, t := range c.Targets() {
+		t := t
+		dir := filepath.Join(c.OutputDir(), filepath.FromSlash(t.OutputDir()))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			abort(c, rep, "unable to create output directory for target %s: %s", t.Name, err.Error())
 		}
+		for _, key := range manifests.Keys() {
+			m := manifests[key]
+			if m.Selects(t) {
+				projectAndWrite(c, p, rep, sum, key, m, &t, dir, tUnix)
+			}
+		}
+	}
 
-		// before we write this out, lets make sure the byte size isnt exceeding our hardcoded limit
-		if len([]byte(cfgString)) > ConfigMapSizeLimit {
-			log.Fatalf("generated ConfigMap for %s/%s that was %d bytes, exceeding size limit of %d bytes\nYou may want to split this projection into multiple ConfigMaps to reduce size", m.GetNamespace(), m.GetName(), len([]byte(cfgString)), ConfigMapSizeLimit)
+	if sum != nil {
+		if err := writeSummary(c, sum); err != nil {
+			abort(c, rep, "unable to write summary: %s", err.Error())
+		}
+	}
+	if rep != nil {
+		if err := writeReport(c, rep); err != nil {
+			log.Fatalf("unable to write report: %s", err.Error())
 		}
+		if !rep.OK() {
+			log.Fatalf("found %d problems projecting manifests", len(rep.Problems))
+		}
+	}
+}
 
-		err = ioutil.WriteFile(fname, []byte(cfgString), 0600)
-		if err != nil {
-			log.Fatalf("unable to write config to %s: %s", fname, err.Error())
+// projectAndWrite projects m (for target t, if not nil) and writes it into dir, recording how long
+// that took and how big it was in rep, if any, and what was written in sum, if any. Problems are
+// recorded in rep too, and abort the run unless keeping going.
+func projectAndWrite(c conf.Config, p *projector.Projector, rep *report.Report, sum *summary.Summary, key string, m manifest.ConfigProjectionManifest, t *targets.Target, dir string, tUnix int64) {
+	var result *projector.Result
+	var err error
+	started := time.Now()
+	if t != nil {
+		key = fmt.Sprintf("%s@%s", key, t.Name)
+		result, err = p.ProjectTarget(m, *t)
+	} else {
+		result, err = p.Project(m)
+	}
+	if err != nil {
+		if rep == nil {
+			log.Fatalf("unable to project %s: %s", key, err.Error())
+		}
+		rep.Record(m.GetPath(), key, started, 0)
+		rep.Add(m.GetPath(), key, err)
+		if !c.KeepGoing() {
+			abort(c, rep, "unable to project %s: %s", key, err.Error())
 		}
+		return
+	}
+	if rep != nil {
+		rep.Record(m.GetPath(), key, started, len(result.YAML))
+	}
+	if !handleFindings(c, rep, key, m, result.Findings) {
+		if !c.KeepGoing() {
+			abort(c, rep, "unable to project %s: %s", key, result.Findings[0].Error())
+		}
+		return
+	}
+	// the name and namespace may use target variables
+	fname := filepath.Join(dir, output.BuildFileOutputName(result.Namespace, result.Name, tUnix))
+	log.Printf("Writing %s %s/%s to %s", result.Resource, result.Namespace, result.Name, fname)
+	if err := output.WriteFileAtomic(fname, []byte(result.YAML)); err != nil {
+		abort(c, rep, "unable to write config to %s: %s", fname, err.Error())
+	}
+	if sum != nil {
+		sum.Add(m, result, fname)
+	}
+}
+
+// abort writes rep, if there is one, then exits, so the problem that stopped the run is in its report
+func abort(c conf.Config, rep *report.Report, format string, args ...interface{}) {
+	if rep != nil {
+		if err := writeReport(c, rep); err != nil {
+			log.Printf("unable to write report: %s", err.Error())
+		}
+	}
+	log.Fatalf(format, args...)
+}
+
+// newProjector returns a projector.Projector projecting with the settings in c
+func newProjector(c conf.Config) (*projector.Projector, error) {
+	return projector.New(projectorOptions(c))
+}
 
+// projectorOptions returns the projector.Options for the settings in c
+func projectorOptions(c conf.Config) projector.Options {
+	return projector.Options{
+		ConfigRoot:      c.ConfigDir(),
+		ConfigFS:        c.ConfigFS(),
+		ConfigCommit:    c.ConfigCommit(),
+		ConfigRoots:     c.ConfigRoots(),
+		ManifestDir:     c.ManifestDir(),
+		Generation:      c.Generation(),
+		LabelVersionKey: c.LabelVersionKey(),
+		LabelManagedKey: c.LabelManagedKey(),
+		SourceAllowlist: c.SourceAllowlist(),
+		Policy:          c.Policy(),
+		SecretScanner:   c.SecretScanner(),
+		SopsKeys:        c.SopsKeys(),
+		Vars:            c.Vars(),
+		Library:         c.Library(),
+		Targets:         c.Targets(),
+		Skipped: func(path string, reason string) {
+			log.Printf("skipped %s: %s", path, reason)
+		},
 	}
 }
 
-// loadManifests takes a conf.Config, determines the root manifest path, and recursively finds all
-// yaml manifests under it. It loads, parses, and validates the manifests before returning them in
-// a map from "namespace/name" -> manifest.ConfigProjectionManifest
-func loadManifests(cfg conf.Config) (manifests map[string]manifest.ConfigProjectionManifest, err error) {
-	rootpath := cfg.ManifestDir()
-	err = filepath.Walk(rootpath, func(path string, info os.FileInfo, err error) error {
+// handleFindings records secret scan findings as problems in rep, as warnings unless
+// --secret-scan=fail. Without a rep, they are logged, or abort the run when failing on them. key
+// is what m was projected as, i.e. `namespace/name@target`. It returns false if the ConfigMap
+// should not be written.
+func handleFindings(c conf.Config, rep *report.Report, key string, m manifest.ConfigProjectionManifest, findings []*scan.Finding) bool {
+	fail := c.SecretScanMode() == scan.ModeFail
+	for _, f := range findings {
+		if rep == nil {
+			if !fail {
+				log.Printf("WARNING: %s: %s", key, f.Error())
+				continue
+			}
+			log.Fatalf("unable to project %s: %s", key, f.Error())
+		}
+		rep.Add(m.GetPath(), key, f)
+		p := &rep.Problems[len(rep.Problems)-1]
+		p.Rule = scan.ReportRule
+		if !fail {
+			p.Severity = report.SeverityWarning
+		}
+	}
+	return len(findings) == 0 || !fail
+}
+
+// writeSummary compares sum to the previous summary, if any, and writes it as JSON and/or Markdown
+func writeSummary(c conf.Config, sum *summary.Summary) error {
+	sum.Finish()
+	if c.PreviousSummaryPath() != "" {
+		previous, err := summary.Load(c.PreviousSummaryPath())
 		if err != nil {
 			return err
 		}
-		if info == nil || info.IsDir() {
-			return nil
-		}
-		if !strings.HasSuffix(info.Name(), ".yaml") {
-			return nil
+		sum.Compare(previous)
+	}
+	outputs := []struct {
+		path  string
+		write func(io.Writer) error
+	}{{c.SummaryPath(), sum.WriteJSON}, {c.SummaryMarkdownPath(), sum.WriteMarkdown}}
+	for _, o := range outputs {
+		if o.path == "" {
+			continue
 		}
-		raw, err := ioutil.ReadFile(path)
+		f, err := os.Create(o.path)
 		if err != nil {
-			return errors.New(path + ": " + err.Error())
+			return err
 		}
-		m, err := manifest.LoadFromYAMLBytes(raw, cfg)
-		if err != nil {
-			return errors.New(path + ": " + err.Error())
+		err = o.write(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
 		}
-		key := fmt.Sprintf("%s/%s", m.Namespace, m.Name)
-		if _, ok := manifests[key]; ok {
-			return fmt.Errorf("duplicate projection mapping found at namespace=%s name=%s file=%s", m.Namespace, m.Name, path)
+		if err != nil {
+			return err
 		}
-		manifests[key] = m
-		return nil
-	})
-	return manifests, err
+	}
+	return nil
+}
+
+// writeReport writes rep to the configured report path, or stdout
+func writeReport(c conf.Config, rep *report.Report) error {
+	rep.Finish()
+	if c.ReportPath() == "" {
+		return rep.Write(os.Stdout, c.ReportFormat())
+	}
+	f, err := os.Create(c.ReportPath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return rep.Write(f, c.ReportFormat())
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tumblr/k8s-config-projector/internal/pkg/conf"
+	"github.com/tumblr/k8s-config-projector/pkg/discover"
+	"github.com/tumblr/k8s-config-projector/pkg/migrate"
+)
+
+// migrateManifests rewrites every manifest in the manifest directory to the newest schema, keeping
+// comments. Manifests that already use it are left alone, as are JSON manifests, which have no
+// comments to keep. It returns the exit code for the process.
+func migrateManifests(c conf.Config) int {
+	files, skipped, err := discover.FS(os.DirFS(c.ManifestDir()))
+	if err != nil {
+		log.Printf("error migrating manifests: %s", err.Error())
+		return 1
+	}
+	for _, s := range skipped {
+		log.Printf("skipped %s: %s", filepath.Join(c.ManifestDir(), filepath.FromSlash(s.Path)), s.Reason)
+	}
+	migrated, failed := 0, 0
+	for _, name := range files {
+		path := filepath.Join(c.ManifestDir(), filepath.FromSlash(name))
+		if strings.HasSuffix(name, ".json") {
+			log.Printf("skipped %s: json manifests are not migrated", path)
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Printf("error migrating manifests: %s", err.Error())
+			return 1
+		}
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Printf("error migrating manifests: %s", err.Error())
+			return 1
+		}
+		out, changed, err := migrate.Manifest(raw)
+		if err != nil {
+			log.Printf("unable to migrate %s: %s", path, err.Error())
+			failed++
+			continue
+		}
+		if !changed {
+			continue
+		}
+		if err := ioutil.WriteFile(path, out, info.Mode()); err != nil {
+			log.Printf("error migrating manifests: %s", err.Error())
+			return 1
+		}
+		log.Printf("migrated %s", path)
+		migrated++
+	}
+	log.Printf("migrated %d manifest files", migrated)
+	if failed > 0 {
+		log.Printf("unable to migrate %d manifest files", failed)
+		return 1
+	}
+	return 0
+}
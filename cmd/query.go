@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tumblr/k8s-config-projector/internal/pkg/conf"
+	"github.com/tumblr/k8s-config-projector/pkg/interpolate"
+	"github.com/tumblr/k8s-config-projector/pkg/projector"
+	"github.com/tumblr/k8s-config-projector/pkg/report"
+	ds "github.com/tumblr/k8s-config-projector/pkg/types/v1/datasource"
+)
+
+// maxQueryValue is the most of a value query prints
+const maxQueryValue = 4096
+
+// query evaluates a jsonpath against a source, printing what it selects and what `extract` would
+// project from it, or with --manifest, explains how each of a manifest's datasources projects. It
+// returns the exit code for the process.
+func query(c conf.Config) int {
+	p, err := newProjector(c)
+	if err != nil {
+		log.Printf("%s", err.Error())
+		return 1
+	}
+	if c.QueryManifest() != "" {
+		return explainManifest(c, p, os.Stdout)
+	}
+	return queryJSONPath(c, p, os.Stdout)
+}
+
+// queryJSONPath evaluates the jsonpath in the args against the source in the args
+func queryJSONPath(c conf.Config, p *projector.Projector, w io.Writer) int {
+	source, err := interpolate.String(c.Args()[0], c.Vars())
+	if err != nil {
+		log.Printf("%s", err.Error())
+		return 1
+	}
+	d := &ds.DataSource{Source: source, Extract: c.Args()[1]}
+	if err := d.SetDefaults(); err != nil {
+		log.Printf("%s: %s", source, err.Error())
+		return 1
+	}
+	fmt.Fprintf(w, "source:   %s (%s)\n", d.Source, d.SourceFormat)
+	fmt.Fprintf(w, "jsonpath: %s\n", d.Extract)
+	doc, err := p.SourceRoot().ReadStructured(d.Source, d.SourceFormat)
+	if err != nil {
+		log.Printf("unable to read %s: %s", d.Source, err.Error())
+		return 1
+	}
+	e, err := ds.Query(doc, d.Extract)
+	if err != nil {
+		log.Printf("unable to evaluate %s: %s", d.Extract, err.Error())
+		return 1
+	}
+	writeExtraction(w, e, "")
+	return 0
+}
+
+// writeExtraction writes the type and value an extraction selected, and what `extract` projects it as
+func writeExtraction(w io.Writer, e *ds.Extraction, indent string) {
+	fmt.Fprintf(w, "%stype:     %s\n", indent, e.Type)
+	fmt.Fprintf(w, "%svalue:\n%s", indent, indented(render(e.Value), indent+"  "))
+	if e.Err != nil {
+		fmt.Fprintf(w, "%sextract cannot project it: %s\n", indent, e.Err.Error())
+		return
+	}
+	fmt.Fprintf(w, "%sextract projects %d bytes:\n%s", indent, len(e.Bytes), indented(truncate(string(e.Bytes)), indent+"  "))
+}
+
+// explainManifest explains each datasource of each manifest in the --manifest file
+func explainManifest(c conf.Config, p *projector.Projector, w io.Writer) int {
+	path := c.QueryManifest()
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("%s", err.Error())
+		return 1
+	}
+	rep := report.New()
+	manifests, err := p.LoadFileBytes(path, raw, rep)
+	if err != nil {
+		rep.Add(path, "", err)
+	}
+	failed := !rep.OK()
+	if failed {
+		rep.WriteText(w)
+	}
+	for _, key := range manifests.Keys() {
+		m := manifests[key]
+		fmt.Fprintf(w, "%s (%s)\n", key, m.Origin())
+		explanations, err := m.Explain()
+		if err != nil {
+			fmt.Fprintf(w, "  error: %s\n", err.Error())
+			failed = true
+			continue
+		}
+		for _, e := range explanations {
+			d := e.DataSource
+			if e.Template != "" {
+				fmt.Fprintf(w, "data[%d] of template %s\n", e.Index, e.Template)
+			} else {
+				fmt.Fprintf(w, "data[%d]\n", e.Index)
+			}
+			fmt.Fprintf(w, "  source:        %s\n", d.Source)
+			fmt.Fprintf(w, "  source_format: %s%s\n", d.SourceFormat, inferred(e.InferredSourceFormat))
+			fmt.Fprintf(w, "  output_format: %s%s\n", d.OutputFormat, inferred(e.InferredOutputFormat))
+			if d.OutputFile != "" {
+				fmt.Fprintf(w, "  output_file:   %s\n", d.OutputFile)
+			}
+			if e.Files != nil {
+				fmt.Fprintf(w, "  files:         %s\n", strings.Join(e.Files, ", "))
+			}
+			for _, x := range e.Extractions {
+				fmt.Fprintf(w, "  %s: %s\n", x.Field, x.JSONPath)
+				fmt.Fprintf(w, "    type:     %s\n", x.Type)
+				fmt.Fprintf(w, "    value:\n%s", indented(render(x.Value), "      "))
+			}
+			for _, k := range sortedKeys(e.Projected) {
+				fmt.Fprintf(w, "  projects %s (%d bytes):\n%s", k, len(e.Projected[k]), indented(truncate(string(e.Projected[k])), "    "))
+			}
+			if e.Err != nil {
+				fmt.Fprintf(w, "  error: %s\n", e.Err.Error())
+				failed = true
+			}
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+func inferred(ok bool) string {
+	if ok {
+		return " (inferred)"
+	}
+	return ""
+}
+
+// render returns v as indented json
+func render(v interface{}) string {
+	raw, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return truncate(string(raw))
+}
+
+// truncate returns s, cut short if it is longer than maxQueryValue, without cutting a character in two
+func truncate(s string) string {
+	if len(s) > maxQueryValue {
+		n := maxQueryValue
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		return fmt.Sprintf("%s\n… (%d more bytes)", s[:n], len(s)-n)
+	}
+	return s
+}
+
+// indented returns each line of s after prefix
+func indented(s string, prefix string) string {
+	var b strings.Builder
+	for _, line := range strings.Split(strings.TrimSuffix(s, "\n"), "\n") {
+		b.WriteString(prefix + line + "\n")
+	}
+	return b.String()
+}
+
+func sortedKeys(m map[string][]byte) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/tumblr/k8s-config-projector/pkg/schema"
+)
+
+// writeSchema writes the JSON Schema of manifests to stdout. It returns the exit code for the process.
+func writeSchema() int {
+	if err := schema.Write(os.Stdout); err != nil {
+		log.Printf("error writing schema: %s", err.Error())
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/tumblr/k8s-config-projector/internal/pkg/conf"
+	"github.com/tumblr/k8s-config-projector/pkg/server"
+)
+
+// serve runs the preview server until it fails. It returns the exit code for the process.
+func serve(c conf.Config) int {
+	p, err := newProjector(c)
+	if err != nil {
+		log.Printf("%s", err.Error())
+		return 1
+	}
+	log.Printf("Serving previews of %s against %s on http://%s/", c.ManifestDir(), c.ConfigDir(), c.ListenAddr())
+	if err := http.ListenAndServe(c.ListenAddr(), server.New(p, c.SecretScanMode(), c.ListenAddr())); err != nil {
+		log.Printf("unable to serve: %s", err.Error())
+		return 1
+	}
+	return 0
+}
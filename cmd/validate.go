@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/tumblr/k8s-config-projector/internal/pkg/conf"
+	"github.com/tumblr/k8s-config-projector/pkg/report"
+)
+
+// validate loads, validates and dry-projects every manifest without writing any ConfigMaps,
+// then writes a report of every problem found. It returns the exit code for the process.
+func validate(c conf.Config) int {
+	p, err := newProjector(c)
+	if err != nil {
+		log.Printf("%s", err.Error())
+		return 1
+	}
+	rep := report.New()
+	manifests, err := p.LoadDir(c.ManifestDir(), rep)
+	if err != nil {
+		log.Printf("error loading projection manifests: %s", err.Error())
+		return 1
+	}
+
+	for _, key := range manifests.Keys() {
+		m := manifests[key]
+		if len(c.Targets()) == 0 {
+			started := time.Now()
+			result, err := p.Project(m)
+			if err != nil {
+				rep.Record(m.GetPath(), key, started, 0)
+				rep.Add(m.GetPath(), key, err)
+				continue
+			}
+			rep.Record(m.GetPath(), key, started, len(result.YAML))
+			handleFindings(c, rep, key, m, result.Findings)
+			continue
+		}
+		for _, t := range c.Targets() {
+			if !m.Selects(t) {
+				continue
+			}
+			tkey := fmt.Sprintf("%s@%s", key, t.Name)
+			started := time.Now()
+			result, err := p.ProjectTarget(m, t)
+			if err != nil {
+				rep.Record(m.GetPath(), tkey, started, 0)
+				rep.Add(m.GetPath(), tkey, err)
+				continue
+			}
+			rep.Record(m.GetPath(), tkey, started, len(result.YAML))
+			handleFindings(c, rep, tkey, m, result.Findings)
+		}
+	}
+
+	if err := writeReport(c, rep); err != nil {
+		log.Printf("unable to write report: %s", err.Error())
+		return 1
+	}
+	if !rep.OK() {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+
+	"github.com/tumblr/k8s-config-projector/internal/pkg/conf"
+	"github.com/tumblr/k8s-config-projector/pkg/projector"
+	"github.com/tumblr/k8s-config-projector/pkg/report"
+	"github.com/tumblr/k8s-config-projector/pkg/watch"
+)
+
+// watchManifests projects every manifest, then reprojects them as they change until the process
+// is killed. Output files are named with timestamp for the whole session, so each manifest
+// rewrites the same file. Problems are reported as they are found, and never abort. It returns
+// the exit code for the process.
+func watchManifests(c conf.Config, p *projector.Projector, manifests projector.Manifests, rep *report.Report, timestamp int64) int {
+	if !rep.OK() {
+		if err := writeReport(c, rep); err != nil {
+			log.Printf("unable to write report: %s", err.Error())
+		}
+	}
+	w, err := watch.New(p, manifests, watch.Options{
+		OutputDir: c.OutputDir(),
+		Timestamp: timestamp,
+		ScanMode:  c.SecretScanMode(),
+		Report: func(rep *report.Report) {
+			if err := writeReport(c, rep); err != nil {
+				log.Printf("unable to write report: %s", err.Error())
+			}
+		},
+	})
+	if err != nil {
+		log.Print(err.Error())
+		return 1
+	}
+	defer w.Close()
+	w.Run()
+	return 0
+}
@@ -1,20 +1,41 @@
 module github.com/tumblr/k8s-config-projector
 
 require (
+	filippo.io/age v1.0.0
+	github.com/ProtonMail/go-crypto v1.0.0
 	github.com/andreyvit/diff v0.0.0-20170406064948-c7f18ee00883
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/ghodss/yaml v1.0.0
+	github.com/go-git/go-git/v5 v5.12.0
 	github.com/gogo/protobuf v1.0.0 // indirect
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/google/btree v0.0.0-20160524151835-7d79101e329e // indirect
 	github.com/google/gofuzz v0.0.0-20170612174753-24818f796faf // indirect
+	github.com/googleapis/gnostic v0.0.0-20170729233727-0c5108395e2d // indirect
+	github.com/gregjones/httpcache v0.0.0-20170728041850-787624de3eb7 // indirect
+	github.com/hashicorp/golang-lru v0.0.0-20160207214719-a0d98a5f2880 // indirect
+	github.com/howeyc/gopass v0.0.0-20170109162249-bf9dde6d0d2c // indirect
+	github.com/imdario/mergo v0.0.0-20141206190957-6633656539c1 // indirect
+	github.com/json-iterator/go v0.0.0-20170829155851-36b14963da70 // indirect
+	github.com/juju/ratelimit v0.0.0-20170523012141-5b9ff8664717 // indirect
 	github.com/oliveagle/jsonpath v0.0.0-20180314032104-46faf33da135
-	github.com/sergi/go-diff v1.0.0 // indirect
+	github.com/peterbourgon/diskv v2.0.1+incompatible // indirect
+	github.com/sergi/go-diff v1.3.2-0.20230802210424-5b0b94c5c0d3 // indirect
 	github.com/spf13/pflag v1.0.0 // indirect
-	golang.org/x/net v0.0.0-20180202180947-2fb46b16b8dd // indirect
-	golang.org/x/text v0.0.0-20171227012246-e19ae1496984 // indirect
+	golang.org/x/crypto v0.21.0
+	golang.org/x/net v0.22.0 // indirect
+	golang.org/x/sys v0.18.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
 	gopkg.in/inf.v0 v0.9.0 // indirect
-	gopkg.in/yaml.v2 v2.0.0
+	gopkg.in/yaml.v2 v2.4.0
+	gopkg.in/yaml.v3 v3.0.1
 	k8s.io/api v0.0.0-20180204170856-65f67c9cb59d
 	k8s.io/apimachinery v0.0.0-20180206050609-caa3b27b0fda
-	k8s.io/client-go v6.0.0+incompatible // indirect
+	k8s.io/client-go v6.0.0+incompatible
 	k8s.io/kubernetes v1.6.13
 )
+
+// yaml.v2 v2.1.0 and later format floats differently, which would change projected ConfigMaps
+replace gopkg.in/yaml.v2 => gopkg.in/yaml.v2 v2.0.0
@@ -1,29 +1,139 @@
 package conf
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io/fs"
+	"io/ioutil"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/tumblr/k8s-config-projector/internal/pkg/version"
+	"github.com/tumblr/k8s-config-projector/pkg/gitfs"
+	"github.com/tumblr/k8s-config-projector/pkg/interpolate"
+	"github.com/tumblr/k8s-config-projector/pkg/library"
+	"github.com/tumblr/k8s-config-projector/pkg/policy"
+	"github.com/tumblr/k8s-config-projector/pkg/scan"
+	"github.com/tumblr/k8s-config-projector/pkg/sops"
+	"github.com/tumblr/k8s-config-projector/pkg/targets"
+	"github.com/tumblr/k8s-config-projector/pkg/types/v1/datasource"
+	"gopkg.in/yaml.v2"
 )
 
+const (
+	// CommandProject projects manifests into ConfigMaps. This is the default when no subcommand is given
+	CommandProject = "project"
+	// CommandValidate loads, validates and dry-projects every manifest, reporting every problem found
+	CommandValidate = "validate"
+	// CommandController runs in-cluster, reconciling ConfigProjection resources into ConfigMaps
+	CommandController = "controller"
+	// CommandServe serves an HTTP API and UI previewing projected ConfigMaps
+	CommandServe = "serve"
+	// CommandMigrate rewrites the manifests in --manifests to the newest manifest schema
+	CommandMigrate = "migrate"
+	// CommandSchema writes the JSON Schema of manifests to stdout, for editors to validate them with
+	CommandSchema = "schema"
+	// CommandLSP serves the Language Server Protocol for manifests over stdio, for editors
+	CommandLSP = "lsp"
+	// CommandQuery evaluates a jsonpath against a source, or explains how a manifest's datasources project
+	CommandQuery = "query"
+	// CommandLint checks manifests against configurable lint rules, beyond what validation requires
+	CommandLint = "lint"
+)
+
+// commands are the subcommands accepted as the first CLI argument
+var commands = map[string]bool{
+	CommandProject:    true,
+	CommandValidate:   true,
+	CommandController: true,
+	CommandServe:      true,
+	CommandMigrate:    true,
+	CommandSchema:     true,
+	CommandLSP:        true,
+	CommandQuery:      true,
+	CommandLint:       true,
+}
+
 // config is the config loaded for a running instance; flags are stuffed in here!
 type config struct {
-	debug bool
+	// command is the subcommand we are running
+	command string
+	debug   bool
 	// manifestDir is the directory where projection manifests are loaded from
 	manifestDir string
 	// outputDir is where the ConfigMap yaml files will be generated in
 	outputDir string
 	// configDir is the root of the config repo checkout
 	configDir string
+	// configRev is the revision of the config repo's git history sources are read from, instead of
+	// the working tree; configFS is that revision
+	configRev string
+	configFS  *gitfs.FS
+	// configRoots are named config roots, which sources like `name:path` are read from
+	configRoots configRoots
+	// vars are substituted for `${var}` in manifests: from varsPath, overridden by PROJECTOR_VAR_*
+	// environment variables, overridden by --var flags
+	varFlags vars
+	varsPath string
+	vars     interpolate.Vars
+	// libraryDir is a directory of datasource templates manifests may include
+	libraryDir string
+	library    *library.Library
+	// targetsPath is a yaml file of the targets (clusters) manifests are projected for, each into its own output directory
+	targetsPath string
+	targets     []targets.Target
 	// configVersion is the label we use to identify a specific generation of configs
 	configVersion   string
 	labelVersionKey string
 	labelManagedKey string
+	// keepGoing continues past manifests that fail to load or project, reporting every problem at the end
+	keepGoing bool
+	// reportPath is where the problem report is written; stdout if empty
+	reportPath   string
+	reportFormat string
+	// sourceAllowlistPath is a yaml file mapping namespaces to the source path prefixes they may project
+	sourceAllowlistPath string
+	sourceAllowlist     map[string][]string
+	// policyPath is the source access policy file
+	policyPath string
+	policy     *policy.Policy
+	// secretScanMode is whether to scan projected data for secrets: off, warn, or fail
+	secretScanMode       string
+	secretScanConfigPath string
+	secretScanner        *scan.Scanner
+	// sopsKeysPath is a file of age and/or pgp private keys for decrypting SOPS encrypted sources
+	sopsKeysPath string
+	sopsKeys     *sops.Keys
+	// watch keeps running after projecting, reprojecting manifests as they or their sources change
+	watch bool
+	// listenAddr is the address the preview server listens on
+	listenAddr string
+	// kubeconfig is the kubeconfig the controller connects with; in-cluster config is used if empty
+	kubeconfig string
+	// resyncPeriod is how often the controller reconciles every ConfigProjection, picking up config repo changes
+	resyncPeriod time.Duration
+	// queryManifest is the manifest file query explains; without it, query evaluates the jsonpath
+	// in args against the source in args
+	queryManifest string
+	// args are the arguments after the flags
+	args []string
+	// summaryPath and summaryMarkdownPath are where the summary of the resources a projection run
+	// wrote is written, as JSON and Markdown. previousSummaryPath is the JSON summary of the
+	// previous run, which resources are compared to
+	summaryPath         string
+	summaryMarkdownPath string
+	previousSummaryPath string
+	// summaryKeyPath is a file holding the HMAC key Secrets are hashed with in the summary
+	summaryKeyPath string
+	summaryKey     []byte
+	// lintConfigPath is the file configuring lint rules. It is loaded by lint, as the lint package
+	// depends on manifests, which depend on this one in tests
+	lintConfigPath string
 }
 
 // Config is the interface for loading flag settings for the CLI app
@@ -31,43 +141,110 @@ type Config interface {
 	ManifestDir() string
 	OutputDir() string
 	ConfigDir() string
+	ConfigFS() fs.FS
+	ConfigCommit() string
+	ConfigRoots() map[string]string
+	Targets() []targets.Target
+	Vars() interpolate.Vars
+	Library() *library.Library
 	Debug() bool
 	Version() string
 	BuildDate() string
 	Generation() string
 	LabelVersionKey() string
 	LabelManagedKey() string
+	Command() string
+	KeepGoing() bool
+	ReportPath() string
+	ReportFormat() string
+	AllowedSourcePrefixes(namespace string) []string
+	SourceAllowlist() map[string][]string
+	Policy() *policy.Policy
+	SecretScanMode() string
+	SecretScanner() *scan.Scanner
+	SopsKeys() *sops.Keys
+	Watch() bool
+	ListenAddr() string
+	Kubeconfig() string
+	ResyncPeriod() time.Duration
+	QueryManifest() string
+	Args() []string
+	LintConfigPath() string
+	SummaryPath() string
+	SummaryMarkdownPath() string
+	PreviousSummaryPath() string
+	SummaryKey() []byte
 }
 
-// LoadConfigFromArgs returns a new config given some CLI args
+// LoadConfigFromArgs returns a new config given some CLI args. If the first argument
+// after the program name is a subcommand (i.e. `validate`), it selects what we run;
+// otherwise we project manifests.
 func LoadConfigFromArgs(args []string) (Config, error) {
+	c := config{command: CommandProject, configRoots: configRoots{}, varFlags: vars{}}
+	if len(args) > 1 && commands[args[1]] {
+		c.command = args[1]
+		args = append([]string{args[0]}, args[2:]...)
+	}
 	fs := flag.NewFlagSet(args[0], flag.ExitOnError)
-	c := config{}
 	fs.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage of %s: (Version=%s Commit=%s Package=%s Built=%s Runtime=%s)\n", args[0], version.Version, version.Commit, version.Package, version.BuildDate, runtime.Version())
+		fmt.Fprintf(os.Stderr, "Usage of %s [project|validate|controller|serve|migrate|schema|lsp|query|lint]: (Version=%s Commit=%s Package=%s Built=%s Runtime=%s)\n", args[0], version.Version, version.Commit, version.Package, version.BuildDate, runtime.Version())
 		fs.PrintDefaults()
 	}
 
 	fs.BoolVar(&c.debug, "debug", false, "Debug")
 	fs.StringVar(&c.configDir, "config-repo", "", "Use this path as the root of the config directory. Projections are relative to this directory. (required)")
+	fs.Var(c.configRoots, "config-root", "Named config root as `name=path`; sources like `name:some/file.json` are read from it, confined to path. May be repeated")
+	fs.StringVar(&c.configRev, "config-rev", "", "Read sources from this revision (sha, branch, or tag) of the --config-repo git repository instead of its working tree, and annotate projections with the commit")
+	fs.Var(c.varFlags, "var", "Variable as `name=value`, substituted for ${name} in manifests. May be repeated, and overrides --vars-file and $PROJECTOR_VAR_name")
+	fs.StringVar(&c.varsPath, "vars-file", "", "YAML file mapping variable names to values, substituted for ${name} in manifests")
+	fs.StringVar(&c.libraryDir, "library", "", "Directory of datasource templates, which manifests may `include:` by their path without .yaml")
+	fs.StringVar(&c.targetsPath, "targets", "", "YAML file of targets (clusters) with their variables; each manifest is projected for every target it selects, into the target's directory under --output (project, validate, lsp)")
 	fs.StringVar(&c.outputDir, "output", "", "Output generated ConfigMaps in this directory (required)")
-	fs.StringVar(&c.manifestDir, "manifests", "", "Directory containing manifests yaml files (required)")
+	fs.StringVar(&c.manifestDir, "manifests", "", "Directory containing manifest .yaml, .yml and .json files, minus those matched by its .projectorignore (required)")
 	fs.StringVar(&c.configVersion, "generation", strconv.FormatInt(time.Now().Unix(), 10), "Generation label used when annotating ConfigMaps")
 	fs.StringVar(&c.labelManagedKey, "label-managed-key", "tumblr.com/managed-configmap", "Label all generated ConfigMaps with this key=true")
 	fs.StringVar(&c.labelVersionKey, "label-version-key", "tumblr.com/config-version", "Label all generated ConfigMaps with this key, using the value of --generation")
+	fs.BoolVar(&c.keepGoing, "keep-going", false, "Keep going past manifests that fail to load or project, and report every problem at the end")
+	fs.StringVar(&c.reportPath, "report", "", "Write the report of problems, timings and output sizes to this file; validate and lint write it to stdout otherwise (validate, lint, project)")
+	fs.StringVar(&c.reportFormat, "report-format", "text", "Format of the report: text, json, sarif, or junit")
+	fs.StringVar(&c.sourceAllowlistPath, "source-allowlist", "", "YAML file mapping namespaces to the source path prefixes their manifests may project from (`*` applies to unlisted namespaces)")
+	fs.StringVar(&c.policyPath, "policy", "", "YAML source access policy restricting which sources and output formats manifests may use, by namespace or manifest directory")
+	fs.StringVar(&c.secretScanMode, "secret-scan", scan.ModeWarn, "Scan projected ConfigMap data for credentials: off, warn (log findings), or fail (report findings as problems)")
+	fs.StringVar(&c.secretScanConfigPath, "secret-scan-config", "", "YAML file allowlisting secret scan findings by manifest/key, and overriding the suggestion printed with them")
+	fs.StringVar(&c.sopsKeysPath, "sops-keys", os.Getenv("SOPS_AGE_KEY_FILE"), "File of age identities and/or an armored PGP private key, used to decrypt SOPS encrypted sources for manifests with `resource: Secret` (default $SOPS_AGE_KEY_FILE)")
+	fs.BoolVar(&c.watch, "watch", false, "After projecting, watch --manifests and --config-repo, and reproject manifests as they or their sources change (project)")
+	fs.StringVar(&c.listenAddr, "listen", "127.0.0.1:8080", "Address the preview server listens on (serve)")
+	fs.StringVar(&c.kubeconfig, "kubeconfig", "", "Kubeconfig the controller connects to the cluster with; uses in-cluster config if empty (controller)")
+	fs.DurationVar(&c.resyncPeriod, "resync-period", 5*time.Minute, "How often the controller reprojects every ConfigProjection, to pick up changes to the config repo (controller)")
+	fs.StringVar(&c.queryManifest, "manifest", "", "Manifest file whose datasources are explained step by step, instead of evaluating a jsonpath (query)")
+	fs.StringVar(&c.summaryPath, "summary", "", "Write a JSON summary of every resource written, with its size, key count, sources and content hash, to this file (project)")
+	fs.StringVar(&c.summaryMarkdownPath, "summary-markdown", "", "Write the summary as a Markdown table to this file, i.e. for a pull request comment (project)")
+	fs.StringVar(&c.previousSummaryPath, "previous-summary", "", "JSON summary written by the previous run; resources are summarized as added, changed or unchanged since then (project)")
+	fs.StringVar(&c.summaryKeyPath, "summary-key", "", "File holding a key to hash Secrets with (HMAC-SHA256) in the summary; without it, Secrets arent hashed, and their changes arent tracked (project)")
+	fs.StringVar(&c.lintConfigPath, "lint-config", "", "YAML file setting the severity (error, warning, info, or off) and options of lint rules (lint)")
 	err := fs.Parse(args[1:])
 	if err != nil {
 		return nil, err
 	}
+	c.args = fs.Args()
 	err = c.Validate()
 	return &c, err
 }
 
 func (c *config) Validate() error {
-	requiredDirs := map[string]string{
-		"manifests": c.manifestDir,
-		"outputDir": c.outputDir,
-		"configDir": c.configDir,
+	requiredDirs := map[string]string{}
+	// migrate only rewrites manifests, so doesnt read sources
+	if c.command != CommandMigrate && c.command != CommandSchema {
+		requiredDirs["configDir"] = c.configDir
+	}
+	// the controller reads manifests from ConfigProjection resources, and writes ConfigMaps to the
+	// cluster, and query reads the one it is given
+	if c.command != CommandController && c.command != CommandSchema && c.command != CommandQuery {
+		requiredDirs["manifests"] = c.manifestDir
+	}
+	// validate never writes ConfigMaps, so it doesnt need somewhere to put them
+	if c.command == CommandProject {
+		requiredDirs["outputDir"] = c.outputDir
 	}
 	for k, v := range requiredDirs {
 		if v == "" {
@@ -91,9 +268,127 @@ func (c *config) Validate() error {
 		}
 
 	}
+	for name, root := range c.configRoots {
+		if s, err := os.Stat(root); err != nil {
+			return err
+		} else if !s.IsDir() {
+			return fmt.Errorf("config-root %s=%s is not a directory", name, root)
+		}
+	}
 	if c.configVersion == "" {
 		return fmt.Errorf("generation argument must be specified")
 	}
+	if c.watch && c.command != CommandProject {
+		return fmt.Errorf("watch is only supported when projecting")
+	}
+	if c.watch && c.configRev != "" {
+		return fmt.Errorf("watch reprojects changes to the working tree, and cannot be used with config-rev")
+	}
+	fileVars := interpolate.Vars{}
+	if c.varsPath != "" {
+		v, err := interpolate.LoadFile(c.varsPath)
+		if err != nil {
+			return err
+		}
+		fileVars = v
+	}
+	c.vars = interpolate.Merge(fileVars, interpolate.FromEnv(os.Environ()), interpolate.Vars(c.varFlags))
+	if c.libraryDir != "" {
+		l, err := library.Load(c.libraryDir)
+		if err != nil {
+			return err
+		}
+		c.library = l
+	}
+	if c.targetsPath != "" {
+		if c.command != CommandProject && c.command != CommandValidate && c.command != CommandLSP {
+			return fmt.Errorf("targets is only supported when projecting, validating, or serving the language server")
+		}
+		if c.watch {
+			return fmt.Errorf("watch does not support targets")
+		}
+		t, err := targets.Load(c.targetsPath)
+		if err != nil {
+			return err
+		}
+		c.targets = t
+	}
+	if c.command == CommandQuery && c.queryManifest == "" && len(c.args) != 2 {
+		return fmt.Errorf("query takes a source and a jsonpath, or --manifest")
+	}
+	if c.command == CommandController && c.resyncPeriod <= 0 {
+		return fmt.Errorf("resync-period must be positive")
+	}
+	switch c.reportFormat {
+	case "text", "json", "sarif", "junit":
+	default:
+		return fmt.Errorf("report-format must be one of text, json, sarif, or junit")
+	}
+	if c.summaryPath != "" || c.summaryMarkdownPath != "" || c.previousSummaryPath != "" || c.summaryKeyPath != "" {
+		if c.command != CommandProject || c.watch {
+			return fmt.Errorf("summary is only supported when projecting, without watch")
+		}
+		if c.summaryPath == "" && c.summaryMarkdownPath == "" {
+			return fmt.Errorf("previous-summary and summary-key require summary or summary-markdown")
+		}
+	}
+	if c.summaryKeyPath != "" {
+		raw, err := ioutil.ReadFile(c.summaryKeyPath)
+		if err != nil {
+			return err
+		}
+		c.summaryKey = bytes.TrimSpace(raw)
+		if len(c.summaryKey) == 0 {
+			return fmt.Errorf("summary-key %s is empty", c.summaryKeyPath)
+		}
+	}
+	if c.lintConfigPath != "" && c.command != CommandLint {
+		return fmt.Errorf("lint-config is only supported when linting")
+	}
+	if c.sourceAllowlistPath != "" {
+		raw, err := ioutil.ReadFile(c.sourceAllowlistPath)
+		if err != nil {
+			return err
+		}
+		if err := yaml.UnmarshalStrict(raw, &c.sourceAllowlist); err != nil {
+			return fmt.Errorf("unable to parse source-allowlist %s: %s", c.sourceAllowlistPath, err.Error())
+		}
+	}
+	if c.policyPath != "" {
+		p, err := policy.Load(c.policyPath)
+		if err != nil {
+			return err
+		}
+		c.policy = p
+	}
+	switch c.secretScanMode {
+	case scan.ModeOff:
+	case scan.ModeWarn, scan.ModeFail:
+		c.secretScanner = scan.New()
+		if c.secretScanConfigPath != "" {
+			s, err := scan.Load(c.secretScanConfigPath)
+			if err != nil {
+				return err
+			}
+			c.secretScanner = s
+		}
+	default:
+		return fmt.Errorf("secret-scan must be one of off, warn, or fail")
+	}
+	if c.configRev != "" {
+		f, err := gitfs.Open(c.configDir, c.configRev)
+		if err != nil {
+			return err
+		}
+		c.configFS = f
+	}
+	if c.sopsKeysPath != "" {
+		k, err := sops.LoadKeys(c.sopsKeysPath)
+		if err != nil {
+			return err
+		}
+		c.sopsKeys = k
+	}
 	return nil
 }
 
@@ -113,6 +408,43 @@ func (c *config) ConfigDir() string {
 	return c.configDir
 }
 
+// ConfigFS returns the --config-rev revision of the config repo, or nil to read sources from the
+// checkout at ConfigDir
+func (c *config) ConfigFS() fs.FS {
+	if c.configFS == nil {
+		return nil
+	}
+	return c.configFS
+}
+
+// ConfigRoots returns the named config roots given with --config-root
+func (c *config) ConfigRoots() map[string]string {
+	return c.configRoots
+}
+
+// ConfigCommit returns the commit --config-rev resolved to, if any
+func (c *config) ConfigCommit() string {
+	if c.configFS == nil {
+		return ""
+	}
+	return c.configFS.Commit()
+}
+
+// Targets returns the targets manifests are projected for, or nil if --targets wasnt given
+func (c *config) Targets() []targets.Target {
+	return c.targets
+}
+
+// Vars returns the variables substituted into manifests as they are loaded
+func (c *config) Vars() interpolate.Vars {
+	return c.vars
+}
+
+// Library returns the datasource templates manifests may include, or nil if --library wasnt given
+func (c *config) Library() *library.Library {
+	return c.library
+}
+
 func (c *config) Debug() bool {
 	return c.debug
 }
@@ -132,3 +464,162 @@ func (c *config) LabelVersionKey() string {
 func (c *config) LabelManagedKey() string {
 	return c.labelManagedKey
 }
+
+func (c *config) Command() string {
+	return c.command
+}
+
+func (c *config) KeepGoing() bool {
+	return c.keepGoing
+}
+
+func (c *config) ReportPath() string {
+	return c.reportPath
+}
+
+func (c *config) ReportFormat() string {
+	return c.reportFormat
+}
+
+// AllowedSourcePrefixes returns the source path prefixes manifests in namespace may project from,
+// falling back to the `*` entry for unlisted namespaces. nil means no restriction.
+func (c *config) AllowedSourcePrefixes(namespace string) []string {
+	if prefixes, ok := c.sourceAllowlist[namespace]; ok {
+		return prefixes
+	}
+	return c.sourceAllowlist["*"]
+}
+
+// SourceAllowlist returns the namespace to source path prefixes mapping loaded from --source-allowlist
+func (c *config) SourceAllowlist() map[string][]string {
+	return c.sourceAllowlist
+}
+
+// Policy returns the source access policy, or nil if there is none
+func (c *config) Policy() *policy.Policy {
+	return c.policy
+}
+
+func (c *config) SecretScanMode() string {
+	return c.secretScanMode
+}
+
+// SecretScanner returns the scanner for projected data, or nil when scanning is off
+func (c *config) SecretScanner() *scan.Scanner {
+	return c.secretScanner
+}
+
+// SopsKeys returns the keys for decrypting SOPS encrypted sources, or nil if none were given
+func (c *config) SopsKeys() *sops.Keys {
+	return c.sopsKeys
+}
+
+func (c *config) Watch() bool {
+	return c.watch
+}
+
+func (c *config) ListenAddr() string {
+	return c.listenAddr
+}
+
+func (c *config) Kubeconfig() string {
+	return c.kubeconfig
+}
+
+func (c *config) ResyncPeriod() time.Duration {
+	return c.resyncPeriod
+}
+
+// QueryManifest returns the manifest file query explains, if any
+func (c *config) QueryManifest() string {
+	return c.queryManifest
+}
+
+// Args returns the arguments after the flags, like query's source and jsonpath
+func (c *config) Args() []string {
+	return c.args
+}
+
+// LintConfigPath returns the file configuring lint rules, if any
+func (c *config) LintConfigPath() string {
+	return c.lintConfigPath
+}
+
+// SummaryPath returns where the JSON summary of a projection run is written, if anywhere
+func (c *config) SummaryPath() string {
+	return c.summaryPath
+}
+
+// SummaryMarkdownPath returns where the Markdown summary of a projection run is written, if anywhere
+func (c *config) SummaryMarkdownPath() string {
+	return c.summaryMarkdownPath
+}
+
+// PreviousSummaryPath returns the JSON summary of the previous projection run, if any
+func (c *config) PreviousSummaryPath() string {
+	return c.previousSummaryPath
+}
+
+// SummaryKey returns the key Secrets are hashed with in the summary, or nil if there is none
+func (c *config) SummaryKey() []byte {
+	return c.summaryKey
+}
+
+// configRoots are the repeatable --config-root name=path flags
+type configRoots map[string]string
+
+func (r configRoots) String() string {
+	roots := make([]string, 0, len(r))
+	for name, p := range r {
+		roots = append(roots, name+"="+p)
+	}
+	sort.Strings(roots)
+	return strings.Join(roots, ",")
+}
+
+func (r configRoots) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i < 0 {
+		return fmt.Errorf("config root %q must be name=path", v)
+	}
+	name, p := v[:i], v[i+1:]
+	if !datasource.ValidRootName(name) {
+		return fmt.Errorf("config root name %q must only consist of lower case alphanumeric characters, - and _", name)
+	}
+	if p == "" {
+		return fmt.Errorf("config root %s requires a path", name)
+	}
+	if _, ok := r[name]; ok {
+		return fmt.Errorf("config root %s is given more than once", name)
+	}
+	r[name] = p
+	return nil
+}
+
+// vars are the repeatable --var name=value flags
+type vars map[string]string
+
+func (v vars) String() string {
+	kvs := make([]string, 0, len(v))
+	for name, value := range v {
+		kvs = append(kvs, name+"="+value)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
+func (v vars) Set(kv string) error {
+	i := strings.Index(kv, "=")
+	if i < 0 {
+		return fmt.Errorf("var %q must be name=value", kv)
+	}
+	name := kv[:i]
+	if !interpolate.ValidName(name) {
+		return fmt.Errorf("var name %q must only consist of alphanumeric characters and _, and not start with a digit", name)
+	}
+	if _, ok := v[name]; ok {
+		return fmt.Errorf("var %s is given more than once", name)
+	}
+	v[name] = kv[i+1:]
+	return nil
+}
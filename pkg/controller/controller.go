@@ -0,0 +1,384 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/tumblr/k8s-config-projector/pkg/projector"
+	"github.com/tumblr/k8s-config-projector/pkg/scan"
+	"github.com/tumblr/k8s-config-projector/pkg/types"
+	"github.com/tumblr/k8s-config-projector/pkg/types/v1/manifest"
+	"gopkg.in/yaml.v2"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// Controller reconciles ConfigProjection resources into ConfigMaps (or Secrets, for specs with
+// `resource: Secret`), owned by the ConfigProjection so they are garbage collected with it.
+// Specs are loaded and projected with a projector.Projector, so the size limit, source allowlist,
+// policy and secret scanner apply just like they do to `project`. Sources are read from its config
+// root, which is expected to be mounted or synced into the pod; every ConfigProjection is
+// reprojected each resync period to pick up changes to it.
+//
+// Secrets decrypt SOPS sources with the controller's keys, for any namespace a ConfigProjection can
+// be created in, so they are refused unless a --policy or --source-allowlist restricts the sources
+// each namespace may project.
+type Controller struct {
+	p *projector.Projector
+	// scanMode is the --secret-scan mode; findings only fail a projection when it is scan.ModeFail
+	scanMode     string
+	resyncPeriod time.Duration
+	kube         kubernetes.Interface
+	projections  dynamic.Interface
+	status       StatusWriter
+	queue        workqueue.RateLimitingInterface
+	// now returns the time conditions transition at; replaced in tests
+	now func() metav1.Time
+}
+
+// New returns a Controller projecting ConfigProjections with a projector.Projector made from opts,
+// reading them with projections, writing their status with status, and writing ConfigMaps with
+// kube. scanMode is the --secret-scan mode findings are handled with, and every ConfigProjection
+// is reprojected each resyncPeriod.
+func New(opts projector.Options, scanMode string, resyncPeriod time.Duration, kube kubernetes.Interface, projections dynamic.Interface, status StatusWriter) (*Controller, error) {
+	p, err := projector.New(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Controller{
+		p:            p,
+		scanMode:     scanMode,
+		resyncPeriod: resyncPeriod,
+		kube:         kube,
+		projections:  projections,
+		status:       status,
+		queue:        workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), Resource),
+		now:          metav1.Now,
+	}, nil
+}
+
+// NewForConfig returns a Controller connected to the cluster described by restConfig, like New
+func NewForConfig(opts projector.Options, scanMode string, resyncPeriod time.Duration, restConfig *rest.Config) (*Controller, error) {
+	kube, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	// the dynamic client talks to a single group version, which it takes from the config
+	dynamicConfig := *restConfig
+	dynamicConfig.APIPath = "/apis"
+	dynamicConfig.GroupVersion = &GroupVersion
+	projections, err := dynamic.NewClient(&dynamicConfig)
+	if err != nil {
+		return nil, err
+	}
+	status, err := newStatusClient(&dynamicConfig)
+	if err != nil {
+		return nil, err
+	}
+	return New(opts, scanMode, resyncPeriod, kube, projections, status)
+}
+
+// Run watches ConfigProjections in every namespace, reconciling them until stopCh is closed
+func (ctl *Controller) Run(stopCh <-chan struct{}) {
+	defer ctl.queue.ShutDown()
+	client := ctl.resource(metav1.NamespaceAll)
+	lw := &cache.ListWatch{
+		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+			return client.List(opts)
+		},
+		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+			return client.Watch(opts)
+		},
+	}
+	// resyncs show up as updates, so every ConfigProjection is reprojected each period
+	_, informer := cache.NewInformer(lw, &unstructured.Unstructured{}, ctl.resyncPeriod, cache.ResourceEventHandlerFuncs{
+		AddFunc: ctl.enqueue,
+		UpdateFunc: func(old, obj interface{}) {
+			if needsReconcile(old, obj) {
+				ctl.enqueue(obj)
+			}
+		},
+		DeleteFunc: ctl.enqueue,
+	})
+	go informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
+		log.Printf("timed out waiting for %s to sync", Resource)
+		return
+	}
+	log.Printf("Watching %s.%s", Resource, Group)
+	go wait.Until(ctl.work, time.Second, stopCh)
+	<-stopCh
+}
+
+// needsReconcile returns false for updates that only wrote the status of a ConfigProjection, i.e. our
+// own status writes, which dont change its generation. Resyncs dont change the resource version.
+func needsReconcile(old, obj interface{}) bool {
+	o, oldOK := old.(metav1.Object)
+	n, newOK := obj.(metav1.Object)
+	if !oldOK || !newOK {
+		return true
+	}
+	return o.GetResourceVersion() == n.GetResourceVersion() || o.GetGeneration() != n.GetGeneration()
+}
+
+func (ctl *Controller) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		log.Printf("unable to queue %v: %s", obj, err.Error())
+		return
+	}
+	ctl.queue.Add(key)
+}
+
+// work reconciles queued ConfigProjections until the queue is shut down, retrying failures with backoff
+func (ctl *Controller) work() {
+	for {
+		item, shutdown := ctl.queue.Get()
+		if shutdown {
+			return
+		}
+		key := item.(string)
+		namespace, name, err := cache.SplitMetaNamespaceKey(key)
+		if err == nil {
+			err = ctl.Reconcile(namespace, name)
+		}
+		if err != nil {
+			log.Printf("unable to reconcile %s: %s", key, err.Error())
+			ctl.queue.AddRateLimited(key)
+		} else {
+			ctl.queue.Forget(key)
+		}
+		ctl.queue.Done(key)
+	}
+}
+
+func (ctl *Controller) resource(namespace string) dynamic.ResourceInterface {
+	return ctl.projections.Resource(&APIResource, namespace)
+}
+
+// Reconcile projects the ConfigProjection namespace/name, and creates or updates its ConfigMap (or
+// Secret) to match, recording the outcome in its Ready condition. It returns an error when
+// reconciling should be retried; an invalid spec isnt retried until it changes.
+func (ctl *Controller) Reconcile(namespace string, name string) error {
+	cp, err := ctl.resource(namespace).Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		// whatever it projected is garbage collected through its owner reference
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	m, err := ctl.manifestFor(cp)
+	if err != nil {
+		return ctl.setReady(cp, v1.ConditionFalse, ReasonInvalidSpec, specError(err))
+	}
+	opts := ctl.p.Options()
+	if m.IsSecret() && opts.Policy == nil && len(opts.SourceAllowlist) == 0 {
+		return ctl.setReady(cp, v1.ConditionFalse, ReasonSecretsNotAllowed, "projecting Secrets requires the controller to run with --policy or --source-allowlist")
+	}
+	result, err := ctl.p.Project(m)
+	var sizeErr *projector.SizeLimitError
+	if errors.As(err, &sizeErr) {
+		// the API server would refuse it too; it isnt retried until the spec or sources change
+		return ctl.setReady(cp, v1.ConditionFalse, ReasonSizeLimitExceeded, sizeErr.Error())
+	}
+	if err != nil {
+		return ctl.failed(cp, ReasonProjectionFailed, specError(err))
+	}
+	if findings := ctl.findings(result); len(findings) > 0 {
+		return ctl.failed(cp, ReasonProjectionFailed, findings[0].Error())
+	}
+	owner := ownerReference(cp)
+	var applyErr error
+	var msg string
+	if secret := result.Secret; secret != nil {
+		secret.OwnerReferences = []metav1.OwnerReference{owner}
+		applyErr = ctl.applySecret(secret)
+		msg = fmt.Sprintf("projected %d keys into Secret %s/%s", len(secret.Data), secret.Namespace, secret.Name)
+	} else {
+		cm := result.ConfigMap
+		cm.OwnerReferences = []metav1.OwnerReference{owner}
+		applyErr = ctl.applyConfigMap(cm)
+		msg = fmt.Sprintf("projected %d keys into ConfigMap %s/%s", len(cm.Data), cm.Namespace, cm.Name)
+	}
+	if applyErr != nil {
+		if ce, ok := applyErr.(*conflictError); ok {
+			return ctl.setReady(cp, v1.ConditionFalse, ReasonConflict, ce.Error())
+		}
+		return ctl.failed(cp, ReasonProjectionFailed, applyErr.Error())
+	}
+	return ctl.setReady(cp, v1.ConditionTrue, ReasonProjected, msg)
+}
+
+// findings logs secret scan findings in the projected ConfigMap, returning them when --secret-scan=fail
+func (ctl *Controller) findings(result *projector.Result) []*scan.Finding {
+	if ctl.scanMode == scan.ModeFail {
+		return result.Findings
+	}
+	for _, f := range result.Findings {
+		log.Printf("WARNING: %s/%s: %s", result.Namespace, result.Name, f.Error())
+	}
+	return nil
+}
+
+// failed records a failed Ready condition, and returns an error so reconciling is retried
+func (ctl *Controller) failed(cp *unstructured.Unstructured, reason string, msg string) error {
+	if err := ctl.setReady(cp, v1.ConditionFalse, reason, msg); err != nil {
+		return err
+	}
+	return fmt.Errorf("%s: %s", reason, msg)
+}
+
+// setReady updates the Ready condition and observed generation of cp, if they changed
+func (ctl *Controller) setReady(cp *unstructured.Unstructured, status v1.ConditionStatus, reason string, msg string) error {
+	current := Status{}
+	if raw, ok := cp.Object["status"].(map[string]interface{}); ok {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(raw, &current); err != nil {
+			return err
+		}
+	}
+	next := Status{
+		ObservedGeneration: cp.GetGeneration(),
+		Conditions:         append([]Condition{}, current.Conditions...),
+	}
+	next.Conditions = setCondition(next.Conditions, Condition{
+		Type:               ConditionReady,
+		Status:             status,
+		LastTransitionTime: ctl.now(),
+		Reason:             reason,
+		Message:            msg,
+	})
+	if reflect.DeepEqual(current, next) {
+		return nil
+	}
+	raw, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&next)
+	if err != nil {
+		return err
+	}
+	cp.Object["status"] = raw
+	_, err = ctl.status.UpdateStatus(cp)
+	return err
+}
+
+// conflictError is returned when the object to apply exists, but isnt controlled by the ConfigProjection
+type conflictError struct {
+	kind string
+	meta metav1.Object
+}
+
+func (e *conflictError) Error() string {
+	return fmt.Sprintf("%s %s/%s already exists and is not managed by this %s", e.kind, e.meta.GetNamespace(), e.meta.GetName(), Kind)
+}
+
+// controlledBy returns true if the controller owner reference of existing is owner
+func controlledBy(existing metav1.Object, owner metav1.OwnerReference) bool {
+	ref := metav1.GetControllerOf(existing)
+	return ref != nil && ref.UID == owner.UID
+}
+
+// applyConfigMap creates cm, or updates it if it is controlled by the same owner and changed
+func (ctl *Controller) applyConfigMap(cm *v1.ConfigMap) error {
+	client := ctl.kube.CoreV1().ConfigMaps(cm.Namespace)
+	existing, err := client.Get(cm.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = client.Create(cm)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if !controlledBy(existing, cm.OwnerReferences[0]) {
+		return &conflictError{kind: "ConfigMap", meta: existing}
+	}
+	if reflect.DeepEqual(existing.Data, cm.Data) && reflect.DeepEqual(existing.Labels, cm.Labels) && reflect.DeepEqual(existing.Annotations, cm.Annotations) && reflect.DeepEqual(existing.OwnerReferences, cm.OwnerReferences) {
+		return nil
+	}
+	existing.Data = cm.Data
+	existing.Labels = cm.Labels
+	existing.Annotations = cm.Annotations
+	existing.OwnerReferences = cm.OwnerReferences
+	_, err = client.Update(existing)
+	return err
+}
+
+// applySecret creates secret, or updates it if it is controlled by the same owner and changed
+func (ctl *Controller) applySecret(secret *v1.Secret) error {
+	client := ctl.kube.CoreV1().Secrets(secret.Namespace)
+	existing, err := client.Get(secret.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = client.Create(secret)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if !controlledBy(existing, secret.OwnerReferences[0]) {
+		return &conflictError{kind: "Secret", meta: existing}
+	}
+	if reflect.DeepEqual(existing.Data, secret.Data) && reflect.DeepEqual(existing.Labels, secret.Labels) && reflect.DeepEqual(existing.Annotations, secret.Annotations) && reflect.DeepEqual(existing.OwnerReferences, secret.OwnerReferences) {
+		return nil
+	}
+	existing.Data = secret.Data
+	existing.Labels = secret.Labels
+	existing.Annotations = secret.Annotations
+	existing.OwnerReferences = secret.OwnerReferences
+	_, err = client.Update(existing)
+	return err
+}
+
+// ownerReference makes cp the controller of what it projects
+func ownerReference(cp *unstructured.Unstructured) metav1.OwnerReference {
+	t := true
+	return metav1.OwnerReference{
+		APIVersion:         GroupVersion.String(),
+		Kind:               Kind,
+		Name:               cp.GetName(),
+		UID:                cp.GetUID(),
+		Controller:         &t,
+		BlockOwnerDeletion: &t,
+	}
+}
+
+// manifestFor loads the spec of cp as a projection manifest, named after cp
+func (ctl *Controller) manifestFor(cp *unstructured.Unstructured) (manifest.ConfigProjectionManifest, error) {
+	spec, ok := cp.Object["spec"].(map[string]interface{})
+	if !ok {
+		return manifest.ConfigProjectionManifest{}, types.NewFieldError("spec", fmt.Errorf("spec is required"))
+	}
+	doc := map[string]interface{}{}
+	for k, v := range spec {
+		doc[k] = v
+	}
+	doc["name"] = cp.GetName()
+	doc["namespace"] = cp.GetNamespace()
+	raw, err := yaml.Marshal(doc)
+	if err != nil {
+		return manifest.ConfigProjectionManifest{}, err
+	}
+	return ctl.p.LoadBytes("", raw)
+}
+
+// specError describes err relative to the ConfigProjection, i.e. `spec.data[1].output_file: ...`.
+// Lines and columns are dropped, as they are positions in the spec re-encoded as yaml.
+func specError(err error) string {
+	pe := types.AsProjectionError(err)
+	located := *pe
+	located.Manifest, located.Line, located.Column = "", 0, 0
+	if f := located.FieldPath(); f != "" {
+		located.DataSource, located.Field = types.NoDataSource, "spec."+f
+	}
+	return located.Error()
+}
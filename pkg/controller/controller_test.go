@@ -0,0 +1,353 @@
+package controller
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/tumblr/k8s-config-projector/internal/pkg/testing"
+	"github.com/tumblr/k8s-config-projector/pkg/policy"
+	"github.com/tumblr/k8s-config-projector/pkg/projector"
+	"github.com/tumblr/k8s-config-projector/pkg/scan"
+	"github.com/tumblr/k8s-config-projector/pkg/sops"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+var (
+	testOptions = projector.Options{
+		ConfigRoot:    "test/sources",
+		Generation:    "unittest123",
+		SecretScanner: scan.New(),
+	}
+	transitionTime = metav1.NewTime(time.Date(2018, 3, 14, 0, 0, 0, 0, time.UTC))
+	gvr            = GroupVersion.WithResource(Resource)
+)
+
+// trackerStatus writes only the status of ConfigProjections in the tracker, like the status subresource
+type trackerStatus struct {
+	tracker clienttesting.ObjectTracker
+}
+
+func (s trackerStatus) UpdateStatus(cp *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	obj, err := s.tracker.Get(gvr, cp.GetNamespace(), cp.GetName())
+	if err != nil {
+		return nil, err
+	}
+	stored := obj.(*unstructured.Unstructured).DeepCopy()
+	stored.Object["status"] = cp.Object["status"]
+	return stored, s.tracker.Update(gvr, stored, cp.GetNamespace())
+}
+
+// newTestController returns a Controller backed by fake clients, seeded with the given ConfigProjections and ConfigMaps
+func newTestController(t *testing.T, projections []*unstructured.Unstructured, configMaps ...runtime.Object) (*Controller, clienttesting.ObjectTracker, *fake.Clientset) {
+	return newTestControllerWithOptions(t, testOptions, scan.ModeWarn, projections, configMaps...)
+}
+
+func newTestControllerWithOptions(t *testing.T, opts projector.Options, scanMode string, projections []*unstructured.Unstructured, configMaps ...runtime.Object) (*Controller, clienttesting.ObjectTracker, *fake.Clientset) {
+	scheme := runtime.NewScheme()
+	tracker := clienttesting.NewObjectTracker(scheme, serializer.NewCodecFactory(scheme).UniversalDecoder())
+	for _, p := range projections {
+		if err := tracker.Create(gvr, p, p.GetNamespace()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dyn := &dynamicfake.FakeClient{GroupVersion: GroupVersion, Fake: &clienttesting.Fake{}}
+	dyn.AddReactor("*", "*", clienttesting.ObjectReaction(tracker))
+	kube := fake.NewSimpleClientset(configMaps...)
+	ctl, err := New(opts, scanMode, time.Minute, kube, dyn, trackerStatus{tracker: tracker})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctl.now = func() metav1.Time { return transitionTime }
+	return ctl, tracker, kube
+}
+
+func newProjection(name string, generation int64, spec map[string]interface{}) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": GroupVersion.String(),
+		"kind":       Kind,
+		"spec":       spec,
+	}}
+	u.SetName(name)
+	u.SetNamespace("test")
+	u.SetUID(k8stypes.UID("uid-" + name))
+	u.SetGeneration(generation)
+	return u
+}
+
+func extractSpec(output string, expr string) map[string]interface{} {
+	return map[string]interface{}{
+		"data": []interface{}{
+			map[string]interface{}{"source": "test.json", "output_file": output, "extract": expr},
+		},
+	}
+}
+
+func readyCondition(t *testing.T, tracker clienttesting.ObjectTracker, name string) (Status, Condition) {
+	obj, err := tracker.Get(gvr, "test", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := Status{}
+	raw, _ := obj.(*unstructured.Unstructured).Object["status"].(map[string]interface{})
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(raw, &status); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range status.Conditions {
+		if c.Type == ConditionReady {
+			return status, c
+		}
+	}
+	t.Fatalf("%s has no %s condition", name, ConditionReady)
+	return status, Condition{}
+}
+
+func TestReconcileCreatesOwnedConfigMap(t *testing.T) {
+	ctl, tracker, kube := newTestController(t, []*unstructured.Unstructured{newProjection("hello", 3, extractSpec("astring", "$.astring"))})
+	if err := ctl.Reconcile("test", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	cm, err := kube.CoreV1().ConfigMaps("test").Get("hello", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm.Data["astring"] != "hello world 1236969" {
+		t.Fatalf("Expected astring to be projected, but got %v", cm.Data)
+	}
+	if cm.Labels["tumblr.com/config-version"] != "unittest123" || cm.Labels["tumblr.com/managed-configmap"] != "true" {
+		t.Fatalf("Expected ConfigMap to be labeled, but got %v", cm.Labels)
+	}
+	ref := metav1.GetControllerOf(cm)
+	if ref == nil || ref.UID != "uid-hello" || ref.Kind != Kind || ref.APIVersion != "projector.tumblr.com/v1alpha1" {
+		t.Fatalf("Expected ConfigMap to be controlled by the ConfigProjection, but got %v", cm.OwnerReferences)
+	}
+	status, ready := readyCondition(t, tracker, "hello")
+	if status.ObservedGeneration != 3 {
+		t.Fatalf("Expected observedGeneration 3, but got %d", status.ObservedGeneration)
+	}
+	if ready.Status != v1.ConditionTrue || ready.Reason != ReasonProjected || !ready.LastTransitionTime.Equal(&transitionTime) {
+		t.Fatalf("Expected Ready=True, but got %+v", ready)
+	}
+	for _, a := range ctl.projections.(*dynamicfake.FakeClient).Actions() {
+		if a.GetVerb() == "update" {
+			t.Fatalf("Expected status to be written to the status subresource, but got an update of the %s", Kind)
+		}
+	}
+
+	// changing the spec updates the ConfigMap in place
+	p := newProjection("hello", 4, extractSpec("hostport", "$.hostport"))
+	if err := tracker.Update(gvr, p, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctl.Reconcile("test", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	cm, err = kube.CoreV1().ConfigMaps("test").Get("hello", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cm.Data) != 1 || cm.Data["hostport"] != "test-6f327ab0.dc2.tumblr.net:3295" {
+		t.Fatalf("Expected ConfigMap to be updated with hostport, but got %v", cm.Data)
+	}
+	if status, _ := readyCondition(t, tracker, "hello"); status.ObservedGeneration != 4 {
+		t.Fatalf("Expected observedGeneration 4, but got %d", status.ObservedGeneration)
+	}
+}
+
+func TestReconcileInvalidSpec(t *testing.T) {
+	spec := map[string]interface{}{
+		"data": []interface{}{
+			map[string]interface{}{"source": "test.json", "extract": "$.astring"},
+		},
+	}
+	ctl, tracker, kube := newTestController(t, []*unstructured.Unstructured{newProjection("invalid", 1, spec)})
+	// an invalid spec isnt retried until it changes
+	if err := ctl.Reconcile("test", "invalid"); err != nil {
+		t.Fatal(err)
+	}
+	_, ready := readyCondition(t, tracker, "invalid")
+	if ready.Status != v1.ConditionFalse || ready.Reason != ReasonInvalidSpec || !strings.HasPrefix(ready.Message, "spec.data[0].output_file: ") {
+		t.Fatalf("Expected Ready=False with the offending field, but got %+v", ready)
+	}
+	if _, err := kube.CoreV1().ConfigMaps("test").Get("invalid", metav1.GetOptions{}); err == nil {
+		t.Fatal("Expected no ConfigMap to be created for an invalid spec")
+	}
+}
+
+func TestReconcileProjectionFailure(t *testing.T) {
+	ctl, tracker, _ := newTestController(t, []*unstructured.Unstructured{newProjection("missing", 1, extractSpec("nope", "$.does.not.exist"))})
+	if err := ctl.Reconcile("test", "missing"); err == nil {
+		t.Fatal("Expected projection failures to be retried")
+	}
+	_, ready := readyCondition(t, tracker, "missing")
+	if ready.Status != v1.ConditionFalse || ready.Reason != ReasonProjectionFailed || !strings.Contains(ready.Message, "jsonpath=$.does.not.exist") {
+		t.Fatalf("Expected Ready=False with the failing jsonpath, but got %+v", ready)
+	}
+}
+
+func TestReconcileSizeLimit(t *testing.T) {
+	opts := testOptions
+	opts.SizeLimit = 10
+	ctl, tracker, kube := newTestControllerWithOptions(t, opts, scan.ModeWarn, []*unstructured.Unstructured{newProjection("big", 1, extractSpec("astring", "$.astring"))})
+	// oversized projections arent sent to the API server, or retried until the spec or sources change
+	if err := ctl.Reconcile("test", "big"); err != nil {
+		t.Fatal(err)
+	}
+	_, ready := readyCondition(t, tracker, "big")
+	if ready.Status != v1.ConditionFalse || ready.Reason != ReasonSizeLimitExceeded || !strings.Contains(ready.Message, "exceeding size limit of 10 bytes") {
+		t.Fatalf("Expected Ready=False with %s, but got %+v", ReasonSizeLimitExceeded, ready)
+	}
+	if _, err := kube.CoreV1().ConfigMaps("test").Get("big", metav1.GetOptions{}); err == nil {
+		t.Fatal("Expected no ConfigMap to be created when it exceeds the size limit")
+	}
+}
+
+func TestReconcileSecretScan(t *testing.T) {
+	projection := newProjection("creds", 1, extractSpec("password", "$.astring"))
+	ctl, tracker, kube := newTestControllerWithOptions(t, testOptions, scan.ModeFail, []*unstructured.Unstructured{projection})
+	if err := ctl.Reconcile("test", "creds"); err == nil {
+		t.Fatal("Expected secret scan findings to fail the projection with --secret-scan=fail")
+	}
+	if _, ready := readyCondition(t, tracker, "creds"); ready.Status != v1.ConditionFalse || ready.Reason != ReasonProjectionFailed {
+		t.Fatalf("Expected Ready=False with %s, but got %+v", ReasonProjectionFailed, ready)
+	}
+	if _, err := kube.CoreV1().ConfigMaps("test").Get("creds", metav1.GetOptions{}); err == nil {
+		t.Fatal("Expected no ConfigMap to be created with secret scan findings")
+	}
+
+	ctl, _, kube = newTestController(t, []*unstructured.Unstructured{projection})
+	if err := ctl.Reconcile("test", "creds"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kube.CoreV1().ConfigMaps("test").Get("creds", metav1.GetOptions{}); err != nil {
+		t.Fatalf("Expected findings to only be warned about by default, but got %s", err.Error())
+	}
+}
+
+func TestReconcileWontAdoptConfigMaps(t *testing.T) {
+	existing := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "taken", Namespace: "test"},
+		Data:       map[string]string{"mine": "dont touch"},
+	}
+	ctl, tracker, kube := newTestController(t, []*unstructured.Unstructured{newProjection("taken", 1, extractSpec("astring", "$.astring"))}, existing)
+	if err := ctl.Reconcile("test", "taken"); err != nil {
+		t.Fatal(err)
+	}
+	_, ready := readyCondition(t, tracker, "taken")
+	if ready.Status != v1.ConditionFalse || ready.Reason != ReasonConflict {
+		t.Fatalf("Expected Ready=False with a conflict, but got %+v", ready)
+	}
+	cm, err := kube.CoreV1().ConfigMaps("test").Get("taken", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm.Data["mine"] != "dont touch" {
+		t.Fatalf("Expected existing ConfigMap to be left alone, but got %v", cm.Data)
+	}
+}
+
+func TestReconcileDeletedProjection(t *testing.T) {
+	ctl, _, _ := newTestController(t, nil)
+	if err := ctl.Reconcile("test", "gone"); err != nil {
+		t.Fatalf("Expected a deleted ConfigProjection to be ignored, but got %s", err.Error())
+	}
+}
+
+func TestReconcileUpdatesAnnotations(t *testing.T) {
+	controller := true
+	existing := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "hello",
+			Namespace:       "test",
+			Annotations:     map[string]string{"stale": "true"},
+			OwnerReferences: []metav1.OwnerReference{{UID: "uid-hello", Controller: &controller}},
+		},
+	}
+	ctl, _, kube := newTestController(t, []*unstructured.Unstructured{newProjection("hello", 1, extractSpec("astring", "$.astring"))}, existing)
+	if err := ctl.Reconcile("test", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	cm, err := kube.CoreV1().ConfigMaps("test").Get("hello", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cm.Annotations["stale"]; ok {
+		t.Fatalf("Expected annotations to be replaced with the projected ones, but got %v", cm.Annotations)
+	}
+}
+
+func TestReconcileRefusesSecretsWithoutPolicy(t *testing.T) {
+	spec := map[string]interface{}{
+		"resource": "Secret",
+		"data": []interface{}{
+			map[string]interface{}{"source": "sops/secrets.yaml", "output_file": "password", "extract": "$.database.password"},
+		},
+	}
+	ctl, tracker, kube := newTestController(t, []*unstructured.Unstructured{newProjection("secret", 1, spec)})
+	err := ctl.Reconcile("test", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ready := readyCondition(t, tracker, "secret"); ready.Status != v1.ConditionFalse || ready.Reason != ReasonSecretsNotAllowed {
+		t.Fatalf("Expected Ready=False with %s, but got %+v", ReasonSecretsNotAllowed, ready)
+	}
+	if _, err := kube.CoreV1().Secrets("test").Get("secret", metav1.GetOptions{}); err == nil {
+		t.Fatal("Expected no Secret to be created without a policy")
+	}
+
+	policyFile := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := ioutil.WriteFile(policyFile, []byte("rules:\n- namespaces: [test]\n  allow_sources: [\"sops/**\"]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	withPolicy := testOptions
+	if withPolicy.Policy, err = policy.Load(policyFile); err != nil {
+		t.Fatal(err)
+	}
+	if withPolicy.SopsKeys, err = sops.LoadKeys("test/sops/age.key"); err != nil {
+		t.Fatal(err)
+	}
+	ctl, tracker, kube = newTestControllerWithOptions(t, withPolicy, scan.ModeWarn, []*unstructured.Unstructured{newProjection("secret", 1, spec)})
+	if err := ctl.Reconcile("test", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ready := readyCondition(t, tracker, "secret"); ready.Status != v1.ConditionTrue {
+		t.Fatalf("Expected Ready=True with a policy, but got %+v", ready)
+	}
+	if _, err := kube.CoreV1().Secrets("test").Get("secret", metav1.GetOptions{}); err != nil {
+		t.Fatalf("Expected a Secret to be created with a policy, but got %s", err.Error())
+	}
+}
+
+func TestNeedsReconcile(t *testing.T) {
+	old := newProjection("hello", 1, extractSpec("astring", "$.astring"))
+	old.SetResourceVersion("1")
+	status := old.DeepCopy()
+	status.SetResourceVersion("2")
+	status.Object["status"] = map[string]interface{}{"observedGeneration": int64(1)}
+	spec := old.DeepCopy()
+	spec.SetResourceVersion("2")
+	spec.SetGeneration(2)
+	for _, tc := range []struct {
+		name     string
+		obj      *unstructured.Unstructured
+		expected bool
+	}{
+		{"resync", old, true},
+		{"status update", status, false},
+		{"spec update", spec, true},
+	} {
+		if actual := needsReconcile(old, tc.obj); actual != tc.expected {
+			t.Fatalf("Expected needsReconcile to be %v for a %s, but got %v", tc.expected, tc.name, actual)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package controller
+
+import (
+	"errors"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+// StatusWriter writes the status subresource of ConfigProjections. The dynamic client cant address
+// subresources, and writing status with a full update would bump metadata.generation on every
+// reconcile, which would be observed as a spec change.
+type StatusWriter interface {
+	// UpdateStatus replaces the status of cp, leaving the rest of it untouched
+	UpdateStatus(cp *unstructured.Unstructured) (*unstructured.Unstructured, error)
+}
+
+// statusClient is a StatusWriter talking to the API server
+type statusClient struct {
+	cl *rest.RESTClient
+}
+
+// newStatusClient returns a StatusWriter for ConfigProjections, from a config for GroupVersion
+func newStatusClient(restConfig *rest.Config) (*statusClient, error) {
+	statusConfig := *restConfig
+	statusConfig.ContentConfig = dynamic.ContentConfig()
+	statusConfig.GroupVersion = &GroupVersion
+	if statusConfig.UserAgent == "" {
+		statusConfig.UserAgent = rest.DefaultKubernetesUserAgent()
+	}
+	cl, err := rest.RESTClientFor(&statusConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &statusClient{cl: cl}, nil
+}
+
+// UpdateStatus puts cp to its status subresource
+func (s *statusClient) UpdateStatus(cp *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	result := &unstructured.Unstructured{}
+	if cp.GetName() == "" {
+		return result, errors.New("object missing name")
+	}
+	err := s.cl.Put().
+		Namespace(cp.GetNamespace()).
+		Resource(Resource).
+		Name(cp.GetName()).
+		SubResource("status").
+		Body(cp).
+		Do().
+		Into(result)
+	return result, err
+}
@@ -0,0 +1,91 @@
+package controller
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	// Group is the API group of the ConfigProjection custom resource
+	Group = "projector.tumblr.com"
+	// Version is the API version of the ConfigProjection custom resource
+	Version = "v1alpha1"
+	// Kind is the kind of the ConfigProjection custom resource
+	Kind = "ConfigProjection"
+	// Resource is the plural resource name of ConfigProjections
+	Resource = "configprojections"
+
+	// ConditionReady is true when the ConfigProjection's spec was projected and applied
+	ConditionReady = "Ready"
+
+	// ReasonProjected means the ConfigMap (or Secret) is up to date with the spec and sources
+	ReasonProjected = "Projected"
+	// ReasonInvalidSpec means the spec isnt a valid projection manifest
+	ReasonInvalidSpec = "InvalidSpec"
+	// ReasonProjectionFailed means the spec is valid, but projecting its sources failed
+	ReasonProjectionFailed = "ProjectionFailed"
+	// ReasonSizeLimitExceeded means the projected ConfigMap (or Secret) is larger than the size limit
+	ReasonSizeLimitExceeded = "SizeLimitExceeded"
+	// ReasonConflict means a ConfigMap (or Secret) with the same name exists, but isnt owned by the ConfigProjection
+	ReasonConflict = "Conflict"
+	// ReasonSecretsNotAllowed means the spec projects a Secret, but the controller has no policy or
+	// source allowlist restricting what it may decrypt
+	ReasonSecretsNotAllowed = "SecretsNotAllowed"
+)
+
+var (
+	// GroupVersion is the group and version of the ConfigProjection custom resource
+	GroupVersion = schema.GroupVersion{Group: Group, Version: Version}
+
+	// APIResource describes ConfigProjections to the dynamic client
+	APIResource = metav1.APIResource{Name: Resource, Namespaced: true, Kind: Kind}
+)
+
+// The spec of a ConfigProjection is a projection manifest, minus the name and namespace, which come
+// from the resource's metadata:
+//
+//   apiVersion: projector.tumblr.com/v1alpha1
+//   kind: ConfigProjection
+//   metadata:
+//     name: notifications
+//     namespace: notification-production
+//   spec:
+//     data:
+//     - source: apps/us-east-1/production/notification.yaml
+//       output_file: launch_flags
+//       extract: $.launch_flags
+//
+// It is decoded with manifest.LoadFromYAMLBytes, so it is validated exactly like a manifest file.
+
+// Status is the observed state of a ConfigProjection
+type Status struct {
+	// ObservedGeneration is the metadata.generation of the spec last reconciled
+	ObservedGeneration int64       `json:"observedGeneration,omitempty"`
+	Conditions         []Condition `json:"conditions,omitempty"`
+}
+
+// Condition is the state of one aspect of a ConfigProjection
+type Condition struct {
+	Type   string             `json:"type"`
+	Status v1.ConditionStatus `json:"status"`
+	// LastTransitionTime is when Status last changed
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+	Reason             string      `json:"reason,omitempty"`
+	Message            string      `json:"message,omitempty"`
+}
+
+// setCondition sets c in conditions, keeping the last transition time if its status didnt change
+func setCondition(conditions []Condition, c Condition) []Condition {
+	for i, existing := range conditions {
+		if existing.Type != c.Type {
+			continue
+		}
+		if existing.Status == c.Status {
+			c.LastTransitionTime = existing.LastTransitionTime
+		}
+		conditions[i] = c
+		return conditions
+	}
+	return append(conditions, c)
+}
@@ -0,0 +1,164 @@
+// Package discover finds the manifest files in a manifest directory: every .yaml, .yml and .json
+// file, except those the directory's ignore file (.projectorignore) matches. Everything else that
+// is skipped is returned along with why, so it can be reported.
+//
+// The ignore file has one pattern per line; blank lines and lines starting with # are ignored.
+// Patterns are globs (see path.Match) matched against the slash separated path of each file and
+// directory relative to the manifest directory. A pattern without a / (other than a trailing one)
+// matches the name of a file or directory at any depth instead, and a pattern ending with / only
+// matches directories. Everything under an ignored directory is ignored.
+package discover
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// IgnoreFile is the file in a manifest directory listing files and directories to skip
+const IgnoreFile = ".projectorignore"
+
+// Extensions are the extensions of manifest files
+var Extensions = []string{".yaml", ".yml", ".json"}
+
+// Skipped is a file or directory that was skipped
+type Skipped struct {
+	// Path is slash separated, relative to the manifest directory
+	Path   string
+	Reason string
+}
+
+// IsManifest returns true if name has a manifest extension
+func IsManifest(name string) bool {
+	for _, ext := range Extensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ignore is the patterns of an ignore file
+type Ignore struct {
+	patterns []pattern
+}
+
+// pattern is a line of an ignore file
+type pattern struct {
+	glob string
+	// line is the line of the ignore file the pattern is on
+	line int
+	// dir is true if the pattern only matches directories
+	dir bool
+	// base is true if the pattern matches names at any depth, rather than paths
+	base bool
+}
+
+// ParseIgnore parses the patterns in the ignore file raw
+func ParseIgnore(raw []byte) (*Ignore, error) {
+	i := &Ignore{}
+	s := bufio.NewScanner(bytes.NewReader(raw))
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		p := pattern{line: line, dir: strings.HasSuffix(text, "/")}
+		p.glob = strings.TrimPrefix(strings.TrimSuffix(text, "/"), "/")
+		p.base = !strings.Contains(strings.TrimSuffix(text, "/"), "/")
+		if _, err := path.Match(p.glob, ""); err != nil || p.glob == "" {
+			return nil, fmt.Errorf("invalid pattern %q on line %d of %s", text, line, IgnoreFile)
+		}
+		i.patterns = append(i.patterns, p)
+	}
+	return i, s.Err()
+}
+
+// LoadIgnore reads the ignore file at the root of fsys. It is not an error for there to be none.
+func LoadIgnore(fsys fs.FS) (*Ignore, error) {
+	raw, err := fs.ReadFile(fsys, IgnoreFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &Ignore{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseIgnore(raw)
+}
+
+// Match returns the pattern matching the file (or directory, if dir) at the slash separated path
+// name, and its line in the ignore file, or "" if none do. Directories name is in arent checked.
+func (i *Ignore) Match(name string, dir bool) (string, int) {
+	if i == nil {
+		return "", 0
+	}
+	for _, p := range i.patterns {
+		if p.dir && !dir {
+			continue
+		}
+		subject := name
+		if p.base {
+			subject = path.Base(name)
+		}
+		if ok, _ := path.Match(p.glob, subject); ok {
+			return p.glob, p.line
+		}
+	}
+	return "", 0
+}
+
+// Ignored returns true if the file at the slash separated path name, or any directory it is in, is ignored
+func (i *Ignore) Ignored(name string) bool {
+	parts := strings.Split(name, "/")
+	for j := range parts {
+		if p, _ := i.Match(strings.Join(parts[:j+1], "/"), j < len(parts)-1); p != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// FS returns the slash separated paths of the manifest files in fsys, in lexical order, along with
+// every file and directory that was skipped. Ignored directories are skipped as a whole, as are
+// hidden ones (like .git).
+func FS(fsys fs.FS) ([]string, []Skipped, error) {
+	ignore, err := LoadIgnore(fsys)
+	if err != nil {
+		return nil, nil, err
+	}
+	files := []string{}
+	skipped := []Skipped{}
+	err = fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == "." || name == IgnoreFile {
+			return nil
+		}
+		if p, line := ignore.Match(name, d.IsDir()); p != "" {
+			skipped = append(skipped, Skipped{Path: name, Reason: fmt.Sprintf("ignored by %s:%d (%s)", IgnoreFile, line, p)})
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if strings.HasPrefix(d.Name(), ".") {
+				skipped = append(skipped, Skipped{Path: name, Reason: "hidden directory"})
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !IsManifest(d.Name()) {
+			skipped = append(skipped, Skipped{Path: name, Reason: fmt.Sprintf("not a manifest; manifests end in %s", strings.Join(Extensions, ", "))})
+			return nil
+		}
+		files = append(files, name)
+		return nil
+	})
+	return files, skipped, err
+}
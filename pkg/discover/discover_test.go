@@ -0,0 +1,71 @@
+package discover
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		IgnoreFile:               {Data: []byte("# drafts arent ready\ndrafts/\n*.tmpl.yaml\n/apps/legacy.yml\n")},
+		"apps/app.yaml":          {Data: []byte("{}")},
+		"apps/app.yml":           {Data: []byte("{}")},
+		"apps/app.json":          {Data: []byte("{}")},
+		"apps/legacy.yml":        {Data: []byte("{}")},
+		"apps/base.tmpl.yaml":    {Data: []byte("{}")},
+		"apps/README.md":         {Data: []byte("not a manifest")},
+		"drafts/app.yaml":        {Data: []byte("{}")},
+		"nested/drafts/app.yaml": {Data: []byte("{}")},
+		".git/config.yaml":       {Data: []byte("{}")},
+	}
+	files, skipped, err := FS(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(files, ",") != "apps/app.json,apps/app.yaml,apps/app.yml" {
+		t.Fatalf("Expected every .yaml, .yml and .json file that isnt ignored, but got %v", files)
+	}
+	reasons := map[string]string{}
+	for _, s := range skipped {
+		reasons[s.Path] = s.Reason
+	}
+	expected := map[string]string{
+		".git":                "hidden directory",
+		"apps/README.md":      "not a manifest",
+		"apps/base.tmpl.yaml": "ignored by .projectorignore:3 (*.tmpl.yaml)",
+		"apps/legacy.yml":     "ignored by .projectorignore:4 (apps/legacy.yml)",
+		"drafts":              "ignored by .projectorignore:2 (drafts)",
+		"nested/drafts":       "ignored by .projectorignore:2 (drafts)",
+	}
+	if len(reasons) != len(expected) {
+		t.Fatalf("Expected %d files and directories to be skipped, but got %v", len(expected), reasons)
+	}
+	for path, reason := range expected {
+		if !strings.HasPrefix(reasons[path], reason) {
+			t.Fatalf("Expected %s to be skipped because %q, but got %q", path, reason, reasons[path])
+		}
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	i, err := ParseIgnore([]byte("drafts/\n*.tmpl.yaml\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, ignored := range map[string]bool{
+		"drafts/app.yaml":          true,
+		"apps/drafts/app.yaml":     true,
+		"apps/base.tmpl.yaml":      true,
+		"apps/app.yaml":            false,
+		"drafts":                   false,
+		"apps/drafts.tmpl.yaml/ok": true,
+	} {
+		if i.Ignored(name) != ignored {
+			t.Fatalf("Expected %s to be ignored=%v", name, ignored)
+		}
+	}
+	if _, err := ParseIgnore([]byte("apps/[\n")); err == nil {
+		t.Fatal("Expected a bad pattern to be rejected")
+	}
+}
@@ -0,0 +1,298 @@
+// Package gitfs reads a revision of a git repository straight from its object database, as an
+// fs.FS, without checking it out.
+package gitfs
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/tumblr/k8s-config-projector/pkg/types"
+)
+
+const (
+	// maxSymlinks is how many symlinks are followed resolving a path before giving up, like ELOOP
+	maxSymlinks = 40
+)
+
+// FS is the tree of a commit, rooted at a directory in it. Symlinks are followed, as long as
+// they resolve inside of the root.
+type FS struct {
+	s      storer.EncodedObjectStorer
+	root   *object.Tree
+	commit plumbing.Hash
+	time   time.Time
+}
+
+// Open returns an FS for rev (a sha, branch, tag, or anything else git rev-parse accepts) of the
+// git repository containing dir, rooted at dir. dir may be the top of a checkout, a directory
+// inside of one, or a bare repository.
+func Open(dir string, rev string) (*FS, error) {
+	repo, err := git.PlainOpenWithOptions(dir, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open git repository at %s: %s", dir, err.Error())
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve revision %s in %s: %s", rev, dir, err.Error())
+	}
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		return nil, fmt.Errorf("revision %s in %s is not a commit: %s", rev, dir, err.Error())
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	// rooted at dir, when it is inside of a checkout
+	if wt, err := repo.Worktree(); err == nil {
+		rel, err := relativePath(wt.Filesystem.Root(), dir)
+		if err != nil {
+			return nil, err
+		}
+		if rel != "." {
+			if tree, err = tree.Tree(rel); err != nil {
+				return nil, fmt.Errorf("%s does not exist at revision %s: %s", rel, rev, err.Error())
+			}
+		}
+	}
+	return &FS{s: repo.Storer, root: tree, commit: commit.Hash, time: commit.Committer.When}, nil
+}
+
+// relativePath returns dir relative to root, after following symlinks in both
+func relativePath(root string, dir string) (string, error) {
+	var err error
+	for _, p := range []*string{&root, &dir} {
+		if *p, err = filepath.EvalSymlinks(*p); err != nil {
+			return "", err
+		}
+		if *p, err = filepath.Abs(*p); err != nil {
+			return "", err
+		}
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// Commit returns the sha of the commit the revision resolved to
+func (f *FS) Commit() string {
+	return f.commit.String()
+}
+
+// Open opens the named file or directory
+func (f *FS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	resolved, entry, err := f.resolve(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	info := &fileInfo{f: f, name: path.Base(name), entry: entry}
+	if entry.Mode == filemode.Dir {
+		tree := f.root
+		if resolved != "." {
+			if tree, err = object.GetTree(f.s, entry.Hash); err != nil {
+				return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+			}
+		}
+		return &dir{info: info, tree: tree}, nil
+	}
+	blob, err := object.GetBlob(f.s, entry.Hash)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	info.size = blob.Size
+	return &file{info: info, ReadCloser: r}, nil
+}
+
+// Resolve returns the path name resolves to, after following symlinks. It is an error for it to
+// resolve outside of the root.
+func (f *FS) Resolve(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", types.ErrSourceOutsideConfigRepo
+	}
+	resolved, _, err := f.resolve(name)
+	return resolved, err
+}
+
+// resolve returns the path name resolves to after following symlinks, and its tree entry
+func (f *FS) resolve(name string) (string, object.TreeEntry, error) {
+	rootEntry := object.TreeEntry{Name: ".", Mode: filemode.Dir, Hash: f.root.Hash}
+	if name == "." {
+		return ".", rootEntry, nil
+	}
+	parts := strings.Split(name, "/")
+	links := 0
+	for {
+		tree, entry, resolved := f.root, rootEntry, []string{}
+		restart := false
+		for i, part := range parts {
+			if entry.Mode != filemode.Dir {
+				return "", entry, fs.ErrNotExist
+			}
+			if i > 0 {
+				t, err := object.GetTree(f.s, entry.Hash)
+				if err != nil {
+					return "", entry, err
+				}
+				tree = t
+			}
+			e, err := tree.FindEntry(part)
+			if err != nil {
+				return "", entry, fs.ErrNotExist
+			}
+			entry = *e
+			if entry.Mode != filemode.Symlink {
+				resolved = append(resolved, part)
+				continue
+			}
+			if links++; links > maxSymlinks {
+				return "", entry, fmt.Errorf("too many levels of symbolic links")
+			}
+			target, err := f.readBlob(entry.Hash)
+			if err != nil {
+				return "", entry, err
+			}
+			var next string
+			if strings.HasPrefix(target, "/") {
+				// absolute links point somewhere on the host that checked the repo out
+				next = ".."
+			} else {
+				next = path.Join(append(append(resolved, target), parts[i+1:]...)...)
+			}
+			if next == ".." || strings.HasPrefix(next, "../") {
+				return "", entry, types.ErrSourceOutsideConfigRepo
+			}
+			if next == "." {
+				return ".", rootEntry, nil
+			}
+			parts = strings.Split(next, "/")
+			restart = true
+			break
+		}
+		if !restart {
+			return strings.Join(resolved, "/"), entry, nil
+		}
+	}
+}
+
+// readBlob returns the contents of a small blob, like a symlink target
+func (f *FS) readBlob(h plumbing.Hash) (string, error) {
+	blob, err := object.GetBlob(f.s, h)
+	if err != nil {
+		return "", err
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	raw, err := io.ReadAll(r)
+	return string(raw), err
+}
+
+// fileInfo describes a tree entry. Files are stamped with the commit time.
+type fileInfo struct {
+	f     *FS
+	name  string
+	entry object.TreeEntry
+	// size is the blob size, or -1 until it is looked up
+	size int64
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) ModTime() time.Time { return i.f.time }
+func (i *fileInfo) IsDir() bool        { return i.entry.Mode == filemode.Dir }
+func (i *fileInfo) Sys() interface{}   { return i.entry }
+
+func (i *fileInfo) Size() int64 {
+	if i.size < 0 {
+		i.size = 0
+		if blob, err := object.GetBlob(i.f.s, i.entry.Hash); err == nil {
+			i.size = blob.Size
+		}
+	}
+	return i.size
+}
+
+func (i *fileInfo) Mode() fs.FileMode {
+	switch i.entry.Mode {
+	case filemode.Dir:
+		return fs.ModeDir | 0555
+	case filemode.Symlink:
+		return fs.ModeSymlink | 0444
+	case filemode.Executable:
+		return 0555
+	case filemode.Submodule:
+		return fs.ModeIrregular
+	}
+	return 0444
+}
+
+// Type and Info make fileInfo a fs.DirEntry too
+func (i *fileInfo) Type() fs.FileMode          { return i.Mode().Type() }
+func (i *fileInfo) Info() (fs.FileInfo, error) { return i, nil }
+
+// file is an open blob
+type file struct {
+	io.ReadCloser
+	info *fileInfo
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+// dir is an open tree
+type dir struct {
+	info    *fileInfo
+	tree    *object.Tree
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *dir) Close() error               { return nil }
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.entries == nil {
+		d.entries = make([]fs.DirEntry, 0, len(d.tree.Entries))
+		for _, e := range d.tree.Entries {
+			d.entries = append(d.entries, &fileInfo{f: d.info.f, name: e.Name, entry: e, size: -1})
+		}
+		sort.Slice(d.entries, func(i, j int) bool { return d.entries[i].Name() < d.entries[j].Name() })
+	}
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.offset += n
+	return rest[:n], nil
+}
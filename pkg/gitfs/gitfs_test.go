@@ -0,0 +1,144 @@
+package gitfs
+
+import (
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/tumblr/k8s-config-projector/pkg/types"
+)
+
+// commit writes files (and symlinks, for values starting with "->") into the checkout at dir, and
+// commits them, returning the sha
+func commit(t *testing.T, dir string, files map[string]string) string {
+	repo, err := git.PlainOpen(dir)
+	if err == git.ErrRepositoryNotExists {
+		repo, err = git.PlainInit(dir, false)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(p)
+		if len(content) > 2 && content[:2] == "->" {
+			err = os.Symlink(content[2:], p)
+		} else {
+			err = ioutil.WriteFile(p, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := wt.Add(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sig := &object.Signature{Name: "test", Email: "test@example.com", When: time.Date(2018, 3, 14, 0, 0, 0, 0, time.UTC)}
+	h, err := wt.Commit("test", &git.CommitOptions{Author: sig, Committer: sig})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.String()
+}
+
+func TestOpenRevisions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	first := commit(t, dir, map[string]string{"config/app.json": `{"v": 1}`, "README": "hi"})
+	second := commit(t, dir, map[string]string{"config/app.json": `{"v": 2}`})
+	// the working tree has moved on, but isnt read
+	if err := ioutil.WriteFile(filepath.Join(dir, "config/app.json"), []byte(`{"v": 3}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for rev, expected := range map[string]string{first: `{"v": 1}`, second: `{"v": 2}`, "HEAD": `{"v": 2}`, "HEAD~1": `{"v": 1}`, "master": `{"v": 2}`} {
+		f, err := Open(dir, rev)
+		if err != nil {
+			t.Fatalf("%s: %s", rev, err.Error())
+		}
+		raw, err := fs.ReadFile(f, "config/app.json")
+		if err != nil || string(raw) != expected {
+			t.Fatalf("Expected %s at %s, but got %s %v", expected, rev, raw, err)
+		}
+	}
+	f, err := Open(dir, "HEAD~1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Commit() != first {
+		t.Fatalf("Expected HEAD~1 to resolve to %s, but got %s", first, f.Commit())
+	}
+	if _, err := Open(dir, "nope"); err == nil {
+		t.Fatal("Expected an unknown revision to fail")
+	}
+}
+
+func TestOpenSubdirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	commit(t, dir, map[string]string{"config/app.json": "{}", "config/hosts/a.txt": "a", "README": "hi"})
+	f, err := Open(filepath.Join(dir, "config"), "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(f, "app.json", "hosts/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat(f, "README"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Expected files outside of the subdirectory to not exist, but got %v", err)
+	}
+}
+
+func TestSymlinksAreConfined(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	commit(t, dir, map[string]string{
+		"config/app.json":       "{}",
+		"config/links/app.json": "->../app.json",
+		"config/links/dir":      "->..",
+		"config/links/outside":  "->../../README",
+		"config/links/absolute": "->/etc/passwd",
+		"README":                "hi",
+	})
+	f, err := Open(filepath.Join(dir, "config"), "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{"links/app.json": "app.json", "links/dir/app.json": "app.json"} {
+		resolved, err := f.Resolve(name)
+		if err != nil || resolved != expected {
+			t.Fatalf("Expected %s to resolve to %s, but got %s %v", name, expected, resolved, err)
+		}
+		if raw, err := fs.ReadFile(f, name); err != nil || string(raw) != "{}" {
+			t.Fatalf("Expected to read %s through its symlink, but got %s %v", name, raw, err)
+		}
+	}
+	for _, name := range []string{"links/outside", "links/absolute"} {
+		if _, err := fs.ReadFile(f, name); !errors.Is(err, types.ErrSourceOutsideConfigRepo) {
+			t.Fatalf("Expected %s to fail with %s, but got %v", name, types.ErrSourceOutsideConfigRepo, err)
+		}
+	}
+}
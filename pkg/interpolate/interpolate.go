@@ -0,0 +1,177 @@
+// Package interpolate replaces `${var}` references in manifest fields with the values of variables.
+// A `$` that isnt followed by `{` is left alone, so jsonpaths like `$.hosts` pass through
+// untouched; `$${` is a literal `${`.
+package interpolate
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/tumblr/k8s-config-projector/pkg/types"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// EnvPrefix prefixes environment variables that define variables; PROJECTOR_VAR_az defines ${az}
+	EnvPrefix = "PROJECTOR_VAR_"
+)
+
+var (
+	nameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// Vars are variable values by name
+type Vars map[string]string
+
+// ValidName returns true if name may be used as a variable, like `az` or `CLUSTER_NAME`
+func ValidName(name string) bool {
+	return nameRegexp.MatchString(name)
+}
+
+// LoadFile reads a yaml file mapping variable names to values
+func LoadFile(file string) (Vars, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	vars := Vars{}
+	if err := yaml.UnmarshalStrict(raw, &vars); err != nil {
+		return nil, fmt.Errorf("unable to parse vars %s: %s", file, err.Error())
+	}
+	for name := range vars {
+		if !ValidName(name) {
+			return nil, fmt.Errorf("invalid vars %s: invalid variable name %q", file, name)
+		}
+	}
+	return vars, nil
+}
+
+// FromEnv returns the variables defined by environment variables (as returned by os.Environ)
+// starting with EnvPrefix
+func FromEnv(environ []string) Vars {
+	vars := Vars{}
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, EnvPrefix) {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			continue
+		}
+		if name := kv[len(EnvPrefix):i]; ValidName(name) {
+			vars[name] = kv[i+1:]
+		}
+	}
+	return vars
+}
+
+// Contains returns true if s references any variables, even malformed references
+func Contains(s string) bool {
+	return strings.Contains(strings.ReplaceAll(s, "$${", ""), "${")
+}
+
+// References returns the names of the variables s references, in order. Malformed references are
+// left out; String reports them.
+func References(s string) []string {
+	refs := []string{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 >= len(s) {
+			continue
+		}
+		if strings.HasPrefix(s[i+1:], "${") {
+			i += 2
+			continue
+		}
+		if s[i+1] != '{' {
+			continue
+		}
+		end := strings.IndexByte(s[i+2:], '}')
+		if end < 0 {
+			break
+		}
+		refs = append(refs, s[i+2:i+2+end])
+		i += 2 + end
+	}
+	return refs
+}
+
+// String returns s with every `${var}` replaced by its value in vars. It is an error to reference
+// a variable that isnt defined, or for a reference to be malformed.
+func String(s string, vars Vars) (string, error) {
+	return expand(s, vars, nil)
+}
+
+// Partial is String, except that references to the variables in later are left as they are (as
+// are `$${` escapes), so the result can be interpolated again once they are defined
+func Partial(s string, vars Vars, later map[string]bool) (string, error) {
+	return expand(s, vars, func(name string) bool { return later[name] })
+}
+
+// Only replaces references to the variables in vars, leaving every other reference (and `$${`
+// escapes) as they are, to be interpolated later
+func Only(s string, vars Vars) (string, error) {
+	return expand(s, vars, func(name string) bool {
+		_, ok := vars[name]
+		return !ok
+	})
+}
+
+// expand interpolates s. When leave is not nil, references to variables it returns true for, and
+// escapes, are kept.
+func expand(s string, vars Vars, leave func(name string) bool) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 >= len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		if strings.HasPrefix(s[i+1:], "${") {
+			// `$${` is a literal `${`
+			if leave != nil {
+				b.WriteString("$")
+			}
+			b.WriteString("${")
+			i += 2
+			continue
+		}
+		if s[i+1] != '{' {
+			b.WriteByte('$')
+			continue
+		}
+		end := strings.IndexByte(s[i+2:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated variable reference in %q", s)
+		}
+		name := s[i+2 : i+2+end]
+		if !ValidName(name) {
+			return "", fmt.Errorf("invalid variable name %q in %q", name, s)
+		}
+		i += 2 + end
+		if leave != nil && leave(name) {
+			b.WriteString("${" + name + "}")
+			continue
+		}
+		v, ok := vars[name]
+		if !ok {
+			return "", fmt.Errorf("%w: %s", types.ErrUndefinedVariable, name)
+		}
+		b.WriteString(v)
+	}
+	return b.String(), nil
+}
+
+// Merge returns the variables in each of vars, with later ones taking precedence
+func Merge(vars ...Vars) Vars {
+	merged := Vars{}
+	for _, v := range vars {
+		for k, val := range v {
+			merged[k] = val
+		}
+	}
+	return merged
+}
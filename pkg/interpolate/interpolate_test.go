@@ -0,0 +1,98 @@
+package interpolate
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/tumblr/k8s-config-projector/pkg/types"
+)
+
+func TestString(t *testing.T) {
+	vars := Vars{"az": "bf2", "cluster": "PRODUCTION", "empty": ""}
+	cases := map[string]string{
+		"generated/${az}/${cluster}/app.json": "generated/bf2/PRODUCTION/app.json",
+		"${az}${empty}-${cluster}":            "bf2-PRODUCTION",
+		"$.hosts[0]":                          "$.hosts[0]",
+		"costs$":                              "costs$",
+		"$${az} is ${az}":                     "${az} is bf2",
+		"no vars here":                        "no vars here",
+	}
+	for s, expected := range cases {
+		got, err := String(s, vars)
+		if err != nil || got != expected {
+			t.Fatalf("Expected %q to interpolate to %q, but got %q %v", s, expected, got, err)
+		}
+	}
+}
+
+func TestStringErrors(t *testing.T) {
+	vars := Vars{"az": "bf2"}
+	if _, err := String("generated/${cluster}/app.json", vars); !errors.Is(err, types.ErrUndefinedVariable) {
+		t.Fatalf("Expected an undefined variable to fail with %s, but got %v", types.ErrUndefinedVariable, err)
+	}
+	for _, s := range []string{"generated/${az", "${not-a-name}", "${}"} {
+		if _, err := String(s, vars); err == nil {
+			t.Fatalf("Expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestReferences(t *testing.T) {
+	refs := References("${az}/$${literal}/${cluster}/$.x/${az}")
+	if !reflect.DeepEqual(refs, []string{"az", "cluster", "az"}) {
+		t.Fatalf("Expected references to az, cluster, az, but got %v", refs)
+	}
+	if !Contains("${unterminated") || Contains("$${escaped}") || Contains("$.hosts") {
+		t.Fatal("Expected Contains to find references, even malformed ones, but not escapes or jsonpaths")
+	}
+}
+
+func TestPartial(t *testing.T) {
+	s, err := Partial("${env}/${az}/$${literal}", Vars{"env": "production", "az": "global"}, map[string]bool{"az": true})
+	if err != nil || s != "production/${az}/$${literal}" {
+		t.Fatalf("Expected az and the escape to be left for later, but got %q %v", s, err)
+	}
+	s, err = String(s, Vars{"az": "bf2"})
+	if err != nil || s != "production/bf2/${literal}" {
+		t.Fatalf("Expected the rest to be interpolated later, but got %q %v", s, err)
+	}
+	if _, err := Partial("${nope}", Vars{}, map[string]bool{"az": true}); !errors.Is(err, types.ErrUndefinedVariable) {
+		t.Fatalf("Expected variables that arent left for later to be undefined, but got %v", err)
+	}
+}
+
+func TestSources(t *testing.T) {
+	env := FromEnv([]string{"HOME=/root", "PROJECTOR_VAR_az=bf2", "PROJECTOR_VAR_not-valid=x", "PROJECTOR_VAR_env=a=b"})
+	if !reflect.DeepEqual(env, Vars{"az": "bf2", "env": "a=b"}) {
+		t.Fatalf("Expected only prefixed environment variables, but got %v", env)
+	}
+	merged := Merge(Vars{"az": "dc2", "env": "devel"}, env, nil)
+	if !reflect.DeepEqual(merged, Vars{"az": "bf2", "env": "a=b"}) {
+		t.Fatalf("Expected later vars to take precedence, but got %v", merged)
+	}
+	f, err := ioutil.TempFile("", "vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("az: bf2\nreplicas: 3\n")
+	f.Close()
+	vars, err := LoadFile(f.Name())
+	if err != nil || !reflect.DeepEqual(vars, Vars{"az": "bf2", "replicas": "3"}) {
+		t.Fatalf("Expected vars from the file, but got %v %v", vars, err)
+	}
+	ioutil.WriteFile(f.Name(), []byte("not-valid: x\n"), 0644)
+	if _, err := LoadFile(f.Name()); err == nil {
+		t.Fatal("Expected an invalid variable name to be rejected")
+	}
+}
+
+func TestOnly(t *testing.T) {
+	s, err := Only("${pool}/${az}/$${literal}", Vars{"pool": "sessions"})
+	if err != nil || s != "sessions/${az}/$${literal}" {
+		t.Fatalf("Expected only pool to be interpolated, but got %q %v", s, err)
+	}
+}
@@ -0,0 +1,202 @@
+// Package library loads shared datasource templates (see --library), which manifests `include:`.
+// A template is a yaml (or json) file in the library directory, named by its path without its
+// extension:
+//
+//	# memcached.yaml
+//	params:
+//	  pool: main  # a default; a param without one must be given by every include
+//	  az: null
+//	data:
+//	- source: generated/${az}/memcached.json
+//	  output_file: memcached-${pool}
+//	  extract: $.pools.${pool}
+//	include:
+//	- template: logging
+//
+// Templates may include other templates; cycles are an error when they are resolved.
+package library
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/tumblr/k8s-config-projector/pkg/discover"
+	"github.com/tumblr/k8s-config-projector/pkg/interpolate"
+	"github.com/tumblr/k8s-config-projector/pkg/types"
+	ds "github.com/tumblr/k8s-config-projector/pkg/types/v1/datasource"
+	"gopkg.in/yaml.v2"
+)
+
+// Template is a reusable list of datasources
+type Template struct {
+	// Params are the parameters the template takes, substituted for `${param}` in its datasources,
+	// and the params of its includes. A nil default means the param is required.
+	Params map[string]*string `yaml:"params,omitempty"`
+	// Data are the template's datasources
+	Data []*ds.DataSource `yaml:"data"`
+	// Include are other templates whose datasources follow this one's
+	Include []Include `yaml:"include,omitempty"`
+
+	// path is the file the template was loaded from
+	path string
+}
+
+// Include includes the datasources of a template, with the given params
+type Include struct {
+	Template string            `yaml:"template"`
+	Params   map[string]string `yaml:"params,omitempty"`
+}
+
+// Resolved is a datasource resolved from an include
+type Resolved struct {
+	DataSource *ds.DataSource
+	// Template is the template the datasource is from, after any templates that included it,
+	// like `memcached > logging`
+	Template string
+	// Index is the index of the datasource in the template's data
+	Index int
+}
+
+// Library is the templates in a library directory, by name
+type Library struct {
+	dir       string
+	templates map[string]*Template
+}
+
+// Load reads every template in dir. Templates are discovered like manifests are (see package
+// discover): every .yaml, .yml and .json file, other than those dir's ignore file matches.
+func Load(dir string) (*Library, error) {
+	l := &Library{dir: dir, templates: map[string]*Template{}}
+	files, _, err := discover.FS(os.DirFS(dir))
+	if err != nil {
+		return nil, err
+	}
+	for _, rel := range files {
+		p := filepath.Join(dir, filepath.FromSlash(rel))
+		raw, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		var t Template
+		if err := yaml.UnmarshalStrict(raw, &t); err != nil {
+			return nil, fmt.Errorf("unable to parse template %s: %s", p, err.Error())
+		}
+		for name := range t.Params {
+			if !interpolate.ValidName(name) {
+				return nil, fmt.Errorf("invalid template %s: invalid param name %q", p, name)
+			}
+		}
+		t.path = p
+		name := strings.TrimSuffix(rel, path.Ext(rel))
+		if existing, ok := l.templates[name]; ok {
+			return nil, fmt.Errorf("template %s is defined by both %s and %s", name, existing.path, p)
+		}
+		l.templates[name] = &t
+	}
+	return l, nil
+}
+
+// Dir returns the library directory
+func (l *Library) Dir() string {
+	return l.dir
+}
+
+// Names returns the names of every template, sorted
+func (l *Library) Names() []string {
+	names := make([]string, 0, len(l.templates))
+	for name := range l.templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Path returns the file the named template was loaded from, or "" if there is no such template
+func (l *Library) Path(name string) string {
+	if t, ok := l.templates[name]; ok {
+		return t.path
+	}
+	return ""
+}
+
+// Resolve returns copies of the datasources inc includes, with its params substituted, followed by
+// those of the templates the template includes, and so on. References to variables that arent
+// params are left for the manifest to interpolate. It is an error to include a template that
+// doesnt exist, to give a param the template doesnt take (or not give one it requires), or for
+// templates to include each other in a cycle.
+func (l *Library) Resolve(inc Include) ([]Resolved, error) {
+	return l.resolve(inc, nil)
+}
+
+func (l *Library) resolve(inc Include, stack []string) ([]Resolved, error) {
+	name := path.Clean(inc.Template)
+	if l == nil {
+		return nil, fmt.Errorf("%w: %s (no --library was given)", types.ErrUnknownTemplate, inc.Template)
+	}
+	t, ok := l.templates[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", types.ErrUnknownTemplate, inc.Template)
+	}
+	for _, s := range stack {
+		if s == name {
+			return nil, fmt.Errorf("%w: %s", types.ErrIncludeCycle, strings.Join(append(stack, name), " > "))
+		}
+	}
+	stack = append(stack, name)
+	params := interpolate.Vars{}
+	for k, v := range t.Params {
+		if v != nil {
+			params[k] = *v
+		}
+	}
+	for k, v := range inc.Params {
+		if _, ok := t.Params[k]; !ok {
+			return nil, fmt.Errorf("template %s does not take param %s", name, k)
+		}
+		params[k] = v
+	}
+	missing := []string{}
+	for k := range t.Params {
+		if _, ok := params[k]; !ok {
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("template %s requires params %s", name, strings.Join(missing, ", "))
+	}
+
+	resolved := []Resolved{}
+	for i, d := range t.Data {
+		c := *d
+		err := c.Interpolate(func(field string, v string) (string, error) {
+			return interpolate.Only(v, params)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("template %s data[%d]: %w", name, i, err)
+		}
+		resolved = append(resolved, Resolved{DataSource: &c, Template: strings.Join(stack, " > "), Index: i})
+	}
+	for _, nested := range t.Include {
+		// the params of nested includes may use this template's params
+		n := Include{Template: nested.Template, Params: map[string]string{}}
+		for k, v := range nested.Params {
+			s, err := interpolate.Only(v, params)
+			if err != nil {
+				return nil, fmt.Errorf("template %s: include %s: %w", name, nested.Template, err)
+			}
+			n.Params[k] = s
+		}
+		r, err := l.resolve(n, stack)
+		if err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, r...)
+	}
+	return resolved, nil
+}
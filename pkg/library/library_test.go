@@ -0,0 +1,113 @@
+package library
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/tumblr/k8s-config-projector/internal/pkg/testing"
+	"github.com/tumblr/k8s-config-projector/pkg/types"
+)
+
+func TestLoad(t *testing.T) {
+	l, err := Load("test/library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := strings.Join(l.Names(), ","); names != "app,cycle/a,cycle/b,shared/sample" {
+		t.Fatalf("Expected templates named by their path, but got %s", names)
+	}
+	if l.Path("shared/sample") != "test/library/shared/sample.yaml" || l.Path("nope") != "" {
+		t.Fatalf("Expected the path of each template, but got %q", l.Path("shared/sample"))
+	}
+}
+
+func TestLoadDiscoversTemplatesLikeManifests(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.yml":            "data:\n- source: a.json\n  output_file: a\n",
+		"b.json":           `{"data": [{"source": "b.json", "output_file": "b"}]}`,
+		"ignored/c.yaml":   "not: a template\n",
+		".hidden/d.yaml":   "not: a template\n",
+		"README.md":        "not a template",
+		".projectorignore": "ignored/\n",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := strings.Join(l.Names(), ","); names != "a,b" {
+		t.Fatalf("Expected the .yml and .json templates, but got %s", names)
+	}
+	if r, err := l.Resolve(Include{Template: "b"}); err != nil || r[0].DataSource.OutputFile != "b" {
+		t.Fatalf("Expected the json template to be resolved, but got %+v %v", r, err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.yaml"), []byte("data: []\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(dir); err == nil || !strings.Contains(err.Error(), "template a is defined by both") {
+		t.Fatalf("Expected a.yaml and a.yml to conflict, but got %v", err)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	l, err := Load("test/library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := l.Resolve(Include{Template: "app", Params: map[string]string{"cluster": "bf2-DEVEL"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 2 {
+		t.Fatalf("Expected the template's datasource and its include's, but got %+v", r)
+	}
+	d := r[0].DataSource
+	if d.Source != "clusters/bf2-DEVEL/app.json" || d.OutputFile != "replicas" || d.Extract != "$.replicas" || r[0].Template != "app" {
+		t.Fatalf("Expected params and their defaults to be substituted, but got %+v from %s", d, r[0].Template)
+	}
+	if r[1].DataSource.OutputFile != "bf2-DEVEL-sample.json" || r[1].Template != "app > shared/sample" || r[1].Index != 0 {
+		t.Fatalf("Expected the nested include to get the template's params, but got %+v from %s", r[1].DataSource, r[1].Template)
+	}
+
+	// variables that arent params are left for the manifest
+	r, err = l.Resolve(Include{Template: "app", Params: map[string]string{"cluster": "${az}-PRODUCTION"}})
+	if err != nil || r[0].DataSource.Source != "clusters/${az}-PRODUCTION/app.json" {
+		t.Fatalf("Expected ${az} to be left alone, but got %+v %v", r, err)
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	l, err := Load("test/library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Resolve(Include{Template: "nope"}); !errors.Is(err, types.ErrUnknownTemplate) {
+		t.Fatalf("Expected an unknown template to fail with %s, but got %v", types.ErrUnknownTemplate, err)
+	}
+	if _, err := (*Library)(nil).Resolve(Include{Template: "app"}); !errors.Is(err, types.ErrUnknownTemplate) {
+		t.Fatalf("Expected includes without a library to fail with %s, but got %v", types.ErrUnknownTemplate, err)
+	}
+	if _, err := l.Resolve(Include{Template: "cycle/a"}); !errors.Is(err, types.ErrIncludeCycle) || !strings.Contains(err.Error(), "cycle/a > cycle/b > cycle/a") {
+		t.Fatalf("Expected a cycle to fail with %s, but got %v", types.ErrIncludeCycle, err)
+	}
+	if _, err := l.Resolve(Include{Template: "app"}); err == nil || !strings.Contains(err.Error(), "requires params cluster") {
+		t.Fatalf("Expected a missing required param to be rejected, but got %v", err)
+	}
+	if _, err := l.Resolve(Include{Template: "app", Params: map[string]string{"cluster": "x", "nope": "x"}}); err == nil || !strings.Contains(err.Error(), "does not take param nope") {
+		t.Fatalf("Expected an unknown param to be rejected, but got %v", err)
+	}
+}
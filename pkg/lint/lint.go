@@ -0,0 +1,280 @@
+package lint
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tumblr/k8s-config-projector/pkg/interpolate"
+	"github.com/tumblr/k8s-config-projector/pkg/projector"
+	"github.com/tumblr/k8s-config-projector/pkg/report"
+	"github.com/tumblr/k8s-config-projector/pkg/types"
+	ds "github.com/tumblr/k8s-config-projector/pkg/types/v1/datasource"
+	"github.com/tumblr/k8s-config-projector/pkg/types/v1/manifest"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// RuleOutputFileExtension finds output_files whose extension doesnt match their output_format
+	RuleOutputFileExtension = "output-file-extension"
+	// RuleFileName finds manifests in files not named after them
+	RuleFileName = "file-name"
+	// RuleNamespaceDirectory finds manifests in directories not named after their namespace
+	RuleNamespaceDirectory = "namespace-directory"
+	// RuleUnusedExtraction finds extractions that are never evaluated, or evaluate a jsonpath
+	// another field_extractions label already does
+	RuleUnusedExtraction = "unused-extraction"
+	// RuleSharedSource finds sources projected by more than Max manifests
+	RuleSharedSource = "shared-source"
+	// RuleEmptyGlob finds glob sources matching no files
+	RuleEmptyGlob = "empty-glob"
+
+	// SeverityOff disables a rule
+	SeverityOff = "off"
+
+	// defaultMaxManifests is how many manifests may project a source before RuleSharedSource finds it
+	defaultMaxManifests = 3
+)
+
+// Rules describes every rule, in the order they are checked
+var Rules = []report.Rule{
+	{ID: RuleOutputFileExtension, Description: "output_file extension should match output_format (.json for json, .yaml or .yml for yaml)"},
+	{ID: RuleFileName, Description: "manifest files should be named after the manifest's name"},
+	{ID: RuleNamespaceDirectory, Description: "manifest files should be in a directory named after the manifest's namespace"},
+	{ID: RuleUnusedExtraction, Description: "extract and field_extractions should be evaluated, and each field_extractions jsonpath should be distinct"},
+	{ID: RuleSharedSource, Description: "sources should not be projected by many manifests"},
+	{ID: RuleEmptyGlob, Description: "glob sources should match files"},
+}
+
+// defaults are the severities of rules that arent configured
+var defaults = map[string]string{
+	RuleOutputFileExtension: report.SeverityWarning,
+	RuleFileName:            report.SeverityWarning,
+	RuleNamespaceDirectory:  report.SeverityWarning,
+	RuleUnusedExtraction:    report.SeverityWarning,
+	RuleSharedSource:        report.SeverityInfo,
+	RuleEmptyGlob:           report.SeverityWarning,
+}
+
+// Config configures the severity of rules, and their options. It is loaded from the file given
+// with --lint-config.
+type Config struct {
+	Rules map[string]RuleConfig `yaml:"rules"`
+}
+
+// RuleConfig overrides a rule's defaults
+type RuleConfig struct {
+	// Severity is error, warning, info, or off
+	Severity string `yaml:"severity,omitempty"`
+	// Max is how many manifests may project a source (shared-source)
+	Max int `yaml:"max,omitempty"`
+}
+
+// Load reads and validates a lint config file
+func Load(file string) (*Config, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var c Config
+	if err := yaml.UnmarshalStrict(raw, &c); err != nil {
+		return nil, fmt.Errorf("unable to parse lint config %s: %s", file, err.Error())
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid lint config %s: %s", file, err.Error())
+	}
+	return &c, nil
+}
+
+// Validate makes sure every configured rule exists, with a known severity
+func (c *Config) Validate() error {
+	for id, rc := range c.Rules {
+		if _, ok := defaults[id]; !ok {
+			return fmt.Errorf("unknown rule %s", id)
+		}
+		switch rc.Severity {
+		case "", report.SeverityError, report.SeverityWarning, report.SeverityInfo, SeverityOff:
+		default:
+			return fmt.Errorf("rule %s: severity must be one of error, warning, info, or off", id)
+		}
+		if rc.Max < 0 || (rc.Max > 0 && id != RuleSharedSource) {
+			return fmt.Errorf("rule %s: max is only supported by %s, and must be positive", id, RuleSharedSource)
+		}
+	}
+	return nil
+}
+
+// severity returns the configured severity of the rule, or its default
+func (c *Config) severity(id string) string {
+	if c != nil && c.Rules[id].Severity != "" {
+		return c.Rules[id].Severity
+	}
+	return defaults[id]
+}
+
+// maxManifests returns how many manifests may project a source
+func (c *Config) maxManifests() int {
+	if c != nil && c.Rules[RuleSharedSource].Max > 0 {
+		return c.Rules[RuleSharedSource].Max
+	}
+	return defaultMaxManifests
+}
+
+// Linter checks manifests against the rules
+type Linter struct {
+	config *Config
+	// root is the config repo globs are resolved in
+	root *ds.SourceRoot
+}
+
+// New returns a Linter with the config (or the defaults, if nil) resolving sources in root
+func New(config *Config, root *ds.SourceRoot) *Linter {
+	return &Linter{config: config, root: root}
+}
+
+// Lint adds a problem to rep for each finding in manifests, with the severity of its rule, and a
+// result for each manifest. Rules that are off arent checked.
+func (l *Linter) Lint(manifests projector.Manifests, rep *report.Report) {
+	for _, rule := range Rules {
+		if l.config.severity(rule.ID) != SeverityOff {
+			rep.Rules = append(rep.Rules, rule)
+		}
+	}
+	// projectors are the manifests projecting each source file, in order
+	projectors := map[string][]string{}
+	// firsts locate the first datasource projecting each source file
+	firsts := map[string]finding{}
+	for _, key := range manifests.Keys() {
+		m := manifests[key]
+		started := time.Now()
+		l.checkFile(rep, key, m)
+		for i, d := range m.Data {
+			if interpolate.Contains(d.Source) {
+				// projected per target, so cant be checked until then
+				continue
+			}
+			l.checkDataSource(rep, key, m, i, d)
+			for _, file := range l.files(d) {
+				ms := projectors[file]
+				if len(ms) > 0 && ms[len(ms)-1] == key {
+					continue
+				}
+				projectors[file] = append(ms, key)
+				if len(ms) == 0 {
+					firsts[file] = finding{key: key, m: m, dataSource: i}
+				}
+			}
+		}
+		rep.Record(m.GetPath(), key, started, 0)
+	}
+
+	max := l.config.maxManifests()
+	files := make([]string, 0, len(projectors))
+	for file := range projectors {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		if ms := projectors[file]; len(ms) > max {
+			f := firsts[file]
+			err := fmt.Errorf("source %s is projected by %d manifests, more than %d: %s", file, len(ms), max, strings.Join(ms, ", "))
+			l.add(rep, RuleSharedSource, f.key, f.m, f.dataSource, "source", err)
+		}
+	}
+}
+
+// finding is where a finding is in a manifest
+type finding struct {
+	key        string
+	m          manifest.ConfigProjectionManifest
+	dataSource int
+}
+
+// checkFile checks the manifest is in the file and directory it should be
+func (l *Linter) checkFile(rep *report.Report, key string, m manifest.ConfigProjectionManifest) {
+	p := m.GetPath()
+	// files holding several manifests, or manifests expanded from a matrix, cant all be named after
+	// their manifest
+	if p != "" && m.Origin() == p {
+		base := filepath.Base(p)
+		if name := strings.TrimSuffix(base, filepath.Ext(base)); name != m.Name {
+			err := fmt.Errorf("manifest %s is in the file %s, but should be in %s%s", m.Name, base, m.Name, filepath.Ext(base))
+			l.add(rep, RuleFileName, key, m, types.NoDataSource, "name", err)
+		}
+	}
+	if dir := filepath.Base(filepath.Dir(p)); p != "" && dir != m.Namespace {
+		err := fmt.Errorf("manifest is in a directory called %s, but should be in one called %s", dir, m.Namespace)
+		l.add(rep, RuleNamespaceDirectory, key, m, types.NoDataSource, "namespace", err)
+	}
+}
+
+// checkDataSource checks the datasource at index i of the manifest
+func (l *Linter) checkDataSource(rep *report.Report, key string, m manifest.ConfigProjectionManifest, i int, d *ds.DataSource) {
+	ext := path.Ext(d.OutputFile)
+	switch {
+	case d.OutputFormat == ds.OutputJSON && ext != ".json",
+		d.OutputFormat == ds.OutputYAML && ext != ".yaml" && ext != ".yml":
+		err := fmt.Errorf("output_file %s has output_format %s, but not a .%s extension", d.OutputFile, d.OutputFormat, d.OutputFormat)
+		l.add(rep, RuleOutputFileExtension, key, m, i, "output_file", err)
+	}
+
+	if d.SourceFormat == ds.FormatFile || d.SourceFormat == ds.FormatGlob {
+		unused := errors.New("extractions are never evaluated for " + string(d.SourceFormat) + " sources; set source_format to json or yaml")
+		if d.Extract != "" {
+			l.add(rep, RuleUnusedExtraction, key, m, i, "extract", unused)
+		}
+		if len(d.FieldExtractions) > 0 {
+			l.add(rep, RuleUnusedExtraction, key, m, i, "field_extractions", unused)
+		}
+	} else {
+		labels := make([]string, 0, len(d.FieldExtractions))
+		for label := range d.FieldExtractions {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		seen := map[string]string{}
+		for _, label := range labels {
+			expr := d.FieldExtractions[label]
+			if first, ok := seen[expr]; ok {
+				err := fmt.Errorf("extracts %s, like %s already does", expr, first)
+				l.add(rep, RuleUnusedExtraction, key, m, i, "field_extractions."+label, err)
+				continue
+			}
+			seen[expr] = label
+		}
+	}
+
+	if d.SourceFormat == ds.FormatGlob && l.config.severity(RuleEmptyGlob) != SeverityOff {
+		// globs that fail to resolve are validation errors, found when projecting
+		if files, err := l.root.Glob(d.Source); err == nil && len(files) == 0 {
+			l.add(rep, RuleEmptyGlob, key, m, i, "source", fmt.Errorf("glob %s matches no files", d.Source))
+		}
+	}
+}
+
+// files returns the source files the datasource projects
+func (l *Linter) files(d *ds.DataSource) []string {
+	if d.SourceFormat != ds.FormatGlob {
+		root, p := ds.SplitSource(d.Source)
+		return []string{ds.JoinSource(root, path.Clean(p))}
+	}
+	files, _ := l.root.Glob(d.Source)
+	return files
+}
+
+// add records a finding of the rule, unless the rule is off
+func (l *Linter) add(rep *report.Report, rule string, key string, m manifest.ConfigProjectionManifest, dataSource int, field string, err error) {
+	severity := l.config.severity(rule)
+	if severity == SeverityOff {
+		return
+	}
+	rep.Add(m.GetPath(), key, m.Locate(dataSource, types.NewFieldError(field, err)))
+	p := &rep.Problems[len(rep.Problems)-1]
+	p.Rule = rule
+	p.Severity = severity
+}
@@ -0,0 +1,121 @@
+package lint
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	_ "github.com/tumblr/k8s-config-projector/internal/pkg/testing"
+	"github.com/tumblr/k8s-config-projector/pkg/projector"
+	"github.com/tumblr/k8s-config-projector/pkg/report"
+)
+
+var manifests = fstest.MapFS{
+	"lint/app.yaml": {Data: []byte(`name: other
+namespace: lint
+data:
+- source: test.json
+  output_file: out.txt
+  field_extractions:
+    a: $.astring
+    b: $.astring
+`)},
+	"lint/globs.yaml": {Data: []byte(`name: globs
+namespace: lint
+data:
+- source: nope/*.php
+- source: test.json
+  source_format: file
+  output_format: raw
+  output_file: test.json
+  extract: $.astring
+`)},
+	"other/shared.yaml": {Data: []byte(`name: shared
+namespace: lint
+data:
+- source: ./test.json
+`)},
+}
+
+func lint(t *testing.T, config *Config) *report.Report {
+	p, err := projector.New(projector.Options{ConfigRoot: "test/sources", Generation: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep := report.New()
+	ms, err := p.LoadFS(manifests, rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.OK() {
+		t.Fatalf("Expected the manifests to be valid, but got %+v", rep.Problems)
+	}
+	New(config, p.SourceRoot()).Lint(ms, rep)
+	return rep
+}
+
+func TestLint(t *testing.T) {
+	rep := lint(t, nil)
+	found := []string{}
+	for _, p := range rep.Problems {
+		found = append(found, strings.Join([]string{p.Rule, p.Severity, p.Location()}, " "))
+	}
+	sort.Strings(found)
+	expected := []string{
+		"empty-glob warning lint/globs.yaml:4:3: data[0].source",
+		"file-name warning lint/app.yaml:1:1: name",
+		"namespace-directory warning other/shared.yaml:2:1: namespace",
+		"output-file-extension warning lint/app.yaml:5:3: data[0].output_file",
+		"unused-extraction warning lint/app.yaml:8:5: data[0].field_extractions.b",
+		"unused-extraction warning lint/globs.yaml:9:3: data[1].extract",
+	}
+	if strings.Join(found, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Expected findings\n%s\nbut got\n%s", strings.Join(expected, "\n"), strings.Join(found, "\n"))
+	}
+	if !rep.OK() || len(rep.Rules) != len(Rules) {
+		t.Fatalf("Expected warnings not to fail the report, and every rule to be described, but got %v and %d rules", rep.OK(), len(rep.Rules))
+	}
+	if len(rep.Results) != 3 || rep.Results[0].Manifest != "lint/globs" || rep.Results[0].File != "lint/globs.yaml" {
+		t.Fatalf("Expected a result for each manifest, but got %+v", rep.Results)
+	}
+}
+
+func TestLintConfig(t *testing.T) {
+	config := &Config{Rules: map[string]RuleConfig{
+		RuleSharedSource:        {Severity: report.SeverityError, Max: 2},
+		RuleFileName:            {Severity: SeverityOff},
+		RuleOutputFileExtension: {Severity: SeverityOff},
+		RuleUnusedExtraction:    {Severity: report.SeverityInfo},
+	}}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	rep := lint(t, config)
+	if rep.OK() {
+		t.Fatal("Expected an error severity finding to fail the report")
+	}
+	severities := map[string]string{}
+	for _, p := range rep.Problems {
+		severities[p.Rule] = p.Severity
+		if p.Rule == RuleSharedSource && p.Message != "source test.json is projected by 3 manifests, more than 2: lint/globs, lint/other, lint/shared" {
+			t.Fatalf("Expected the manifests projecting test.json to be listed, but got %s", p.Message)
+		}
+	}
+	if _, ok := severities[RuleFileName]; ok || severities[RuleSharedSource] != report.SeverityError || severities[RuleUnusedExtraction] != report.SeverityInfo || severities[RuleEmptyGlob] != report.SeverityWarning {
+		t.Fatalf("Expected configured severities, but got %v", severities)
+	}
+	if len(rep.Rules) != len(Rules)-2 {
+		t.Fatalf("Expected rules that are off not to be described, but got %v", rep.Rules)
+	}
+
+	for _, bad := range []*Config{
+		{Rules: map[string]RuleConfig{"nope": {}}},
+		{Rules: map[string]RuleConfig{RuleFileName: {Severity: "fatal"}}},
+		{Rules: map[string]RuleConfig{RuleFileName: {Max: 2}}},
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Fatalf("Expected %+v to be invalid", bad)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package lsp
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/tumblr/k8s-config-projector/pkg/projector"
+	ds "github.com/tumblr/k8s-config-projector/pkg/types/v1/datasource"
+	"github.com/tumblr/k8s-config-projector/pkg/types/v1/manifest"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// document is an open manifest file
+type document struct {
+	uri  string
+	path string
+	text string
+	// results are the projections of the file's valid manifests, by namespace/name (and
+	// @target, when projecting for targets), as of the last change
+	results map[string]projection
+}
+
+// projection is a manifest projected from a document
+type projection struct {
+	// origin is the Origin of the manifest
+	origin string
+	result *projector.Result
+}
+
+// section is one of the yaml documents in a manifest file, and the datasources in it
+type section struct {
+	// origin is what the manifests in the section give as their Origin
+	origin string
+	// line is the 1 based line the section starts on
+	line int
+	// items are the section's `data` items, and end is the line after the last of them
+	items []*yamlv3.Node
+	end   int
+}
+
+// sections parses each yaml document in the file. Documents that dont parse have no items.
+func (d *document) sections() []section {
+	docs := []manifest.Document{}
+	for _, doc := range manifest.SplitDocuments([]byte(d.text)) {
+		if !doc.Empty() {
+			docs = append(docs, doc)
+		}
+	}
+	sections := []section{}
+	for i, doc := range docs {
+		s := section{origin: d.path, line: doc.Line}
+		if len(docs) > 1 {
+			s.origin = fmt.Sprintf("%s:%d", d.path, doc.Line)
+		}
+		s.items, s.end = dataItems(append(bytes.Repeat([]byte("\n"), doc.Line-1), doc.Raw...))
+		if i+1 < len(docs) && s.end > docs[i+1].Line {
+			s.end = docs[i+1].Line
+		}
+		sections = append(sections, s)
+	}
+	return sections
+}
+
+// dataItems returns the `data` items of the manifest in raw (in its `spec` for v2 manifests), and
+// the line of whatever key follows `data`
+func dataItems(raw []byte) ([]*yamlv3.Node, int) {
+	var n yamlv3.Node
+	if err := yamlv3.Unmarshal(raw, &n); err != nil || len(n.Content) == 0 {
+		return nil, 0
+	}
+	root := n.Content[0]
+	if spec := mappingValue(root, "spec"); spec != nil {
+		root = spec
+	}
+	if root.Kind != yamlv3.MappingNode {
+		return nil, 0
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != "data" || root.Content[i+1].Kind != yamlv3.SequenceNode {
+			continue
+		}
+		end := math.MaxInt32
+		if i+2 < len(root.Content) {
+			end = root.Content[i+2].Line
+		}
+		return root.Content[i+1].Content, end
+	}
+	return nil, 0
+}
+
+// mappingValue returns the value of key in the mapping n, if it is a mapping too
+func mappingValue(n *yamlv3.Node, key string) *yamlv3.Node {
+	if n.Kind != yamlv3.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key && n.Content[i+1].Kind == yamlv3.MappingNode {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// item returns the index of the data item on the 1 based line, or -1
+func (s section) item(line int) int {
+	for i, item := range s.items {
+		next := s.end
+		if i+1 < len(s.items) {
+			next = s.items[i+1].Line
+		}
+		if line >= item.Line && line < next {
+			return i
+		}
+	}
+	return -1
+}
+
+// cursor is a datasource field under a position in a manifest
+type cursor struct {
+	section section
+	// dataSource is the index of the datasource in its manifest's `data`
+	dataSource int
+	// source is the datasource as written, before variables are substituted or defaults inferred
+	source ds.DataSource
+	// field is the field under the position, like `source` or `field_extractions.hosts`, if any
+	field string
+	// value is the field's value up to the position, and start is the byte offset in the line it
+	// starts at, or -1 if the position is before it
+	value string
+	start int
+}
+
+// at returns the datasource field at pos, if there is one
+func (d *document) at(pos Position) (*cursor, bool) {
+	ls := lines(d.text)
+	if pos.Line >= len(ls) {
+		return nil, false
+	}
+	text := ls[pos.Line]
+	line := pos.Line + 1
+	for _, s := range d.sections() {
+		i := s.item(line)
+		if i < 0 {
+			continue
+		}
+		c := &cursor{section: s, dataSource: i}
+		item := s.items[i]
+		if err := item.Decode(&c.source); err != nil {
+			return nil, false
+		}
+		key := keyOn(item, line)
+		if key != nil && key.Value == "field_extractions" && key.Line != line {
+			if fe := mappingValue(item, "field_extractions"); fe != nil {
+				if label := keyOn(fe, line); label != nil {
+					key = label
+					c.field = "field_extractions."
+				}
+			}
+		}
+		if key == nil || key.Line != line {
+			// a line of a value spanning several
+			c.field = ""
+			return c, true
+		}
+		c.field += key.Value
+		// the value follows the key and its colon on the same line
+		col := runeColumn(text, key.Column) + len(key.Value)
+		colon := -1
+		if col <= len(text) {
+			colon = strings.Index(text[col:], ":")
+		}
+		if colon < 0 {
+			c.start = -1
+			return c, true
+		}
+		c.start = col + colon + 1
+		for c.start < len(text) && text[c.start] == ' ' {
+			c.start++
+		}
+		if c.start < len(text) && (text[c.start] == '"' || text[c.start] == '\'') {
+			c.start++
+		}
+		if end := byteOffset(text, pos.Character); end >= c.start {
+			c.value = text[c.start:end]
+		} else {
+			c.start = -1
+		}
+		return c, true
+	}
+	return nil, false
+}
+
+// keyOn returns the key of the mapping n on the 1 based line, or the last key before it, whose
+// value spans the line
+func keyOn(n *yamlv3.Node, line int) *yamlv3.Node {
+	var key *yamlv3.Node
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Line > line {
+			break
+		}
+		key = n.Content[i]
+	}
+	return key
+}
@@ -0,0 +1,501 @@
+// Package lsp serves the Language Server Protocol for projection manifests, so editors can show
+// problems in a manifest as it is written, and help write it:
+//
+//   - diagnostics: every problem `validate` would report with the file, as it is edited
+//   - completion: of `source` paths in the config repo (and named config roots), and of jsonpaths
+//     in `extract` and `field_extractions`, from the keys of the source they extract from
+//   - hover: over a datasource, a preview of what it projects
+//   - go to definition: on `source`, the file (or files, for globs) it projects
+//
+// The server speaks JSON-RPC over stdio, and only syncs whole documents.
+package lsp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/oliveagle/jsonpath"
+	"github.com/tumblr/k8s-config-projector/internal/pkg/version"
+	"github.com/tumblr/k8s-config-projector/pkg/interpolate"
+	"github.com/tumblr/k8s-config-projector/pkg/projector"
+	"github.com/tumblr/k8s-config-projector/pkg/report"
+	ds "github.com/tumblr/k8s-config-projector/pkg/types/v1/datasource"
+)
+
+const (
+	// diagnosticSource names the server in diagnostics
+	diagnosticSource = "k8s-config-projector"
+	// maxPreview is the most of a projected value shown when hovering
+	maxPreview = 2000
+	// maxDetail is the most of a value shown alongside a completion
+	maxDetail = 60
+)
+
+var errExit = errors.New("exit without shutdown")
+
+// Server is a language server for the manifests a projector loads. Completion and definitions
+// read the config repo directly; the source allowlist and policy only apply to diagnostics.
+type Server struct {
+	p    *projector.Projector
+	root *ds.SourceRoot
+	conn *conn
+	docs map[string]*document
+	// shutdown is set once the client has asked the server to shut down
+	shutdown bool
+}
+
+// New returns a Server loading and projecting manifests with p
+func New(p *projector.Projector) *Server {
+	return &Server{p: p, root: p.SourceRoot(), docs: map[string]*document{}}
+}
+
+// Serve handles messages read from r, writing responses to w, until the client exits or r is
+// closed. It is an error for the client to exit without shutting the server down first.
+func (s *Server) Serve(r io.Reader, w io.Writer) error {
+	s.conn = newConn(r, w)
+	for {
+		m, err := s.conn.read()
+		if err == io.EOF {
+			return nil
+		}
+		var rerr *rpcError
+		if errors.As(err, &rerr) {
+			if err := s.conn.reply(nil, nil, rerr); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if m.Method == "exit" {
+			if !s.shutdown {
+				return errExit
+			}
+			return nil
+		}
+		result, err := s.handle(m)
+		if m.ID == nil {
+			// notifications arent answered
+			continue
+		}
+		if err := s.conn.reply(m.ID, result, err); err != nil {
+			return err
+		}
+	}
+}
+
+// handle dispatches m, returning the result for requests
+func (s *Server) handle(m *message) (interface{}, error) {
+	switch m.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":   syncFull,
+				"completionProvider": map[string]interface{}{"triggerCharacters": []string{"/", ":", ".", "["}},
+				"hoverProvider":      true,
+				"definitionProvider": true,
+			},
+			"serverInfo": map[string]string{"name": diagnosticSource, "version": version.Version},
+		}, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if err := json.Unmarshal(m.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		return nil, s.change(params.TextDocument.URI, params.TextDocument.Text)
+	case "textDocument/didChange":
+		var params didChangeParams
+		if err := json.Unmarshal(m.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		if n := len(params.ContentChanges); n > 0 {
+			return nil, s.change(params.TextDocument.URI, params.ContentChanges[n-1].Text)
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		var params didCloseParams
+		if err := json.Unmarshal(m.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		delete(s.docs, params.TextDocument.URI)
+		return nil, s.conn.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{URI: params.TextDocument.URI, Diagnostics: []Diagnostic{}})
+	case "textDocument/completion", "textDocument/hover", "textDocument/definition":
+		var params textDocumentPositionParams
+		if err := json.Unmarshal(m.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		d, ok := s.docs[params.TextDocument.URI]
+		if !ok {
+			return nil, nil
+		}
+		c, ok := d.at(params.Position)
+		if !ok {
+			return nil, nil
+		}
+		switch m.Method {
+		case "textDocument/completion":
+			return s.complete(c, params.Position), nil
+		case "textDocument/hover":
+			return s.hover(d, c), nil
+		default:
+			return s.definition(c), nil
+		}
+	case "initialized", "textDocument/didSave", "$/cancelRequest", "$/setTrace":
+		return nil, nil
+	}
+	return nil, &rpcError{Code: codeMethodNotFound, Message: "method not found: " + m.Method}
+}
+
+func invalidParams(err error) error {
+	return &rpcError{Code: codeInvalidParams, Message: err.Error()}
+}
+
+// change replaces the text of the document at uri, then publishes its diagnostics
+func (s *Server) change(uri string, text string) error {
+	p, err := uriPath(uri)
+	if err != nil {
+		return invalidParams(err)
+	}
+	d := &document{uri: uri, path: p, text: text}
+	s.docs[uri] = d
+	return s.conn.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{URI: uri, Diagnostics: s.diagnose(d)})
+}
+
+// diagnose loads, validates and dry-projects the manifests in d like `validate`, keeping the
+// projections for previews, and returns every problem found. Secret scan findings are warnings.
+func (s *Server) diagnose(d *document) []Diagnostic {
+	rep := report.New()
+	manifests, err := s.p.LoadFileBytes(d.path, []byte(d.text), rep)
+	if err != nil {
+		rep.Add(d.path, "", err)
+	}
+	d.results = map[string]projection{}
+	warnings := []Diagnostic{}
+	targets := s.p.Options().Targets
+	for _, key := range manifests.Keys() {
+		m := manifests[key]
+		keep := func(k string, result *projector.Result, err error) {
+			if err != nil {
+				rep.Add(m.GetPath(), k, err)
+				return
+			}
+			d.results[k] = projection{origin: m.Origin(), result: result}
+			for _, f := range result.Findings {
+				warnings = append(warnings, d.diagnostic(d.line(m.Origin(), result, f.Key), 0, severityWarning, f.Error()))
+			}
+		}
+		if len(targets) == 0 {
+			result, err := s.p.Project(m)
+			keep(key, result, err)
+		}
+		for _, t := range targets {
+			if m.Selects(t) {
+				result, err := s.p.ProjectTarget(m, t)
+				keep(fmt.Sprintf("%s@%s", key, t.Name), result, err)
+			}
+		}
+	}
+	diagnostics := []Diagnostic{}
+	for _, p := range rep.Problems {
+		diagnostics = append(diagnostics, d.diagnostic(p.Line, p.Column, severityError, describe(p)))
+	}
+	return append(diagnostics, warnings...)
+}
+
+// line returns the 1 based line of the datasource that projected key in the manifest from origin,
+// or the manifest's first line
+func (d *document) line(origin string, result *projector.Result, key string) int {
+	for _, sec := range d.sections() {
+		if sec.origin != origin {
+			continue
+		}
+		for _, l := range result.Lineage {
+			if l.Key == key && l.Template == "" && l.DataSource < len(sec.items) {
+				return sec.items[l.DataSource].Line
+			}
+		}
+		return sec.line
+	}
+	return 0
+}
+
+// diagnostic returns a diagnostic from the 1 based line and column to the end of the line. An
+// unknown line is the first line.
+func (d *document) diagnostic(line int, column int, severity int, msg string) Diagnostic {
+	ls := lines(d.text)
+	if line < 1 || line > len(ls) {
+		line = 1
+	}
+	text := ls[line-1]
+	start := 0
+	if column > 0 {
+		start = character(text, runeColumn(text, column))
+	}
+	return Diagnostic{
+		Range: Range{
+			Start: Position{Line: line - 1, Character: start},
+			End:   Position{Line: line - 1, Character: character(text, len(text))},
+		},
+		Severity: severity,
+		Source:   diagnosticSource,
+		Message:  msg,
+	}
+}
+
+// describe returns the problem's message, after the field at fault
+func describe(p report.Problem) string {
+	field := p.Field
+	if p.DataSource != nil {
+		field = strings.TrimSuffix(fmt.Sprintf("data[%d].%s", *p.DataSource, p.Field), ".")
+	}
+	msg := p.Message
+	if field != "" {
+		msg = field + ": " + msg
+	}
+	if p.JSONPath != "" {
+		msg = fmt.Sprintf("%s (jsonpath=%s)", msg, p.JSONPath)
+	}
+	if p.Manifest != "" {
+		msg = fmt.Sprintf("%s [%s]", msg, p.Manifest)
+	}
+	return msg
+}
+
+// complete returns completions for the value under the position: paths for `source`, and
+// jsonpaths for `extract` and `field_extractions`
+func (s *Server) complete(c *cursor, pos Position) []CompletionItem {
+	items := []CompletionItem{}
+	if c.start < 0 {
+		return items
+	}
+	switch {
+	case c.field == "source":
+		items = s.completeSource(c, pos)
+	case c.field == "extract" || strings.HasPrefix(c.field, "field_extractions."):
+		items = s.completeJSONPath(c, pos)
+	}
+	return items
+}
+
+// completeSource completes the last path element of the source, or a config root name
+func (s *Server) completeSource(c *cursor, pos Position) []CompletionItem {
+	items := []CompletionItem{}
+	if interpolate.Contains(c.value) {
+		return items
+	}
+	name, p := ds.SplitSource(c.value)
+	dir, partial := ".", p
+	if i := strings.LastIndex(p, "/"); i >= 0 {
+		dir, partial = p[:i+1], p[i+1:]
+	}
+	edit := editRange(pos, partial)
+	if name == "" && !strings.Contains(p, "/") {
+		for root := range s.root.Roots {
+			if strings.HasPrefix(root, partial) {
+				items = append(items, CompletionItem{Label: root + ":", Kind: completionFolder, Detail: "config root", TextEdit: &TextEdit{Range: edit, NewText: root + ":"}})
+			}
+		}
+	}
+	entries, err := s.root.ReadDir(ds.JoinSource(name, dir))
+	if err != nil {
+		return items
+	}
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), partial) || (strings.HasPrefix(e.Name(), ".") && !strings.HasPrefix(partial, ".")) {
+			continue
+		}
+		item := CompletionItem{Label: e.Name(), Kind: completionFile}
+		if e.IsDir() {
+			item.Label, item.Kind = e.Name()+"/", completionFolder
+		}
+		item.TextEdit = &TextEdit{Range: edit, NewText: item.Label}
+		items = append(items, item)
+	}
+	return items
+}
+
+// completeJSONPath completes the last element of a jsonpath with the keys (or indexes) of what the
+// rest of it selects in the source
+func (s *Server) completeJSONPath(c *cursor, pos Position) []CompletionItem {
+	items := []CompletionItem{}
+	doc, err := s.document(c.source)
+	if err != nil {
+		return items
+	}
+	if c.value == "" {
+		return append(items, CompletionItem{Label: "$", Kind: completionField, Detail: "the whole source", TextEdit: &TextEdit{Range: editRange(pos, ""), NewText: "$"}})
+	}
+	i := strings.LastIndexAny(c.value, ".[")
+	if i < 0 {
+		return items
+	}
+	parent, partial := c.value[:i], c.value[i+1:]
+	selected := doc
+	if parent != "$" {
+		if selected, err = jsonpath.JsonPathLookup(doc, parent); err != nil {
+			return items
+		}
+	}
+	edit := editRange(pos, partial)
+	switch v := selected.(type) {
+	case map[string]interface{}:
+		if c.value[i] != '.' {
+			return items
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if strings.HasPrefix(k, partial) {
+				items = append(items, CompletionItem{Label: k, Kind: completionField, Detail: detail(v[k]), TextEdit: &TextEdit{Range: edit, NewText: k}})
+			}
+		}
+	case []interface{}:
+		if c.value[i] != '[' {
+			return items
+		}
+		for n, e := range v {
+			label := fmt.Sprintf("%d", n)
+			if strings.HasPrefix(label, partial) {
+				items = append(items, CompletionItem{Label: label, Kind: completionField, Detail: detail(e), TextEdit: &TextEdit{Range: edit, NewText: label + "]"}})
+			}
+		}
+	}
+	return items
+}
+
+// document reads the structured source d extracts from, with variables substituted
+func (s *Server) document(d ds.DataSource) (interface{}, error) {
+	source, err := interpolate.String(d.Source, s.p.Options().Vars)
+	if err != nil {
+		return nil, err
+	}
+	d.Source = source
+	if err := d.SetDefaults(); err != nil {
+		return nil, err
+	}
+	return s.root.ReadStructured(d.Source, d.SourceFormat)
+}
+
+// editRange returns the range of the partial text just before pos
+func editRange(pos Position, partial string) Range {
+	start := pos
+	start.Character -= character(partial, len(partial))
+	return Range{Start: start, End: pos}
+}
+
+// detail returns a short json rendering of v
+func detail(v interface{}) string {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	if len(raw) > maxDetail {
+		return prefix(string(raw), maxDetail) + "…"
+	}
+	return string(raw)
+}
+
+// prefix returns at most the first n bytes of s, without cutting a character in two
+func prefix(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// hover previews what the datasource under the position projects, in each valid manifest (and
+// target) from its document
+func (s *Server) hover(d *document, c *cursor) *Hover {
+	keys := []string{}
+	for k := range d.results {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		r := d.results[k].result
+		if d.results[k].origin != c.section.origin {
+			continue
+		}
+		if r.ConfigMap == nil {
+			fmt.Fprintf(&b, "**%s**: Secret projections are not previewed\n\n", k)
+			continue
+		}
+		for _, l := range r.Lineage {
+			if l.DataSource != c.dataSource || l.Template != "" {
+				continue
+			}
+			value := r.ConfigMap.Data[l.Key]
+			if len(value) > maxPreview {
+				value = prefix(value, maxPreview) + "\n…"
+			}
+			fmt.Fprintf(&b, "**%s** `%s` from `%s`\n\n```\n%s\n```\n\n", k, l.Key, l.Source, value)
+		}
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	return &Hover{Contents: MarkupContent{Kind: "markdown", Value: strings.TrimSpace(b.String())}}
+}
+
+// definition returns the files the `source` under the position projects
+func (s *Server) definition(c *cursor) []Location {
+	locations := []Location{}
+	if c.field != "source" {
+		return locations
+	}
+	source, err := interpolate.String(c.source.Source, s.p.Options().Vars)
+	if err != nil {
+		return locations
+	}
+	sources := []string{source}
+	if strings.Contains(source, "*") {
+		if sources, err = s.root.Glob(source); err != nil {
+			return locations
+		}
+	}
+	for _, source := range sources {
+		p, err := s.root.FilePath(source)
+		if err != nil {
+			continue
+		}
+		locations = append(locations, Location{URI: pathURI(p)})
+	}
+	return locations
+}
+
+// uriPath returns the file a file:// uri names
+func uriPath(uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("unsupported uri %s: only file:// uris are", uri)
+	}
+	return filepath.FromSlash(u.Path), nil
+}
+
+// pathURI returns the file:// uri of the absolute path p
+func pathURI(p string) string {
+	u := url.URL{Scheme: "file", Path: path.Clean(filepath.ToSlash(p))}
+	return u.String()
+}
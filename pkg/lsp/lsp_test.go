@@ -0,0 +1,229 @@
+package lsp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	_ "github.com/tumblr/k8s-config-projector/internal/pkg/testing"
+	"github.com/tumblr/k8s-config-projector/pkg/projector"
+)
+
+const (
+	editing = `name: app
+namespace: test
+data:
+- source: gen
+  output_file: sample
+- source: test.json
+  output_file: hostport
+  extract: $.num
+`
+	valid = `name: app
+namespace: test
+data:
+- source: test.json
+  output_file: hostport
+  extract: "$.hostport"
+`
+)
+
+// session sends requests to a server, followed by a shutdown and exit, and returns its responses
+// and notifications
+func session(t *testing.T, requests ...map[string]interface{}) []*message {
+	p, err := projector.New(projector.Options{ConfigRoot: "test/sources", Generation: "unittest123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var in, out bytes.Buffer
+	client := newConn(nil, &in)
+	requests = append(requests, map[string]interface{}{"id": 1000, "method": "shutdown"}, map[string]interface{}{"method": "exit"})
+	for _, r := range requests {
+		raw, err := json.Marshal(r["params"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := &message{Method: r["method"].(string), Params: raw}
+		if id, ok := r["id"]; ok {
+			rawID := json.RawMessage(fmt.Sprint(id))
+			m.ID = &rawID
+		}
+		if err := client.write(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := New(p).Serve(&in, &out); err != nil {
+		t.Fatal(err)
+	}
+	responses := []*message{}
+	server := newConn(&out, nil)
+	for {
+		m, err := server.read()
+		if err == io.EOF {
+			return responses
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		responses = append(responses, m)
+	}
+}
+
+func uri(t *testing.T, name string) string {
+	p, err := filepath.Abs(filepath.Join("test/manifests", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pathURI(p)
+}
+
+func open(t *testing.T, name string, text string) map[string]interface{} {
+	return map[string]interface{}{"method": "textDocument/didOpen", "params": map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri(t, name), "languageId": "yaml", "version": 1, "text": text},
+	}}
+}
+
+func at(t *testing.T, id int, method string, name string, line int, character int) map[string]interface{} {
+	return map[string]interface{}{"id": id, "method": method, "params": map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri(t, name)},
+		"position":     map[string]interface{}{"line": line, "character": character},
+	}}
+}
+
+// result returns the result of the response to the request with id, decoded into v
+func result(t *testing.T, responses []*message, id int, v interface{}) {
+	for _, m := range responses {
+		if m.ID == nil || string(*m.ID) != fmt.Sprint(id) {
+			continue
+		}
+		if m.Error != nil {
+			t.Fatalf("Expected a result for request %d, but got %s", id, m.Error.Message)
+		}
+		raw, err := json.Marshal(m.Result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(raw, v); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	t.Fatalf("Expected a response to request %d, but got %d messages", id, len(responses))
+}
+
+// diagnostics returns the last diagnostics published for the document name
+func diagnostics(t *testing.T, responses []*message, name string) []Diagnostic {
+	var params *publishDiagnosticsParams
+	for _, m := range responses {
+		if m.Method != "textDocument/publishDiagnostics" {
+			continue
+		}
+		var p publishDiagnosticsParams
+		if err := json.Unmarshal(m.Params, &p); err != nil {
+			t.Fatal(err)
+		}
+		if p.URI == uri(t, name) {
+			params = &p
+		}
+	}
+	if params == nil {
+		t.Fatalf("Expected diagnostics to be published for %s", name)
+	}
+	return params.Diagnostics
+}
+
+func TestInitialize(t *testing.T) {
+	responses := session(t, map[string]interface{}{"id": 1, "method": "initialize", "params": map[string]interface{}{}})
+	var init struct {
+		Capabilities map[string]interface{} `json:"capabilities"`
+	}
+	result(t, responses, 1, &init)
+	for _, c := range []string{"textDocumentSync", "completionProvider", "hoverProvider", "definitionProvider"} {
+		if _, ok := init.Capabilities[c]; !ok {
+			t.Fatalf("Expected the %s capability, but got %v", c, init.Capabilities)
+		}
+	}
+	responses = session(t, map[string]interface{}{"id": 2, "method": "textDocument/formatting", "params": map[string]interface{}{}})
+	if len(responses) < 1 || responses[0].Error == nil || responses[0].Error.Code != codeMethodNotFound {
+		t.Fatalf("Expected unsupported requests to fail, but got %+v", responses[0])
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	responses := session(t, open(t, "valid.yaml", valid), open(t, "editing.yaml", editing))
+	if d := diagnostics(t, responses, "valid.yaml"); len(d) != 0 {
+		t.Fatalf("Expected a valid manifest to have no diagnostics, but got %+v", d)
+	}
+	d := diagnostics(t, responses, "editing.yaml")
+	if len(d) != 1 || d[0].Range.Start.Line != 3 || d[0].Severity != severityError || !strings.Contains(d[0].Message, "data[0]") {
+		t.Fatalf("Expected the missing source to be reported on its line, but got %+v", d)
+	}
+
+	broken := "name: app\nnamespace: test\ndata:\n- source: test.json\n  extract: [\n"
+	d = diagnostics(t, session(t, open(t, "broken.yaml", broken)), "broken.yaml")
+	if len(d) != 1 {
+		t.Fatalf("Expected unparseable manifests to be reported, but got %+v", d)
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	responses := session(t,
+		open(t, "editing.yaml", editing),
+		at(t, 1, "textDocument/completion", "editing.yaml", 3, len("- source: gen")),
+		at(t, 2, "textDocument/completion", "editing.yaml", 7, len("  extract: $.num")),
+		at(t, 3, "textDocument/completion", "editing.yaml", 0, 2),
+	)
+	var items []CompletionItem
+	result(t, responses, 1, &items)
+	if len(items) != 1 || items[0].Label != "generated/" || items[0].TextEdit.Range.Start.Character != len("- source: ") {
+		t.Fatalf("Expected the generated directory to complete gen, but got %+v", items)
+	}
+	result(t, responses, 2, &items)
+	if len(items) != 1 || items[0].Label != "numbers" || items[0].TextEdit.NewText != "numbers" || items[0].Detail == "" {
+		t.Fatalf("Expected the numbers key of test.json to complete $.num, but got %+v", items)
+	}
+	result(t, responses, 3, &items)
+	if len(items) != 0 {
+		t.Fatalf("Expected nothing to complete outside of datasources, but got %+v", items)
+	}
+}
+
+func TestHoverAndDefinition(t *testing.T) {
+	responses := session(t,
+		open(t, "valid.yaml", valid),
+		at(t, 1, "textDocument/hover", "valid.yaml", 5, 12),
+		at(t, 2, "textDocument/definition", "valid.yaml", 3, 12),
+		at(t, 3, "textDocument/definition", "valid.yaml", 5, 12),
+	)
+	var hover Hover
+	result(t, responses, 1, &hover)
+	if !strings.Contains(hover.Contents.Value, "test-6f327ab0.dc2.tumblr.net:3295") {
+		t.Fatalf("Expected a preview of the extracted value, but got %+v", hover)
+	}
+	var locations []Location
+	result(t, responses, 2, &locations)
+	wd, _ := os.Getwd()
+	if len(locations) != 1 || locations[0].URI != pathURI(filepath.Join(wd, "test/sources/test.json")) {
+		t.Fatalf("Expected the source's file, but got %+v", locations)
+	}
+	result(t, responses, 3, &locations)
+	if len(locations) != 0 {
+		t.Fatalf("Expected only sources to have definitions, but got %+v", locations)
+	}
+}
+
+func TestDetailKeepsCharactersWhole(t *testing.T) {
+	d := detail(strings.Repeat("é", maxDetail))
+	if !utf8.ValidString(d) || !strings.HasSuffix(d, "é…") || len(d) > maxDetail+len("…") {
+		t.Fatalf("Expected the detail to be cut between characters, but got %q", d)
+	}
+	if p := prefix("aé", 2); p != "a" {
+		t.Fatalf("Expected the cut to back up to the start of é, but got %q", p)
+	}
+}
@@ -0,0 +1,126 @@
+// Package migrate rewrites projection manifests to the newest schema (see pkg/types/v2/manifest),
+// keeping their comments and field order. Only the layout changes; values are left as written.
+package migrate
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/tumblr/k8s-config-projector/pkg/types"
+	v1 "github.com/tumblr/k8s-config-projector/pkg/types/v1/manifest"
+	v2 "github.com/tumblr/k8s-config-projector/pkg/types/v2/manifest"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// metadataFields are the v1 fields that move under metadata in v2; the rest move under spec
+var metadataFields = map[string]bool{"name": true, "namespace": true}
+
+// Manifest returns the manifest file raw with each of its manifests rewritten to the newest schema,
+// and true, or raw and false if they all already are in the newest schema
+func Manifest(raw []byte) ([]byte, bool, error) {
+	lines := strings.SplitAfter(string(raw), "\n")
+	docs := v1.SplitDocuments(raw)
+	out := bytes.Buffer{}
+	changed := false
+	for _, d := range docs {
+		if d.Line > 1 {
+			// the `---` starting the document
+			out.WriteString(lines[d.Line-2])
+		}
+		if d.Empty() {
+			out.Write(d.Raw)
+			continue
+		}
+		migrated, c, err := document(d.Raw)
+		if err != nil && len(docs) > 1 {
+			return nil, false, fmt.Errorf("document on line %d: %w", d.Line, err)
+		} else if err != nil {
+			return nil, false, err
+		}
+		out.Write(migrated)
+		changed = changed || c
+	}
+	if !changed {
+		return raw, false, nil
+	}
+	return out.Bytes(), true, nil
+}
+
+// document returns the yaml document raw rewritten to the newest schema, and true, or raw and false
+// if it already is in the newest schema
+func document(raw []byte) ([]byte, bool, error) {
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(raw, &doc); err != nil {
+		return nil, false, err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yamlv3.MappingNode {
+		return nil, false, fmt.Errorf("manifest is not a yaml mapping")
+	}
+	root := doc.Content[0]
+	// the apiVersion and kind fields, if any, as key and value
+	var apiVersion, kind []*yamlv3.Node
+	metadata := &yamlv3.Node{Kind: yamlv3.MappingNode, Tag: "!!map"}
+	spec := &yamlv3.Node{Kind: yamlv3.MappingNode, Tag: "!!map"}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		k, v := root.Content[i], root.Content[i+1]
+		switch {
+		case k.Value == "apiVersion":
+			apiVersion = []*yamlv3.Node{k, v}
+		case k.Value == "kind":
+			kind = []*yamlv3.Node{k, v}
+			if v.Value != v1.Kind {
+				return nil, false, types.ErrUnsupportedKind
+			}
+		case metadataFields[k.Value]:
+			metadata.Content = append(metadata.Content, k, v)
+		default:
+			spec.Content = append(spec.Content, k, v)
+		}
+	}
+	if apiVersion != nil {
+		switch apiVersion[1].Value {
+		case v2.APIVersion:
+			return raw, false, nil
+		case v1.APIVersion:
+		default:
+			return nil, false, fmt.Errorf("%w: %s", types.ErrUnsupportedAPIVersion, apiVersion[1].Value)
+		}
+	}
+
+	migrated := &yamlv3.Node{Kind: yamlv3.MappingNode, Tag: "!!map"}
+	migrated.Content = append(field(apiVersion, "apiVersion", v2.APIVersion), field(kind, "kind", v2.Kind)...)
+	migrated.Content = append(migrated.Content, scalar("metadata"), metadata, scalar("spec"), spec)
+	// comments above the first field describe the manifest, so stay at the top
+	if first := root.Content[0]; first != migrated.Content[0] {
+		migrated.Content[0].HeadComment, first.HeadComment = first.HeadComment, ""
+	}
+	migrated.FootComment = root.FootComment
+	doc.Content[0] = migrated
+
+	buf := bytes.Buffer{}
+	enc := yamlv3.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, false, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, false, err
+	}
+	return buf.Bytes(), true, nil
+}
+
+// field returns the key and value of the field name set to value, reusing the nodes of existing
+// (and so their comments) if it isnt nil
+func field(existing []*yamlv3.Node, name string, value string) []*yamlv3.Node {
+	if existing == nil {
+		existing = []*yamlv3.Node{scalar(name), scalar(value)}
+	}
+	existing[1].Value, existing[1].Style = value, 0
+	return existing
+}
+
+// scalar returns a plain scalar node of s
+func scalar(s string) *yamlv3.Node {
+	return &yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str", Value: s}
+}
@@ -0,0 +1,82 @@
+package migrate
+
+import (
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	_ "github.com/tumblr/k8s-config-projector/internal/pkg/testing"
+	"github.com/tumblr/k8s-config-projector/pkg/types"
+	v1 "github.com/tumblr/k8s-config-projector/pkg/types/v1/manifest"
+	v2 "github.com/tumblr/k8s-config-projector/pkg/types/v2/manifest"
+	"gopkg.in/yaml.v2"
+)
+
+func TestManifest(t *testing.T) {
+	raw, err := ioutil.ReadFile("test/migrate/v1.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrated, changed, err := Manifest(raw)
+	if err != nil || !changed {
+		t.Fatalf("Expected the manifest to be migrated, but got %v %v", changed, err)
+	}
+	out := string(migrated)
+	if !strings.HasPrefix(out, "---\n# notifications, for every az\napiVersion: "+v2.APIVersion+"\nkind: ConfigProjection\nmetadata:\n") {
+		t.Fatalf("Expected the header, with the manifest's comment above it, but got:\n%s", out)
+	}
+	for _, comment := range []string{"# the namespace is shared", "# launch flags"} {
+		if !strings.Contains(out, comment) {
+			t.Fatalf("Expected comment %q to be kept, but got:\n%s", comment, out)
+		}
+	}
+
+	// the migrated manifest is the same manifest
+	var before v1.ConfigProjectionManifest
+	var after v2.ConfigProjection
+	if err := yaml.UnmarshalStrict(raw, &before); err != nil {
+		t.Fatal(err)
+	}
+	if err := yaml.UnmarshalStrict(migrated, &after); err != nil {
+		t.Fatal(err)
+	}
+	converted := v1.FromV2(after)
+	converted.APIVersion, converted.Kind = "", ""
+	if !reflect.DeepEqual(before, converted) {
+		t.Fatalf("Expected the migrated manifest to convert back to %+v, but got %+v", before, converted)
+	}
+
+	again, changed, err := Manifest(migrated)
+	if err != nil || changed || string(again) != out {
+		t.Fatalf("Expected a v2 manifest to be left alone, but got %v %v", changed, err)
+	}
+}
+
+func TestManifestErrors(t *testing.T) {
+	if _, _, err := Manifest([]byte("apiVersion: projector.tumblr.com/v0\nname: x\n")); !errors.Is(err, types.ErrUnsupportedAPIVersion) {
+		t.Fatalf("Expected an unknown apiVersion to fail with %s, but got %v", types.ErrUnsupportedAPIVersion, err)
+	}
+	if _, _, err := Manifest([]byte("kind: ConfigMap\nname: x\n")); !errors.Is(err, types.ErrUnsupportedKind) {
+		t.Fatalf("Expected another kind to fail with %s, but got %v", types.ErrUnsupportedKind, err)
+	}
+	if _, _, err := Manifest([]byte("- not a manifest\n")); err == nil {
+		t.Fatal("Expected a manifest that isnt a mapping to be rejected")
+	}
+}
+
+func TestManifestDocuments(t *testing.T) {
+	raw, err := ioutil.ReadFile("test/migrate/multi.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrated, changed, err := Manifest(raw)
+	if err != nil || !changed {
+		t.Fatalf("Expected the first manifest to be migrated, but got %v %v", changed, err)
+	}
+	expected := "# every notification manifest\n---\napiVersion: " + v2.APIVersion + "\nkind: ConfigProjection\nmetadata:\n  name: notification\n  namespace: notification-production\nspec:\n  data: []\n"
+	if !strings.HasPrefix(string(migrated), expected) || !strings.HasSuffix(string(migrated), string(raw[strings.Index(string(raw), "--- # already"):])) {
+		t.Fatalf("Expected only the v1 document to be migrated, but got:\n%s", migrated)
+	}
+}
@@ -0,0 +1,30 @@
+package output
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic writes data to a temp file next to fname, then renames it over fname, so
+// nothing reading the output directory sees a partially written file
+func WriteFileAtomic(fname string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(fname), "."+filepath.Base(fname))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0600); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), fname)
+}
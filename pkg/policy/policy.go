@@ -0,0 +1,182 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	// ErrPolicyViolation is wrapped by every Violation, so callers can match them with errors.Is
+	ErrPolicyViolation = errors.New("source access policy violation")
+)
+
+// Policy restricts which sources, and which output formats, manifests may project.
+// It is loaded from the file given with --policy.
+type Policy struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Rule applies to manifests in any of Namespaces, or in any of ManifestDirs. A rule with
+// neither applies to every manifest. Every rule that applies to a manifest must be satisfied.
+type Rule struct {
+	// Name describes the rule in violations
+	Name string `yaml:"name,omitempty"`
+	// Namespaces are globs matching the namespaces this rule applies to
+	Namespaces []string `yaml:"namespaces,omitempty"`
+	// ManifestDirs are globs matching the directories (relative to --manifests) this rule applies to
+	ManifestDirs []string `yaml:"manifest_dirs,omitempty"`
+	// AllowSources, if not empty, are globs matching the only sources that may be projected
+	AllowSources []string `yaml:"allow_sources,omitempty"`
+	// DenySources are globs matching sources that may not be projected. These win over AllowSources
+	DenySources []string `yaml:"deny_sources,omitempty"`
+	// OutputFormats, if not empty, are the only output formats that may be used
+	OutputFormats []string `yaml:"output_formats,omitempty"`
+}
+
+// Subject is the manifest a policy is enforced against
+type Subject struct {
+	Namespace string
+	// ManifestDir is the directory of the manifest file, relative to --manifests
+	ManifestDir string
+}
+
+// Violation is an error describing which rule was broken, and how
+type Violation struct {
+	// Rule is the index of the rule in the policy
+	Rule   int
+	Name   string
+	Reason string
+}
+
+func (v *Violation) Error() string {
+	name := fmt.Sprintf("rule %d", v.Rule)
+	if v.Name != "" {
+		name = fmt.Sprintf("%s (%s)", name, v.Name)
+	}
+	return fmt.Sprintf("%s: %s: %s", ErrPolicyViolation.Error(), name, v.Reason)
+}
+
+// Unwrap returns ErrPolicyViolation
+func (v *Violation) Unwrap() error {
+	return ErrPolicyViolation
+}
+
+// Load reads and validates a policy file
+func Load(file string) (*Policy, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var p Policy
+	if err := yaml.UnmarshalStrict(raw, &p); err != nil {
+		return nil, fmt.Errorf("unable to parse policy %s: %s", file, err.Error())
+	}
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %s", file, err.Error())
+	}
+	return &p, nil
+}
+
+// Validate makes sure every glob in the policy is well formed
+func (p *Policy) Validate() error {
+	for i, r := range p.Rules {
+		for _, globs := range [][]string{r.Namespaces, r.ManifestDirs, r.AllowSources, r.DenySources} {
+			for _, g := range globs {
+				if _, err := Match(g, ""); err != nil {
+					return fmt.Errorf("rule %d: bad glob %q: %s", i, g, err.Error())
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// applies returns true if the rule applies to the subject
+func (r *Rule) applies(s Subject) bool {
+	if len(r.Namespaces) == 0 && len(r.ManifestDirs) == 0 {
+		return true
+	}
+	return matchAny(r.Namespaces, s.Namespace) || matchAny(r.ManifestDirs, path.Clean(s.ManifestDir))
+}
+
+// CheckSource returns a Violation if the subject may not project the source path. source is relative
+// to the config repo; it may be a glob from a manifest, or a file a glob resolved to.
+func (p *Policy) CheckSource(s Subject, source string) error {
+	source = path.Clean(source)
+	for i, r := range p.Rules {
+		if !r.applies(s) {
+			continue
+		}
+		for _, g := range r.DenySources {
+			if ok, _ := Match(g, source); ok {
+				return &Violation{Rule: i, Name: r.Name, Reason: fmt.Sprintf("source %s matches deny_sources %s", source, g)}
+			}
+		}
+		if len(r.AllowSources) > 0 && !matchAny(r.AllowSources, source) {
+			return &Violation{Rule: i, Name: r.Name, Reason: fmt.Sprintf("source %s matches none of allow_sources %s", source, strings.Join(r.AllowSources, ", "))}
+		}
+	}
+	return nil
+}
+
+// CheckOutputFormat returns a Violation if the subject may not use the output format
+func (p *Policy) CheckOutputFormat(s Subject, format string) error {
+	for i, r := range p.Rules {
+		if !r.applies(s) || len(r.OutputFormats) == 0 {
+			continue
+		}
+		allowed := false
+		for _, f := range r.OutputFormats {
+			if f == format {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return &Violation{Rule: i, Name: r.Name, Reason: fmt.Sprintf("output_format %s is not one of %s", format, strings.Join(r.OutputFormats, ", "))}
+		}
+	}
+	return nil
+}
+
+func matchAny(globs []string, name string) bool {
+	for _, g := range globs {
+		if ok, _ := Match(g, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Match is path.Match, extended so a `**` path segment matches any number of segments
+// (including none). i.e. `secrets/**` matches `secrets`, `secrets/a` and `secrets/a/b.yaml`.
+func Match(pattern string, name string) (bool, error) {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern []string, name []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// try to let ** consume 0..n segments
+			for i := 0; i <= len(name); i++ {
+				if ok, err := matchSegments(pattern[1:], name[i:]); ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+		if len(name) == 0 {
+			return false, nil
+		}
+		ok, err := path.Match(pattern[0], name[0])
+		if err != nil || !ok {
+			return false, err
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0, nil
+}
@@ -0,0 +1,76 @@
+package policy
+
+import (
+	"errors"
+	"testing"
+
+	_ "github.com/tumblr/k8s-config-projector/internal/pkg/testing"
+)
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"secrets/**", "secrets", true},
+		{"secrets/**", "secrets/db.yaml", true},
+		{"secrets/**", "secrets/a/b/c.yaml", true},
+		{"secrets/**", "secretsx/db.yaml", false},
+		{"**/*.pem", "certs/a/b.pem", true},
+		{"**/*.pem", "b.pem", true},
+		{"generated/*/production/*.json", "generated/us-east-1/production/config.json", true},
+		{"generated/*/production/*.json", "generated/us-east-1/devel/config.json", false},
+		{"notification-*", "notification-production", true},
+	}
+	for _, c := range cases {
+		ok, err := Match(c.pattern, c.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != c.match {
+			t.Fatalf("Expected Match(%q, %q) to be %t, but got %t", c.pattern, c.name, c.match, ok)
+		}
+	}
+}
+
+func TestPolicyRules(t *testing.T) {
+	p, err := Load("test/policy.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	test := Subject{Namespace: "test"}
+	other := Subject{Namespace: "other", ManifestDir: "other"}
+
+	if err := p.CheckSource(test, "doods/a.php"); err != nil {
+		t.Fatalf("Expected doods/a.php to be allowed for test, but got %s", err)
+	}
+	for _, source := range []string{"doods/m.php", "a.php", "secrets/db.yaml"} {
+		if err := p.CheckSource(test, source); !errors.Is(err, ErrPolicyViolation) {
+			t.Fatalf("Expected %s to violate the policy for test, but got %v", source, err)
+		}
+	}
+	if err := p.CheckSource(other, "a.php"); err != nil {
+		t.Fatalf("Expected a.php to be allowed for other, but got %s", err)
+	}
+	var v *Violation
+	if err := p.CheckSource(other, "secrets/db.yaml"); !errors.As(err, &v) || v.Rule != 1 {
+		t.Fatalf("Expected secrets/db.yaml to violate rule 1 for other, but got %v", err)
+	}
+	if err := p.CheckOutputFormat(test, "yaml"); !errors.Is(err, ErrPolicyViolation) {
+		t.Fatalf("Expected yaml output to violate the policy for test, but got %v", err)
+	}
+	if err := p.CheckOutputFormat(other, "yaml"); err != nil {
+		t.Fatalf("Expected yaml output to be allowed for other, but got %s", err)
+	}
+}
+
+func TestRuleSelectsManifestDirs(t *testing.T) {
+	p := &Policy{Rules: []Rule{{ManifestDirs: []string{"production/**"}, DenySources: []string{"devel/**"}}}}
+	if err := p.CheckSource(Subject{Namespace: "a", ManifestDir: "production/a"}, "devel/x.json"); !errors.Is(err, ErrPolicyViolation) {
+		t.Fatalf("Expected rule for production/** to apply to production/a, but got %v", err)
+	}
+	if err := p.CheckSource(Subject{Namespace: "a", ManifestDir: "devel/a"}, "devel/x.json"); err != nil {
+		t.Fatalf("Expected rule for production/** to not apply to devel/a, but got %s", err)
+	}
+}
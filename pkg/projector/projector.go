@@ -0,0 +1,446 @@
+// Package projector loads projection manifests and projects them into ConfigMaps (or Secrets),
+// for Go programs embedding the projector instead of running the CLI.
+//
+//	p, err := projector.New(projector.Options{ConfigRoot: "/srv/config", Generation: "1234"})
+//	...
+//	manifests, err := p.LoadDir("/srv/manifests", nil)
+//	...
+//	for _, key := range manifests.Keys() {
+//		result, err := p.Project(manifests[key])
+//		...
+//	}
+package projector
+
+import (
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/tumblr/k8s-config-projector/pkg/discover"
+	"github.com/tumblr/k8s-config-projector/pkg/interpolate"
+	"github.com/tumblr/k8s-config-projector/pkg/library"
+	"github.com/tumblr/k8s-config-projector/pkg/policy"
+	"github.com/tumblr/k8s-config-projector/pkg/report"
+	"github.com/tumblr/k8s-config-projector/pkg/scan"
+	"github.com/tumblr/k8s-config-projector/pkg/sops"
+	"github.com/tumblr/k8s-config-projector/pkg/targets"
+	"github.com/tumblr/k8s-config-projector/pkg/types/v1/datasource"
+	"github.com/tumblr/k8s-config-projector/pkg/types/v1/manifest"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// DefaultSizeLimit is the max size of a projected ConfigMap we support (in yaml format).
+	// This is pretty rough, but it is intended to avoid the 1M etcd max
+	// There are a few limits:
+	// * ConfigMaps cannot be over 1M.  This is etcd's limitation.
+	// * Internally, `kubectl apply` creates annotations, which has a size limit of 256K. This translates to a ConfigMap that can't be over ~512K.
+	// For reference, these are size limits discussions:
+	// * https://github.com/coreos/prometheus-operator/issues/535#issuecomment-319659063
+	// * https://github.com/kubernetes/kubernetes/issues/15878#issuecomment-149728026
+	DefaultSizeLimit = 500000 // 500k max!
+	// NoSizeLimit disables the size limit
+	NoSizeLimit = -1
+
+	// DefaultLabelVersionKey labels projected resources with the generation
+	DefaultLabelVersionKey = "tumblr.com/config-version"
+	// DefaultLabelManagedKey labels projected resources with `true`
+	DefaultLabelManagedKey = "tumblr.com/managed-configmap"
+)
+
+// Options configure where manifests project their sources from, and how
+type Options struct {
+	// ConfigRoot is the root of the config repo checkout sources are projected from (required,
+	// unless ConfigFS is set)
+	ConfigRoot string
+	// ConfigFS, if set, is the config repo sources are projected from instead of ConfigRoot. It
+	// may be an in-memory tree (like fstest.MapFS), an archive, or a git tree.
+	ConfigFS fs.FS
+	// ConfigCommit, if set, is the config repo commit ConfigFS is, which projected resources are
+	// annotated with (see manifest.AnnotationConfigCommit)
+	ConfigCommit string
+	// ConfigRoots are named config roots, mapping names to the checkouts that sources like
+	// `name:path` project from. Each is confined on its own.
+	ConfigRoots map[string]string
+	// ManifestDir is the directory manifests are loaded from. Policy rules matching manifest
+	// directories are relative to it; LoadDir and LoadFile paths should be under it.
+	ManifestDir string
+	// Generation labels projected resources, with LabelVersionKey (required)
+	Generation string
+	// LabelVersionKey defaults to DefaultLabelVersionKey
+	LabelVersionKey string
+	// LabelManagedKey defaults to DefaultLabelManagedKey
+	LabelManagedKey string
+	// SizeLimit is the max size in bytes of a projected resource as yaml. 0 uses DefaultSizeLimit,
+	// and NoSizeLimit disables it.
+	SizeLimit int
+	// SourceAllowlist maps namespaces to the source path prefixes their manifests may project
+	// from; `*` applies to unlisted namespaces. nil means no restriction.
+	SourceAllowlist map[string][]string
+	// Policy is the source access policy manifests are subject to, if any. When SourceAllowlist
+	// is set too, sources must be allowed by both.
+	Policy *policy.Policy
+	// SecretScanner scans projected ConfigMap data for credentials. nil disables scanning.
+	SecretScanner *scan.Scanner
+	// SopsKeys decrypt SOPS encrypted sources for Secret projections, if any
+	SopsKeys *sops.Keys
+	// Vars are substituted for `${var}` in manifests as they are loaded
+	Vars interpolate.Vars
+	// Library is the datasource templates manifests may include, if any
+	Library *library.Library
+	// Targets, if any, are what manifests are projected for with ProjectTarget. References to the
+	// variables they define are left in manifests as they are loaded, to be substituted per target.
+	Targets []targets.Target
+	// Skipped, if set, is called with each file and directory LoadDir and LoadFS skip (see package
+	// discover), and why, when they arent given a report to record them in
+	Skipped func(path string, reason string)
+}
+
+// Manifests are loaded manifests, keyed by "namespace/name"
+type Manifests map[string]manifest.ConfigProjectionManifest
+
+// Keys returns the keys of ms in a stable order, so runs (and their reports) are reproducible
+func (ms Manifests) Keys() []string {
+	keys := make([]string, 0, len(ms))
+	for k := range ms {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Result is a projected manifest
+type Result struct {
+	Namespace string
+	Name      string
+	// Resource is manifest.ResourceConfigMap or manifest.ResourceSecret; only the matching one of
+	// ConfigMap and Secret is set
+	Resource  string
+	ConfigMap *v1.ConfigMap
+	Secret    *v1.Secret
+	// Lineage is where each ConfigMap key was projected from. It is not recorded for Secrets.
+	Lineage []manifest.Lineage
+	// Findings are credentials the SecretScanner found in the ConfigMap data. They do not fail
+	// the projection; it is up to the caller to warn or fail on them.
+	Findings []*scan.Finding
+	// YAML is the projected resource, as written by the CLI
+	YAML string
+	// Target is the name of the target this was projected for by ProjectTarget, if any
+	Target string
+}
+
+// SizeLimitError is returned by Project when the projected resource exceeds the size limit
+type SizeLimitError struct {
+	Resource  string
+	Namespace string
+	Name      string
+	// Size is the size of the projected resource as yaml, and Limit the size limit, in bytes
+	Size  int
+	Limit int
+}
+
+func (e *SizeLimitError) Error() string {
+	return fmt.Sprintf("generated %s for %s/%s that was %d bytes, exceeding size limit of %d bytes\nYou may want to split this projection into multiple %ss to reduce size", e.Resource, e.Namespace, e.Name, e.Size, e.Limit, e.Resource)
+}
+
+// Projector loads and projects manifests with a set of Options
+type Projector struct {
+	opts Options
+}
+
+// New returns a Projector, after validating opts and filling in their defaults
+func New(opts Options) (*Projector, error) {
+	if opts.ConfigFS == nil {
+		if opts.ConfigRoot == "" {
+			return nil, fmt.Errorf("config root must be specified")
+		}
+		if s, err := os.Stat(opts.ConfigRoot); err != nil {
+			return nil, err
+		} else if !s.IsDir() {
+			return nil, fmt.Errorf("config root %s is not a directory", opts.ConfigRoot)
+		}
+	}
+	for name, root := range opts.ConfigRoots {
+		if !datasource.ValidRootName(name) {
+			return nil, fmt.Errorf("config root name %q must only consist of lower case alphanumeric characters, - and _", name)
+		}
+		if s, err := os.Stat(root); err != nil {
+			return nil, err
+		} else if !s.IsDir() {
+			return nil, fmt.Errorf("config root %s=%s is not a directory", name, root)
+		}
+	}
+	if opts.Generation == "" {
+		return nil, fmt.Errorf("generation must be specified")
+	}
+	if opts.LabelVersionKey == "" {
+		opts.LabelVersionKey = DefaultLabelVersionKey
+	}
+	if opts.LabelManagedKey == "" {
+		opts.LabelManagedKey = DefaultLabelManagedKey
+	}
+	if opts.SizeLimit == 0 {
+		opts.SizeLimit = DefaultSizeLimit
+	}
+	return &Projector{opts: opts}, nil
+}
+
+// Options returns the Options p was created with, with defaults filled in
+func (p *Projector) Options() Options {
+	return p.opts
+}
+
+// SourceRoot returns the config repo, and named config roots, that sources are read from. Unlike the
+// roots manifests project from, it isnt confined by the source allowlist or policy; tools browsing
+// the config repo use it.
+func (p *Projector) SourceRoot() *datasource.SourceRoot {
+	root := &datasource.SourceRoot{Path: p.opts.ConfigRoot, FS: p.opts.ConfigFS}
+	if len(p.opts.ConfigRoots) > 0 {
+		root.Roots = map[string]*datasource.SourceRoot{}
+		for name, path := range p.opts.ConfigRoots {
+			root.Roots[name] = &datasource.SourceRoot{Path: path}
+		}
+	}
+	return root
+}
+
+// LoadBytes parses and validates a manifest. path is where it was read from, for locating
+// problems in it, and may be empty. A manifest with a matrix expanding into more than one
+// manifest is an error; use ExpandBytes.
+func (p *Projector) LoadBytes(path string, raw []byte) (manifest.ConfigProjectionManifest, error) {
+	return p.loadOne(p.ExpandBytes(path, raw))
+}
+
+// LoadFile parses and validates the manifest in the file at path, like LoadBytes
+func (p *Projector) LoadFile(path string) (manifest.ConfigProjectionManifest, error) {
+	return p.loadOne(p.ExpandFile(path))
+}
+
+// ExpandBytes parses and validates a manifest, returning the manifests its matrix expands into (or
+// just the manifest, if it has none)
+func (p *Projector) ExpandBytes(path string, raw []byte) ([]manifest.ConfigProjectionManifest, error) {
+	return p.expand(path, raw, config{p.opts, p.opts.ManifestDir})
+}
+
+// ExpandFile is ExpandBytes, reading the manifest from the file at path
+func (p *Projector) ExpandFile(path string) ([]manifest.ConfigProjectionManifest, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return p.ExpandBytes(path, raw)
+}
+
+// loadOne returns the only manifest in expanded
+func (p *Projector) loadOne(expanded []manifest.ConfigProjectionManifest, err error) (manifest.ConfigProjectionManifest, error) {
+	if err != nil {
+		return manifest.ConfigProjectionManifest{}, err
+	}
+	if len(expanded) != 1 {
+		return manifest.ConfigProjectionManifest{}, fmt.Errorf("manifest matrix expands into %d manifests; load it with ExpandBytes or ExpandFile", len(expanded))
+	}
+	return expanded[0], nil
+}
+
+// expand parses, validates and expands every manifest in a (possibly multi-document) file,
+// returning the first problem found
+func (p *Projector) expand(path string, raw []byte, cfg config) ([]manifest.ConfigProjectionManifest, error) {
+	parsed, errs := manifest.ParseFileDocuments(path, raw, cfg)
+	expanded := []manifest.ConfigProjectionManifest{}
+	for i, m := range parsed {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if err := m.Validate(); err != nil {
+			return nil, err
+		}
+		e, expandErrs := m.Expand()
+		if len(expandErrs) > 0 {
+			return nil, expandErrs[0]
+		}
+		expanded = append(expanded, e...)
+	}
+	return expanded, nil
+}
+
+// LoadDir recursively loads every manifest under dir: each document of every .yaml, .yml and
+// .json file, other than those ignored by dir's .projectorignore (see package discover).
+// When rep is nil, it stops at the first problem and returns it. Otherwise every problem is
+// recorded in rep and the offending manifest is skipped, and only errors walking dir are returned.
+func (p *Projector) LoadDir(dir string, rep *report.Report) (Manifests, error) {
+	return p.loadFS(os.DirFS(dir), dir, config{p.opts, p.opts.ManifestDir}, rep)
+}
+
+// LoadFS recursively loads every manifest in fsys, like LoadDir. Manifest paths, and the
+// manifest directories policy rules match, are relative to the root of fsys.
+func (p *Projector) LoadFS(fsys fs.FS, rep *report.Report) (Manifests, error) {
+	return p.loadFS(fsys, "", config{p.opts, "."}, rep)
+}
+
+// LoadFileBytes loads every manifest in the file read from path, like LoadDir: each of its documents,
+// and every manifest their matrix expands into. Editors use it for files that arent saved yet.
+func (p *Projector) LoadFileBytes(path string, raw []byte, rep *report.Report) (Manifests, error) {
+	manifests := Manifests{}
+	err := p.add(manifests, path, raw, config{p.opts, p.opts.ManifestDir}, rep)
+	return manifests, err
+}
+
+// loadFS loads every manifest in fsys, naming them by their path in fsys joined to dir
+func (p *Projector) loadFS(fsys fs.FS, dir string, cfg config, rep *report.Report) (Manifests, error) {
+	manifests := Manifests{}
+	files, skipped, err := discover.FS(fsys)
+	if err != nil {
+		return manifests, err
+	}
+	for _, s := range skipped {
+		name := s.Path
+		if dir != "" {
+			name = filepath.Join(dir, filepath.FromSlash(name))
+		}
+		if rep != nil {
+			rep.Skip(name, s.Reason)
+		} else if p.opts.Skipped != nil {
+			p.opts.Skipped(name, s.Reason)
+		}
+	}
+	for _, name := range files {
+		raw, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return manifests, err
+		}
+		if dir != "" {
+			name = filepath.Join(dir, filepath.FromSlash(name))
+		}
+		if err := p.add(manifests, name, raw, cfg, rep); err != nil {
+			return manifests, err
+		}
+	}
+	return manifests, nil
+}
+
+// add loads the manifests read from path into manifests, along with every manifest their matrix
+// expands into, unless they have problems, or are duplicates
+func (p *Projector) add(manifests Manifests, path string, raw []byte, cfg config, rep *report.Report) error {
+	expanded := []manifest.ConfigProjectionManifest{}
+	if rep != nil {
+		parsed, parseErrs := manifest.ParseFileDocuments(path, raw, cfg)
+		for i, m := range parsed {
+			rep.Manifests++
+			if parseErrs[i] != nil {
+				rep.Add(path, "", parseErrs[i])
+				continue
+			}
+			key := fmt.Sprintf("%s/%s", m.Namespace, m.Name)
+			if errs := m.ValidateAll(); len(errs) > 0 {
+				for _, e := range errs {
+					rep.Add(path, key, e)
+				}
+				continue
+			}
+			e, errs := m.Expand()
+			for _, err := range errs {
+				rep.Add(path, key, err)
+			}
+			expanded = append(expanded, e...)
+		}
+	} else {
+		var err error
+		if expanded, err = p.expand(path, raw, cfg); err != nil {
+			return err
+		}
+	}
+	for _, m := range expanded {
+		key := fmt.Sprintf("%s/%s", m.Namespace, m.Name)
+		if existing, ok := manifests[key]; ok {
+			err := fmt.Errorf("duplicate projection mapping found at namespace=%s name=%s file=%s (already loaded from %s)", m.Namespace, m.Name, m.Origin(), existing.Origin())
+			if rep != nil {
+				rep.Add(m.GetPath(), key, err)
+				continue
+			}
+			return err
+		}
+		manifests[key] = m
+	}
+	return nil
+}
+
+// Project projects m into a ConfigMap (or Secret), making sure it doesnt exceed the size limit.
+// Unless scanning is off, projected ConfigMap data is scanned for secrets.
+// m must have been loaded by p, or with a manifest.Config describing the same config repo.
+func (p *Projector) Project(m manifest.ConfigProjectionManifest) (*Result, error) {
+	r := &Result{Namespace: m.GetNamespace(), Name: m.GetName(), Resource: m.Resource}
+	if m.IsSecret() {
+		secret, err := m.ProjectSecret()
+		if err != nil {
+			return nil, err
+		}
+		r.Secret = &secret
+		if r.YAML, err = manifest.ObjectAsYAML(&secret); err != nil {
+			return nil, err
+		}
+	} else {
+		cm, lineage, err := m.ProjectWithLineage()
+		if err != nil {
+			return nil, err
+		}
+		r.ConfigMap, r.Lineage = &cm, lineage
+		if s := p.opts.SecretScanner; s != nil {
+			r.Findings = s.Scan(fmt.Sprintf("%s/%s", r.Namespace, r.Name), cm.Data)
+		}
+		if r.YAML, err = manifest.ObjectAsYAML(&cm); err != nil {
+			return nil, err
+		}
+	}
+
+	// before this is written out, lets make sure the byte size isnt exceeding our limit
+	if p.opts.SizeLimit != NoSizeLimit && len(r.YAML) > p.opts.SizeLimit {
+		return nil, &SizeLimitError{Resource: r.Resource, Namespace: r.Namespace, Name: r.Name, Size: len(r.YAML), Limit: p.opts.SizeLimit}
+	}
+	return r, nil
+}
+
+// ProjectTarget projects m as it is for target t: with the target's vars substituted into its
+// sources. Callers should only project the targets m.Selects.
+func (p *Projector) ProjectTarget(m manifest.ConfigProjectionManifest, t targets.Target) (*Result, error) {
+	tm, err := m.ForTarget(t)
+	if err != nil {
+		return nil, err
+	}
+	r, err := p.Project(tm)
+	if err != nil {
+		return nil, err
+	}
+	r.Target = t.Name
+	return r, nil
+}
+
+// config adapts Options into the manifest.Config manifests are projected with
+type config struct {
+	opts        Options
+	manifestDir string
+}
+
+func (c config) ConfigDir() string              { return c.opts.ConfigRoot }
+func (c config) ConfigFS() fs.FS                { return c.opts.ConfigFS }
+func (c config) ConfigCommit() string           { return c.opts.ConfigCommit }
+func (c config) ConfigRoots() map[string]string { return c.opts.ConfigRoots }
+func (c config) ManifestDir() string            { return c.manifestDir }
+func (c config) Generation() string             { return c.opts.Generation }
+func (c config) LabelVersionKey() string        { return c.opts.LabelVersionKey }
+func (c config) LabelManagedKey() string        { return c.opts.LabelManagedKey }
+func (c config) Policy() *policy.Policy         { return c.opts.Policy }
+func (c config) SopsKeys() *sops.Keys           { return c.opts.SopsKeys }
+func (c config) Vars() interpolate.Vars         { return c.opts.Vars }
+func (c config) Targets() []targets.Target      { return c.opts.Targets }
+func (c config) Library() *library.Library      { return c.opts.Library }
+
+// AllowedSourcePrefixes falls back to the `*` entry for unlisted namespaces
+func (c config) AllowedSourcePrefixes(namespace string) []string {
+	if prefixes, ok := c.opts.SourceAllowlist[namespace]; ok {
+		return prefixes
+	}
+	return c.opts.SourceAllowlist["*"]
+}
@@ -0,0 +1,609 @@
+package projector
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	_ "github.com/tumblr/k8s-config-projector/internal/pkg/testing"
+	"github.com/tumblr/k8s-config-projector/pkg/interpolate"
+	"github.com/tumblr/k8s-config-projector/pkg/library"
+	"github.com/tumblr/k8s-config-projector/pkg/policy"
+	"github.com/tumblr/k8s-config-projector/pkg/report"
+	"github.com/tumblr/k8s-config-projector/pkg/scan"
+	"github.com/tumblr/k8s-config-projector/pkg/targets"
+	"github.com/tumblr/k8s-config-projector/pkg/types"
+	ds "github.com/tumblr/k8s-config-projector/pkg/types/v1/datasource"
+	"github.com/tumblr/k8s-config-projector/pkg/types/v1/manifest"
+)
+
+const hostportManifest = `
+name: hostport
+namespace: test
+data:
+- source: test.json
+  output_file: hostport
+  extract: $.hostport
+`
+
+func newTestProjector(t *testing.T, opts Options) *Projector {
+	opts.ConfigRoot = "test/sources"
+	opts.Generation = "unittest123"
+	p, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestNewRequiresConfigRootAndGeneration(t *testing.T) {
+	if _, err := New(Options{Generation: "1"}); err == nil {
+		t.Fatal("Expected a missing config root to be rejected")
+	}
+	if _, err := New(Options{ConfigRoot: "test/sources/test.json", Generation: "1"}); err == nil {
+		t.Fatal("Expected a config root that isnt a directory to be rejected")
+	}
+	if _, err := New(Options{ConfigRoot: "test/sources"}); err == nil {
+		t.Fatal("Expected a missing generation to be rejected")
+	}
+	p, err := New(Options{ConfigRoot: "test/sources", Generation: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o := p.Options(); o.LabelVersionKey != DefaultLabelVersionKey || o.LabelManagedKey != DefaultLabelManagedKey || o.SizeLimit != DefaultSizeLimit {
+		t.Fatalf("Expected defaults to be filled in, but got %+v", o)
+	}
+}
+
+func TestLoadBytesAndProject(t *testing.T) {
+	p := newTestProjector(t, Options{LabelVersionKey: "example.com/generation"})
+	m, err := p.LoadBytes("", []byte(hostportManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := p.Project(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ConfigMap == nil || r.Secret != nil || r.ConfigMap.Data["hostport"] != "test-6f327ab0.dc2.tumblr.net:3295" {
+		t.Fatalf("Expected a ConfigMap with hostport, but got %+v", r)
+	}
+	if r.ConfigMap.Labels["example.com/generation"] != "unittest123" {
+		t.Fatalf("Expected the configured version label, but got %v", r.ConfigMap.Labels)
+	}
+	if len(r.Lineage) != 1 || r.Lineage[0].Source != "test.json" || r.Lineage[0].Extract != "$.hostport" {
+		t.Fatalf("Expected lineage of hostport, but got %+v", r.Lineage)
+	}
+	if !strings.Contains(r.YAML, "kind: ConfigMap") {
+		t.Fatalf("Expected yaml for the ConfigMap, but got %s", r.YAML)
+	}
+}
+
+func TestLoadDir(t *testing.T) {
+	p := newTestProjector(t, Options{ManifestDir: "test/manifests"})
+	if _, err := p.LoadDir("test/manifests", nil); err == nil {
+		t.Fatal("Expected the first problem to be returned without a report")
+	}
+	rep := report.New()
+	manifests, err := p.LoadDir("test/manifests", rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.OK() {
+		t.Fatal("Expected the problems in test/manifests/parseerrors to be reported")
+	}
+	if m, ok := manifests["test/raw1"]; !ok || m.GetPath() != "test/manifests/raw1.yaml" {
+		t.Fatalf("Expected raw1 to be loaded from test/manifests/raw1.yaml, but got %v", manifests.Keys())
+	}
+	keys := manifests.Keys()
+	for i := 1; i < len(keys); i++ {
+		if keys[i-1] >= keys[i] {
+			t.Fatalf("Expected sorted keys, but got %v", keys)
+		}
+	}
+}
+
+func TestSourceAllowlistAndPolicyBothApply(t *testing.T) {
+	pol, err := policy.Load("test/policy.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// test/policy.yaml allows namespace test doods/** and *.json, but denies doods/m.php
+	p := newTestProjector(t, Options{
+		SourceAllowlist: map[string][]string{"test": {"doods/"}},
+		Policy:          pol,
+	})
+	raw := []byte(`
+name: both
+namespace: test
+data:
+- source: doods/a.php
+- source: test.json
+- source: doods/m.php
+- source: a.php
+`)
+	rep := report.New()
+	if _, err := p.LoadFileBytes("both.yaml", raw, rep); err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		dataSource int
+		err        error
+	}{
+		// allowed by the policy, but not the allowlist
+		{1, types.ErrSourceNotAllowed},
+		// allowed by the allowlist, but not the policy
+		{2, policy.ErrPolicyViolation},
+		// allowed by neither, so both are reported
+		{3, types.ErrSourceNotAllowed},
+		{3, policy.ErrPolicyViolation},
+	}
+	if len(rep.Problems) != len(expected) {
+		t.Fatalf("Expected %d problems, but got %v", len(expected), rep.Problems)
+	}
+	for i, e := range expected {
+		problem := rep.Problems[i]
+		if problem.DataSource == nil || *problem.DataSource != e.dataSource || !strings.HasPrefix(problem.Message, e.err.Error()) {
+			t.Fatalf("Expected problem %d to be %q for data[%d], but got %s", i, e.err, e.dataSource, problem)
+		}
+	}
+
+	// a source allowed by both projects
+	m, err := p.LoadBytes("", []byte("name: both\nnamespace: test\ndata:\n- source: doods/a.php\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Project(m); err != nil {
+		t.Fatalf("Expected doods/a.php to be allowed by the allowlist and policy, but got %v", err)
+	}
+}
+
+func TestLoadFS(t *testing.T) {
+	p := newTestProjector(t, Options{})
+	fsys := fstest.MapFS{
+		"apps/hostport.yaml": {Data: []byte(hostportManifest)},
+		"apps/dupe.yaml":     {Data: []byte(hostportManifest)},
+		"README.md":          {Data: []byte("not a manifest")},
+	}
+	if _, err := p.LoadFS(fsys, nil); err == nil || !strings.Contains(err.Error(), "duplicate projection mapping") {
+		t.Fatalf("Expected a duplicate manifest to be an error, but got %v", err)
+	}
+	delete(fsys, "apps/dupe.yaml")
+	manifests, err := p.LoadFS(fsys, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := manifests["test/hostport"]
+	if len(manifests) != 1 || !ok || m.GetPath() != "apps/hostport.yaml" {
+		t.Fatalf("Expected only test/hostport from apps/hostport.yaml, but got %v", manifests)
+	}
+}
+
+func TestProjectFromConfigFS(t *testing.T) {
+	p, err := New(Options{
+		ConfigFS: fstest.MapFS{
+			"test.json": {Data: []byte(`{"hostport": "in-memory:1234"}`)},
+		},
+		ConfigCommit: "0123456789abcdef0123456789abcdef01234567",
+		Generation:   "unittest123",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := p.LoadBytes("", []byte(hostportManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := p.Project(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ConfigMap.Data["hostport"] != "in-memory:1234" {
+		t.Fatalf("Expected hostport to be projected from the ConfigFS, but got %v", r.ConfigMap.Data)
+	}
+	if r.ConfigMap.Annotations[manifest.AnnotationConfigCommit] != "0123456789abcdef0123456789abcdef01234567" {
+		t.Fatalf("Expected the ConfigMap to be annotated with the config commit, but got %v", r.ConfigMap.Annotations)
+	}
+}
+
+func TestProjectFromNamedConfigRoots(t *testing.T) {
+	if _, err := New(Options{ConfigRoot: "test/sources", ConfigRoots: map[string]string{"Infra": "test/roots/infra"}, Generation: "1"}); err == nil {
+		t.Fatal("Expected an invalid config root name to be rejected")
+	}
+	p := newTestProjector(t, Options{ConfigRoots: map[string]string{"infra": "test/roots/infra"}})
+	m, err := p.LoadBytes("", []byte(`
+name: hosts
+namespace: test
+data:
+- source: infra:generated/hosts.json
+  output_file: port
+  extract: $.port
+- source: test.json
+  output_file: hostport
+  extract: $.hostport
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := p.Project(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ConfigMap.Data["port"] != "3306" || r.ConfigMap.Data["hostport"] != "test-6f327ab0.dc2.tumblr.net:3295" {
+		t.Fatalf("Expected keys from both roots, but got %v", r.ConfigMap.Data)
+	}
+	if len(r.Lineage) != 2 || r.Lineage[1].Root != "infra" || r.Lineage[1].Source != "infra:generated/hosts.json" || r.Lineage[0].Root != "" {
+		t.Fatalf("Expected lineage to record the config root of each key, but got %+v", r.Lineage)
+	}
+}
+
+func TestProjectSizeLimit(t *testing.T) {
+	p := newTestProjector(t, Options{SizeLimit: 100})
+	m, err := p.LoadBytes("", []byte(hostportManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.Project(m)
+	var sizeErr *SizeLimitError
+	if err == nil || !strings.Contains(err.Error(), "exceeding size limit of 100 bytes") || !errors.As(err, &sizeErr) || sizeErr.Limit != 100 {
+		t.Fatalf("Expected the size limit to be exceeded, but got %v", err)
+	}
+	p = newTestProjector(t, Options{SizeLimit: NoSizeLimit})
+	if _, err := p.Project(m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProjectScansForSecrets(t *testing.T) {
+	p := newTestProjector(t, Options{SecretScanner: scan.New()})
+	m, err := p.LoadBytes("", []byte(`
+name: creds
+namespace: test
+data:
+- source: test.json
+  output_file: password
+  extract: $.astring
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := p.Project(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Findings) == 0 {
+		t.Fatalf("Expected the password key to be found by the scanner, but got %+v", r)
+	}
+}
+
+func TestProjectTarget(t *testing.T) {
+	all, err := targets.Load("test/targets.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProjector(t, Options{Targets: all})
+	m, err := p.LoadBytes("", []byte(`
+name: app
+namespace: test
+targets:
+  cluster: PRODUCTION
+data:
+- source: clusters/${az}-${cluster}/app.json
+  output_file: replicas
+  extract: $.replicas
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replicas := map[string]string{}
+	for _, target := range all {
+		if !m.Selects(target) {
+			continue
+		}
+		r, err := p.ProjectTarget(m, target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Target != target.Name || r.Lineage[0].Source != "clusters/"+target.Name+"/app.json" {
+			t.Fatalf("Expected %s to be projected from its own source, but got %+v", target.Name, r)
+		}
+		replicas[target.Name] = r.ConfigMap.Data["replicas"]
+	}
+	if len(replicas) != 2 || replicas["bf2-PRODUCTION"] != "12" || replicas["dc2-PRODUCTION"] != "8" {
+		t.Fatalf("Expected the PRODUCTION targets to be projected, but got %v", replicas)
+	}
+
+	if _, err := p.Project(m); !errors.Is(err, types.ErrUndefinedVariable) {
+		t.Fatalf("Expected projecting a manifest using target variables without a target to fail, but got %v", err)
+	}
+
+	// variables no target defines are undefined as soon as the manifest is loaded
+	_, err = p.LoadBytes("", []byte(`
+name: app
+namespace: test
+data:
+- source: clusters/${region}/app.json
+  output_file: replicas
+  extract: $.replicas
+`))
+	if !errors.Is(err, types.ErrUndefinedVariable) {
+		t.Fatalf("Expected an undefined variable to be an error, but got %v", err)
+	}
+}
+
+func TestLoadInterpolatesVars(t *testing.T) {
+	p := newTestProjector(t, Options{Vars: interpolate.Vars{"env": "production", "az": "bf2", "field": "replicas"}})
+	m, err := p.LoadBytes("", []byte(`
+name: app-${env}
+namespace: ${env}
+data:
+- source: clusters/${az}-PRODUCTION/app.json
+  output_file: ${field}
+  extract: $.${field}
+- source: clusters/${az}-DEVEL/app.json
+  output_file: devel-${field}.json
+  field_extractions:
+    devel: $.${field}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := p.Project(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Name != "app-production" || r.Namespace != "production" || r.ConfigMap.Data["replicas"] != "12" || r.ConfigMap.Data["devel-replicas.json"] != `{"devel":1}` {
+		t.Fatalf("Expected every field to be interpolated, but got %s/%s %v", r.Namespace, r.Name, r.ConfigMap.Data)
+	}
+
+	// validation sees the interpolated values
+	p = newTestProjector(t, Options{Vars: interpolate.Vars{"env": "Not_Valid"}})
+	if _, err := p.LoadBytes("", []byte("name: app\nnamespace: ${env}\ndata: []\n")); !errors.Is(err, types.ErrInvalidNamespace) {
+		t.Fatalf("Expected the interpolated namespace to be validated, but got %v", err)
+	}
+	if _, err := p.LoadBytes("", []byte("name: app-${nope}\nnamespace: test\ndata: []\n")); !errors.Is(err, types.ErrUndefinedVariable) || !strings.Contains(err.Error(), "name: undefined variable: nope") {
+		t.Fatalf("Expected an undefined variable to be located at its field, but got %v", err)
+	}
+}
+
+const matrixManifest = `
+name: app-${az}
+namespace: test
+matrix:
+  az: [bf2, dc2]
+  cluster: [PRODUCTION]
+data:
+- source: clusters/${az}-${cluster}/app.json
+  output_file: replicas
+  extract: $.replicas
+`
+
+func TestLoadExpandsMatrix(t *testing.T) {
+	p := newTestProjector(t, Options{})
+	manifests, err := p.LoadFS(fstest.MapFS{"app.yaml": {Data: []byte(matrixManifest)}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := manifests.Keys(); strings.Join(keys, ",") != "test/app-bf2,test/app-dc2" {
+		t.Fatalf("Expected a manifest per combination, but got %v", keys)
+	}
+	m := manifests["test/app-dc2"]
+	if m.Combination()["az"] != "dc2" || m.GetPath() != "app.yaml" {
+		t.Fatalf("Expected the combination dc2 PRODUCTION from app.yaml, but got %v %s", m.Combination(), m.GetPath())
+	}
+	r, err := p.Project(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ConfigMap.Data["replicas"] != "8" {
+		t.Fatalf("Expected dc2-PRODUCTION to be projected, but got %v", r.ConfigMap.Data)
+	}
+	if _, err := p.LoadBytes("", []byte(matrixManifest)); err == nil || !strings.Contains(err.Error(), "expands into 2 manifests") {
+		t.Fatalf("Expected LoadBytes to refuse a matrix expanding into many manifests, but got %v", err)
+	}
+	expanded, err := p.ExpandBytes("", []byte(matrixManifest))
+	if err != nil || len(expanded) != 2 {
+		t.Fatalf("Expected 2 manifests, but got %d %v", len(expanded), err)
+	}
+}
+
+func TestLoadMatrixDuplicates(t *testing.T) {
+	p := newTestProjector(t, Options{})
+	fsys := fstest.MapFS{"app.yaml": {Data: []byte(strings.Replace(matrixManifest, "name: app-${az}", "name: app", 1))}}
+	_, err := p.LoadFS(fsys, nil)
+	if err == nil || !strings.Contains(err.Error(), "file=app.yaml (matrix az=dc2 cluster=PRODUCTION) (already loaded from app.yaml (matrix az=bf2 cluster=PRODUCTION))") {
+		t.Fatalf("Expected the colliding combinations to be reported, but got %v", err)
+	}
+	rep := report.New()
+	manifests, err := p.LoadFS(fsys, rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifests) != 1 || len(rep.Problems) != 1 || rep.Problems[0].Manifest != "test/app" {
+		t.Fatalf("Expected the second combination to be reported, but got %v %+v", manifests.Keys(), rep.Problems)
+	}
+
+	fsys["app.yaml"] = &fstest.MapFile{Data: []byte(strings.Replace(matrixManifest, "cluster: [PRODUCTION]", "cluster: [PRODUCTION, PRODUCTION]", 1))}
+	if _, err := p.LoadFS(fsys, nil); err == nil || !strings.Contains(err.Error(), `matrix: cluster: duplicate value "PRODUCTION"`) {
+		t.Fatalf("Expected duplicate matrix values to be rejected, but got %v", err)
+	}
+}
+
+func TestMatrixWithTargets(t *testing.T) {
+	all, err := targets.Load("test/targets.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProjector(t, Options{Targets: all})
+	expanded, err := p.ExpandBytes("", []byte(`
+name: app-${env}
+namespace: test
+matrix:
+  env: [a, b]
+data:
+- source: clusters/${target}/app.json
+  output_file: replicas-${env}
+  extract: $.replicas
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := p.ProjectTarget(expanded[1], all[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Name != "app-b" || r.ConfigMap.Data["replicas-b"] != "12" {
+		t.Fatalf("Expected the b combination for bf2-PRODUCTION, but got %s %v", r.Name, r.ConfigMap.Data)
+	}
+}
+
+func TestExpandInfersSourceFormats(t *testing.T) {
+	p := newTestProjector(t, Options{})
+	expanded, err := p.ExpandBytes("", []byte(`
+name: app-${format}
+namespace: test
+matrix:
+  format: [json, yaml]
+data:
+- source: test.${format}
+  output_file: astring
+  extract: $.astring
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, format := range []ds.SourceFormat{ds.FormatJSON, ds.FormatYAML} {
+		if f := expanded[i].Data[0].SourceFormat; f != format {
+			t.Fatalf("Expected %s to be inferred from the expanded source, but got %s", format, f)
+		}
+		r, err := p.Project(expanded[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.ConfigMap.Data["astring"] != "hello world 1236969" {
+			t.Fatalf("Expected astring to be extracted, but got %v", r.ConfigMap.Data)
+		}
+	}
+
+	_, err = p.ExpandBytes("", []byte(`
+name: app-${format}
+namespace: test
+matrix:
+  format: [php]
+data:
+- source: a.${format}
+  output_file: astring
+  extract: $.astring
+`))
+	var pe *types.ProjectionError
+	if !errors.Is(err, types.ErrUnableToInferSourceFormat) || !errors.As(err, &pe) || pe.FieldPath() != "data[0].source_format" {
+		t.Fatalf("Expected the source format of the expanded source to be uninferrable, but got %v", err)
+	}
+}
+
+func TestLoadIncludes(t *testing.T) {
+	l, err := library.Load("test/library")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProjector(t, Options{Library: l, Vars: interpolate.Vars{"az": "bf2"}})
+	m, err := p.LoadBytes("", []byte(`
+name: app
+namespace: test
+data:
+- source: test.json
+  output_file: hostport
+  extract: $.hostport
+include:
+- template: app
+  params:
+    cluster: ${az}-PRODUCTION
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := p.Project(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ConfigMap.Data["replicas"] != "12" || r.ConfigMap.Data["bf2-PRODUCTION-sample.json"] == "" || len(r.Lineage) != 3 {
+		t.Fatalf("Expected the included datasources to be projected, but got %v", r.ConfigMap.Data)
+	}
+	for _, l := range r.Lineage {
+		if l.Key == "replicas" && (l.Template != "app" || l.DataSource != 0) {
+			t.Fatalf("Expected lineage to record the template of included keys, but got %+v", l)
+		}
+		if l.Key == "hostport" && l.Template != "" {
+			t.Fatalf("Expected no template for the manifest's own datasources, but got %+v", l)
+		}
+	}
+
+	for raw, expected := range map[string]error{
+		"include: [{template: nope}]":    types.ErrUnknownTemplate,
+		"include: [{template: cycle/a}]": types.ErrIncludeCycle,
+	} {
+		_, err := p.LoadBytes("m.yaml", []byte("name: app\nnamespace: test\ndata: []\n"+raw+"\n"))
+		if !errors.Is(err, expected) || !strings.Contains(err.Error(), "m.yaml:4:11: include[0]") {
+			t.Fatalf("Expected %s to fail with %s at include[0], but got %v", raw, expected, err)
+		}
+	}
+}
+
+func TestLoadFSDocuments(t *testing.T) {
+	p := newTestProjector(t, Options{})
+	fsys := fstest.MapFS{
+		".projectorignore":  {Data: []byte("drafts/\n")},
+		"apps/hostport.yml": {Data: []byte(hostportManifest)},
+		"apps/app.json":     {Data: []byte(`{"name": "app", "namespace": "test", "data": [{"source": "clusters/bf2-DEVEL/app.json", "output_file": "replicas", "extract": "$.replicas"}]}`)},
+		"apps/many.yaml":    {Data: []byte("# several manifests\n---\nname: one\nnamespace: test\ndata: []\n---\nname: two\nnamespace: test\ndata: []\n")},
+		"drafts/draft.yaml": {Data: []byte("not: [a manifest")},
+		"README.md":         {Data: []byte("not a manifest")},
+	}
+	rep := report.New()
+	manifests, err := p.LoadFS(fsys, rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := strings.Join(manifests.Keys(), ","); keys != "test/app,test/hostport,test/one,test/two" || !rep.OK() {
+		t.Fatalf("Expected a manifest from each .yml, .json and yaml document, but got %s %v", keys, rep.Problems)
+	}
+	if rep.Manifests != 4 || len(rep.Skipped) != 2 || rep.Skipped[0].File != "README.md" || rep.Skipped[1].File != "drafts" {
+		t.Fatalf("Expected 4 manifests checked, and the README and drafts skipped, but got %d %+v", rep.Manifests, rep.Skipped)
+	}
+
+	// problems are located in the file, and each document is loaded on its own
+	fsys["apps/many.yaml"] = &fstest.MapFile{Data: []byte("name: one\nnamespace: test\ndata: []\n---\nname: Two\nnamespace: test\ndata: []\n---\nname: one\nnamespace: test\ndata: []\n")}
+	rep = report.New()
+	manifests, err = p.LoadFS(fsys, rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := manifests["test/one"]; !ok || len(rep.Problems) != 2 {
+		t.Fatalf("Expected the first document to load, and problems with the others, but got %v", rep.Problems)
+	}
+	if loc := rep.Problems[0].Location(); loc != "apps/many.yaml:5:1: name" {
+		t.Fatalf("Expected the problem to be located in the file, but got %s", loc)
+	}
+	if msg := rep.Problems[1].Message; !strings.Contains(msg, "file=apps/many.yaml:9 (already loaded from apps/many.yaml:1)") {
+		t.Fatalf("Expected duplicates to name the lines of their documents, but got %s", msg)
+	}
+
+	skipped := []string{}
+	p = newTestProjector(t, Options{Skipped: func(path string, reason string) { skipped = append(skipped, path) }})
+	if _, err := p.LoadFS(fstest.MapFS{"README.md": {Data: []byte("not a manifest")}}, nil); err != nil || len(skipped) != 1 {
+		t.Fatalf("Expected skipped files to be passed to Skipped without a report, but got %v %v", skipped, err)
+	}
+}
+
+func TestLoadFileBytes(t *testing.T) {
+	p := newTestProjector(t, Options{})
+	rep := report.New()
+	manifests, err := p.LoadFileBytes("apps/many.yaml", []byte(hostportManifest+"---\nname: Bad\nnamespace: test\ndata: []\n"), rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := manifests["test/hostport"]; !ok || len(manifests) != 1 || len(rep.Problems) != 1 || rep.Problems[0].Line != 9 {
+		t.Fatalf("Expected the valid manifest, and the other's problem located in the file, but got %v %+v", manifests.Keys(), rep.Problems)
+	}
+}
@@ -0,0 +1,134 @@
+package report
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Name     string       `xml:"name,attr"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Time     string       `xml:"time,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Time      string      `xml:"time,attr"`
+	Timestamp string      `xml:"timestamp,attr"`
+	Cases     []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name       string          `xml:"name,attr"`
+	ClassName  string          `xml:"classname,attr"`
+	Time       string          `xml:"time,attr"`
+	Properties []junitProperty `xml:"properties>property,omitempty"`
+	Failure    *junitFailure   `xml:"failure,omitempty"`
+	SystemOut  string          `xml:"system-out,omitempty"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// WriteJUnit renders the report as JUnit XML, with a test case per manifest: each result, and
+// each manifest (or file) that had problems without one. Errors fail a manifest's test case;
+// warnings and info are its output.
+func (r *Report) WriteJUnit(w io.Writer) error {
+	type testCase struct {
+		result   Result
+		problems []Problem
+	}
+	cases := []*testCase{}
+	byKey := map[string]*testCase{}
+	for _, res := range r.Results {
+		c := &testCase{result: res}
+		cases = append(cases, c)
+		byKey[res.File+"\x00"+res.Manifest] = c
+	}
+	for _, p := range r.Problems {
+		key := p.File + "\x00" + p.Manifest
+		c, ok := byKey[key]
+		if !ok {
+			c = &testCase{result: Result{File: p.File, Manifest: p.Manifest}}
+			cases = append(cases, c)
+			byKey[key] = c
+		}
+		c.problems = append(c.problems, p)
+	}
+
+	suite := junitSuite{
+		Name:      toolName,
+		Tests:     len(cases),
+		Time:      seconds(r.Seconds),
+		Timestamp: r.Started.UTC().Format("2006-01-02T15:04:05"),
+		Cases:     []junitCase{},
+	}
+	for _, c := range cases {
+		name := c.result.Manifest
+		if name == "" {
+			name = c.result.File
+		}
+		jc := junitCase{Name: name, ClassName: c.result.File, Time: seconds(c.result.Seconds)}
+		if c.result.Bytes > 0 {
+			jc.Properties = []junitProperty{{Name: "bytes", Value: fmt.Sprint(c.result.Bytes)}}
+		}
+		errs, out := []string{}, []string{}
+		for _, p := range c.problems {
+			if p.Level() != SeverityError {
+				out = append(out, p.String())
+				continue
+			}
+			if jc.Failure == nil {
+				rule := p.Rule
+				if rule == "" {
+					rule = RuleProjection
+				}
+				jc.Failure = &junitFailure{Message: p.describe(), Type: rule}
+			}
+			errs = append(errs, p.String())
+		}
+		if jc.Failure != nil {
+			jc.Failure.Text = strings.Join(errs, "\n")
+			suite.Failures++
+		}
+		jc.SystemOut = strings.Join(out, "\n")
+		suite.Cases = append(suite.Cases, jc)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(junitSuites{
+		Name:     toolName,
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Time:     suite.Time,
+		Suites:   []junitSuite{suite},
+	}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// seconds formats a duration in seconds for JUnit
+func seconds(s float64) string {
+	return fmt.Sprintf("%.3f", s)
+}
@@ -0,0 +1,242 @@
+package report
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/tumblr/k8s-config-projector/pkg/types"
+)
+
+const (
+	// FormatText renders a report as human readable lines
+	FormatText = "text"
+	// FormatJSON renders a report as a JSON document, suitable for CI annotations
+	FormatJSON = "json"
+	// FormatSARIF renders a report as a SARIF log, for code scanning annotations on manifest lines
+	FormatSARIF = "sarif"
+	// FormatJUnit renders a report as JUnit XML, with a test case per manifest
+	FormatJUnit = "junit"
+)
+
+const (
+	// SeverityError problems fail the run. Problems without a severity are errors
+	SeverityError = "error"
+	// SeverityWarning problems are reported, but dont fail the run
+	SeverityWarning = "warning"
+	// SeverityInfo problems are informational
+	SeverityInfo = "info"
+)
+
+// Problem is a single error found while loading, validating, or projecting a manifest
+type Problem struct {
+	// File is the manifest file the problem was found in
+	File string `json:"file"`
+	// Line and Column locate the problem in File, if known
+	Line   int `json:"line,omitempty"`
+	Column int `json:"column,omitempty"`
+	// Manifest is the namespace/name of the manifest, if it could be parsed
+	Manifest string `json:"manifest,omitempty"`
+	// DataSource is the index of the datasource in the manifest's `data` list, if the problem is with a datasource
+	DataSource *int `json:"datasource,omitempty"`
+	// Field is the manifest or datasource field at fault, if known
+	Field string `json:"field,omitempty"`
+	// Source is the source file being projected, if known
+	Source string `json:"source,omitempty"`
+	// JSONPath is the extraction expression being evaluated, if known
+	JSONPath string `json:"jsonpath,omitempty"`
+	Message  string `json:"message"`
+	// Rule is the lint rule that found the problem, if any
+	Rule string `json:"rule,omitempty"`
+	// Severity is one of the Severity constants; empty means SeverityError
+	Severity string `json:"severity,omitempty"`
+}
+
+// Level returns the severity of the problem, defaulting to SeverityError
+func (p Problem) Level() string {
+	if p.Severity == "" {
+		return SeverityError
+	}
+	return p.Severity
+}
+
+// Location returns a short description of where the problem is, like file:12:5: data[2].output_file
+func (p Problem) Location() string {
+	loc := p.File
+	if p.Line > 0 {
+		loc = fmt.Sprintf("%s:%d:%d", loc, p.Line, p.Column)
+	}
+	parts := []string{}
+	if p.DataSource != nil {
+		parts = append(parts, fmt.Sprintf("data[%d]", *p.DataSource))
+	}
+	if p.Field != "" {
+		parts = append(parts, p.Field)
+	}
+	if len(parts) > 0 {
+		loc = loc + ": " + strings.Join(parts, ".")
+	}
+	return loc
+}
+
+// String returns the problem as a line of a text report, like
+// `file:12:5: data[2].output_file: message (source=app.json) [rule]`
+func (p Problem) String() string {
+	ctx := ""
+	if p.Source != "" {
+		ctx = " source=" + p.Source
+	}
+	if p.JSONPath != "" {
+		ctx = ctx + " jsonpath=" + p.JSONPath
+	}
+	if ctx != "" {
+		ctx = " (" + strings.TrimSpace(ctx) + ")"
+	}
+	if p.Rule != "" {
+		ctx = fmt.Sprintf("%s [%s]", ctx, p.Rule)
+	}
+	level := ""
+	if p.Severity != "" {
+		level = p.Severity + ": "
+	}
+	return fmt.Sprintf("%s: %s%s%s", p.Location(), level, p.Message, ctx)
+}
+
+// Skipped is a file or directory in the manifest directory that wasnt loaded as a manifest. It isnt a problem.
+type Skipped struct {
+	File   string `json:"file"`
+	Reason string `json:"reason"`
+}
+
+// Rule describes a rule problems may be found by, like a lint rule
+type Rule struct {
+	ID          string `json:"id"`
+	Description string `json:"description"`
+}
+
+// Result is a manifest that was checked or projected, how long that took, and how big what it
+// projected was
+type Result struct {
+	File string `json:"file"`
+	// Manifest is the namespace/name of the manifest (and @target, when projecting for targets),
+	// like the Manifest of its problems
+	Manifest string  `json:"manifest"`
+	Seconds  float64 `json:"seconds"`
+	// Bytes is the size of the projected resource as yaml, if it was projected
+	Bytes int `json:"bytes,omitempty"`
+}
+
+// Report collects every Problem found during a run, instead of stopping at the first one
+type Report struct {
+	// Started is when the run started, and Seconds how long it took, once it is Finished
+	Started time.Time `json:"started"`
+	Seconds float64   `json:"seconds"`
+	// Manifests is the number of manifests that were checked
+	Manifests int       `json:"manifests"`
+	Problems  []Problem `json:"problems"`
+	// Skipped are the files and directories that werent loaded as manifests
+	Skipped []Skipped `json:"skipped,omitempty"`
+	// Rules describe the rules of the problems that have one
+	Rules []Rule `json:"rules,omitempty"`
+	// Results are the manifests that were checked or projected, in order
+	Results []Result `json:"results,omitempty"`
+}
+
+// New returns an empty Report, for a run starting now
+func New() *Report {
+	return &Report{Problems: []Problem{}, Started: time.Now()}
+}
+
+// Record records that the manifest in file was checked or projected, starting at started, into
+// a resource of size bytes (0 if it wasnt projected)
+func (r *Report) Record(file string, manifest string, started time.Time, bytes int) {
+	r.Results = append(r.Results, Result{File: file, Manifest: manifest, Seconds: time.Since(started).Seconds(), Bytes: bytes})
+}
+
+// Finish records how long the run took, before the report is written
+func (r *Report) Finish() {
+	r.Seconds = time.Since(r.Started).Seconds()
+}
+
+// Add records err as a Problem with the manifest in file. manifest is the namespace/name of the
+// manifest, and may be empty if the file could not be parsed. When err is a types.ProjectionError,
+// its location is recorded in the Problem, and the message is that of the error it wraps.
+func (r *Report) Add(file string, manifest string, err error) {
+	p := Problem{
+		File:     file,
+		Manifest: manifest,
+		Message:  err.Error(),
+	}
+	var pe *types.ProjectionError
+	if errors.As(err, &pe) {
+		// keep the context of errors wrapping it
+		pe = types.AsProjectionError(err)
+		p.Line, p.Column = pe.Line, pe.Column
+		if pe.DataSource != types.NoDataSource {
+			idx := pe.DataSource
+			p.DataSource = &idx
+		}
+		p.Field = pe.Field
+		p.Source = pe.Source
+		p.JSONPath = pe.JSONPath
+		p.Message = pe.Err.Error()
+	}
+	r.Problems = append(r.Problems, p)
+}
+
+// Skip records that file was skipped when discovering manifests, and why
+func (r *Report) Skip(file string, reason string) {
+	r.Skipped = append(r.Skipped, Skipped{File: file, Reason: reason})
+}
+
+// OK returns true when no errors were recorded; warnings and info dont count
+func (r *Report) OK() bool {
+	for _, p := range r.Problems {
+		if p.Level() == SeverityError {
+			return false
+		}
+	}
+	return true
+}
+
+// Write renders the report to w in the given format (text, json, sarif or junit)
+func (r *Report) Write(w io.Writer, format string) error {
+	switch format {
+	case FormatJSON:
+		return r.WriteJSON(w)
+	case FormatSARIF:
+		return r.WriteSARIF(w)
+	case FormatJUnit:
+		return r.WriteJUnit(w)
+	case FormatText, "":
+		return r.WriteText(w)
+	default:
+		return fmt.Errorf("unsupported report format %s; must be one of text, json, sarif or junit", format)
+	}
+}
+
+// WriteJSON renders the report as indented JSON
+func (r *Report) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+// WriteText renders the report as one line per problem, then one per skipped file, followed by a summary
+func (r *Report) WriteText(w io.Writer) error {
+	for _, p := range r.Problems {
+		if _, err := fmt.Fprintln(w, p.String()); err != nil {
+			return err
+		}
+	}
+	for _, s := range r.Skipped {
+		if _, err := fmt.Fprintf(w, "skipped %s: %s\n", s.File, s.Reason); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "checked %d manifests, found %d problems\n", r.Manifests, len(r.Problems))
+	return err
+}
@@ -0,0 +1,154 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tumblr/k8s-config-projector/pkg/types"
+)
+
+func TestAddExtractsLocation(t *testing.T) {
+	r := New()
+	r.Add("manifests/foo.yaml", "ns/foo", &types.ProjectionError{Manifest: "manifests/foo.yaml", Line: 12, Column: 5, DataSource: 2, Field: "output_file", Err: types.ErrOutputFileRequired})
+	r.Add("manifests/bar.yaml", "", errors.New("yaml: line 3: did not find expected key"))
+
+	if r.OK() {
+		t.Fatal("Expected report with problems to not be OK")
+	}
+	if loc := r.Problems[0].Location(); loc != "manifests/foo.yaml:12:5: data[2].output_file" {
+		t.Fatalf("Expected location manifests/foo.yaml:12:5: data[2].output_file, but got %s", loc)
+	}
+	if msg := r.Problems[0].Message; msg != types.ErrOutputFileRequired.Error() {
+		t.Fatalf("Expected message to be the wrapped error %s, but got %s", types.ErrOutputFileRequired, msg)
+	}
+	if loc := r.Problems[1].Location(); loc != "manifests/bar.yaml" {
+		t.Fatalf("Expected location manifests/bar.yaml, but got %s", loc)
+	}
+
+	r.Add("manifests/baz.yaml", "", fmt.Errorf("document on line 4: %w", &types.ProjectionError{Line: 5, Column: 1, DataSource: types.NoDataSource, Field: "name", Err: types.ErrInvalidName}))
+	if p := r.Problems[2]; p.Line != 5 || p.Field != "name" || p.Message != "document on line 4: "+types.ErrInvalidName.Error() {
+		t.Fatalf("Expected the location and the context wrapping it, but got %#v", p)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	r := New()
+	r.Manifests = 1
+	r.Add("manifests/foo.yaml", "ns/foo", &types.ProjectionError{DataSource: 0, Field: "source", Source: "/etc/passwd", Err: types.ErrAbsolutePathSource})
+
+	buf := bytes.NewBuffer([]byte{})
+	if err := r.Write(buf, FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	var decoded Report
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Problems) != 1 {
+		t.Fatalf("Expected 1 problem, but got %d", len(decoded.Problems))
+	}
+	p := decoded.Problems[0]
+	if p.DataSource == nil || *p.DataSource != 0 || p.Field != "source" || p.Source != "/etc/passwd" || p.Message != types.ErrAbsolutePathSource.Error() {
+		t.Fatalf("Unexpected problem decoded from JSON: %#v", p)
+	}
+}
+
+func TestWriteTextSkipped(t *testing.T) {
+	r := New()
+	r.Manifests = 2
+	r.Skip("manifests/README.md", "not a manifest")
+
+	buf := bytes.NewBuffer([]byte{})
+	if err := r.Write(buf, FormatText); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "skipped manifests/README.md: not a manifest\nchecked 2 manifests, found 0 problems\n"; buf.String() != expected || !r.OK() {
+		t.Fatalf("Expected skipped files to be listed without being problems, but got %q", buf.String())
+	}
+}
+
+func TestWriteSARIF(t *testing.T) {
+	r := New()
+	r.Rules = []Rule{{ID: "file-name", Description: "manifest files should be named after the manifest's name"}}
+	r.Add("manifests/foo.yaml", "ns/foo", &types.ProjectionError{Line: 12, Column: 5, DataSource: 2, Field: "output_file", Err: types.ErrOutputFileRequired})
+	r.Add("manifests/bar.yaml", "ns/bar", &types.ProjectionError{Line: 1, Column: 1, DataSource: types.NoDataSource, Field: "name", Err: errors.New("misnamed")})
+	r.Problems[1].Rule, r.Problems[1].Severity = "file-name", SeverityInfo
+	if r.OK() {
+		t.Fatal("Expected the error to fail the report")
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	if err := r.Write(buf, FormatSARIF); err != nil {
+		t.Fatal(err)
+	}
+	var log sarifLog
+	if err := json.Unmarshal(buf.Bytes(), &log); err != nil {
+		t.Fatal(err)
+	}
+	run := log.Runs[0]
+	if log.Version != "2.1.0" || len(run.Tool.Driver.Rules) != 2 || run.Tool.Driver.Rules[1].ID != RuleProjection {
+		t.Fatalf("Expected the lint rule and the projection rule to be described, but got %+v", run.Tool.Driver.Rules)
+	}
+	results := run.Results
+	if len(results) != 2 || results[0].RuleID != RuleProjection || results[0].Level != "error" || results[0].Message.Text != "data[2].output_file: "+types.ErrOutputFileRequired.Error() {
+		t.Fatalf("Expected the error as a projection result, but got %+v", results)
+	}
+	if loc := results[0].Locations[0].PhysicalLocation; loc.ArtifactLocation.URI != "manifests/foo.yaml" || loc.Region.StartLine != 12 || loc.Region.StartColumn != 5 {
+		t.Fatalf("Expected the result to be located at manifests/foo.yaml:12:5, but got %+v", loc)
+	}
+	if inv := run.Invocations[0]; inv.ExecutionSuccessful || inv.StartTimeUTC == "" {
+		t.Fatalf("Expected the failed run to be timed, but got %+v", inv)
+	}
+	if results[1].RuleID != "file-name" || results[1].Level != "note" || results[1].Properties["manifest"] != "ns/bar" {
+		t.Fatalf("Expected the info as a file-name note, but got %+v", results[1])
+	}
+
+	r.Problems = r.Problems[1:]
+	if !r.OK() {
+		t.Fatal("Expected info problems not to fail the report")
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	r := New()
+	r.Manifests = 3
+	r.Record("manifests/foo.yaml", "ns/foo", time.Now(), 1234)
+	r.Record("manifests/bar.yaml", "ns/bar", time.Now(), 0)
+	r.Add("manifests/bar.yaml", "ns/bar", &types.ProjectionError{Line: 4, Column: 3, DataSource: 0, Field: "source", Source: "missing.json", Err: errors.New("no such file")})
+	r.Add("manifests/bar.yaml", "ns/bar", &types.ProjectionError{Line: 1, Column: 1, DataSource: types.NoDataSource, Field: "name", Err: errors.New("misnamed")})
+	r.Problems[1].Rule, r.Problems[1].Severity = "file-name", SeverityWarning
+	r.Add("manifests/baz.yaml", "", errors.New("yaml: line 3: did not find expected key"))
+	r.Finish()
+
+	buf := bytes.NewBuffer([]byte{})
+	if err := r.Write(buf, FormatJUnit); err != nil {
+		t.Fatal(err)
+	}
+	var suites junitSuites
+	if err := xml.Unmarshal(buf.Bytes(), &suites); err != nil {
+		t.Fatal(err)
+	}
+	if suites.Tests != 3 || suites.Failures != 2 || len(suites.Suites) != 1 {
+		t.Fatalf("Expected 3 test cases, 2 failing, but got %+v", suites)
+	}
+	cases := suites.Suites[0].Cases
+	if foo := cases[0]; foo.Name != "ns/foo" || foo.ClassName != "manifests/foo.yaml" || foo.Failure != nil || len(foo.Properties) != 1 || foo.Properties[0].Value != "1234" {
+		t.Fatalf("Expected ns/foo to pass, projecting 1234 bytes, but got %+v", foo)
+	}
+	bar := cases[1]
+	if bar.Failure == nil || bar.Failure.Message != "data[0].source: no such file" || bar.Failure.Type != RuleProjection || !strings.Contains(bar.Failure.Text, "(source=missing.json)") {
+		t.Fatalf("Expected ns/bar to fail with its error, but got %+v", bar.Failure)
+	}
+	if bar.SystemOut != "manifests/bar.yaml:1:1: name: warning: misnamed [file-name]" {
+		t.Fatalf("Expected the warning to be output, but got %q", bar.SystemOut)
+	}
+	if baz := cases[2]; baz.Name != "manifests/baz.yaml" || baz.Failure == nil {
+		t.Fatalf("Expected the file that didnt parse to fail, but got %+v", baz)
+	}
+}
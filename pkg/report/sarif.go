@@ -0,0 +1,178 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	sarifSchema  = "https://json.schemastore.org/sarif-2.1.0.json"
+	sarifVersion = "2.1.0"
+	// toolName names the tool in SARIF and JUnit reports
+	toolName = "k8s-config-projector"
+	sarifURI = "https://github.com/tumblr/k8s-config-projector"
+	// RuleProjection is the SARIF rule of problems without a rule: manifests that fail to load,
+	// validate or project
+	RuleProjection = "projection"
+)
+
+// sarifLevels maps severities to SARIF result levels
+var sarifLevels = map[string]string{
+	SeverityError:   "error",
+	SeverityWarning: "warning",
+	SeverityInfo:    "note",
+}
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool        sarifTool         `json:"tool"`
+	Invocations []sarifInvocation `json:"invocations"`
+	Results     []sarifResult     `json:"results"`
+	// Properties are the manifests checked, and their results
+	Properties sarifRunProperties `json:"properties"`
+}
+
+type sarifInvocation struct {
+	ExecutionSuccessful bool   `json:"executionSuccessful"`
+	StartTimeUTC        string `json:"startTimeUtc"`
+	EndTimeUTC          string `json:"endTimeUtc"`
+}
+
+type sarifRunProperties struct {
+	Manifests int      `json:"manifests"`
+	Seconds   float64  `json:"seconds"`
+	Results   []Result `json:"results,omitempty"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID     string            `json:"ruleId"`
+	Level      string            `json:"level"`
+	Message    sarifMessage      `json:"message"`
+	Locations  []sarifLocation   `json:"locations"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+}
+
+// WriteSARIF renders the report as a SARIF 2.1.0 log, with a result per problem located at its
+// manifest line. Problems without a rule are results of RuleProjection. The run's properties are
+// the report's Results.
+func (r *Report) WriteSARIF(w io.Writer) error {
+	driver := sarifDriver{Name: toolName, InformationURI: sarifURI, Rules: []sarifRule{}}
+	described := map[string]bool{}
+	for _, rule := range r.Rules {
+		driver.Rules = append(driver.Rules, sarifRule{ID: rule.ID, ShortDescription: sarifMessage{Text: rule.Description}})
+		described[rule.ID] = true
+	}
+	results := []sarifResult{}
+	for _, p := range r.Problems {
+		id := p.Rule
+		if id == "" {
+			id = RuleProjection
+		}
+		if !described[id] {
+			text := fmt.Sprintf("Problems found by %s", id)
+			if id == RuleProjection {
+				text = "Manifests must load, validate and project"
+			}
+			driver.Rules = append(driver.Rules, sarifRule{ID: id, ShortDescription: sarifMessage{Text: text}})
+			described[id] = true
+		}
+		loc := sarifPhysicalLocation{ArtifactLocation: sarifArtifactLocation{URI: filepath.ToSlash(p.File)}}
+		if p.Line > 0 {
+			loc.Region = &sarifRegion{StartLine: p.Line, StartColumn: p.Column}
+		}
+		results = append(results, sarifResult{
+			RuleID:     id,
+			Level:      sarifLevels[p.Level()],
+			Message:    sarifMessage{Text: p.describe()},
+			Locations:  []sarifLocation{{PhysicalLocation: loc}},
+			Properties: p.properties(),
+		})
+	}
+	end := r.Started.Add(time.Duration(r.Seconds * float64(time.Second)))
+	run := sarifRun{
+		Tool: sarifTool{Driver: driver},
+		Invocations: []sarifInvocation{{
+			ExecutionSuccessful: r.OK(),
+			StartTimeUTC:        r.Started.UTC().Format(time.RFC3339Nano),
+			EndTimeUTC:          end.UTC().Format(time.RFC3339Nano),
+		}},
+		Results:    results,
+		Properties: sarifRunProperties{Manifests: r.Manifests, Seconds: r.Seconds, Results: r.Results},
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sarifLog{Schema: sarifSchema, Version: sarifVersion, Runs: []sarifRun{run}})
+}
+
+// describe returns the message of the problem, prefixed with the field at fault, for reports that
+// locate problems by line alone
+func (p Problem) describe() string {
+	field := p.Field
+	if p.DataSource != nil {
+		field = strings.TrimSuffix(fmt.Sprintf("data[%d].%s", *p.DataSource, p.Field), ".")
+	}
+	if field == "" {
+		return p.Message
+	}
+	return field + ": " + p.Message
+}
+
+// properties returns what else is known about the problem, by name
+func (p Problem) properties() map[string]string {
+	props := map[string]string{}
+	for k, v := range map[string]string{"manifest": p.Manifest, "source": p.Source, "jsonpath": p.JSONPath} {
+		if v != "" {
+			props[k] = v
+		}
+	}
+	if len(props) == 0 {
+		return nil
+	}
+	return props
+}
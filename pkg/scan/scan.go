@@ -0,0 +1,236 @@
+package scan
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// ModeOff disables scanning
+	ModeOff = "off"
+	// ModeWarn logs findings (or reports them as warnings), but projects anyway
+	ModeWarn = "warn"
+	// ModeFail reports findings as problems, failing the run
+	ModeFail = "fail"
+
+	// ReportRule is the rule findings are reported as problems of
+	ReportRule = "secret-scan"
+
+	// DefaultSuggestion is appended to findings, unless the scanner config overrides it.
+	// {key} and {manifest} are replaced with the ConfigMap data key and manifest namespace/name
+	DefaultSuggestion = "ConfigMaps are not secret; encrypt {key}'s source with SOPS and project it with `resource: Secret`, or allowlist it"
+)
+
+var (
+	// ErrPossibleSecret is wrapped by every Finding, so callers can match them with errors.Is
+	ErrPossibleSecret = errors.New("possible secret in projected ConfigMap data")
+
+	privateKeyRegexp = regexp.MustCompile(`-----BEGIN ([A-Z0-9]+ )*PRIVATE KEY( BLOCK)?-----`)
+	awsKeyRegexp     = regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)
+	// secretNameRegexp matches key names that usually hold credentials
+	secretNameRegexp = regexp.MustCompile(`(?i)(password|passwd|passphrase|secret|api[_-]?key|access[_-]?key|private[_-]?key|token|credential)`)
+	// assignmentRegexp matches `key: value`, `key = value` and `"key": "value"` pairs in structured or ini-ish data
+	assignmentRegexp = regexp.MustCompile(`["']?([A-Za-z0-9_.\-]+)["']?\s*[:=]\s*["']?([^\s"',}]*)`)
+	// tokenRegexp matches runs of characters that make up base64/urlsafe encoded values
+	tokenRegexp = regexp.MustCompile(`[A-Za-z0-9+/_\-]{24,}={0,2}`)
+	uuidRegexp  = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+	// values that dont count as a credential, even if assigned to a key named like one
+	placeholderValues = map[string]bool{"": true, "null": true, "~": true, "true": true, "false": true, "none": true}
+)
+
+const (
+	// entropyThreshold is the Shannon entropy (bits per char) above which a token looks random
+	entropyThreshold = 4.0
+)
+
+// Finding is a projected value that looks like a credential
+type Finding struct {
+	// Manifest is the namespace/name of the manifest that projected the value
+	Manifest string `json:"manifest"`
+	// Key is the ConfigMap data key the value was found in
+	Key string `json:"key"`
+	// Rule is which rule matched: private-key, aws-access-key, secret-key-name or high-entropy
+	Rule string `json:"rule"`
+	// Line is the line in the data value the match is on
+	Line int `json:"line"`
+	// Match is what matched, with the value masked, like `password: **** (14 chars)`
+	Match      string `json:"match"`
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+func (f *Finding) Error() string {
+	msg := fmt.Sprintf("%s: %s rule matched %s line %d: %s", ErrPossibleSecret.Error(), f.Rule, f.Key, f.Line, f.Match)
+	if f.Suggestion != "" {
+		msg = msg + "; " + f.Suggestion
+	}
+	return msg
+}
+
+// Unwrap returns ErrPossibleSecret
+func (f *Finding) Unwrap() error {
+	return ErrPossibleSecret
+}
+
+// Allow suppresses findings for matching manifests and keys
+type Allow struct {
+	// Manifest is a glob matching manifest namespace/name; empty matches all
+	Manifest string `yaml:"manifest,omitempty"`
+	// Key is a glob matching ConfigMap data keys; empty matches all
+	Key string `yaml:"key,omitempty"`
+	// Rules are the rules allowed; empty allows all
+	Rules []string `yaml:"rules,omitempty"`
+}
+
+func (a *Allow) allows(f *Finding) bool {
+	if a.Manifest != "" {
+		if ok, _ := path.Match(a.Manifest, f.Manifest); !ok {
+			return false
+		}
+	}
+	if a.Key != "" {
+		if ok, _ := path.Match(a.Key, f.Key); !ok {
+			return false
+		}
+	}
+	if len(a.Rules) == 0 {
+		return true
+	}
+	for _, r := range a.Rules {
+		if r == f.Rule {
+			return true
+		}
+	}
+	return false
+}
+
+// Scanner looks for credentials in projected ConfigMap data
+type Scanner struct {
+	Allow []Allow `yaml:"allow,omitempty"`
+	// Suggestion is appended to every finding; see DefaultSuggestion
+	Suggestion string `yaml:"suggestion,omitempty"`
+}
+
+// New returns a Scanner with no allowlist
+func New() *Scanner {
+	return &Scanner{Suggestion: DefaultSuggestion}
+}
+
+// Load reads a Scanner's allowlist and suggestion from a yaml file
+func Load(file string) (*Scanner, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	s := New()
+	if err := yaml.UnmarshalStrict(raw, s); err != nil {
+		return nil, fmt.Errorf("unable to parse secret scan config %s: %s", file, err.Error())
+	}
+	return s, nil
+}
+
+// Scan returns every finding in the data of the ConfigMap projected by manifest (namespace/name),
+// minus those that are allowlisted. Findings are sorted by key and line.
+func (s *Scanner) Scan(manifest string, data map[string]string) []*Finding {
+	findings := []*Finding{}
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, f := range scanValue(k, data[k]) {
+			f.Manifest = manifest
+			if s.allowed(f) {
+				continue
+			}
+			if s.Suggestion != "" {
+				f.Suggestion = strings.NewReplacer("{key}", k, "{manifest}", manifest).Replace(s.Suggestion)
+			}
+			findings = append(findings, f)
+		}
+	}
+	return findings
+}
+
+func (s *Scanner) allowed(f *Finding) bool {
+	for i := range s.Allow {
+		if s.Allow[i].allows(f) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanValue runs every rule over a single data item, returning at most one finding per rule per line
+func scanValue(key string, value string) []*Finding {
+	findings := []*Finding{}
+	if secretNameRegexp.MatchString(key) && !placeholderValues[strings.ToLower(strings.TrimSpace(value))] {
+		findings = append(findings, &Finding{Key: key, Rule: "secret-key-name", Line: 1, Match: key + ": " + redact(strings.TrimSpace(value))})
+	}
+	for i, line := range strings.Split(value, "\n") {
+		n := i + 1
+		if m := privateKeyRegexp.FindString(line); m != "" {
+			findings = append(findings, &Finding{Key: key, Rule: "private-key", Line: n, Match: redact(m)})
+		}
+		if m := awsKeyRegexp.FindString(line); m != "" {
+			findings = append(findings, &Finding{Key: key, Rule: "aws-access-key", Line: n, Match: redact(m)})
+		}
+		for _, a := range assignmentRegexp.FindAllStringSubmatch(line, -1) {
+			name, v := a[1], a[2]
+			if secretNameRegexp.MatchString(name) && !placeholderValues[strings.ToLower(v)] {
+				findings = append(findings, &Finding{Key: key, Rule: "secret-key-name", Line: n, Match: name + ": " + redact(v)})
+				break
+			}
+		}
+		for _, t := range tokenRegexp.FindAllString(line, -1) {
+			if looksRandom(t) {
+				findings = append(findings, &Finding{Key: key, Rule: "high-entropy", Line: n, Match: redact(t)})
+				break
+			}
+		}
+	}
+	return findings
+}
+
+// looksRandom returns true for tokens that look like encoded keys: mixed case and digits, with
+// high entropy. Lower case hex (shas) and uuids are common in configs, so they are left alone.
+func looksRandom(t string) bool {
+	if uuidRegexp.MatchString(t) {
+		return false
+	}
+	if !strings.ContainsAny(t, "0123456789") || strings.ToLower(t) == t || strings.ToUpper(t) == t {
+		return false
+	}
+	return entropy(t) >= entropyThreshold
+}
+
+// entropy returns the Shannon entropy of s, in bits per character
+func entropy(s string) float64 {
+	counts := map[rune]int{}
+	for _, r := range s {
+		counts[r]++
+	}
+	e := 0.0
+	l := float64(len(s))
+	for _, c := range counts {
+		p := float64(c) / l
+		e -= p * math.Log2(p)
+	}
+	return e
+}
+
+// redact masks the whole of a value, keeping only its length. Findings end up in CI logs and
+// reports, so even a prefix of a credential would be published.
+func redact(v string) string {
+	return fmt.Sprintf("**** (%d chars)", utf8.RuneCountInString(v))
+}
@@ -0,0 +1,294 @@
+// Package schema generates a JSON Schema (draft-07) for projection manifests of every version from
+// their Go types, so editors can validate manifests as they are written:
+//
+//	# yaml-language-server: $schema=https://raw.githubusercontent.com/tumblr/k8s-config-projector/master/docs/manifest.schema.json
+//
+// Properties come from the types' yaml tags; fields without omitempty are required. Descriptions,
+// enums and the rules spanning several fields (like extract and field_extractions being mutually
+// exclusive) are added here, as reflection cant see them. The schema describes manifests as they are
+// written; it cant know which sources exist, or what variables are defined.
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/tumblr/k8s-config-projector/pkg/targets"
+	ds "github.com/tumblr/k8s-config-projector/pkg/types/v1/datasource"
+	"github.com/tumblr/k8s-config-projector/pkg/types/v1/manifest"
+	v2 "github.com/tumblr/k8s-config-projector/pkg/types/v2/manifest"
+)
+
+const (
+	// Draft is the JSON Schema version generated
+	Draft = "http://json-schema.org/draft-07/schema#"
+	// ID identifies the generated schema
+	ID = "https://raw.githubusercontent.com/tumblr/k8s-config-projector/master/docs/manifest.schema.json"
+	// varName is the pattern of variable, matrix dimension and template param names
+	varName = `^[A-Za-z_][A-Za-z0-9_]*$`
+)
+
+// Schema is a JSON Schema, or a subschema of one
+type Schema struct {
+	Schema               string             `json:"$schema,omitempty"`
+	ID                   string             `json:"$id,omitempty"`
+	Ref                  string             `json:"$ref,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Const                string             `json:"const,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	MinItems             int                `json:"minItems,omitempty"`
+	UniqueItems          bool               `json:"uniqueItems,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	PropertyNames        *Schema            `json:"propertyNames,omitempty"`
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+	AnyOf                []*Schema          `json:"anyOf,omitempty"`
+	AllOf                []*Schema          `json:"allOf,omitempty"`
+	Not                  *Schema            `json:"not,omitempty"`
+	If                   *Schema            `json:"if,omitempty"`
+	Then                 *Schema            `json:"then,omitempty"`
+	Else                 *Schema            `json:"else,omitempty"`
+	Definitions          map[string]*Schema `json:"definitions,omitempty"`
+}
+
+var (
+	// descriptions describe each type, and each of their properties as Type.property
+	descriptions = map[string]string{
+		"ConfigProjectionManifest":            "A projection manifest (projector.tumblr.com/v1), projecting datasources into a ConfigMap or Secret",
+		"ConfigProjectionManifest.apiVersion": "Optional in v1 manifests",
+		"ConfigProjectionManifest.kind":       "Optional in v1 manifests",
+		"ConfigProjectionManifest.name":       "Name of the projected ConfigMap or Secret",
+		"ConfigProjectionManifest.namespace":  "Namespace of the projected ConfigMap or Secret",
+		"ConfigProjectionManifest.data":       "Datasources projected into the ConfigMap or Secret",
+		"ConfigProjectionManifest.resource":   "Kind of resource to project into",
+		"ConfigProjectionManifest.targets":    "Selects the targets (see --targets) the manifest is projected for, by target variable; all of them if empty",
+		"ConfigProjectionManifest.matrix":     "Expands the manifest into one manifest per combination of the values of each dimension, substituted for ${dimension}",
+		"ConfigProjectionManifest.include":    "Library templates (see --library) whose datasources follow the manifest's own",
+
+		"ConfigProjection":            "A projection manifest (projector.tumblr.com/v2), shaped like a Kubernetes object",
+		"ConfigProjection.apiVersion": "Schema version of the manifest",
+		"ConfigProjection.kind":       "Kind of the manifest",
+		"ConfigProjection.metadata":   "Metadata of the projected ConfigMap or Secret",
+		"ConfigProjection.spec":       "What is projected, and how",
+
+		"Metadata":             "Metadata of the projected ConfigMap or Secret",
+		"Metadata.name":        "Name of the projected ConfigMap or Secret",
+		"Metadata.namespace":   "Namespace of the projected ConfigMap or Secret",
+		"Metadata.labels":      "Labels added to the projected resource, besides the projector's own",
+		"Metadata.annotations": "Annotations added to the projected resource, besides the projector's own",
+
+		"Spec":          "What is projected, and how",
+		"Spec.resource": "Kind of resource to project into",
+		"Spec.targets":  "Selects the targets (see --targets) the manifest is projected for, by target variable; all of them if empty",
+		"Spec.matrix":   "Expands the manifest into one manifest per combination of the values of each dimension, substituted for ${dimension}",
+		"Spec.include":  "Library templates (see --library) whose datasources follow the manifest's own",
+		"Spec.data":     "Datasources projected into the ConfigMap or Secret",
+
+		"DataSource":                   "A source file, projected into one or more keys. Only one of extract and field_extractions may be used",
+		"DataSource.source":            "Path of the source relative to the config repo, or name:path for a named config root. Sources containing * are globs, projecting each matching file under its own name",
+		"DataSource.output_file":       "Key the source is projected into. Defaults to the source's file name when projecting a whole file; globs cant set it",
+		"DataSource.source_format":     "Format of the source; inferred from its extension and whether anything is extracted",
+		"DataSource.extract":           "JSONPath of a single value to project",
+		"DataSource.field_extractions": "Keys of the output document, mapped to the JSONPath of their values",
+		"DataSource.output_format":     "Format of the projected value; json and yaml require extract or field_extractions",
+
+		"Include":          "Includes the datasources of a library template",
+		"Include.template": "Name of the template: its path in the library directory, without .yaml",
+		"Include.params":   "Values of the template's params, substituted for ${param}",
+	}
+	// properties adjust the schema of a property, as Type.property
+	properties = map[string]func(s *Schema){
+		"ConfigProjectionManifest.apiVersion": constant(manifest.APIVersion),
+		"ConfigProjectionManifest.kind":       constant(manifest.Kind),
+		"ConfigProjectionManifest.resource":   enum(manifest.ResourceConfigMap, manifest.ResourceSecret),
+		"ConfigProjectionManifest.matrix":     matrix,
+		"ConfigProjection.apiVersion":         constant(v2.APIVersion),
+		"ConfigProjection.kind":               constant(v2.Kind),
+		"Spec.resource":                       enum(manifest.ResourceConfigMap, manifest.ResourceSecret),
+		"Spec.matrix":                         matrix,
+		"Include.params":                      names,
+	}
+	// optional are the properties without omitempty that may still be left out
+	optional = map[string]bool{
+		// manifests may only include templates
+		"ConfigProjectionManifest.data": true,
+		"Spec.data":                     true,
+	}
+	// types are the schemas of types that arent described by their kind alone
+	types = map[reflect.Type]func() *Schema{
+		reflect.TypeOf(ds.SourceFormat("")): func() *Schema {
+			return &Schema{Type: "string", Enum: []string{string(ds.FormatFile), string(ds.FormatGlob), string(ds.FormatJSON), string(ds.FormatYAML)}}
+		},
+		reflect.TypeOf(ds.OutputType("")): func() *Schema {
+			return &Schema{Type: "string", Enum: []string{string(ds.OutputRaw), string(ds.OutputJSON), string(ds.OutputYAML)}}
+		},
+		reflect.TypeOf(targets.Values{}): values,
+		reflect.TypeOf(targets.Selector{}): func() *Schema {
+			s := &Schema{Type: "object", AdditionalProperties: values()}
+			names(s)
+			return s
+		},
+	}
+	// rules are the constraints spanning several properties of a type
+	rules = map[string][]*Schema{
+		"DataSource": {
+			// only one of extract and field_extractions
+			{Not: &Schema{Required: []string{"extract", "field_extractions"}}},
+			// globs project each file under its own name
+			{
+				If:   &Schema{Properties: map[string]*Schema{"source": {Pattern: `\*`}}, Required: []string{"source"}},
+				Then: &Schema{Not: &Schema{Required: []string{"output_file"}}},
+			},
+			// raw output cant hold several fields
+			{
+				If:   &Schema{Properties: map[string]*Schema{"output_format": {Const: string(ds.OutputRaw)}}, Required: []string{"output_format"}},
+				Then: &Schema{Not: &Schema{Required: []string{"field_extractions"}}},
+			},
+			// structured output needs something to structure
+			{
+				If:   &Schema{Properties: map[string]*Schema{"output_format": {Enum: []string{string(ds.OutputJSON), string(ds.OutputYAML)}}}, Required: []string{"output_format"}},
+				Then: &Schema{AnyOf: []*Schema{{Required: []string{"extract"}}, {Required: []string{"field_extractions"}}}},
+			},
+		},
+	}
+)
+
+// constant returns a property adjustment making it always value
+func constant(value string) func(s *Schema) {
+	return func(s *Schema) {
+		s.Const = value
+	}
+}
+
+// enum returns a property adjustment making it one of values
+func enum(values ...string) func(s *Schema) {
+	return func(s *Schema) {
+		s.Enum = values
+	}
+}
+
+// values returns the schema of target values: a single value, or a list of them
+func values() *Schema {
+	return &Schema{OneOf: []*Schema{{Type: "string"}, {Type: "array", Items: &Schema{Type: "string"}, MinItems: 1}}}
+}
+
+// names requires the keys of an object to be variable names
+func names(s *Schema) {
+	s.PropertyNames = &Schema{Pattern: varName}
+}
+
+// matrix requires dimensions to be variable names, with at least one value, each different
+func matrix(s *Schema) {
+	names(s)
+	values := s.AdditionalProperties.(*Schema)
+	values.MinItems, values.UniqueItems = 1, true
+}
+
+// Generate returns the schema of projection manifests. Manifests with apiVersion
+// projector.tumblr.com/v2 are v2 manifests; every other manifest is a v1 manifest.
+func Generate() *Schema {
+	g := &generator{definitions: map[string]*Schema{}, types: map[string]reflect.Type{}}
+	v1Ref := g.schema(reflect.TypeOf(manifest.ConfigProjectionManifest{}))
+	v2Ref := g.schema(reflect.TypeOf(v2.ConfigProjection{}))
+	return &Schema{
+		Schema:      Draft,
+		ID:          ID,
+		Title:       "k8s-config-projector manifest",
+		Description: "A projection manifest, projecting files from a config repo into a ConfigMap or Secret",
+		If: &Schema{
+			Properties: map[string]*Schema{"apiVersion": {Const: v2.APIVersion}},
+			Required:   []string{"apiVersion"},
+		},
+		Then:        v2Ref,
+		Else:        v1Ref,
+		Definitions: g.definitions,
+	}
+}
+
+// Write writes the schema of projection manifests to w as indented JSON
+func Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(Generate())
+}
+
+// generator builds schemas for Go types, defining each struct once
+type generator struct {
+	definitions map[string]*Schema
+	// types are the type of each definition, to catch two types with the same name
+	types map[string]reflect.Type
+}
+
+// schema returns the schema for values of t; a reference to its definition for structs
+func (g *generator) schema(t reflect.Type) *Schema {
+	if f, ok := types[t]; ok {
+		return f()
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.Struct:
+		return g.define(t)
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: g.schema(t.Elem())}
+	case reflect.Slice:
+		return &Schema{Type: "array", Items: g.schema(t.Elem())}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return &Schema{Type: "integer"}
+	}
+	panic(fmt.Sprintf("schema: unsupported type %s", t))
+}
+
+// define adds the definition of the struct t, if it isnt defined yet, and returns a reference to it
+func (g *generator) define(t reflect.Type) *Schema {
+	name := t.Name()
+	ref := &Schema{Ref: "#/definitions/" + name}
+	if existing, ok := g.types[name]; ok {
+		if existing != t {
+			panic(fmt.Sprintf("schema: %s and %s are both named %s", existing, t, name))
+		}
+		return ref
+	}
+	g.types[name] = t
+	s := &Schema{
+		Type:                 "object",
+		Description:          descriptions[name],
+		Properties:           map[string]*Schema{},
+		AdditionalProperties: false,
+		AllOf:                rules[name],
+	}
+	g.definitions[name] = s
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("yaml"), ",")
+		if f.PkgPath != "" || tag[0] == "-" || tag[0] == "" {
+			continue
+		}
+		p := g.schema(f.Type)
+		if p.Ref != "" {
+			// descriptions alongside $ref are ignored, so wrap it
+			p = &Schema{AllOf: []*Schema{p}}
+		}
+		p.Description = descriptions[name+"."+tag[0]]
+		if adjust, ok := properties[name+"."+tag[0]]; ok {
+			adjust(p)
+		}
+		s.Properties[tag[0]] = p
+		if (len(tag) == 1 || tag[1] != "omitempty") && !optional[name+"."+tag[0]] {
+			s.Required = append(s.Required, tag[0])
+		}
+	}
+	return ref
+}
@@ -0,0 +1,78 @@
+package schema
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	_ "github.com/tumblr/k8s-config-projector/internal/pkg/testing"
+)
+
+func TestGenerate(t *testing.T) {
+	s := Generate()
+	for _, name := range []string{"ConfigProjectionManifest", "ConfigProjection", "Metadata", "Spec", "DataSource", "Include"} {
+		d, ok := s.Definitions[name]
+		if !ok {
+			t.Fatalf("Expected a definition of %s, but got %v", name, s.Definitions)
+		}
+		if d.Description == "" {
+			t.Fatalf("Expected %s to be described", name)
+		}
+		for p, ps := range d.Properties {
+			if ps.Description == "" {
+				t.Fatalf("Expected %s.%s to be described", name, p)
+			}
+		}
+	}
+	for key := range descriptions {
+		if !described(s, key) {
+			t.Fatalf("Expected %s to describe a definition or property", key)
+		}
+	}
+	m := s.Definitions["ConfigProjectionManifest"]
+	if _, ok := m.Properties["labels"]; ok {
+		t.Fatal("Expected fields v1 manifests dont accept to be left out")
+	}
+	if len(m.Required) != 2 || m.Required[0] != "name" || m.Required[1] != "namespace" {
+		t.Fatalf("Expected only name and namespace to be required, but got %v", m.Required)
+	}
+	if m.Properties["apiVersion"].Const != "projector.tumblr.com/v1" || len(m.Properties["resource"].Enum) != 2 {
+		t.Fatalf("Expected apiVersion to be constant and resource an enum, but got %+v %+v", m.Properties["apiVersion"], m.Properties["resource"])
+	}
+	d := s.Definitions["DataSource"]
+	if len(d.AllOf) == 0 || d.AllOf[0].Not == nil {
+		t.Fatal("Expected extract and field_extractions to be mutually exclusive")
+	}
+	if len(d.Properties["source_format"].Enum) != 4 || len(d.Properties["output_format"].Enum) != 3 {
+		t.Fatalf("Expected formats to be enums, but got %+v %+v", d.Properties["source_format"], d.Properties["output_format"])
+	}
+}
+
+// described returns whether key, a definition or Definition.property, is in s
+func described(s *Schema, key string) bool {
+	for name, d := range s.Definitions {
+		if key == name {
+			return true
+		}
+		for p := range d.Properties {
+			if key == name+"."+p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestGenerated(t *testing.T) {
+	var b bytes.Buffer
+	if err := Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	committed, err := ioutil.ReadFile("docs/manifest.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.Bytes(), committed) {
+		t.Fatal("Expected docs/manifest.schema.json to be up to date; regenerate it with `k8s-config-projector schema > docs/manifest.schema.json`")
+	}
+}
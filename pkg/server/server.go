@@ -0,0 +1,356 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/tumblr/k8s-config-projector/pkg/projector"
+	"github.com/tumblr/k8s-config-projector/pkg/report"
+	"github.com/tumblr/k8s-config-projector/pkg/scan"
+	"github.com/tumblr/k8s-config-projector/pkg/types"
+	"github.com/tumblr/k8s-config-projector/pkg/types/v1/manifest"
+)
+
+const (
+	// FormatYAML renders projected ConfigMaps as yaml. This is the default
+	FormatYAML = "yaml"
+	// FormatJSON renders projected ConfigMaps as json
+	FormatJSON = "json"
+
+	// maxManifestBytes is the largest manifest that may be POSTed for preview
+	maxManifestBytes = 1 << 20
+)
+
+// Manifest is a manifest file found under --manifests
+type Manifest struct {
+	// Path is the manifest file, relative to --manifests
+	Path      string `json:"path"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Resource  string `json:"resource,omitempty"`
+	// Matrix is the combination of matrix values this manifest was expanded with, if any
+	Matrix map[string]string `json:"matrix,omitempty"`
+	// Problems are why the manifest couldnt be loaded, if it couldnt
+	Problems []report.Problem `json:"problems,omitempty"`
+}
+
+// Server serves the ConfigMaps projected from the manifests in --manifests, the lineage of their
+// keys, and previews of POSTed manifests, all against the local --config-repo. Manifests are
+// reloaded on every request, so edits show up without a restart. They are loaded and projected
+// with a projector.Projector, so the source allowlist, policy and size limit apply just like they
+// do to `project`, and secret scan findings are problems when scanning fails on them. Secret
+// projections are never served; their manifests are listed, but previewing them is refused.
+//
+// Previews are only accepted from the server's own pages, or from clients that arent browsers:
+// POSTs from other origins are refused, so other sites cant have a browser project from the
+// config repo. Requests for any Host but the listen address (or a loopback name with its port) are
+// refused too, so a site whose name is rebound to this server's address doesnt count as its origin.
+//
+//	GET  /                                      HTML UI
+//	GET  /manifests/{namespace}/{name}          HTML view of a projected ConfigMap and its lineage
+//	GET  /api/manifests                         every manifest file, with any problems loading it
+//	GET  /api/manifests/{namespace}/{name}      the projected ConfigMap (?format=yaml|json)
+//	GET  /api/manifests/{namespace}/{name}/lineage
+//	POST /api/preview                           project the manifest in the body (?format=yaml|json)
+//	POST /api/preview/lineage
+//
+// Problems are returned as a JSON report.Report, with status 422.
+type Server struct {
+	p *projector.Projector
+	// scanMode is the --secret-scan mode; findings are only problems when it is scan.ModeFail
+	scanMode string
+	// hosts are the Host headers requests are accepted with
+	hosts map[string]bool
+	mux   *http.ServeMux
+}
+
+// New returns a Server for the manifests in p's ManifestDir, projected by p. scanMode is the
+// --secret-scan mode findings are handled with, and addr is the address it listens on.
+func New(p *projector.Projector, scanMode string, addr string) *Server {
+	s := &Server{p: p, scanMode: scanMode, hosts: allowedHosts(addr), mux: http.NewServeMux()}
+	s.mux.HandleFunc("/", s.index)
+	s.mux.HandleFunc("/manifests/", s.manifestPage)
+	s.mux.HandleFunc("/api/manifests", s.listManifests)
+	s.mux.HandleFunc("/api/manifests/", s.getManifest)
+	s.mux.HandleFunc("/api/preview", s.preview)
+	s.mux.HandleFunc("/api/preview/lineage", s.preview)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.hosts[strings.ToLower(r.Host)] {
+		http.Error(w, fmt.Sprintf("unexpected Host %q", r.Host), http.StatusForbidden)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// allowedHosts returns the Host headers of requests to addr: addr itself, and the loopback names
+// with its port. The port may be left out of them when it is 80.
+func allowedHosts(addr string) map[string]bool {
+	hosts := map[string]bool{}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "80"
+	}
+	names := []string{"localhost", "127.0.0.1", "::1"}
+	if host != "" {
+		names = append(names, host)
+	}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		hosts[net.JoinHostPort(name, port)] = true
+		if port == "80" {
+			if strings.Contains(name, ":") {
+				name = "[" + name + "]"
+			}
+			hosts[name] = true
+		}
+	}
+	return hosts
+}
+
+// load parses and validates every manifest under --manifests, returning the list of them, and the
+// valid ones keyed by "namespace/name"
+func (s *Server) load() ([]Manifest, projector.Manifests, error) {
+	list := []Manifest{}
+	root := s.p.Options().ManifestDir
+	rep := report.New()
+	valid, err := s.p.LoadDir(root, rep)
+	if err != nil {
+		return list, valid, err
+	}
+	rel := func(path string) string {
+		if r, err := filepath.Rel(root, path); err == nil {
+			return filepath.ToSlash(r)
+		}
+		return filepath.ToSlash(path)
+	}
+	// manifests with problems are listed once per manifest (or file, if it couldnt be parsed)
+	problems := map[string]int{}
+	for _, p := range rep.Problems {
+		key := p.File + "\x00" + p.Manifest
+		i, ok := problems[key]
+		if !ok {
+			entry := Manifest{Path: rel(p.File)}
+			if parts := strings.SplitN(p.Manifest, "/", 2); len(parts) == 2 {
+				entry.Namespace, entry.Name = parts[0], parts[1]
+			}
+			i = len(list)
+			problems[key] = i
+			list = append(list, entry)
+		}
+		list[i].Problems = append(list[i].Problems, p)
+	}
+	// a manifest with a matrix is listed once per combination
+	for _, key := range valid.Keys() {
+		m := valid[key]
+		list = append(list, Manifest{Path: rel(m.GetPath()), Namespace: m.Namespace, Name: m.Name, Resource: m.Resource, Matrix: m.Combination()})
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	return list, valid, nil
+}
+
+// lookup returns the manifest for the namespace/name at the start of rest, and whatever follows it
+func (s *Server) lookup(rest string) (manifest.ConfigProjectionManifest, string, error) {
+	parts := strings.SplitN(strings.Trim(rest, "/"), "/", 3)
+	if len(parts) < 2 {
+		return manifest.ConfigProjectionManifest{}, "", errNotFound
+	}
+	_, valid, err := s.load()
+	if err != nil {
+		return manifest.ConfigProjectionManifest{}, "", err
+	}
+	m, ok := valid[parts[0]+"/"+parts[1]]
+	if !ok {
+		return m, "", errNotFound
+	}
+	if len(parts) == 3 {
+		return m, parts[2], nil
+	}
+	return m, "", nil
+}
+
+func (s *Server) listManifests(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	list, _, err := s.load()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) getManifest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	m, rest, err := s.lookup(strings.TrimPrefix(r.URL.Path, "/api/manifests/"))
+	if err == errNotFound || (rest != "" && rest != "lineage") {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.project(w, r, m, rest == "lineage")
+}
+
+func (s *Server) preview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(r) {
+		http.Error(w, "cross-origin previews are not allowed", http.StatusForbidden)
+		return
+	}
+	raw, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxManifestBytes))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	m, err := s.p.LoadBytes("", raw)
+	if err != nil {
+		writeProblems(w, "", err)
+		return
+	}
+	s.project(w, r, m, strings.HasSuffix(r.URL.Path, "/lineage"))
+}
+
+// sameOrigin returns false for requests a browser made from another origin. Requests without
+// Sec-Fetch-Site or Origin headers arent from browsers (or are from browsers too old to send
+// them), so they are allowed.
+func sameOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "", "same-origin", "none":
+	default:
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// projectResult projects m, returning the problems with it when it cant be served: errors
+// projecting it, and secret scan findings when scanning fails on them
+func (s *Server) projectResult(m manifest.ConfigProjectionManifest) (*projector.Result, error) {
+	if m.IsSecret() {
+		return nil, types.NewFieldError("resource", fmt.Errorf("%w: Secret projections are not previewed", types.ErrUnsupportedResource))
+	}
+	result, err := s.p.Project(m)
+	if err != nil {
+		return nil, err
+	}
+	if s.scanMode == scan.ModeFail && len(result.Findings) > 0 {
+		return result, result.Findings[0]
+	}
+	for _, f := range result.Findings {
+		log.Printf("WARNING: %s/%s: %s", m.GetNamespace(), m.GetName(), f.Error())
+	}
+	return result, nil
+}
+
+// project writes the ConfigMap projected from m in the requested format, or the lineage of its keys
+func (s *Server) project(w http.ResponseWriter, r *http.Request, m manifest.ConfigProjectionManifest, lineage bool) {
+	format := r.URL.Query().Get("format")
+	if !lineage && format != FormatJSON && format != FormatYAML && format != "" {
+		http.Error(w, "format must be one of yaml or json", http.StatusBadRequest)
+		return
+	}
+	result, err := s.projectResult(m)
+	if err != nil {
+		writeProblems(w, m.GetPath(), err)
+		return
+	}
+	switch {
+	case lineage:
+		writeJSON(w, http.StatusOK, result.Lineage)
+	case format == FormatJSON:
+		writeJSON(w, http.StatusOK, result.ConfigMap)
+	default:
+		w.Header().Set("Content-Type", "application/yaml")
+		fmt.Fprint(w, result.YAML)
+	}
+}
+
+func (s *Server) index(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	list, _, err := s.load()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := indexTemplate.Execute(w, list); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) manifestPage(w http.ResponseWriter, r *http.Request) {
+	m, rest, err := s.lookup(strings.TrimPrefix(r.URL.Path, "/manifests/"))
+	if err == errNotFound || rest != "" {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page := struct {
+		Manifest manifest.ConfigProjectionManifest
+		Path     string
+		YAML     string
+		Lineage  []manifest.Lineage
+		Error    string
+	}{Manifest: m, Path: m.GetPath()}
+	if m.IsSecret() {
+		page.Error = "Secret projections are not previewed"
+	} else if result, err := s.projectResult(m); err != nil {
+		page.Error = err.Error()
+	} else {
+		page.YAML, page.Lineage = result.YAML, result.Lineage
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := manifestTemplate.Execute(w, page); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+var errNotFound = errors.New("not found")
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// writeProblems writes err as a report, with status 422
+func writeProblems(w http.ResponseWriter, file string, err error) {
+	rep := report.New()
+	rep.Manifests = 1
+	rep.Add(file, "", err)
+	writeJSON(w, http.StatusUnprocessableEntity, rep)
+}
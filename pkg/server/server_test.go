@@ -0,0 +1,232 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	_ "github.com/tumblr/k8s-config-projector/internal/pkg/testing"
+	"github.com/tumblr/k8s-config-projector/pkg/policy"
+	"github.com/tumblr/k8s-config-projector/pkg/projector"
+	"github.com/tumblr/k8s-config-projector/pkg/report"
+	"github.com/tumblr/k8s-config-projector/pkg/scan"
+	"github.com/tumblr/k8s-config-projector/pkg/types/v1/manifest"
+	v1 "k8s.io/api/core/v1"
+)
+
+func newServer(t *testing.T, opts projector.Options, scanMode string) *Server {
+	opts.ConfigRoot, opts.ManifestDir, opts.Generation = "test/sources", "test/manifests", "unittest123"
+	p, err := projector.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// httptest requests are to example.com
+	return New(p, scanMode, "example.com:80")
+}
+
+func do(t *testing.T, method string, url string, body string) *httptest.ResponseRecorder {
+	return doWith(t, newServer(t, projector.Options{}, scan.ModeOff), httptest.NewRequest(method, url, strings.NewReader(body)))
+}
+
+func doWith(t *testing.T, s *Server, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestListManifests(t *testing.T) {
+	rec := do(t, http.MethodGet, "/api/manifests", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, but got %d: %s", rec.Code, rec.Body.String())
+	}
+	var list []Manifest
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]Manifest{}
+	for _, m := range list {
+		found[m.Path] = m
+	}
+	if m := found["raw1.yaml"]; m.Namespace != "test" || m.Name != "raw1" || len(m.Problems) > 0 {
+		t.Fatalf("Expected raw1.yaml to be listed without problems, but got %+v", m)
+	}
+	if m := found["parseerrors/1.yaml"]; len(m.Problems) == 0 {
+		t.Fatalf("Expected parseerrors/1.yaml to be listed with its problems, but got %+v", m)
+	}
+}
+
+func TestGetProjectedConfigMap(t *testing.T) {
+	rec := do(t, http.MethodGet, "/api/manifests/test/raw1", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "kind: ConfigMap") {
+		t.Fatalf("Expected a yaml ConfigMap, but got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = do(t, http.MethodGet, "/api/manifests/test/raw1?format=json", "")
+	var cm v1.ConfigMap
+	if err := json.Unmarshal(rec.Body.Bytes(), &cm); err != nil {
+		t.Fatal(err)
+	}
+	if cm.Name != "raw1" || len(cm.Data) != 3 {
+		t.Fatalf("Expected raw1 with 3 keys, but got %+v", cm)
+	}
+	if rec := do(t, http.MethodGet, "/api/manifests/test/nope", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for an unknown manifest, but got %d", rec.Code)
+	}
+}
+
+func TestGetLineage(t *testing.T) {
+	rec := do(t, http.MethodGet, "/api/manifests/test/globs1/lineage", "")
+	var lineage []manifest.Lineage
+	if err := json.Unmarshal(rec.Body.Bytes(), &lineage); err != nil {
+		t.Fatalf("%s: %s", err, rec.Body.String())
+	}
+	if len(lineage) != 2 || lineage[0].Key != "a.php" || lineage[0].Source != "a.php" || lineage[0].SourceFormat != "glob" {
+		t.Fatalf("Expected lineage for a.php and z.php, but got %+v", lineage)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	body := `
+name: preview
+namespace: test
+data:
+- source: test.json
+  output_file: hostport
+  extract: $.hostport
+`
+	rec := do(t, http.MethodPost, "/api/preview?format=json", body)
+	var cm v1.ConfigMap
+	if err := json.Unmarshal(rec.Body.Bytes(), &cm); err != nil {
+		t.Fatal(err)
+	}
+	if cm.Data["hostport"] != "test-6f327ab0.dc2.tumblr.net:3295" {
+		t.Fatalf("Expected hostport to be previewed, but got %s", rec.Body.String())
+	}
+	rec = do(t, http.MethodPost, "/api/preview/lineage", body)
+	var lineage []manifest.Lineage
+	if err := json.Unmarshal(rec.Body.Bytes(), &lineage); err != nil {
+		t.Fatal(err)
+	}
+	if len(lineage) != 1 || lineage[0].Extract != "$.hostport" || lineage[0].Source != "test.json" {
+		t.Fatalf("Expected lineage of hostport, but got %+v", lineage)
+	}
+
+	// problems are reported with their location
+	rec = do(t, http.MethodPost, "/api/preview", strings.Replace(body, "  output_file: hostport\n", "", 1))
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected 422, but got %d", rec.Code)
+	}
+	var rep report.Report
+	if err := json.Unmarshal(rec.Body.Bytes(), &rep); err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Problems) != 1 || rep.Problems[0].Field != "output_file" || rep.Problems[0].DataSource == nil || *rep.Problems[0].DataSource != 0 {
+		t.Fatalf("Expected a problem with data[0].output_file, but got %+v", rep.Problems)
+	}
+
+	if rec := do(t, http.MethodGet, "/api/preview", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected 405, but got %d", rec.Code)
+	}
+}
+
+func TestSecretsArentPreviewed(t *testing.T) {
+	rec := do(t, http.MethodGet, "/api/manifests/test/sops1", "")
+	if rec.Code != http.StatusUnprocessableEntity || strings.Contains(rec.Body.String(), "hunter2") {
+		t.Fatalf("Expected Secret projections to be refused, but got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestUI(t *testing.T) {
+	rec := do(t, http.MethodGet, "/", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `<a href="/manifests/test/raw1">test/raw1</a>`) {
+		t.Fatalf("Expected the index to link raw1, but got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = do(t, http.MethodGet, "/manifests/test/raw1", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "<td>test.json</td>") {
+		t.Fatalf("Expected the manifest page to show lineage, but got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestPreviewsAreProjectedLikeProject(t *testing.T) {
+	body := "name: preview\nnamespace: test\ndata:\n- source: test.json\n  output_file: hostport\n  extract: $.hostport\n"
+	for name, tc := range map[string]struct {
+		opts     projector.Options
+		scanMode string
+		body     string
+		problem  string
+	}{
+		"size limit": {projector.Options{SizeLimit: 10}, scan.ModeOff, body, "exceeding size limit of 10 bytes"},
+		"policy": {
+			projector.Options{Policy: &policy.Policy{Rules: []policy.Rule{{DenySources: []string{"test.json"}}}}}, scan.ModeOff, body,
+			policy.ErrPolicyViolation.Error(),
+		},
+		"secret scan": {
+			projector.Options{SecretScanner: scan.New()}, scan.ModeFail,
+			"name: preview\nnamespace: test\ndata:\n- source: test.json\n  output_file: password\n  extract: $.astring\n", "password",
+		},
+	} {
+		s := newServer(t, tc.opts, tc.scanMode)
+		rec := doWith(t, s, httptest.NewRequest(http.MethodPost, "/api/preview", strings.NewReader(tc.body)))
+		if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), tc.problem) {
+			t.Fatalf("Expected the %s to refuse the preview with %q, but got %d: %s", name, tc.problem, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestAllowedHosts(t *testing.T) {
+	hosts := allowedHosts("127.0.0.1:8080")
+	for _, host := range []string{"127.0.0.1:8080", "localhost:8080", "LOCALHOST:8080", "[::1]:8080"} {
+		if !hosts[strings.ToLower(host)] {
+			t.Fatalf("Expected Host %s to be allowed, but got %v", host, hosts)
+		}
+	}
+	for _, host := range []string{"127.0.0.1", "localhost:8081", "evil.example:8080", "evil.example"} {
+		if hosts[host] {
+			t.Fatalf("Expected Host %s to be refused, but got %v", host, hosts)
+		}
+	}
+	if hosts := allowedHosts(":80"); !hosts["localhost"] || !hosts["[::1]"] || !hosts["127.0.0.1:80"] {
+		t.Fatalf("Expected loopback names without the default port to be allowed, but got %v", hosts)
+	}
+}
+
+func TestForgedHostsAreRefused(t *testing.T) {
+	body := "name: preview\nnamespace: test\ndata:\n- source: test.json\n  output_file: hostport\n  extract: $.hostport\n"
+	s := newServer(t, projector.Options{}, scan.ModeOff)
+	// a page on evil.example, rebound to this server's address, is same-origin with itself
+	req := httptest.NewRequest(http.MethodPost, "http://evil.example/api/preview", strings.NewReader(body))
+	req.Header.Set("Origin", "http://evil.example")
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	if rec := doWith(t, s, req); rec.Code != http.StatusForbidden || strings.Contains(rec.Body.String(), "hostport") {
+		t.Fatalf("Expected a preview with a forged Host to be refused, but got %d: %s", rec.Code, rec.Body.String())
+	}
+	req = httptest.NewRequest(http.MethodGet, "http://evil.example/api/manifests", nil)
+	if rec := doWith(t, s, req); rec.Code != http.StatusForbidden {
+		t.Fatalf("Expected any request with a forged Host to be refused, but got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCrossOriginPreviewsAreRefused(t *testing.T) {
+	body := "name: preview\nnamespace: test\ndata:\n- source: test.json\n  output_file: hostport\n  extract: $.hostport\n"
+	s := newServer(t, projector.Options{}, scan.ModeOff)
+	for _, tc := range []struct {
+		headers  map[string]string
+		expected int
+	}{
+		{map[string]string{}, http.StatusOK},
+		{map[string]string{"Origin": "http://example.com", "Sec-Fetch-Site": "same-origin"}, http.StatusOK},
+		{map[string]string{"Origin": "http://evil.example"}, http.StatusForbidden},
+		{map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusForbidden},
+		{map[string]string{"Origin": "null"}, http.StatusForbidden},
+	} {
+		// httptest requests are to example.com
+		req := httptest.NewRequest(http.MethodPost, "/api/preview", strings.NewReader(body))
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		if rec := doWith(t, s, req); rec.Code != tc.expected {
+			t.Fatalf("Expected %d for a preview with %v, but got %d: %s", tc.expected, tc.headers, rec.Code, rec.Body.String())
+		}
+	}
+}
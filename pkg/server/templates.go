@@ -0,0 +1,71 @@
+package server
+
+import "html/template"
+
+const style = `<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; vertical-align: top; }
+pre { background: #f6f6f6; padding: 1em; overflow: auto; }
+.problem { color: #b00; }
+textarea { width: 100%; font-family: monospace; }
+</style>`
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><title>k8s-config-projector</title>` + style + `</head>
+<body>
+<h1>Manifests</h1>
+<table>
+<tr><th>manifest</th><th>resource</th><th>file</th></tr>
+{{range .}}<tr>
+<td>{{if .Problems}}{{.Namespace}}/{{.Name}}{{else}}<a href="/manifests/{{.Namespace}}/{{.Name}}">{{.Namespace}}/{{.Name}}</a>{{end}}</td>
+<td>{{.Resource}}</td>
+<td>{{.Path}}{{range .Problems}}<div class="problem">{{.Location}}: {{.Message}}</div>{{end}}</td>
+</tr>{{end}}
+</table>
+<h1>Preview</h1>
+<p>Paste a manifest to project it against the local config repo.</p>
+<textarea id="manifest" rows="16">name: preview
+namespace: default
+data:
+- source: ""
+</textarea>
+<p><button onclick="preview()">Project</button></p>
+<pre id="result"></pre>
+<script>
+function preview() {
+  fetch("/api/preview", {method: "POST", body: document.getElementById("manifest").value})
+    .then(function (r) { return r.text(); })
+    .then(function (t) { document.getElementById("result").textContent = t; });
+}
+</script>
+</body>
+</html>
+`))
+
+var manifestTemplate = template.Must(template.New("manifest").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Manifest.Namespace}}/{{.Manifest.Name}}</title>` + style + `</head>
+<body>
+<p><a href="/">manifests</a></p>
+<h1>{{.Manifest.Namespace}}/{{.Manifest.Name}}</h1>
+<p>{{.Path}} &middot; <a href="/api/manifests/{{.Manifest.Namespace}}/{{.Manifest.Name}}">yaml</a> &middot; <a href="/api/manifests/{{.Manifest.Namespace}}/{{.Manifest.Name}}?format=json">json</a></p>
+{{if .Error}}<pre class="problem">{{.Error}}</pre>{{else}}
+<h2>Lineage</h2>
+<table>
+<tr><th>key</th><th>datasource</th><th>source</th><th>format</th><th>extraction</th></tr>
+{{range .Lineage}}<tr>
+<td>{{.Key}}</td>
+<td>data[{{.DataSource}}]</td>
+<td>{{.Source}}</td>
+<td>{{.SourceFormat}}{{if .OutputFormat}} &rarr; {{.OutputFormat}}{{end}}</td>
+<td>{{if .Extract}}{{.Extract}}{{end}}{{range $k, $v := .FieldExtractions}}<div>{{$k}}: {{$v}}</div>{{end}}</td>
+</tr>{{end}}
+</table>
+<h2>ConfigMap</h2>
+<pre>{{.YAML}}</pre>
+{{end}}
+</body>
+</html>
+`))
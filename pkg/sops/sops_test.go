@@ -0,0 +1,118 @@
+package sops
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ghodss/yaml"
+	_ "github.com/tumblr/k8s-config-projector/internal/pkg/testing"
+)
+
+func loadDoc(t *testing.T, file string) (interface{}, []byte) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parseDoc(t, raw), raw
+}
+
+func parseDoc(t *testing.T, raw []byte) interface{} {
+	var doc interface{}
+	if err := yaml.Unmarshal(raw, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestDecrypt(t *testing.T) {
+	for _, keyFile := range []string{"test/sops/age.key", "test/sops/pgp.asc"} {
+		keys, err := LoadKeys(keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, source := range []string{"test/sources/sops/secrets.yaml", "test/sources/sops/secrets.json"} {
+			doc, raw := loadDoc(t, source)
+			if !IsEncrypted(doc) {
+				t.Fatalf("Expected %s to be detected as SOPS encrypted", source)
+			}
+			plain, err := keys.Decrypt(doc, raw)
+			if err != nil {
+				t.Fatalf("Unable to decrypt %s with %s: %s", source, keyFile, err)
+			}
+			actual, _ := json.Marshal(plain)
+			expected := `{"database":{"password":"hunter2","port":5432,"tls":true,"user":"projector"},"hosts":["db-1.domain.tld","db-2.domain.tld"],"region_unencrypted":"us-east-1"}`
+			if string(actual) != expected {
+				t.Fatalf("Expected %s decrypted with %s to be %s, but got %s", source, keyFile, expected, actual)
+			}
+		}
+	}
+}
+
+func TestDecryptWithWrongKey(t *testing.T) {
+	f, err := ioutil.TempFile("", "age.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	// a valid identity that isnt a recipient of the fixtures
+	f.WriteString("AGE-SECRET-KEY-1GFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPQ4EGAEX\n")
+	f.Close()
+	keys, err := LoadKeys(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.Decrypt(loadDoc(t, "test/sources/sops/secrets.yaml")); !errors.Is(err, ErrNoMatchingKey) {
+		t.Fatalf("Expected %s, but got %v", ErrNoMatchingKey, err)
+	}
+}
+
+func TestDecryptTamperedDocument(t *testing.T) {
+	keys, err := LoadKeys("test/sops/age.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, raw := loadDoc(t, "test/sources/sops/secrets.yaml")
+	// each change is authenticated by the MAC alone: values are still decryptable
+	for name, tamper := range map[string]func(string) string{
+		"changed plaintext value": func(s string) string {
+			return strings.Replace(s, "region_unencrypted: us-east-1", "region_unencrypted: eu-west-1", 1)
+		},
+		"swapped list items": func(s string) string {
+			lines := strings.Split(s, "\n")
+			for i, l := range lines {
+				if strings.HasPrefix(l, "hosts:") {
+					lines[i+1], lines[i+2] = lines[i+2], lines[i+1]
+					break
+				}
+			}
+			return strings.Join(lines, "\n")
+		},
+		"removed value": func(s string) string {
+			lines := strings.Split(s, "\n")
+			for i, l := range lines {
+				if strings.HasPrefix(strings.TrimSpace(l), "tls:") {
+					return strings.Join(append(lines[:i:i], lines[i+1:]...), "\n")
+				}
+			}
+			return s
+		},
+	} {
+		tampered := []byte(tamper(string(raw)))
+		if string(tampered) == string(raw) {
+			t.Fatalf("Expected %s to change the document", name)
+		}
+		if _, err := keys.Decrypt(parseDoc(t, tampered), tampered); !errors.Is(err, ErrMACMismatch) {
+			t.Fatalf("Expected %s for a document with a %s, but got %v", ErrMACMismatch, name, err)
+		}
+	}
+}
+
+func TestPlainDocumentsArentEncrypted(t *testing.T) {
+	if doc, _ := loadDoc(t, "test/sources/test.yaml"); IsEncrypted(doc) {
+		t.Fatal("Expected test.yaml to not be detected as SOPS encrypted")
+	}
+}
@@ -0,0 +1,258 @@
+// Package summary records the ConfigMaps and Secrets a projection run wrote: their size against the
+// size limit, their keys, the sources they were read from, and a hash of their data. Summaries are
+// written as JSON, which the next run compares itself to, and as Markdown for pull request comments.
+package summary
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tumblr/k8s-config-projector/pkg/projector"
+	"github.com/tumblr/k8s-config-projector/pkg/types/v1/manifest"
+)
+
+const (
+	// StatusAdded resources werent in the previous summary
+	StatusAdded = "added"
+	// StatusChanged resources have different data than in the previous summary
+	StatusChanged = "changed"
+	// StatusUnchanged resources have the same data as in the previous summary
+	StatusUnchanged = "unchanged"
+	// StatusUnknown resources are Secrets that werent hashed, in this summary or the previous one,
+	// so arent known to have changed or not
+	StatusUnknown = "unknown"
+)
+
+// Resource is a ConfigMap (or Secret) written by a run
+type Resource struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Kind is ConfigMap or Secret
+	Kind string `json:"kind"`
+	// Target is the target it was projected for, if any
+	Target string `json:"target,omitempty"`
+	// File is where it was written
+	File string `json:"file"`
+	// Bytes is its size as yaml, which must not exceed the summary's Limit
+	Bytes int `json:"bytes"`
+	Keys  int `json:"keys"`
+	// Sources are the source files its data was read from. For Secrets, whose lineage isnt
+	// recorded, they are the sources of its manifest's datasources, as written
+	Sources []string `json:"sources"`
+	// Hash is the sha256 of its data. Unlike its yaml, it doesnt change with the generation. A
+	// plain hash of decrypted data could be used to check guesses at it, so Secrets are hashed
+	// with an HMAC keyed with the summary's key, or not at all when there is no key
+	Hash string `json:"hash,omitempty"`
+	// Status is StatusAdded, StatusChanged, StatusUnchanged or StatusUnknown, when compared to a
+	// previous summary
+	Status string `json:"status,omitempty"`
+}
+
+// Key returns namespace/name, and @target when it was projected for one
+func (r Resource) Key() string {
+	key := fmt.Sprintf("%s/%s", r.Namespace, r.Name)
+	if r.Target != "" {
+		key += "@" + r.Target
+	}
+	return key
+}
+
+// Summary is the resources written by a projection run
+type Summary struct {
+	Generation string    `json:"generation"`
+	Started    time.Time `json:"started"`
+	Seconds    float64   `json:"seconds"`
+	// Limit is the size limit of resources in bytes, or 0 if there is none
+	Limit     int        `json:"limit"`
+	Resources []Resource `json:"resources"`
+	// Previous is the generation of the summary this one was compared to, if any, and Removed are
+	// the resources in it that werent written this time
+	Previous string   `json:"previous,omitempty"`
+	Removed  []string `json:"removed,omitempty"`
+	// key is the HMAC key Secrets are hashed with, if any
+	key []byte
+}
+
+// New returns an empty Summary, for a run of the generation starting now. limit is the size limit
+// of resources, or projector.NoSizeLimit. key is the HMAC key Secrets are hashed with; when it is
+// empty, Secrets arent hashed.
+func New(generation string, limit int, key []byte) *Summary {
+	if limit == projector.NoSizeLimit {
+		limit = 0
+	}
+	return &Summary{Generation: generation, Started: time.Now(), Limit: limit, Resources: []Resource{}, key: key}
+}
+
+// Load reads a summary written as JSON by a previous run
+func Load(file string) (*Summary, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var s Summary
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, fmt.Errorf("unable to parse summary %s: %s", file, err.Error())
+	}
+	return &s, nil
+}
+
+// Add records that r, projected from m, was written to file
+func (s *Summary) Add(m manifest.ConfigProjectionManifest, r *projector.Result, file string) {
+	res := Resource{Namespace: r.Namespace, Name: r.Name, Kind: r.Resource, Target: r.Target, File: file, Bytes: len(r.YAML)}
+	sources := map[string]bool{}
+	data := map[string][]byte{}
+	if r.Secret != nil {
+		for _, d := range m.Data {
+			sources[d.Source] = true
+		}
+		data = r.Secret.Data
+	} else {
+		for _, l := range r.Lineage {
+			sources[l.Source] = true
+		}
+		for k, v := range r.ConfigMap.Data {
+			data[k] = []byte(v)
+		}
+	}
+	res.Keys = len(data)
+	for source := range sources {
+		res.Sources = append(res.Sources, source)
+	}
+	sort.Strings(res.Sources)
+	switch {
+	case r.Secret == nil:
+		res.Hash = "sha256:" + hashData(sha256.New(), data)
+	case len(s.key) > 0:
+		res.Hash = "hmac-sha256:" + hashData(hmac.New(sha256.New, s.key), data)
+	}
+	s.Resources = append(s.Resources, res)
+}
+
+// hashData returns the hex encoded sum of data written to h, each key and value in key order
+func hashData(h hash.Hash, data map[string][]byte) string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		// keys cant contain NUL, and values are prefixed with their length, so neither run together
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+		h.Write([]byte(fmt.Sprintf("%d:", len(data[k]))))
+		h.Write(data[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Compare sets the Status of each resource by comparing its hash to the one in previous, and
+// records the resources in previous that are gone. Resources without a hash in either summary are
+// StatusUnknown.
+func (s *Summary) Compare(previous *Summary) {
+	s.Previous = previous.Generation
+	hashes := map[string]string{}
+	for _, r := range previous.Resources {
+		hashes[r.Key()] = r.Hash
+	}
+	for i, r := range s.Resources {
+		h, ok := hashes[r.Key()]
+		switch {
+		case !ok:
+			s.Resources[i].Status = StatusAdded
+		case h == "" || r.Hash == "":
+			s.Resources[i].Status = StatusUnknown
+		case h != r.Hash:
+			s.Resources[i].Status = StatusChanged
+		default:
+			s.Resources[i].Status = StatusUnchanged
+		}
+		delete(hashes, r.Key())
+	}
+	s.Removed = nil
+	for key := range hashes {
+		s.Removed = append(s.Removed, key)
+	}
+	sort.Strings(s.Removed)
+}
+
+// Finish records how long the run took, before the summary is written
+func (s *Summary) Finish() {
+	s.Seconds = time.Since(s.Started).Seconds()
+}
+
+// WriteJSON renders the summary as indented JSON, which Load reads
+func (s *Summary) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+// WriteMarkdown renders the summary as a Markdown table, with a row per resource, suitable for a
+// pull request comment
+func (s *Summary) WriteMarkdown(w io.Writer) error {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "### Projection summary\n\n")
+	counts := ""
+	if s.Previous != "" {
+		statuses := map[string]int{}
+		for _, r := range s.Resources {
+			statuses[r.Status]++
+		}
+		unknown := ""
+		if statuses[StatusUnknown] > 0 {
+			unknown = fmt.Sprintf(", %d %s", statuses[StatusUnknown], StatusUnknown)
+		}
+		counts = fmt.Sprintf(": %d %s, %d %s, %d %s%s, and %d removed since generation `%s`", statuses[StatusChanged], StatusChanged, statuses[StatusAdded], StatusAdded, statuses[StatusUnchanged], StatusUnchanged, unknown, len(s.Removed), s.Previous)
+	}
+	fmt.Fprintf(b, "Generation `%s` wrote %d resources in %.2fs%s.\n\n", s.Generation, len(s.Resources), s.Seconds, counts)
+	if len(s.Resources) > 0 {
+		header, rule := "| Resource | Size | Keys | Sources | Hash |", "| --- | ---: | ---: | --- | --- |"
+		if s.Previous != "" {
+			header, rule = header+" Status |", rule+" --- |"
+		}
+		fmt.Fprintf(b, "%s\n%s\n", header, rule)
+		for _, r := range s.Resources {
+			sources := make([]string, len(r.Sources))
+			for i, source := range r.Sources {
+				sources[i] = "`" + source + "`"
+			}
+			// the hash is abbreviated, like a git commit
+			short := "-"
+			if r.Hash != "" {
+				short = r.Hash[strings.Index(r.Hash, ":")+1:]
+				if len(short) > 12 {
+					short = short[:12]
+				}
+				short = "`" + short + "`"
+			}
+			fmt.Fprintf(b, "| %s `%s` | %s | %d | %s | %s |", r.Kind, r.Key(), s.size(r.Bytes), r.Keys, strings.Join(sources, ", "), short)
+			if s.Previous != "" {
+				fmt.Fprintf(b, " %s |", r.Status)
+			}
+			b.WriteString("\n")
+		}
+		b.WriteString("\n")
+	}
+	if len(s.Removed) > 0 {
+		fmt.Fprintf(b, "Removed: `%s`\n", strings.Join(s.Removed, "`, `"))
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// size formats bytes, compared to the limit if there is one, like `1234 B / 500000 B (0.2%)`
+func (s *Summary) size(bytes int) string {
+	if s.Limit == 0 {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	return fmt.Sprintf("%d B / %d B (%.1f%%)", bytes, s.Limit, 100*float64(bytes)/float64(s.Limit))
+}
@@ -0,0 +1,172 @@
+package summary
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/tumblr/k8s-config-projector/internal/pkg/testing"
+	"github.com/tumblr/k8s-config-projector/pkg/projector"
+	"github.com/tumblr/k8s-config-projector/pkg/sops"
+)
+
+const manifests = `name: raw
+namespace: summary
+data:
+- source: test.json
+---
+name: globs
+namespace: summary
+data:
+- source: "*.php"
+`
+
+const secretManifest = `name: secret
+namespace: summary
+resource: Secret
+data:
+- source: sops/secrets.yaml
+  output_file: password
+  extract: $.database.password
+`
+
+// project projects manifests for the generation, summarizing them
+func project(t *testing.T, generation string, raw string) *Summary {
+	return projectWithKey(t, generation, raw, nil)
+}
+
+// projectWithKey projects manifests for the generation, summarizing them with the key
+func projectWithKey(t *testing.T, generation string, raw string, key []byte) *Summary {
+	keys, err := sops.LoadKeys("test/sops/age.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := projector.New(projector.Options{ConfigRoot: "test/sources", Generation: generation, SopsKeys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms, err := p.LoadFileBytes("summary.yaml", []byte(raw), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(generation, p.Options().SizeLimit, key)
+	for _, key := range ms.Keys() {
+		m := ms[key]
+		r, err := p.Project(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Add(m, r, key+".yaml")
+	}
+	s.Finish()
+	return s
+}
+
+func TestSummary(t *testing.T) {
+	first := project(t, "1", manifests)
+	if len(first.Resources) != 2 || first.Limit != projector.DefaultSizeLimit {
+		t.Fatalf("Expected 2 resources limited to %d bytes, but got %+v", projector.DefaultSizeLimit, first)
+	}
+	globs := first.Resources[0]
+	if globs.Key() != "summary/globs" || globs.Kind != "ConfigMap" || globs.Keys != 2 || strings.Join(globs.Sources, ",") != "a.php,z.php" || globs.Bytes == 0 || !strings.HasPrefix(globs.Hash, "sha256:") {
+		t.Fatalf("Expected the globbed ConfigMap to be summarized, but got %+v", globs)
+	}
+
+	// round trip the first summary, as the next run would read it
+	file := filepath.Join(t.TempDir(), "summary.json")
+	buf := bytes.NewBuffer([]byte{})
+	if err := first.WriteJSON(buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	previous, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := project(t, "2", strings.Replace(manifests, "- source: test.json", "- source: test.yaml", 1)+"---\nname: new\nnamespace: summary\ndata:\n- source: test.json\n")
+	second.Compare(previous)
+	statuses := map[string]string{}
+	for _, r := range second.Resources {
+		statuses[r.Key()] = r.Status
+	}
+	if statuses["summary/globs"] != StatusUnchanged || statuses["summary/raw"] != StatusChanged || statuses["summary/new"] != StatusAdded || second.Previous != "1" || len(second.Removed) != 0 {
+		t.Fatalf("Expected the data to be compared, whatever the generation, but got %v", statuses)
+	}
+	second.Compare(&Summary{Generation: "0", Resources: []Resource{{Namespace: "summary", Name: "old"}}})
+	if strings.Join(second.Removed, ",") != "summary/old" {
+		t.Fatalf("Expected summary/old to be removed, but got %v", second.Removed)
+	}
+
+	buf.Reset()
+	if err := second.WriteMarkdown(buf); err != nil {
+		t.Fatal(err)
+	}
+	md := buf.String()
+	for _, expected := range []string{
+		"Generation `2` wrote 3 resources in ",
+		": 0 changed, 3 added, 0 unchanged, and 1 removed since generation `0`.",
+		"| Resource | Size | Keys | Sources | Hash | Status |\n",
+		"| ConfigMap `summary/globs` | " + first.size(globs.Bytes) + " | 2 | `a.php`, `z.php` | `" + globs.Hash[7:19] + "` | added |\n",
+		"Removed: `summary/old`\n",
+	} {
+		if !strings.Contains(md, expected) {
+			t.Fatalf("Expected the markdown to contain %q, but got\n%s", expected, md)
+		}
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	if _, err := Load("test/sources/missing.json"); !os.IsNotExist(err) {
+		t.Fatalf("Expected a missing summary to fail, but got %v", err)
+	}
+	if _, err := Load("test/sources/test.yaml"); err == nil {
+		t.Fatal("Expected a summary that isnt JSON to fail")
+	}
+}
+
+func TestSummarySecrets(t *testing.T) {
+	unkeyed := project(t, "1", secretManifest)
+	if secret := unkeyed.Resources[0]; secret.Kind != "Secret" || secret.Keys != 1 || secret.Hash != "" {
+		t.Fatalf("Expected the Secret to be summarized without a hash, but got %+v", secret)
+	}
+
+	keyed := projectWithKey(t, "2", secretManifest, []byte("k1"))
+	secret := keyed.Resources[0]
+	if !strings.HasPrefix(secret.Hash, "hmac-sha256:") {
+		t.Fatalf("Expected the Secret to be hashed with an HMAC, but got %+v", secret)
+	}
+	if plain := "sha256:" + hashData(sha256.New(), map[string][]byte{"password": []byte("hunter2")}); secret.Hash == plain {
+		t.Fatal("Expected the Secret hash to be keyed")
+	}
+	if rekeyed := projectWithKey(t, "3", secretManifest, []byte("k2")); rekeyed.Resources[0].Hash == secret.Hash {
+		t.Fatal("Expected the Secret hash to depend on the key")
+	}
+
+	keyed.Compare(unkeyed)
+	if keyed.Resources[0].Status != StatusUnknown {
+		t.Fatalf("Expected a Secret without a previous hash to be %s, but got %s", StatusUnknown, keyed.Resources[0].Status)
+	}
+	again := projectWithKey(t, "4", secretManifest, []byte("k1"))
+	again.Compare(keyed)
+	if again.Resources[0].Status != StatusUnchanged {
+		t.Fatalf("Expected a Secret hashed with the same key to be %s, but got %s", StatusUnchanged, again.Resources[0].Status)
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	unkeyed.Compare(keyed)
+	if err := unkeyed.WriteMarkdown(buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{", 1 unknown, and 0 removed", " | - | unknown |\n"} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Fatalf("Expected the markdown to contain %q, but got\n%s", expected, buf.String())
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Package targets describes the clusters manifests are projected for. A targets file (see
+// --targets) lists each cluster, with the variables its manifests' sources use, and the directory
+// its projections are written to; manifests select which targets they apply to.
+package targets
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/tumblr/k8s-config-projector/pkg/interpolate"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// NameVar is the variable every target defines as its name, and the selector key matching it
+	NameVar = "target"
+)
+
+var (
+	nameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.\-]*$`)
+)
+
+// File is a targets file
+type File struct {
+	Targets []Target `yaml:"targets"`
+}
+
+// Target is a cluster manifests are projected for
+type Target struct {
+	// Name identifies the target, like bf2-PRODUCTION
+	Name string `yaml:"name"`
+	// Output is the directory, relative to --output, this target's projections are written to.
+	// It defaults to Name
+	Output string `yaml:"output,omitempty"`
+	// Vars are substituted for `${var}` in the sources of manifests projected for this target
+	Vars map[string]string `yaml:"vars,omitempty"`
+}
+
+// Load reads and validates a targets file, returning its targets in order
+func Load(file string) ([]Target, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var f File
+	if err := yaml.UnmarshalStrict(raw, &f); err != nil {
+		return nil, fmt.Errorf("unable to parse targets %s: %s", file, err.Error())
+	}
+	if err := f.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid targets %s: %s", file, err.Error())
+	}
+	return f.Targets, nil
+}
+
+// Validate makes sure every target is named, and that no two targets share a name or output directory
+func (f *File) Validate() error {
+	if len(f.Targets) == 0 {
+		return fmt.Errorf("no targets")
+	}
+	names := map[string]bool{}
+	outputs := map[string]string{}
+	for i, t := range f.Targets {
+		if !nameRegexp.MatchString(t.Name) {
+			return fmt.Errorf("target %d: name %q must be alphanumeric, -, _ or .", i, t.Name)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("target %s: duplicate name", t.Name)
+		}
+		names[t.Name] = true
+		out := t.OutputDir()
+		if path.IsAbs(out) || out == ".." || strings.HasPrefix(out, "../") {
+			return fmt.Errorf("target %s: output %s must be a directory inside of --output", t.Name, t.Output)
+		}
+		if other, ok := outputs[out]; ok {
+			return fmt.Errorf("target %s: output %s is also the output of target %s", t.Name, out, other)
+		}
+		outputs[out] = t.Name
+		for k := range t.Vars {
+			if !interpolate.ValidName(k) {
+				return fmt.Errorf("target %s: invalid variable name %q", t.Name, k)
+			}
+			if k == NameVar {
+				return fmt.Errorf("target %s: variable %s is the target's name, and cannot be set", t.Name, NameVar)
+			}
+		}
+	}
+	return nil
+}
+
+// OutputDir returns the directory, relative to --output, this target's projections are written to
+func (t Target) OutputDir() string {
+	if t.Output == "" {
+		return t.Name
+	}
+	return path.Clean(t.Output)
+}
+
+// Variables returns the target's vars, along with its name as `target`
+func (t Target) Variables() interpolate.Vars {
+	vars := interpolate.Vars{NameVar: t.Name}
+	for k, v := range t.Vars {
+		vars[k] = v
+	}
+	return vars
+}
+
+// Values are the values a selector accepts for a variable. In yaml, it is either a single value or
+// a list of them. Values may be globs, like `PROD*`.
+type Values []string
+
+// UnmarshalYAML accepts a single value as well as a list
+func (v *Values) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var one string
+	if err := unmarshal(&one); err == nil {
+		*v = Values{one}
+		return nil
+	}
+	var many []string
+	if err := unmarshal(&many); err != nil {
+		return err
+	}
+	*v = Values(many)
+	return nil
+}
+
+// Selector selects targets by their variables: a target is selected when, for every variable in
+// the selector, the target defines it with one of the accepted values. `target` matches the
+// target's name. An empty selector selects every target.
+type Selector map[string]Values
+
+// Validate makes sure every variable name and glob in the selector is well formed
+func (s Selector) Validate() error {
+	for _, k := range s.keys() {
+		if !interpolate.ValidName(k) {
+			return fmt.Errorf("invalid variable name %q", k)
+		}
+		if len(s[k]) == 0 {
+			return fmt.Errorf("%s: no values", k)
+		}
+		for _, g := range s[k] {
+			if _, err := path.Match(g, ""); err != nil {
+				return fmt.Errorf("%s: bad glob %q: %s", k, g, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// Matches returns true if the selector selects t
+func (s Selector) Matches(t Target) bool {
+	vars := t.Variables()
+	for k, values := range s {
+		v, ok := vars[k]
+		if !ok {
+			return false
+		}
+		matched := false
+		for _, g := range values {
+			if ok, _ := path.Match(g, v); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// keys returns the selector's variables, sorted
+func (s Selector) keys() []string {
+	keys := make([]string, 0, len(s))
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
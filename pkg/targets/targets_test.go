@@ -0,0 +1,88 @@
+package targets
+
+import (
+	"strings"
+	"testing"
+
+	_ "github.com/tumblr/k8s-config-projector/internal/pkg/testing"
+	"gopkg.in/yaml.v2"
+)
+
+func TestLoad(t *testing.T) {
+	targets, err := Load("test/targets.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 3 || targets[0].Name != "bf2-DEVEL" {
+		t.Fatalf("Expected 3 targets in order, but got %+v", targets)
+	}
+	if targets[1].OutputDir() != "bf2/PRODUCTION" || targets[2].OutputDir() != "dc2-PRODUCTION" {
+		t.Fatalf("Expected output directories to default to the target name, but got %s and %s", targets[1].OutputDir(), targets[2].OutputDir())
+	}
+	vars := targets[0].Variables()
+	if vars["target"] != "bf2-DEVEL" || vars["az"] != "bf2" || vars["cluster"] != "DEVEL" {
+		t.Fatalf("Expected the target's vars and name, but got %v", vars)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := map[string]string{
+		"targets: []":                     "no targets",
+		"targets: [{name: ''}]":           "must be alphanumeric",
+		"targets: [{name: a}, {name: a}]": "duplicate name",
+		"targets: [{name: a, output: x}, {name: b, output: x/}]":     "also the output of target a",
+		"targets: [{name: a, output: ../x}]":                         "inside of --output",
+		"targets: [{name: a, output: /x}]":                           "inside of --output",
+		"targets: [{name: a, vars: {target: b}}]":                    "cannot be set",
+		"targets: [{name: a, vars: {not-a-name: b}}]":                "invalid variable name",
+		"targets: [{name: a, output: a/PROD}, {name: b, output: b}]": "",
+	}
+	for raw, expected := range cases {
+		var f File
+		if err := yaml.UnmarshalStrict([]byte(raw), &f); err != nil {
+			t.Fatal(err)
+		}
+		err := f.Validate()
+		if expected == "" && err != nil {
+			t.Fatalf("Expected %s to be valid, but got %s", raw, err.Error())
+		}
+		if expected != "" && (err == nil || !strings.Contains(err.Error(), expected)) {
+			t.Fatalf("Expected %s to fail with %q, but got %v", raw, expected, err)
+		}
+	}
+}
+
+func TestSelector(t *testing.T) {
+	targets, err := Load("test/targets.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string][]string{
+		"{}":                               {"bf2-DEVEL", "bf2-PRODUCTION", "dc2-PRODUCTION"},
+		"{cluster: PRODUCTION}":            {"bf2-PRODUCTION", "dc2-PRODUCTION"},
+		"{cluster: PRODUCTION, az: [dc2]}": {"dc2-PRODUCTION"},
+		"{target: [bf2-DEVEL, dc2-*]}":     {"bf2-DEVEL", "dc2-PRODUCTION"},
+		"{undefined: x}":                   {},
+	}
+	for raw, expected := range cases {
+		var s Selector
+		if err := yaml.UnmarshalStrict([]byte(raw), &s); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		selected := []string{}
+		for _, target := range targets {
+			if s.Matches(target) {
+				selected = append(selected, target.Name)
+			}
+		}
+		if strings.Join(selected, ",") != strings.Join(expected, ",") {
+			t.Fatalf("Expected %s to select %v, but got %v", raw, expected, selected)
+		}
+	}
+	if err := (Selector{"az": Values{"[bad"}}).Validate(); err == nil {
+		t.Fatal("Expected a bad glob to be rejected")
+	}
+}
@@ -25,11 +25,29 @@ var (
 	ErrUnsupportedOutputFormat = errors.New("unsupported output format; must be one of raw, yaml, or json")
 	// ErrAbsolutePathSource ...
 	ErrAbsolutePathSource = errors.New("absolute paths for `source` are not permitted")
+	// ErrSourceOutsideConfigRepo ...
+	ErrSourceOutsideConfigRepo = errors.New("`source` must resolve to a path inside the config repo")
+	// ErrUnknownConfigRoot ...
+	ErrUnknownConfigRoot = errors.New("`source` is in a config root that was not given (see --config-root)")
+	// ErrUndefinedVariable ...
+	ErrUndefinedVariable = errors.New("undefined variable")
+	// ErrUnknownTemplate ...
+	ErrUnknownTemplate = errors.New("unknown template (see --library)")
+	// ErrIncludeCycle ...
+	ErrIncludeCycle = errors.New("templates include each other in a cycle")
+	// ErrSourceNotAllowed ...
+	ErrSourceNotAllowed = errors.New("`source` is not under any path this namespace is allowed to project from")
+	// ErrEncryptedSourceWithoutKeys ...
+	ErrEncryptedSourceWithoutKeys = errors.New("source is SOPS encrypted, but no keys were given to decrypt it with (see --sops-keys)")
+	// ErrEncryptedSourceRequiresSecret ...
+	ErrEncryptedSourceRequiresSecret = errors.New("source is SOPS encrypted; decrypted values can only be projected into a Secret (set `resource: Secret`)")
 	// ErrUnableToInferSourceFormat ...
 	ErrUnableToInferSourceFormat = errors.New("unable to infer source format, you should specify this explicitly")
 	// ErrUnableToInferOutputFormat ...
 	ErrUnableToInferOutputFormat = errors.New("unable to infer output format, you should specify this explicitly")
 
+	// ErrUnsupportedResource ...
+	ErrUnsupportedResource = errors.New("unsupported resource; must be ConfigMap or Secret")
 	// ErrMissingName ...
 	ErrMissingName = errors.New("missing name field")
 	// ErrMissingNamespace ...
@@ -42,4 +60,14 @@ var (
 	ErrInvalidName = errors.New("name must only consist of lower case alphanumeric characters, -, and . and be 253 chars or less")
 	// ErrInvalidNamespace ...
 	ErrInvalidNamespace = errors.New("namespace must only consist of lower case alphanumeric characters, -, and . and be 253 chars or less")
+	// ErrUnsupportedAPIVersion ...
+	ErrUnsupportedAPIVersion = errors.New("unsupported apiVersion; must be projector.tumblr.com/v1 or projector.tumblr.com/v2")
+	// ErrUnsupportedKind ...
+	ErrUnsupportedKind = errors.New("unsupported kind; must be ConfigProjection")
+	// ErrInvalidLabel ...
+	ErrInvalidLabel = errors.New("invalid label")
+	// ErrInvalidAnnotation ...
+	ErrInvalidAnnotation = errors.New("invalid annotation")
+	// ErrReservedMetadata ...
+	ErrReservedMetadata = errors.New("label or annotation is set by the projector")
 )
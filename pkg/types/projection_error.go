@@ -0,0 +1,120 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// NoDataSource is the DataSource index of a ProjectionError that isnt about any one datasource
+const NoDataSource = -1
+
+// ProjectionError is an error along with where in a projection manifest it came from.
+// It wraps the underlying error (usually one of the sentinels in this package), so callers
+// can still match it with errors.Is, and pull out its location with errors.As.
+type ProjectionError struct {
+	// Manifest is the path of the manifest file
+	Manifest string
+	// Line and Column locate the offending yaml node in the manifest; 0 when unknown
+	Line   int
+	Column int
+	// DataSource is the index into the manifest's `data` list, or NoDataSource
+	DataSource int
+	// Field is the manifest or datasource field at fault, i.e. `output_file` or `field_extractions.hosts`
+	Field string
+	// Source is the source file being projected, relative to the config repo
+	Source string
+	// JSONPath is the extraction expression being evaluated
+	JSONPath string
+	Err      error
+}
+
+// Error returns the underlying error prefixed with whatever location is known,
+// like `manifests/foo.yaml:12:5: data[2].output_file: output_file field required for this projection type`
+func (e *ProjectionError) Error() string {
+	prefix := []string{}
+	if loc := e.Position(); loc != "" {
+		prefix = append(prefix, loc)
+	}
+	if f := e.FieldPath(); f != "" {
+		prefix = append(prefix, f)
+	}
+	msg := e.Err.Error()
+	if len(prefix) > 0 {
+		msg = strings.Join(prefix, ": ") + ": " + msg
+	}
+	ctx := []string{}
+	if e.Source != "" {
+		ctx = append(ctx, "source="+e.Source)
+	}
+	if e.JSONPath != "" {
+		ctx = append(ctx, "jsonpath="+e.JSONPath)
+	}
+	if len(ctx) > 0 {
+		msg = fmt.Sprintf("%s (%s)", msg, strings.Join(ctx, " "))
+	}
+	return msg
+}
+
+// Unwrap returns the underlying error
+func (e *ProjectionError) Unwrap() error {
+	return e.Err
+}
+
+// Position returns file:line:column, omitting whatever is unknown
+func (e *ProjectionError) Position() string {
+	pos := e.Manifest
+	if e.Line > 0 {
+		pos = fmt.Sprintf("%s:%d:%d", pos, e.Line, e.Column)
+	}
+	return strings.TrimPrefix(pos, ":")
+}
+
+// FieldPath returns the path to the offending field within the manifest, like data[2].output_file
+func (e *ProjectionError) FieldPath() string {
+	if e.DataSource == NoDataSource {
+		return e.Field
+	}
+	if e.Field == "" {
+		return fmt.Sprintf("data[%d]", e.DataSource)
+	}
+	return fmt.Sprintf("data[%d].%s", e.DataSource, e.Field)
+}
+
+// NewFieldError returns a ProjectionError for err, caused by field
+func NewFieldError(field string, err error) *ProjectionError {
+	return &ProjectionError{DataSource: NoDataSource, Field: field, Err: err}
+}
+
+// AsProjectionError returns the ProjectionError wrapped in err, or wraps err in a new one,
+// so callers further up can fill in the context they know about. When err wraps a ProjectionError
+// with more context, like `document on line 3: %w`, a copy of it is returned, with that context
+// kept in its Err.
+func AsProjectionError(err error) *ProjectionError {
+	var pe *ProjectionError
+	if !errors.As(err, &pe) {
+		return &ProjectionError{DataSource: NoDataSource, Err: err}
+	}
+	if err == error(pe) {
+		return pe
+	}
+	outer := *pe
+	outer.Err = &contextError{msg: strings.Replace(err.Error(), pe.Error(), pe.Err.Error(), 1), err: err}
+	return &outer
+}
+
+// contextError is the message of an error wrapping a ProjectionError, without the location the
+// ProjectionError adds to it
+type contextError struct {
+	msg string
+	err error
+}
+
+func (e *contextError) Error() string {
+	return e.msg
+}
+
+// Unwrap returns the error wrapping the ProjectionError
+func (e *contextError) Unwrap() error {
+	return e.err
+}
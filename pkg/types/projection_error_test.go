@@ -0,0 +1,34 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestAsProjectionErrorKeepsContext(t *testing.T) {
+	pe := &ProjectionError{Manifest: "foo.yaml", Line: 3, Column: 1, DataSource: NoDataSource, Field: "name", Err: ErrInvalidName}
+	if AsProjectionError(pe) != pe {
+		t.Fatal("Expected a ProjectionError to be returned as is")
+	}
+
+	wrapped := fmt.Errorf("document on line 3: %w", pe)
+	located := AsProjectionError(wrapped)
+	if located == pe || located.Field != "name" || located.Line != 3 {
+		t.Fatalf("Expected a copy of the ProjectionError, but got %#v", located)
+	}
+	if msg := located.Err.Error(); msg != "document on line 3: "+ErrInvalidName.Error() {
+		t.Fatalf("Expected the wrapping context to be kept, but got %q", msg)
+	}
+	if expected := "foo.yaml:3:1: name: document on line 3: " + ErrInvalidName.Error(); located.Error() != expected {
+		t.Fatalf("Expected %q, but got %q", expected, located.Error())
+	}
+	if !errors.Is(located, ErrInvalidName) || !errors.Is(located, pe) {
+		t.Fatalf("Expected the copy to still wrap the original errors, but got %#v", located)
+	}
+
+	other := errors.New("unable to read x")
+	if located := AsProjectionError(other); located.Err != other || located.DataSource != NoDataSource {
+		t.Fatalf("Expected other errors to be wrapped, but got %#v", located)
+	}
+}
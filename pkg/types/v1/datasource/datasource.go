@@ -4,9 +4,9 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"path"
-	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/tumblr/k8s-config-projector/pkg/types"
@@ -49,11 +49,58 @@ const (
 	OutputYAML OutputType = "yaml"
 )
 
+var (
+	// sourceRootRegexp matches sources in a named config root, like `infra:generated/hosts.json`
+	sourceRootRegexp = regexp.MustCompile(`^([a-z0-9][a-z0-9_-]*):(.*)$`)
+)
+
+// ValidRootName returns true if name can name a config root
+func ValidRootName(name string) bool {
+	return sourceRootRegexp.MatchString(name + ":")
+}
+
+// SplitSource splits source into the name of the config root it is in, and its path in that
+// root. Sources without a `name:` prefix are in the default config root, named "".
+func SplitSource(source string) (string, string) {
+	if m := sourceRootRegexp.FindStringSubmatch(source); m != nil {
+		return m[1], m[2]
+	}
+	return "", source
+}
+
+// JoinSource returns the source for the path p in the named config root
+func JoinSource(root string, p string) string {
+	if root == "" {
+		return p
+	}
+	return root + ":" + p
+}
+
+// cleanSource returns source with its path cleaned, keeping its config root
+func cleanSource(source string) string {
+	root, p := SplitSource(source)
+	return JoinSource(root, path.Clean(p))
+}
+
 // isGlobSource tells us if the DataSource uses globs (not one file)
 func (f *DataSource) isGlobSource() bool {
 	return strings.Contains(f.Source, `*`)
 }
 
+// Projects returns true if source (relative to the config repo, prefixed with `name:` for named
+// config roots) is, or matches the glob of, this DataSource's source
+func (f *DataSource) Projects(source string) bool {
+	source = cleanSource(source)
+	if cleanSource(f.Source) == source {
+		return true
+	}
+	if !f.isGlobSource() {
+		return false
+	}
+	ok, _ := path.Match(cleanSource(f.Source), source)
+	return ok
+}
+
 // if source format is empty, infers proper format, or errors
 func (f *DataSource) inferredSourceFormat() (SourceFormat, error) {
 	if f.isGlobSource() {
@@ -101,6 +148,10 @@ func (f *DataSource) SetDefaults() error {
 		}
 		f.SourceFormat = sf
 	}
+	if f.SourceFormat != FormatFile && f.SourceFormat != FormatGlob && f.SourceFormat != FormatJSON && f.SourceFormat != FormatYAML {
+		// an output format cant be inferred for it either
+		return types.ErrUnsupportedSourceFormat
+	}
 
 	if f.OutputFormat == "" {
 		of, err := f.inferredOutputFormat()
@@ -112,63 +163,100 @@ func (f *DataSource) SetDefaults() error {
 
 	if f.OutputFile == "" && f.OutputFormat == OutputRaw && f.SourceFormat == FormatFile {
 		// assume the OutputFile is the same name as the source, without any directory component!
-		f.OutputFile = path.Base(f.Source)
+		_, p := SplitSource(f.Source)
+		f.OutputFile = path.Base(p)
 	}
 	return nil
 }
 
 // Project will take a base path and project the source into a list of byte arrays
-// performing any extraction and globbing necessary
+// performing any extraction and globbing necessary. Errors are returned as a *types.ProjectionError
+// carrying the source (and jsonpath, if extracting) that failed.
 func (f *DataSource) Project(basePath string) (map[string][]byte, error) {
+	return f.ProjectFromRoot(&SourceRoot{Path: basePath})
+}
+
+// ProjectFromRoot is Project, reading sources from root. Reads are confined to the root (and its
+// allowed prefixes) after following symlinks.
+func (f *DataSource) ProjectFromRoot(root *SourceRoot) (map[string][]byte, error) {
+	projected, _, err := f.ProjectWithSources(root)
+	return projected, err
+}
+
+// ProjectWithSources is ProjectFromRoot, also returning the source file (relative to the root) each
+// projected key was read from. For globs, that is the file matched; otherwise it is Source.
+func (f *DataSource) ProjectWithSources(root *SourceRoot) (map[string][]byte, map[string]string, error) {
+	projected, sources, err := f.project(root)
+	if err != nil {
+		pe := types.AsProjectionError(err)
+		if pe.Source == "" {
+			pe.Source = f.Source
+		}
+		return nil, nil, pe
+	}
+	return projected, sources, nil
+}
+
+func (f *DataSource) project(root *SourceRoot) (map[string][]byte, map[string]string, error) {
 	projectedFiles := map[string][]byte{}
+	sources := map[string]string{}
 
 	switch f.SourceFormat {
 	case FormatGlob:
-		files, err := filepath.Glob(filepath.Join(basePath, f.Source))
+		files, err := root.Glob(f.Source)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		for _, v := range files {
-			// extract the filename without any paths
-			relativeSource := strings.TrimLeft(strings.Split(v, basePath)[1], "/")
-			name := relativeSource[strings.LastIndex(relativeSource, "/")+1:]
+		for _, relativeSource := range files {
+			// extract the filename without any paths (or config root)
+			_, p := SplitSource(relativeSource)
+			name := path.Base(p)
 
 			// check for duplicate files in the output bucket before reading files
 			if _, ok := projectedFiles[name]; ok {
 				// already exists a projection with this name. abort!
-				return nil, errors.New("existing file projection with name " + name)
+				return nil, nil, errors.New("existing file projection with name " + name)
 			}
 
-			source := path.Join(basePath, relativeSource)
-			buf, err := ioutil.ReadFile(source)
+			buf, err := root.ReadFile(relativeSource)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 			// because we are globbing files from the filesystem, remove the trailing \n always
 			// TODO(gabe) i dunno if this is appropriate; we really need to strip the trailing non-printing
 			// char that is always present when we read from disk?
 			projectedFiles[name] = bytes.TrimSuffix(buf, []byte("\n"))
+			sources[name] = relativeSource
 		}
 	case FormatFile:
 		// its just a single raw file extraction, read from Source and return its contents
 		if _, ok := projectedFiles[f.OutputFile]; ok {
-			return nil, errors.New("existing file projection with name " + f.OutputFile)
+			return nil, nil, errors.New("existing file projection with name " + f.OutputFile)
 		}
 
-		source := path.Join(basePath, f.Source)
-		buf, err := ioutil.ReadFile(source)
+		buf, err := root.ReadFile(f.Source)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		projectedFiles[f.OutputFile] = bytes.TrimSuffix(buf, []byte("\n"))
-	case FormatJSON:
-		return f.projectJSON(basePath)
-	case FormatYAML:
-		return f.projectYAML(basePath)
+		sources[f.OutputFile] = f.Source
+	case FormatJSON, FormatYAML:
+		var err error
+		if f.SourceFormat == FormatJSON {
+			projectedFiles, err = f.projectJSON(root)
+		} else {
+			projectedFiles, err = f.projectYAML(root)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		for k := range projectedFiles {
+			sources[k] = f.Source
+		}
 	default:
-		return nil, types.ErrUnsupportedSourceType
+		return nil, nil, types.ErrUnsupportedSourceType
 	}
-	return projectedFiles, nil
+	return projectedFiles, sources, nil
 }
 
 // String returns a string of the DataSource
@@ -176,31 +264,82 @@ func (f *DataSource) String() string {
 	return fmt.Sprintf("DataSource{%s:%s} output=%s extract=%s fields=%s", f.Source, f.SourceFormat, f.OutputFormat, f.Extract, f.FieldExtractions)
 }
 
-// Validate validates a DataSource
+// Interpolate replaces the source, output_file, extract and field_extractions values with what
+// expand returns for them, stopping at the first error. FieldExtractions is replaced rather than
+// changed, so a DataSource copied from another can be interpolated without changing it.
+func (f *DataSource) Interpolate(expand func(field string, value string) (string, error)) error {
+	for _, x := range []struct {
+		field string
+		v     *string
+	}{{"source", &f.Source}, {"output_file", &f.OutputFile}, {"extract", &f.Extract}} {
+		s, err := expand(x.field, *x.v)
+		if err != nil {
+			return err
+		}
+		*x.v = s
+	}
+	if len(f.FieldExtractions) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(f.FieldExtractions))
+	for k := range f.FieldExtractions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	extractions := make(map[string]string, len(keys))
+	for _, k := range keys {
+		s, err := expand("field_extractions."+k, f.FieldExtractions[k])
+		if err != nil {
+			return err
+		}
+		extractions[k] = s
+	}
+	f.FieldExtractions = extractions
+	return nil
+}
+
+// Validate validates a DataSource, returning the first problem found
 func (f *DataSource) Validate() error {
+	if errs := f.ValidateAll(); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// ValidateAll validates a DataSource, returning every problem found instead of stopping
+// at the first one. Each error is a *types.ProjectionError naming the field at fault.
+func (f *DataSource) ValidateAll() []error {
+	errs := []error{}
+	fail := func(field string, err error) {
+		pe := types.NewFieldError(field, err)
+		pe.Source = f.Source
+		errs = append(errs, pe)
+	}
 	if f.SourceFormat != FormatFile && f.SourceFormat != FormatGlob && f.SourceFormat != FormatJSON && f.SourceFormat != FormatYAML {
-		return types.ErrUnsupportedSourceFormat
+		fail("source_format", types.ErrUnsupportedSourceFormat)
 	}
 	if f.OutputFormat != OutputJSON && f.OutputFormat != OutputYAML && f.OutputFormat != OutputRaw {
-		return types.ErrUnsupportedOutputFormat
+		fail("output_format", types.ErrUnsupportedOutputFormat)
 	}
 	if f.isGlobSource() && f.OutputFormat != OutputRaw {
-		return types.ErrSourceGlobWithRawOutput
+		fail("output_format", types.ErrSourceGlobWithRawOutput)
 	}
 	if f.OutputFile == "" && (f.OutputFormat == OutputRaw || f.OutputFormat == OutputJSON || f.OutputFormat == OutputYAML) && f.SourceFormat != FormatGlob {
-		return types.ErrOutputFileRequired
+		fail("output_file", types.ErrOutputFileRequired)
 	}
 	if f.Extract == "" && len(f.FieldExtractions) == 0 && f.OutputFormat != OutputRaw {
-		return types.ErrOutputFormatRequiresExtractors
+		fail("output_format", types.ErrOutputFormatRequiresExtractors)
 	}
 	if f.OutputFormat == OutputRaw && len(f.FieldExtractions) != 0 {
-		return types.ErrWrongOutputFormatWithFieldExtractions
+		fail("field_extractions", types.ErrWrongOutputFormatWithFieldExtractions)
 	}
 	if f.OutputFile != "" && f.SourceFormat == FormatGlob {
-		return types.ErrFormatGlobRequiresNoOutputFile
+		fail("output_file", types.ErrFormatGlobRequiresNoOutputFile)
 	}
-	if path.IsAbs(f.Source) {
-		return types.ErrAbsolutePathSource
+	if _, p := SplitSource(f.Source); path.IsAbs(p) {
+		fail("source", types.ErrAbsolutePathSource)
+	} else if clean := path.Clean(p); clean == ".." || strings.HasPrefix(clean, "../") {
+		fail("source", types.ErrSourceOutsideConfigRepo)
 	}
-	return nil
+	return errs
 }
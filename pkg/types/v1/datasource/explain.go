@@ -0,0 +1,142 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/oliveagle/jsonpath"
+)
+
+// Extraction is a jsonpath evaluated against a structured source, as `extract` evaluates it
+type Extraction struct {
+	// Field is the datasource field the jsonpath is from, like `extract` or `field_extractions.hosts`
+	Field    string
+	JSONPath string
+	// Value is what the jsonpath selects, and Type is its kind: string, integer, number, boolean,
+	// null, object or array
+	Value interface{}
+	Type  string
+	// Bytes are what `extract` projects Value as, unless Err is why it cant
+	Bytes []byte
+	Err   error
+}
+
+// Query evaluates the jsonpath expr against doc, a source read with ReadStructured. It is an error
+// for expr to be invalid, or to select nothing.
+func Query(doc interface{}, expr string) (*Extraction, error) {
+	v, err := jsonpath.JsonPathLookup(doc, expr)
+	if err != nil {
+		return nil, err
+	}
+	e := &Extraction{Field: "extract", JSONPath: expr, Value: v, Type: TypeOf(v)}
+	e.Bytes, e.Err = convertInterfaceValueToBytes(v)
+	return e, nil
+}
+
+// TypeOf returns the kind of a value decoded from a structured source
+func TypeOf(v interface{}) string {
+	switch n := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case int, int64:
+		return "integer"
+	case float64:
+		if n == float64(int64(n)) {
+			return "integer"
+		}
+		return "number"
+	case json.Number:
+		if _, err := n.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// Explanation is how a datasource projects, step by step. Steps after one that failed are left out.
+type Explanation struct {
+	DataSource *DataSource
+	// InferredSourceFormat and InferredOutputFormat are true when the formats are what would be
+	// inferred if they werent set
+	InferredSourceFormat bool
+	InferredOutputFormat bool
+	// Files are what the source resolves to, after following symlinks: each file a glob matches,
+	// or the one file
+	Files []string
+	// Extractions are the results of `extract`, or of each of the `field_extractions`, by label
+	Extractions []*Extraction
+	// Projected are the keys the datasource projects, and their values
+	Projected map[string][]byte
+	// Err is the step that failed, if any
+	Err error
+}
+
+// Explain projects f from root, like ProjectFromRoot, recording each step. f should have its
+// defaults set.
+func (f *DataSource) Explain(root *SourceRoot) *Explanation {
+	e := &Explanation{DataSource: f}
+	inferred := *f
+	inferred.SourceFormat, inferred.OutputFormat = "", ""
+	if sf, err := inferred.inferredSourceFormat(); err == nil {
+		e.InferredSourceFormat = sf == f.SourceFormat
+		inferred.SourceFormat = sf
+		if of, err := inferred.inferredOutputFormat(); err == nil {
+			e.InferredOutputFormat = of == f.OutputFormat
+		}
+	}
+
+	if f.SourceFormat == FormatGlob {
+		if e.Files, e.Err = root.Glob(f.Source); e.Err != nil {
+			return e
+		}
+	} else {
+		resolved, err := root.Resolve(f.Source)
+		if err != nil {
+			e.Err = err
+			return e
+		}
+		e.Files = []string{resolved}
+	}
+
+	if f.SourceFormat == FormatJSON || f.SourceFormat == FormatYAML {
+		doc, err := root.ReadStructured(f.Source, f.SourceFormat)
+		if err != nil {
+			e.Err = err
+			return e
+		}
+		paths := map[string]string{}
+		if f.Extract != "" {
+			paths["extract"] = f.Extract
+		}
+		for label, p := range f.FieldExtractions {
+			paths["field_extractions."+label] = p
+		}
+		fields := make([]string, 0, len(paths))
+		for field := range paths {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			x, err := Query(doc, paths[field])
+			if err != nil {
+				e.Err = extractionError(field, paths[field], err)
+				return e
+			}
+			x.Field = field
+			e.Extractions = append(e.Extractions, x)
+		}
+	}
+
+	e.Projected, e.Err = f.ProjectFromRoot(root)
+	return e
+}
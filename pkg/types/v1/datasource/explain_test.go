@@ -0,0 +1,78 @@
+package datasource
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	_ "github.com/tumblr/k8s-config-projector/internal/pkg/testing"
+	"github.com/tumblr/k8s-config-projector/pkg/types"
+)
+
+func TestQuery(t *testing.T) {
+	doc, err := testRoot.ReadStructured("test.json", FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string][2]string{
+		"$.hostport":          {"string", "test-6f327ab0.dc2.tumblr.net:3295"},
+		"$.numbers.int":       {"integer", "420"},
+		"$.numbers.float":     {"number", "-69.69"},
+		"$.numbers.giantint":  {"integer", "9219999999999999999"},
+		"$.nest.object.bool":  {"boolean", "true"},
+		"$.nest.object.array": {"array", ""},
+		"$.nest":              {"object", ""},
+	}
+	for expr, expected := range cases {
+		e, err := Query(doc, expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Type != expected[0] || string(e.Bytes) != expected[1] {
+			t.Fatalf("Expected %s to select a %s projecting %q, but got a %s projecting %q", expr, expected[0], expected[1], e.Type, e.Bytes)
+		}
+		if expected[1] == "" && e.Err == nil {
+			t.Fatalf("Expected %s to select a value extract cant project", expr)
+		}
+	}
+	if _, err := Query(doc, "$.nope"); err == nil {
+		t.Fatal("Expected selecting nothing to fail")
+	}
+}
+
+func TestExplain(t *testing.T) {
+	d := &DataSource{Source: "test.yaml", OutputFile: "out.json", OutputFormat: OutputJSON, FieldExtractions: map[string]string{"s": "$.astring", "i": "$.numbers.int"}}
+	if err := d.SetDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	e := d.Explain(testRoot)
+	if e.Err != nil {
+		t.Fatal(e.Err)
+	}
+	if !e.InferredSourceFormat || e.InferredOutputFormat || len(e.Files) != 1 || e.Files[0] != "test.yaml" {
+		t.Fatalf("Expected the source format to be inferred, the output format not to be, and test.yaml to be read, but got %+v", e)
+	}
+	if len(e.Extractions) != 2 || e.Extractions[0].Field != "field_extractions.i" || e.Extractions[1].Type != "string" {
+		t.Fatalf("Expected each field extraction in order, but got %+v", e.Extractions)
+	}
+	if string(e.Projected["out.json"]) != `{"i":420,"s":"hello world 1236969"}` {
+		t.Fatalf("Expected the projection, but got %s", e.Projected)
+	}
+
+	d = &DataSource{Source: "test.json", OutputFile: "x", Extract: "$.nope"}
+	if err := d.SetDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	e = d.Explain(testRoot)
+	if pe := types.AsProjectionError(e.Err); pe.Field != "extract" || pe.JSONPath != "$.nope" || e.Projected != nil {
+		t.Fatalf("Expected the failing extraction to stop the explanation, but got %+v", e)
+	}
+	e = (&DataSource{Source: "missing/*.json", SourceFormat: FormatGlob, OutputFormat: OutputRaw}).Explain(testRoot)
+	if e.Err != nil || len(e.Files) != 0 {
+		t.Fatalf("Expected a glob matching nothing to resolve to no files, but got %+v", e)
+	}
+	e = (&DataSource{Source: "missing.json", SourceFormat: FormatFile, OutputFormat: OutputRaw}).Explain(testRoot)
+	if !errors.Is(e.Err, os.ErrNotExist) || e.Files != nil {
+		t.Fatalf("Expected a missing source to fail to resolve, but got %+v", e)
+	}
+}
@@ -0,0 +1,297 @@
+package datasource
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/tumblr/k8s-config-projector/pkg/sops"
+	"github.com/tumblr/k8s-config-projector/pkg/types"
+)
+
+// SourceRoot is the config repo that sources are read from. Every read is confined to it after
+// following symlinks, so neither `../` nor a symlink in the repo can project files from elsewhere.
+type SourceRoot struct {
+	// Path is the root of the config repo checkout. It is ignored when FS is set.
+	Path string
+	// FS, if set, is the config repo sources are read from, instead of the checkout at Path. It
+	// may be an in-memory tree, an archive, or a git tree; fs.FS paths can never contain `../`.
+	// If it has symlinks, it should implement Resolver, so they are confined too.
+	FS fs.FS
+	// Roots are the named config roots, read from by sources like `name:path`. Each is confined on
+	// its own; only their Path and FS are used, while this root's AllowedPrefixes, Check, and
+	// Decrypt apply to all of them.
+	Roots map[string]*SourceRoot
+	// AllowedPrefixes, if not empty, are the only paths (relative to Path) that sources may resolve to.
+	// Prefixes in named roots are written like sources, i.e. `infra:generated/`.
+	AllowedPrefixes []string
+	// Check, if set, is called with every path (relative to Path, or `name:path` in a named root) a
+	// source resolves to, before it is read. Returning an error stops the read; this is how access
+	// policies are enforced.
+	Check func(resolved string) error
+	// Decrypt, if set, decrypts SOPS encrypted structured sources before fields are extracted from
+	// them. When it is nil, projecting from an encrypted source is an error rather than
+	// projecting its ciphertext. raw is the document as read, which its MAC is verified against.
+	Decrypt func(doc interface{}, raw []byte) (interface{}, error)
+}
+
+// Resolver is implemented by filesystems with symlinks, returning the path name resolves to
+// after following them
+type Resolver interface {
+	Resolve(name string) (string, error)
+}
+
+// Allows returns true if the relative source path (or glob) is under one of the allowed prefixes
+func (r *SourceRoot) Allows(source string) bool {
+	if len(r.AllowedPrefixes) == 0 {
+		return true
+	}
+	root, source := SplitSource(source)
+	source = path.Clean(source)
+	for _, prefix := range r.AllowedPrefixes {
+		prefixRoot, p := SplitSource(prefix)
+		if prefixRoot != root {
+			continue
+		}
+		p = strings.TrimSuffix(path.Clean(p), "/")
+		if p == "." || source == p || strings.HasPrefix(source, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the path (relative to the root) the relative source path reads from, after
+// following symlinks. It is an error for that to be outside of the root, or outside of the allowed prefixes.
+func (r *SourceRoot) Resolve(source string) (string, error) {
+	rel, err := r.resolve(source)
+	if err != nil {
+		return "", err
+	}
+	if !r.Allows(rel) {
+		return "", fmt.Errorf("%s resolves to %s: %w", source, rel, types.ErrSourceNotAllowed)
+	}
+	if r.Check != nil {
+		if err := r.Check(rel); err != nil {
+			return "", err
+		}
+	}
+	return rel, nil
+}
+
+// resolve returns the path source reads from, following symlinks in checkouts
+func (r *SourceRoot) resolve(source string) (string, error) {
+	name, p := SplitSource(source)
+	root, err := r.root(name)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", source, err)
+	}
+	rel, err := root.resolveIn(p)
+	if err != nil {
+		return "", err
+	}
+	return JoinSource(name, rel), nil
+}
+
+// root returns the named root, or this one for the default root
+func (r *SourceRoot) root(name string) (*SourceRoot, error) {
+	if name == "" {
+		return r, nil
+	}
+	root, ok := r.Roots[name]
+	if !ok {
+		return nil, types.ErrUnknownConfigRoot
+	}
+	return root, nil
+}
+
+// resolveIn returns the path source reads from in this root alone
+func (r *SourceRoot) resolveIn(source string) (string, error) {
+	if r.FS != nil {
+		rel := path.Clean(source)
+		if !fs.ValidPath(rel) {
+			return "", fmt.Errorf("%s: %w", source, types.ErrSourceOutsideConfigRepo)
+		}
+		if resolver, ok := r.FS.(Resolver); ok {
+			resolved, err := resolver.Resolve(rel)
+			if errors.Is(err, types.ErrSourceOutsideConfigRepo) {
+				return "", fmt.Errorf("%s: %w", source, err)
+			}
+			return resolved, err
+		}
+		return rel, nil
+	}
+	root, err := r.realPath()
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(r.Path, source))
+	if err != nil {
+		return "", err
+	}
+	resolved, err = filepath.Abs(resolved)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil {
+		return "", err
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s: %w", source, types.ErrSourceOutsideConfigRepo)
+	}
+	return rel, nil
+}
+
+// realPath returns the absolute path of the checkout at Path, after following symlinks
+func (r *SourceRoot) realPath() (string, error) {
+	root, err := filepath.EvalSymlinks(r.Path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(root)
+}
+
+// fsys returns the filesystem sources are read from
+func (r *SourceRoot) fsys() (fs.FS, error) {
+	if r.FS != nil {
+		return r.FS, nil
+	}
+	root, err := r.realPath()
+	if err != nil {
+		return nil, err
+	}
+	return os.DirFS(root), nil
+}
+
+// ReadFile reads the relative source path, confined to its root
+func (r *SourceRoot) ReadFile(source string) ([]byte, error) {
+	resolved, err := r.Resolve(source)
+	if err != nil {
+		return nil, err
+	}
+	name, rel := SplitSource(resolved)
+	root, err := r.root(name)
+	if err != nil {
+		return nil, err
+	}
+	fsys, err := root.fsys()
+	if err != nil {
+		return nil, err
+	}
+	return fs.ReadFile(fsys, rel)
+}
+
+// ReadStructured reads the relative source path as format (FormatJSON or FormatYAML), confined to
+// its root, returning the decoded document, decrypted if it is SOPS encrypted
+func (r *SourceRoot) ReadStructured(source string, format SourceFormat) (interface{}, error) {
+	buf, err := r.ReadFile(source)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	switch format {
+	case FormatJSON:
+		// Very large numbers get converted to floating points if you use json.Unmarshall
+		// Decoding avoids this issue by converting numbers to json.Number type
+		// https://stackoverflow.com/questions/22343083/json-marshaling-with-long-numbers-in-golang-gives-floating-point-number
+		decoder := json.NewDecoder(bytes.NewReader(buf))
+		decoder.UseNumber()
+		if err := decoder.Decode(&doc); err != nil {
+			return nil, err
+		}
+	case FormatYAML:
+		if err := yaml.Unmarshal(buf, &doc); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, types.ErrUnsupportedSourceType
+	}
+	return r.decrypt(doc, buf)
+}
+
+// ReadDir returns the entries of the relative directory dir (`name:dir` in a named root), sorted
+// by name. Like Glob, it isnt confined beyond its root.
+func (r *SourceRoot) ReadDir(dir string) ([]fs.DirEntry, error) {
+	name, p := SplitSource(dir)
+	p = path.Clean(p)
+	if !fs.ValidPath(p) {
+		return nil, fmt.Errorf("%s: %w", dir, types.ErrSourceOutsideConfigRepo)
+	}
+	root, err := r.root(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", dir, err)
+	}
+	fsys, err := root.fsys()
+	if err != nil {
+		return nil, err
+	}
+	return fs.ReadDir(fsys, p)
+}
+
+// FilePath returns the file the relative source path reads from, confined like ReadFile. It is an
+// error for the source to be in a root read from an FS rather than a checkout.
+func (r *SourceRoot) FilePath(source string) (string, error) {
+	resolved, err := r.Resolve(source)
+	if err != nil {
+		return "", err
+	}
+	name, rel := SplitSource(resolved)
+	root, err := r.root(name)
+	if err != nil {
+		return "", err
+	}
+	if root.FS != nil {
+		return "", fmt.Errorf("%s is not in a checkout", source)
+	}
+	dir, err := root.realPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.FromSlash(rel)), nil
+}
+
+// Glob returns the paths (relative to the root, prefixed with the root name in named roots)
+// matching the relative pattern. Matches are not resolved; read them with ReadFile to confine them.
+func (r *SourceRoot) Glob(pattern string) ([]string, error) {
+	name, p := SplitSource(pattern)
+	p = path.Clean(p)
+	if !fs.ValidPath(p) {
+		return nil, fmt.Errorf("%s: %w", pattern, types.ErrSourceOutsideConfigRepo)
+	}
+	root, err := r.root(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", pattern, err)
+	}
+	fsys, err := root.fsys()
+	if err != nil {
+		return nil, err
+	}
+	matches, err := fs.Glob(fsys, p)
+	if err != nil {
+		return nil, err
+	}
+	for i := range matches {
+		matches[i] = JoinSource(name, matches[i])
+	}
+	return matches, nil
+}
+
+// decrypt returns doc, read as raw, decrypted if it is SOPS encrypted
+func (r *SourceRoot) decrypt(doc interface{}, raw []byte) (interface{}, error) {
+	if !sops.IsEncrypted(doc) {
+		return doc, nil
+	}
+	if r.Decrypt == nil {
+		return nil, types.ErrEncryptedSourceWithoutKeys
+	}
+	return r.Decrypt(doc, raw)
+}
@@ -0,0 +1,173 @@
+package datasource
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	_ "github.com/tumblr/k8s-config-projector/internal/pkg/testing"
+	"github.com/tumblr/k8s-config-projector/pkg/types"
+)
+
+var (
+	testRoot = &SourceRoot{Path: "test/sources"}
+)
+
+func TestSourceRootFollowsSymlinksInside(t *testing.T) {
+	if _, err := testRoot.ReadFile("links/inside.json"); err != nil {
+		t.Fatalf("Expected symlink inside the config repo to be readable, but got %s", err)
+	}
+}
+
+func TestSourceRootRejectsEscapes(t *testing.T) {
+	for _, source := range []string{"links/outside.yaml", "../manifests/raw1.yaml", "doods/../../manifests/raw1.yaml"} {
+		_, err := testRoot.ReadFile(source)
+		if !errors.Is(err, types.ErrSourceOutsideConfigRepo) {
+			t.Fatalf("Expected reading %s to fail with %s, but got %v", source, types.ErrSourceOutsideConfigRepo, err)
+		}
+	}
+}
+
+func TestSourceRootAllowedPrefixes(t *testing.T) {
+	root := &SourceRoot{Path: "test/sources", AllowedPrefixes: []string{"doods/", "generated"}}
+	allowed := []string{"doods/a.php", "doods/*.php", "generated/sample.json", "./generated/sample.json"}
+	for _, source := range allowed {
+		if !root.Allows(source) {
+			t.Fatalf("Expected %s to be allowed by %v", source, root.AllowedPrefixes)
+		}
+	}
+	denied := []string{"test.json", "doodsx/a.php", "generatedx.json", "links/inside.json"}
+	for _, source := range denied {
+		if root.Allows(source) {
+			t.Fatalf("Expected %s to not be allowed by %v", source, root.AllowedPrefixes)
+		}
+	}
+	// symlinks are checked against the prefixes after they are resolved
+	root.AllowedPrefixes = []string{"links/"}
+	if _, err := root.ReadFile("links/inside.json"); !errors.Is(err, types.ErrSourceNotAllowed) {
+		t.Fatalf("Expected links/inside.json to resolve outside of links/ and fail with %s, but got %v", types.ErrSourceNotAllowed, err)
+	}
+}
+
+func TestSourceRootFS(t *testing.T) {
+	root := &SourceRoot{
+		FS: fstest.MapFS{
+			"app/a.php":       {Data: []byte("a\n")},
+			"app/b.php":       {Data: []byte("b")},
+			"app/config.json": {Data: []byte(`{"hostport": "localhost:80"}`)},
+		},
+		AllowedPrefixes: []string{"app/"},
+	}
+	projected, err := (&DataSource{Source: "app/*.php", SourceFormat: FormatGlob, OutputFormat: OutputRaw}).ProjectFromRoot(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(projected) != 2 || string(projected["a.php"]) != "a" || string(projected["b.php"]) != "b" {
+		t.Fatalf("Expected a.php and b.php to be globbed from the FS, but got %v", projected)
+	}
+	d := &DataSource{Source: "app/config.json", OutputFile: "hostport", Extract: "$.hostport"}
+	if err := d.SetDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	if projected, err = d.ProjectFromRoot(root); err != nil || string(projected["hostport"]) != "localhost:80" {
+		t.Fatalf("Expected hostport to be extracted from the FS, but got %v %v", projected, err)
+	}
+	for _, source := range []string{"../app/a.php", "app/../../a.php"} {
+		if _, err := root.ReadFile(source); !errors.Is(err, types.ErrSourceOutsideConfigRepo) {
+			t.Fatalf("Expected reading %s to fail with %s, but got %v", source, types.ErrSourceOutsideConfigRepo, err)
+		}
+	}
+	if _, err := root.Glob("../*"); !errors.Is(err, types.ErrSourceOutsideConfigRepo) {
+		t.Fatalf("Expected globbing ../* to fail with %s, but got %v", types.ErrSourceOutsideConfigRepo, err)
+	}
+}
+
+func TestSourceRootNamedRoots(t *testing.T) {
+	root := &SourceRoot{
+		Path: "test/sources",
+		Roots: map[string]*SourceRoot{
+			"infra": {FS: fstest.MapFS{
+				"generated/hosts.json": {Data: []byte(`{"port": 3306}`)},
+				"hosts/a.txt":          {Data: []byte("a")},
+				"hosts/b.txt":          {Data: []byte("b")},
+			}},
+		},
+	}
+	if raw, err := root.ReadFile("infra:generated/hosts.json"); err != nil || string(raw) != `{"port": 3306}` {
+		t.Fatalf("Expected to read infra:generated/hosts.json, but got %s %v", raw, err)
+	}
+	// unprefixed sources are still read from the default root
+	if _, err := root.ReadFile("test.json"); err != nil {
+		t.Fatal(err)
+	}
+	d := &DataSource{Source: "infra:hosts/*.txt"}
+	if err := d.SetDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	projected, sources, err := d.ProjectWithSources(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(projected) != 2 || string(projected["a.txt"]) != "a" || sources["b.txt"] != "infra:hosts/b.txt" {
+		t.Fatalf("Expected a.txt and b.txt to be globbed from infra, but got %v %v", projected, sources)
+	}
+	if !d.Projects("infra:hosts/a.txt") || d.Projects("hosts/a.txt") {
+		t.Fatal("Expected the glob to only project files in the infra root")
+	}
+	d = &DataSource{Source: "infra:generated/hosts.json"}
+	if err := d.SetDefaults(); err != nil {
+		t.Fatal(err)
+	}
+	if d.OutputFile != "hosts.json" {
+		t.Fatalf("Expected output_file to default to hosts.json, but got %s", d.OutputFile)
+	}
+
+	if _, err := root.ReadFile("flags:enabled.json"); !errors.Is(err, types.ErrUnknownConfigRoot) {
+		t.Fatalf("Expected an unknown root to fail with %s, but got %v", types.ErrUnknownConfigRoot, err)
+	}
+	if _, err := root.ReadFile("infra:../test.json"); !errors.Is(err, types.ErrSourceOutsideConfigRepo) {
+		t.Fatalf("Expected escaping the infra root to fail with %s, but got %v", types.ErrSourceOutsideConfigRepo, err)
+	}
+
+	root.AllowedPrefixes = []string{"infra:hosts/", "doods"}
+	for source, allowed := range map[string]bool{"infra:hosts/a.txt": true, "doods/a.php": true, "infra:generated/hosts.json": false, "hosts/a.txt": false, "infra:doods/a.php": false} {
+		if root.Allows(source) != allowed {
+			t.Fatalf("Expected Allows(%s) to be %t with %v", source, allowed, root.AllowedPrefixes)
+		}
+	}
+}
+
+func TestValidateRejectsParentSources(t *testing.T) {
+	for _, source := range []string{"../../etc/passwd", "infra:../../etc/passwd"} {
+		d := &DataSource{Source: source}
+		if err := d.SetDefaults(); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Validate(); !errors.Is(err, types.ErrSourceOutsideConfigRepo) {
+			t.Fatalf("Expected %s for %s, but got %v", types.ErrSourceOutsideConfigRepo, source, err)
+		}
+	}
+}
+
+func TestSourceRootBrowse(t *testing.T) {
+	entries, err := testRoot.ReadDir("doods")
+	if err != nil || len(entries) != 3 || entries[0].Name() != "a.php" {
+		t.Fatalf("Expected the 3 files in doods, but got %v %v", entries, err)
+	}
+	if _, err := testRoot.ReadDir("../"); !errors.Is(err, types.ErrSourceOutsideConfigRepo) {
+		t.Fatalf("Expected listing ../ to fail with %s, but got %v", types.ErrSourceOutsideConfigRepo, err)
+	}
+	p, err := testRoot.FilePath("links/inside.json")
+	if err != nil || !strings.HasSuffix(p, filepath.FromSlash("test/sources/test.json")) || !filepath.IsAbs(p) {
+		t.Fatalf("Expected the absolute path the symlink resolves to, but got %s %v", p, err)
+	}
+	doc, err := testRoot.ReadStructured("test.yaml", FormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := doc.(map[string]interface{})["astring"]; !ok || s != "hello world 1236969" {
+		t.Fatalf("Expected the decoded document, but got %v", doc)
+	}
+}
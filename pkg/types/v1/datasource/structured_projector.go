@@ -2,9 +2,6 @@ package datasource
 
 import (
 	"encoding/json"
-	"io/ioutil"
-	"path/filepath"
-	"strings"
 
 	"github.com/ghodss/yaml"
 	"github.com/oliveagle/jsonpath"
@@ -36,27 +33,25 @@ func validateBeforeStructuredProjection(d *DataSource) error {
 	return nil
 }
 
+// extractionError wraps an error evaluating a jsonpath expression with the field and expression that failed
+func extractionError(field string, expr string, err error) error {
+	pe := types.NewFieldError(field, err)
+	pe.JSONPath = expr
+	return pe
+}
+
 // projectJSON will extract fields from the json source and project it into
 // the desired output format
 // returns a list of data item: result string
-func (d *DataSource) projectJSON(basePath string) (map[string][]byte, error) {
+func (d *DataSource) projectJSON(root *SourceRoot) (map[string][]byte, error) {
 	if err := validateBeforeStructuredProjection(d); err != nil {
 		return nil, err
 	}
 	// read the JSON source file
-	var jsonData interface{}
-	bytes, err := ioutil.ReadFile(filepath.Join(basePath, d.Source))
+	jsonData, err := root.ReadStructured(d.Source, FormatJSON)
 	if err != nil {
 		return nil, err
 	}
-	// Very large numbers get converted to floating points if you use json.Unmarshall
-	// Decoding avoids this issue by converting numbers to json.Number type
-	// https://stackoverflow.com/questions/22343083/json-marshaling-with-long-numbers-in-golang-gives-floating-point-number
-	decoder := json.NewDecoder(strings.NewReader(string(bytes)))
-	decoder.UseNumber()
-	if err = decoder.Decode(&jsonData); err != nil {
-		return nil, err
-	}
 
 	// this is the path for handling the jsonPath entry, it parses the field and returns a raw value
 	// NOTE: this bails out before we get to the FieldExtractions projection below
@@ -64,10 +59,13 @@ func (d *DataSource) projectJSON(basePath string) (map[string][]byte, error) {
 		res, err := jsonpath.JsonPathLookup(jsonData, d.Extract)
 		// this will probably explode if the dereferenced value isnt a string
 		if err != nil {
-			return nil, err
+			return nil, extractionError("extract", d.Extract, err)
 		}
 		v, err := convertInterfaceValueToBytes(res)
-		return map[string][]byte{d.OutputFile: v}, err
+		if err != nil {
+			return nil, extractionError("extract", d.Extract, err)
+		}
+		return map[string][]byte{d.OutputFile: v}, nil
 	}
 
 	// this is a map of a subset of labels to json fields (which may or may not be structured)
@@ -76,7 +74,7 @@ func (d *DataSource) projectJSON(basePath string) (map[string][]byte, error) {
 		res, err := jsonpath.JsonPathLookup(jsonData, string(path))
 		// this will probably explode if the dereferenced value isnt a string
 		if err != nil {
-			return nil, err
+			return nil, extractionError("field_extractions."+label, path, err)
 		}
 		resArray[label] = res
 	}
@@ -100,17 +98,12 @@ func (d *DataSource) projectJSON(basePath string) (map[string][]byte, error) {
 // projectYAML will extract fields from the yaml source and project it into
 // the desired output format
 // returns a list of data item: result string
-func (d *DataSource) projectYAML(basePath string) (map[string][]byte, error) {
+func (d *DataSource) projectYAML(root *SourceRoot) (map[string][]byte, error) {
 	if err := validateBeforeStructuredProjection(d); err != nil {
 		return nil, err
 	}
 	// read the YAML source file
-	var yamlData interface{}
-	bytes, err := ioutil.ReadFile(filepath.Join(basePath, d.Source))
-	if err != nil {
-		return nil, err
-	}
-	err = yaml.Unmarshal(bytes, &yamlData)
+	yamlData, err := root.ReadStructured(d.Source, FormatYAML)
 	if err != nil {
 		return nil, err
 	}
@@ -121,10 +114,13 @@ func (d *DataSource) projectYAML(basePath string) (map[string][]byte, error) {
 		res, err := jsonpath.JsonPathLookup(yamlData, d.Extract)
 		// this will probably explode if the dereferenced value isnt a string
 		if err != nil {
-			return nil, err
+			return nil, extractionError("extract", d.Extract, err)
 		}
 		v, err := convertInterfaceValueToBytes(res)
-		return map[string][]byte{d.OutputFile: v}, err
+		if err != nil {
+			return nil, extractionError("extract", d.Extract, err)
+		}
+		return map[string][]byte{d.OutputFile: v}, nil
 	}
 
 	// this is a map of a subset of labels to json fields (which may or may not be structured)
@@ -133,7 +129,7 @@ func (d *DataSource) projectYAML(basePath string) (map[string][]byte, error) {
 		res, err := jsonpath.JsonPathLookup(yamlData, string(path))
 		// this will probably explode if the dereferenced value isnt a string
 		if err != nil {
-			return nil, err
+			return nil, extractionError("field_extractions."+label, path, err)
 		}
 		resArray[label] = res
 	}
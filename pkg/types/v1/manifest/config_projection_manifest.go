@@ -4,30 +4,183 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
 
-	"github.com/tumblr/k8s-config-projector/internal/pkg/conf"
+	"github.com/tumblr/k8s-config-projector/pkg/interpolate"
+	"github.com/tumblr/k8s-config-projector/pkg/library"
+	"github.com/tumblr/k8s-config-projector/pkg/policy"
+	"github.com/tumblr/k8s-config-projector/pkg/sops"
+	"github.com/tumblr/k8s-config-projector/pkg/targets"
 	"github.com/tumblr/k8s-config-projector/pkg/types"
 	ds "github.com/tumblr/k8s-config-projector/pkg/types/v1/datasource"
-	"gopkg.in/yaml.v2"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/kubernetes/pkg/printers"
 )
 
 var (
 	nameValidationRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9\-\.]+$`)
+	// documentSeparator matches the lines separating yaml documents
+	documentSeparator = regexp.MustCompile(`^---\s*(#.*)?$`)
 )
 
+const (
+	// APIVersion is the apiVersion of v1 manifests. Manifests without an apiVersion are v1 too
+	APIVersion = "projector.tumblr.com/v1"
+	// Kind is the kind of projection manifests
+	Kind = "ConfigProjection"
+	// ResourceConfigMap projects the manifest into a ConfigMap. This is the default
+	ResourceConfigMap = "ConfigMap"
+	// AnnotationConfigCommit annotates projected resources with the config repo commit their sources were read from
+	AnnotationConfigCommit = "tumblr.com/config-commit"
+	// ResourceSecret projects the manifest into a Secret. Only Secrets may project values decrypted from SOPS sources
+	ResourceSecret = "Secret"
+)
+
+// Config is what a manifest needs to know about where, and how, it is projected. The CLI's
+// conf.Config satisfies it, as does the configuration built by the projector package.
+type Config interface {
+	// ConfigDir is the root of the config repo checkout sources are projected from
+	ConfigDir() string
+	// ConfigFS, if not nil, is the config repo sources are projected from instead of ConfigDir
+	ConfigFS() fs.FS
+	// ConfigRoots are the checkouts of named config roots, which sources like `name:path` project from
+	ConfigRoots() map[string]string
+	// ConfigCommit, if not empty, is the config repo commit sources are projected from
+	ConfigCommit() string
+	// ManifestDir is the directory manifests are loaded from, which policy rules are relative to
+	ManifestDir() string
+	Generation() string
+	LabelVersionKey() string
+	LabelManagedKey() string
+	// AllowedSourcePrefixes returns the source path prefixes manifests in namespace may project from; nil means no restriction
+	AllowedSourcePrefixes(namespace string) []string
+	// Policy is the source access policy, or nil if there is none
+	Policy() *policy.Policy
+	// SopsKeys decrypt SOPS encrypted sources, or nil if there are none
+	SopsKeys() *sops.Keys
+	// Vars are substituted for `${var}` in manifests as they are loaded
+	Vars() interpolate.Vars
+	// Targets are the targets manifests are projected for, if any. Variables they define are
+	// substituted per target, by ForTarget
+	Targets() []targets.Target
+	// Library is the datasource templates manifests include, or nil if there are none
+	Library() *library.Library
+}
+
 // ConfigProjectionManifest is the user-supplied config ConfigProjectionManifest
 type ConfigProjectionManifest struct {
-	Name      string           `yaml:"name"`
-	Namespace string           `yaml:"namespace"`
-	Data      []*ds.DataSource `yaml:"data"`
+	// APIVersion and Kind are optional in v1 manifests. Manifests of other versions are converted
+	// to this one, keeping the apiVersion they were written in
+	APIVersion string           `yaml:"apiVersion,omitempty"`
+	Kind       string           `yaml:"kind,omitempty"`
+	Name       string           `yaml:"name"`
+	Namespace  string           `yaml:"namespace"`
+	Data       []*ds.DataSource `yaml:"data"`
+	// Resource is the kind of resource to project into: ConfigMap (default) or Secret
+	Resource string `yaml:"resource,omitempty"`
+	// Targets selects the targets (see --targets) this manifest is projected for; all of them if empty
+	Targets targets.Selector `yaml:"targets,omitempty"`
+	// Matrix expands the manifest into one manifest per combination of its dimensions' values,
+	// each with the values substituted for `${dimension}`
+	Matrix Matrix `yaml:"matrix,omitempty"`
+	// Include appends the datasources of library templates (see --library) to Data
+	Include []library.Include `yaml:"include,omitempty"`
+	// Labels and Annotations are added to the projected resource. Only v2 manifests can set them
+	Labels      map[string]string `yaml:"-"`
+	Annotations map[string]string `yaml:"-"`
+
+	c Config
+	// path is the file this manifest was loaded from, if any
+	path string
+	// document is the line its document starts on, if the file holds several
+	document int
+	// positions are where each field is in the manifest yaml, for locating errors
+	positions positions
+	// templated is set when the manifest references matrix or target variables, so must be
+	// expanded, or projected ForTarget
+	templated bool
+	// combination is the matrix values this manifest was expanded with, if any
+	combination interpolate.Vars
+	// included describes the datasources at the end of Data that came from Include, in order
+	included []inclusion
+}
+
+// inclusion is where an included datasource came from
+type inclusion struct {
+	// include is the index in the manifest's Include
+	include int
+	// template is the template the datasource is in, after any that included it
+	template string
+	// index is the index of the datasource in the template's data
+	index int
+}
+
+// Matrix maps dimensions to the values a manifest is expanded with
+type Matrix map[string][]string
+
+// dimensions returns the matrix's dimensions, sorted
+func (mx Matrix) dimensions() []string {
+	dims := make([]string, 0, len(mx))
+	for d := range mx {
+		dims = append(dims, d)
+	}
+	sort.Strings(dims)
+	return dims
+}
+
+// Combinations returns every combination of the matrix's values, varying the last dimension (in
+// sorted order) fastest, and each dimension's values in the order they are listed
+func (mx Matrix) Combinations() []interpolate.Vars {
+	combinations := []interpolate.Vars{{}}
+	for _, d := range mx.dimensions() {
+		next := make([]interpolate.Vars, 0, len(combinations)*len(mx[d]))
+		for _, c := range combinations {
+			for _, v := range mx[d] {
+				n := interpolate.Merge(c)
+				n[d] = v
+				next = append(next, n)
+			}
+		}
+		combinations = next
+	}
+	return combinations
+}
 
-	c conf.Config
+// Validate makes sure every dimension is a valid variable name, with distinct values
+func (mx Matrix) Validate() error {
+	for _, d := range mx.dimensions() {
+		if !interpolate.ValidName(d) {
+			return fmt.Errorf("invalid dimension name %q", d)
+		}
+		if len(mx[d]) == 0 {
+			return fmt.Errorf("%s: no values", d)
+		}
+		seen := map[string]bool{}
+		for _, v := range mx[d] {
+			if seen[v] {
+				return fmt.Errorf("%s: duplicate value %q", d, v)
+			}
+			seen[v] = true
+		}
+	}
+	return nil
+}
+
+// FormatCombination describes matrix values, like `env=production region=us-east-1`
+func FormatCombination(combination interpolate.Vars) string {
+	kvs := make([]string, 0, len(combination))
+	for k, v := range combination {
+		kvs = append(kvs, k+"="+v)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, " ")
 }
 
 // GetName - return the name of the ConfigProjectionManifest
@@ -40,6 +193,29 @@ func (m *ConfigProjectionManifest) GetNamespace() string {
 	return m.Namespace
 }
 
+// GetPath - return the file the ConfigProjectionManifest was loaded from, if any
+func (m *ConfigProjectionManifest) GetPath() string {
+	return m.path
+}
+
+// Combination returns the matrix values this manifest was expanded with, or nil if it wasnt
+func (m *ConfigProjectionManifest) Combination() interpolate.Vars {
+	return m.combination
+}
+
+// Origin describes where the manifest came from: its path (and line, in files holding several
+// manifests), and matrix combination, if any
+func (m *ConfigProjectionManifest) Origin() string {
+	origin := m.path
+	if m.document > 0 {
+		origin = fmt.Sprintf("%s:%d", origin, m.document)
+	}
+	if m.combination == nil {
+		return origin
+	}
+	return fmt.Sprintf("%s (matrix %s)", origin, FormatCombination(m.combination))
+}
+
 // String returns a string rep for debugging
 func (m *ConfigProjectionManifest) String() string {
 	items := []string{}
@@ -57,49 +233,350 @@ func (m *ConfigProjectionManifest) String() string {
 // https://v1-7.docs.kubernetes.io/docs/api-reference/v1.7/#configmap-v1-core
 // https://godoc.org/k8s.io/api/core/v1#ConfigMap
 func (m *ConfigProjectionManifest) Project() (v1.ConfigMap, error) {
-	basePath := m.c.ConfigDir()
+	cm, _, err := m.ProjectWithLineage()
+	return cm, err
+}
 
-	// each []byte is a projected file, each key is a file name
-	dataList := map[string]string{}
+// Lineage describes where a projected data key came from
+type Lineage struct {
+	Key string `json:"key"`
+	// DataSource is the index of the datasource in the manifest's `data` list that projected Key
+	DataSource int `json:"datasource"`
+	// Source is the file Key was read from, relative to the config repo (and prefixed with `name:`
+	// when it is in a named config root)
+	Source string `json:"source"`
+	// Root is the named config root Source is in, or empty for the default config repo
+	Root string `json:"root,omitempty"`
+	// Template is the library template the datasource was included from, if any. DataSource is
+	// then the index of the datasource in the template's `data`
+	Template         string            `json:"template,omitempty"`
+	SourceFormat     string            `json:"source_format"`
+	OutputFormat     string            `json:"output_format,omitempty"`
+	Extract          string            `json:"extract,omitempty"`
+	FieldExtractions map[string]string `json:"field_extractions,omitempty"`
+}
+
+// ProjectWithLineage is Project, also returning the lineage of every data key, sorted by key
+func (m *ConfigProjectionManifest) ProjectWithLineage() (v1.ConfigMap, []Lineage, error) {
 	cm := v1.ConfigMap{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      m.Name,
-			Namespace: m.Namespace,
-			Labels: map[string]string{
-				m.c.LabelVersionKey(): m.c.Generation(),
-				m.c.LabelManagedKey(): "true",
-			},
-		},
+		ObjectMeta: m.objectMeta(),
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "ConfigMap",
 			APIVersion: "v1",
 		},
 	}
+	// a ConfigMap never gets to decrypt SOPS sources, even when the manifest is for a Secret
+	dataList, lineage, err := m.projectData(false)
+	if err != nil {
+		return cm, nil, err
+	}
+	cm.Data = dataList
+	return cm, lineage, nil
+}
+
+// Explanation is how one of a manifest's datasources projects
+type Explanation struct {
+	*ds.Explanation
+	// Index is the index of the datasource in the manifest's `data`; or in Template's, when it was
+	// included from a library template
+	Index    int
+	Template string
+}
+
+// Explain projects each datasource like ProjectWithLineage, but explaining each step, and going on
+// past datasources that fail. Their errors are located like those of ProjectWithLineage.
+func (m *ConfigProjectionManifest) Explain() ([]Explanation, error) {
+	if m.templated {
+		return nil, m.locate(types.NoDataSource, fmt.Errorf("%w: manifest uses matrix or target variables, and must be expanded, or projected for a target", types.ErrUndefinedVariable))
+	}
+	root := m.sourceRoot(false)
+	explanations := make([]Explanation, len(m.Data))
+	for i, d := range m.Data {
+		e := Explanation{Explanation: d.Explain(root), Index: i}
+		if e.Err != nil {
+			e.Err = m.locate(i, e.Err)
+		}
+		if inc := m.inclusion(i); inc != nil {
+			e.Index, e.Template = inc.index, inc.template
+		}
+		explanations[i] = e
+	}
+	return explanations, nil
+}
+
+// ProjectSecret - returns the manifest projected into a Secret. Only manifests with
+// `resource: Secret` may do this, and only they may project values from SOPS encrypted sources.
+// https://godoc.org/k8s.io/api/core/v1#Secret
+func (m *ConfigProjectionManifest) ProjectSecret() (v1.Secret, error) {
+	secret := v1.Secret{
+		ObjectMeta: m.objectMeta(),
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Secret",
+			APIVersion: "v1",
+		},
+		Type: v1.SecretTypeOpaque,
+	}
+	if !m.IsSecret() {
+		return secret, m.locate(types.NoDataSource, types.NewFieldError("resource", types.ErrUnsupportedResource))
+	}
+	dataList, _, err := m.projectData(true)
+	if err != nil {
+		return secret, err
+	}
+	secret.Data = map[string][]byte{}
+	for k, v := range dataList {
+		secret.Data[k] = []byte(v)
+	}
+	return secret, nil
+}
 
+// DependsOn returns true if any datasource projects source, a path relative to the config repo.
+// Globs match files that dont exist yet, so a file added to a globbed directory counts.
+func (m *ConfigProjectionManifest) DependsOn(source string) bool {
 	for _, d := range m.Data {
-		projectedDataItems, err := d.Project(basePath)
+		if d.Projects(source) {
+			return true
+		}
+	}
+	return false
+}
+
+// Selects returns true if the manifest is projected for target t
+func (m *ConfigProjectionManifest) Selects(t targets.Target) bool {
+	return m.Targets.Matches(t)
+}
+
+// ForTarget returns the manifest as it is projected for target t, with `${var}` replaced by the
+// target's vars (which take precedence over Config.Vars), then validated. It is an error to use a
+// variable that isnt defined.
+func (m *ConfigProjectionManifest) ForTarget(t targets.Target) (ConfigProjectionManifest, error) {
+	n := m.copy()
+	var vars interpolate.Vars
+	if m.c != nil {
+		vars = m.c.Vars()
+	}
+	if err := n.expandVars(interpolate.Merge(vars, t.Variables()), nil, "target "+t.Name); err != nil {
+		return n, err
+	}
+	if err := n.SetDefaults(); err != nil {
+		return n, err
+	}
+	return n, n.Validate()
+}
+
+// Expand returns the manifests a manifest with a matrix expands into: one per combination, with
+// its values substituted (taking precedence over Config.Vars), each validated. A manifest without
+// a matrix expands into itself. Problems with any expansion are returned, and it is left out.
+func (m *ConfigProjectionManifest) Expand() ([]ConfigProjectionManifest, []error) {
+	if len(m.Matrix) == 0 {
+		return []ConfigProjectionManifest{*m}, nil
+	}
+	var vars interpolate.Vars
+	if m.c != nil {
+		vars = m.c.Vars()
+	}
+	// target variables are still left for ForTarget, unless they are matrix dimensions
+	later := laterVars(m.c)
+	for d := range m.Matrix {
+		delete(later, d)
+	}
+	expanded := []ConfigProjectionManifest{}
+	errs := []error{}
+	for _, c := range m.Matrix.Combinations() {
+		n := m.copy()
+		n.Matrix = nil
+		n.combination = c
+		if err := n.expandVars(interpolate.Merge(vars, c), later, "matrix "+FormatCombination(c)); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := n.SetDefaults(); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if e := n.ValidateAll(); len(e) > 0 {
+			errs = append(errs, e...)
+			continue
+		}
+		expanded = append(expanded, n)
+	}
+	return expanded, errs
+}
+
+// copy returns a copy of the manifest that can be interpolated without changing this one
+func (m *ConfigProjectionManifest) copy() ConfigProjectionManifest {
+	n := *m
+	n.templated = false
+	n.Data = make([]*ds.DataSource, len(m.Data))
+	for i, d := range m.Data {
+		c := *d
+		n.Data[i] = &c
+	}
+	return n
+}
+
+// expandVars replaces `${var}` in the name, namespace, and each datasource's source, output_file,
+// extract and field_extractions with vars. References to variables in later are left as they are,
+// for ForTarget. Errors are prefixed with context, if given.
+func (m *ConfigProjectionManifest) expandVars(vars interpolate.Vars, later map[string]bool, context string) error {
+	expand := func(dataSource int, field string, source string, v string) (string, error) {
+		var s string
+		var err error
+		if later == nil {
+			s, err = interpolate.String(v, vars)
+		} else {
+			s, err = interpolate.Partial(v, vars, later)
+		}
 		if err != nil {
-			return cm, err
+			if context != "" {
+				err = fmt.Errorf("%s: %w", context, err)
+			}
+			pe := types.NewFieldError(field, err)
+			pe.Source = source
+			return "", m.locate(dataSource, pe)
+		}
+		if later != nil && interpolate.Contains(s) {
+			m.templated = true
+		}
+		return s, nil
+	}
+	var err error
+	if m.Name, err = expand(types.NoDataSource, "name", "", m.Name); err != nil {
+		return err
+	}
+	if m.Namespace, err = expand(types.NoDataSource, "namespace", "", m.Namespace); err != nil {
+		return err
+	}
+	for i, d := range m.Data {
+		i, source := i, d.Source
+		err := d.Interpolate(func(field string, v string) (string, error) {
+			return expand(i, field, source, v)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// laterVars returns the variables defined by cfg's targets, which are substituted by ForTarget
+// instead of as the manifest is loaded
+func laterVars(cfg Config) map[string]bool {
+	if cfg == nil || len(cfg.Targets()) == 0 {
+		return nil
+	}
+	later := map[string]bool{targets.NameVar: true}
+	for _, t := range cfg.Targets() {
+		for k := range t.Vars {
+			later[k] = true
+		}
+	}
+	return later
+}
+
+// IsSecret returns true if the manifest projects into a Secret instead of a ConfigMap
+func (m *ConfigProjectionManifest) IsSecret() bool {
+	return m.Resource == ResourceSecret
+}
+
+// objectMeta returns the metadata for the projected resource
+func (m *ConfigProjectionManifest) objectMeta() metav1.ObjectMeta {
+	meta := metav1.ObjectMeta{
+		Name:      m.Name,
+		Namespace: m.Namespace,
+		Labels: map[string]string{
+			m.c.LabelVersionKey(): m.c.Generation(),
+			m.c.LabelManagedKey(): "true",
+		},
+	}
+	for k, v := range m.Labels {
+		meta.Labels[k] = v
+	}
+	if len(m.Annotations) > 0 {
+		meta.Annotations = map[string]string{}
+		for k, v := range m.Annotations {
+			meta.Annotations[k] = v
+		}
+	}
+	if commit := m.c.ConfigCommit(); commit != "" {
+		if meta.Annotations == nil {
+			meta.Annotations = map[string]string{}
+		}
+		meta.Annotations[AnnotationConfigCommit] = commit
+	}
+	return meta
+}
+
+// projectData projects every datasource, returning the data items keyed by file name, and the
+// lineage of each, sorted by key. decrypt allows values to be extracted from SOPS encrypted sources.
+func (m *ConfigProjectionManifest) projectData(decrypt bool) (map[string]string, []Lineage, error) {
+	if m.templated {
+		return nil, nil, m.locate(types.NoDataSource, fmt.Errorf("%w: manifest uses matrix or target variables, and must be expanded, or projected for a target", types.ErrUndefinedVariable))
+	}
+	root := m.sourceRoot(decrypt)
+
+	// each []byte is a projected file, each key is a file name
+	dataList := map[string]string{}
+	lineage := []Lineage{}
+	for i, d := range m.Data {
+		projectedDataItems, sources, err := d.ProjectWithSources(root)
+		if err != nil {
+			return nil, nil, m.locate(i, err)
 		}
 		for k, v := range projectedDataItems {
 			if _, ok := dataList[k]; ok {
-				return cm, errors.New("duplicate projection key " + k + " in projection sources")
+				pe := types.NewFieldError("output_file", errors.New("duplicate projection key "+k+" in projection sources"))
+				pe.Source = d.Source
+				return nil, nil, m.locate(i, pe)
 			}
 			// NOTE: the ConfigMap takes strings, not []bytes so we need to type conversions
 			// to bring []byte into strings
 			dataList[k] = string(v)
+			index, template := i, ""
+			if inc := m.inclusion(i); inc != nil {
+				index, template = inc.index, inc.template
+			}
+			lineage = append(lineage, Lineage{
+				Key:              k,
+				DataSource:       index,
+				Template:         template,
+				Source:           sources[k],
+				Root:             rootOf(sources[k]),
+				SourceFormat:     string(d.SourceFormat),
+				OutputFormat:     string(d.OutputFormat),
+				Extract:          d.Extract,
+				FieldExtractions: d.FieldExtractions,
+			})
 		}
 	}
-	cm.Data = dataList
-	return cm, nil
+	sort.Slice(lineage, func(i, j int) bool { return lineage[i].Key < lineage[j].Key })
+	return dataList, lineage, nil
 }
 
-// SetDefaults after loading from a yaml
+// rootOf returns the name of the config root source is in
+func rootOf(source string) string {
+	root, _ := ds.SplitSource(source)
+	return root
+}
+
+// SetDefaults after loading from a yaml. Datasources with sources using matrix or target variables
+// are left until the manifest is expanded, so their formats are inferred from the resolved source.
 func (m *ConfigProjectionManifest) SetDefaults() error {
-	for _, d := range m.Data {
-		err := d.SetDefaults()
-		if err != nil {
-			return err
+	if m.Resource == "" {
+		m.Resource = ResourceConfigMap
+	}
+	for i, d := range m.Data {
+		if m.deferred(d.Source) {
+			continue
+		}
+		if err := d.SetDefaults(); err != nil {
+			field := "source_format"
+			if errors.Is(err, types.ErrUnableToInferOutputFormat) {
+				field = "output_format"
+			}
+			pe := types.NewFieldError(field, err)
+			pe.Source = d.Source
+			return m.locate(i, pe)
 		}
 	}
 	return nil
@@ -111,9 +588,14 @@ func (m *ConfigProjectionManifest) ProjectConfigMapAsYAML() (string, error) {
 	if err != nil {
 		return "", err
 	}
+	return ObjectAsYAML(&cm)
+}
+
+// ObjectAsYAML marshals a projected ConfigMap or Secret as a yaml string
+func ObjectAsYAML(obj runtime.Object) (string, error) {
 	printer := printers.YAMLPrinter{}
 	buf := bytes.NewBuffer([]byte{})
-	err = printer.PrintObj(&cm, buf)
+	err := printer.PrintObj(obj, buf)
 	if err != nil {
 		return "", err
 	}
@@ -121,14 +603,11 @@ func (m *ConfigProjectionManifest) ProjectConfigMapAsYAML() (string, error) {
 }
 
 // LoadFromYAMLBytes - load a ConfigProjectionManifest from a byte slice typically read from IO
-func LoadFromYAMLBytes(raw []byte, cfg conf.Config) (ConfigProjectionManifest, error) {
-	var m ConfigProjectionManifest
-	err := yaml.UnmarshalStrict(raw, &m)
+func LoadFromYAMLBytes(raw []byte, cfg Config) (ConfigProjectionManifest, error) {
+	m, err := ParseYAMLBytes(raw, cfg)
 	if err != nil {
 		return m, err
 	}
-	m.SetDefaults()
-	m.c = cfg
 	err = m.Validate()
 	if err != nil {
 		return m, err
@@ -136,27 +615,327 @@ func LoadFromYAMLBytes(raw []byte, cfg conf.Config) (ConfigProjectionManifest, e
 	return m, nil
 }
 
-// Validate validates a ProjectionManifest
+// LoadFromFile - load a ConfigProjectionManifest from a file. Errors are located in this file
+func LoadFromFile(path string, cfg Config) (ConfigProjectionManifest, error) {
+	m, err := ParseFile(path, cfg)
+	if err != nil {
+		return m, err
+	}
+	err = m.Validate()
+	if err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// ParseYAMLBytes - parse a ConfigProjectionManifest and set its defaults, without validating it.
+// Use this with ValidateAll when every problem in the manifest should be reported.
+func ParseYAMLBytes(raw []byte, cfg Config) (ConfigProjectionManifest, error) {
+	pos := indexPositions(raw)
+	m, err := decode(raw, pos)
+	if err != nil {
+		return m, err
+	}
+	m.c = cfg
+	m.positions = pos
+	// includes are resolved first, so their datasources are interpolated like the manifest's own
+	if err := m.resolveIncludes(); err != nil {
+		return m, err
+	}
+	// variables are substituted first, so defaults and validation see the values. Target
+	// variables are left for ForTarget, and matrix dimensions for Expand
+	var vars interpolate.Vars
+	if cfg != nil {
+		vars = cfg.Vars()
+	}
+	later := laterVars(cfg)
+	if len(m.Matrix) > 0 && later == nil {
+		later = map[string]bool{}
+	}
+	for d := range m.Matrix {
+		later[d] = true
+	}
+	if err := m.expandVars(vars, later, ""); err != nil {
+		return m, err
+	}
+	if err := m.SetDefaults(); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// ParseFile - parse a ConfigProjectionManifest from a file, without validating it
+func ParseFile(path string, cfg Config) (ConfigProjectionManifest, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ConfigProjectionManifest{}, err
+	}
+	return ParseFileBytes(path, raw, cfg)
+}
+
+// ParseFileBytes - parse a ConfigProjectionManifest already read from path, without validating it.
+// Errors are located in path, as with ParseFile.
+func ParseFileBytes(path string, raw []byte, cfg Config) (ConfigProjectionManifest, error) {
+	m, err := ParseYAMLBytes(raw, cfg)
+	if err != nil {
+		pe := types.AsProjectionError(err)
+		pe.Manifest = path
+		return m, pe
+	}
+	m.path = path
+	return m, nil
+}
+
+// Document is one of the yaml documents in a manifest file
+type Document struct {
+	// Raw is the document, without the `---` starting it
+	Raw []byte
+	// Line is the line of the file Raw starts on
+	Line int
+}
+
+// Empty returns true if the document has nothing but comments
+func (d Document) Empty() bool {
+	for _, line := range strings.Split(string(d.Raw), "\n") {
+		if l := strings.TrimSpace(line); l != "" && !strings.HasPrefix(l, "#") {
+			return false
+		}
+	}
+	return true
+}
+
+// SplitDocuments splits a manifest file into its yaml documents, including empty ones, at each
+// `---` line
+func SplitDocuments(raw []byte) []Document {
+	docs := []Document{}
+	lines := strings.SplitAfter(string(raw), "\n")
+	start := 0
+	for i := 0; i <= len(lines); i++ {
+		if i < len(lines) && !documentSeparator.MatchString(strings.TrimRight(lines[i], "\r\n")) {
+			continue
+		}
+		if i > start || i == len(lines) {
+			docs = append(docs, Document{Raw: []byte(strings.Join(lines[start:i], "")), Line: start + 1})
+		}
+		start = i + 1
+	}
+	return docs
+}
+
+// ParseFileDocuments parses each manifest in the file read from path, which may hold several yaml
+// documents, without validating them. Documents with nothing but comments are left out. Problems
+// are returned for each manifest, so one bad document doesnt hide the others: errs[i] is the
+// problem parsing manifests[i], if any. Errors are located in path, as with ParseFile.
+func ParseFileDocuments(path string, raw []byte, cfg Config) ([]ConfigProjectionManifest, []error) {
+	docs := []Document{}
+	for _, d := range SplitDocuments(raw) {
+		if !d.Empty() {
+			docs = append(docs, d)
+		}
+	}
+	if len(docs) == 0 {
+		m, err := ParseFileBytes(path, raw, cfg)
+		return []ConfigProjectionManifest{m}, []error{err}
+	}
+	manifests := make([]ConfigProjectionManifest, len(docs))
+	errs := make([]error, len(docs))
+	for i, d := range docs {
+		// padded, so lines in the document are lines in the file
+		padded := append(bytes.Repeat([]byte("\n"), d.Line-1), d.Raw...)
+		manifests[i], errs[i] = ParseFileBytes(path, padded, cfg)
+		if len(docs) > 1 {
+			manifests[i].document = d.Line
+		}
+	}
+	return manifests, errs
+}
+
+// Validate validates a ProjectionManifest, returning the first problem found
 func (m *ConfigProjectionManifest) Validate() error {
+	if errs := m.ValidateAll(); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// ValidateAll validates a ProjectionManifest, returning every problem found instead of stopping
+// at the first one. Each error is a *types.ProjectionError locating the problem in the manifest.
+func (m *ConfigProjectionManifest) ValidateAll() []error {
+	errs := []error{}
+	if m.Resource != ResourceConfigMap && m.Resource != ResourceSecret {
+		errs = append(errs, m.locate(types.NoDataSource, types.NewFieldError("resource", types.ErrUnsupportedResource)))
+	}
 	if m.Name == "" {
-		return types.ErrMissingName
+		errs = append(errs, m.locate(types.NoDataSource, types.NewFieldError("name", types.ErrMissingName)))
+	} else if m.deferred(m.Name) {
+		// checked per target
+	} else if len(m.Name) > 253 || !nameValidationRegexp.MatchString(m.Name) {
+		// validate name and namespace meets k8s requirements:
+		// https://kubernetes.io/docs/concepts/overview/working-with-objects/names/
+		errs = append(errs, m.locate(types.NoDataSource, types.NewFieldError("name", types.ErrInvalidName)))
 	}
 	if m.Namespace == "" {
-		return types.ErrMissingNamespace
+		errs = append(errs, m.locate(types.NoDataSource, types.NewFieldError("namespace", types.ErrMissingNamespace)))
+	} else if m.deferred(m.Namespace) {
+		// checked per target
+	} else if len(m.Namespace) > 253 || !nameValidationRegexp.MatchString(m.Namespace) {
+		errs = append(errs, m.locate(types.NoDataSource, types.NewFieldError("namespace", types.ErrInvalidNamespace)))
 	}
-	// validate name and namespace meets k8s requirements:
-	// https://kubernetes.io/docs/concepts/overview/working-with-objects/names/
-	if len(m.Name) > 253 || !nameValidationRegexp.MatchString(m.Name) {
-		return types.ErrInvalidName
+	for _, err := range m.validateMetadata() {
+		errs = append(errs, m.locate(types.NoDataSource, err))
 	}
-	if len(m.Namespace) > 253 || !nameValidationRegexp.MatchString(m.Namespace) {
-		return types.ErrInvalidNamespace
+	if err := m.Targets.Validate(); err != nil {
+		errs = append(errs, m.locate(types.NoDataSource, types.NewFieldError("targets", err)))
 	}
-	for _, d := range m.Data {
-		err := d.Validate()
+	if err := m.Matrix.Validate(); err != nil {
+		errs = append(errs, m.locate(types.NoDataSource, types.NewFieldError("matrix", err)))
+	}
+	root := m.sourceRoot(false)
+	for i, d := range m.Data {
+		// sources using matrix or target vars are checked as they are expanded, once their
+		// defaults are set
+		if m.deferred(d.Source) {
+			continue
+		}
+		dsErrs := d.ValidateAll()
+		for _, err := range dsErrs {
+			errs = append(errs, m.locate(i, err))
+		}
+		if len(dsErrs) > 0 {
+			continue
+		}
+		if !root.Allows(d.Source) {
+			pe := types.NewFieldError("source", types.ErrSourceNotAllowed)
+			pe.Source = d.Source
+			errs = append(errs, m.locate(i, pe))
+		}
+		if p := m.policy(); p != nil {
+			if err := p.CheckSource(m.policySubject(), d.Source); err != nil {
+				pe := types.NewFieldError("source", err)
+				pe.Source = d.Source
+				errs = append(errs, m.locate(i, pe))
+			}
+			if err := p.CheckOutputFormat(m.policySubject(), string(d.OutputFormat)); err != nil {
+				pe := types.NewFieldError("output_format", err)
+				pe.Source = d.Source
+				errs = append(errs, m.locate(i, pe))
+			}
+		}
+	}
+	return errs
+}
+
+// deferred returns true if field references target variables, so cant be checked until ForTarget
+func (m *ConfigProjectionManifest) deferred(field string) bool {
+	return m.templated && interpolate.Contains(field)
+}
+
+// policy returns the source access policy this manifest is subject to, if any
+func (m *ConfigProjectionManifest) policy() *policy.Policy {
+	if m.c == nil {
+		return nil
+	}
+	return m.c.Policy()
+}
+
+// policySubject describes this manifest to the source access policy
+func (m *ConfigProjectionManifest) policySubject() policy.Subject {
+	s := policy.Subject{Namespace: m.Namespace}
+	if m.path != "" && m.c != nil {
+		if rel, err := filepath.Rel(m.c.ManifestDir(), filepath.Dir(m.path)); err == nil {
+			s.ManifestDir = filepath.ToSlash(rel)
+		}
+	}
+	return s
+}
+
+// sourceRoot returns the config repo this manifest projects from, restricted to the source
+// prefixes its namespace is allowed to use. When decrypt is set, SOPS encrypted sources are
+// decrypted with the configured keys; otherwise projecting from them is an error.
+func (m *ConfigProjectionManifest) sourceRoot(decrypt bool) *ds.SourceRoot {
+	if m.c == nil {
+		return &ds.SourceRoot{}
+	}
+	root := &ds.SourceRoot{
+		Path:            m.c.ConfigDir(),
+		FS:              m.c.ConfigFS(),
+		AllowedPrefixes: m.c.AllowedSourcePrefixes(m.Namespace),
+	}
+	if roots := m.c.ConfigRoots(); len(roots) > 0 {
+		root.Roots = map[string]*ds.SourceRoot{}
+		for name, p := range roots {
+			root.Roots[name] = &ds.SourceRoot{Path: p}
+		}
+	}
+	if p := m.policy(); p != nil {
+		// globs are checked against the policy per file they resolve to, not just as written
+		subject := m.policySubject()
+		root.Check = func(resolved string) error {
+			return p.CheckSource(subject, resolved)
+		}
+	}
+	root.Decrypt = func(doc interface{}, raw []byte) (interface{}, error) {
+		return nil, types.ErrEncryptedSourceRequiresSecret
+	}
+	if decrypt {
+		root.Decrypt = nil
+		if keys := m.c.SopsKeys(); keys != nil {
+			root.Decrypt = keys.Decrypt
+		}
+	}
+	return root
+}
+
+// locate returns err as a *types.ProjectionError, filled in with this manifest's path, the
+// index of the datasource at fault (or types.NoDataSource), and the line and column of the field.
+// Problems with included datasources are located at the include, naming the template.
+func (m *ConfigProjectionManifest) locate(dataSource int, err error) *types.ProjectionError {
+	pe := types.AsProjectionError(err)
+	pe.Manifest = m.path
+	pe.DataSource = dataSource
+	if inc := m.inclusion(dataSource); inc != nil {
+		pe.DataSource = types.NoDataSource
+		field := fmt.Sprintf("include[%d]", inc.include)
+		if pe.Field != "" {
+			field += "." + pe.Field
+		}
+		pe.Field = field
+		pe.Err = fmt.Errorf("template %s data[%d]: %w", inc.template, inc.index, pe.Err)
+	}
+	m.positions.locate(pe)
+	return pe
+}
+
+// Locate locates err like the manifest's own validation errors, for problems found by others, like
+// lint rules. dataSource is the index of the datasource at fault, or types.NoDataSource.
+func (m *ConfigProjectionManifest) Locate(dataSource int, err error) *types.ProjectionError {
+	return m.locate(dataSource, err)
+}
+
+// resolveIncludes appends the datasources of each included template to Data
+func (m *ConfigProjectionManifest) resolveIncludes() error {
+	var lib *library.Library
+	if m.c != nil {
+		lib = m.c.Library()
+	}
+	for j, inc := range m.Include {
+		resolved, err := lib.Resolve(inc)
 		if err != nil {
-			return err
+			return m.locate(types.NoDataSource, types.NewFieldError(fmt.Sprintf("include[%d]", j), err))
+		}
+		for _, r := range resolved {
+			m.Data = append(m.Data, r.DataSource)
+			m.included = append(m.included, inclusion{include: j, template: r.Template, index: r.Index})
 		}
 	}
 	return nil
 }
+
+// inclusion returns where the datasource at index i came from, or nil if it is the manifest's own
+func (m *ConfigProjectionManifest) inclusion(i int) *inclusion {
+	own := len(m.Data) - len(m.included)
+	if i < own || i-own >= len(m.included) {
+		return nil
+	}
+	return &m.included[i-own]
+}
@@ -2,15 +2,22 @@ package manifest
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"path"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/andreyvit/diff"
 	"github.com/tumblr/k8s-config-projector/internal/pkg/conf"
 	_ "github.com/tumblr/k8s-config-projector/internal/pkg/testing"
+	"github.com/tumblr/k8s-config-projector/pkg/policy"
+	"github.com/tumblr/k8s-config-projector/pkg/report"
+	"github.com/tumblr/k8s-config-projector/pkg/types"
 )
 
 var (
@@ -25,17 +32,42 @@ var (
 		("-config-repo=" + TestConfigBasePath),
 	})
 	cfg conf.Config = testConfig
+	// testPolicyConfig is testConfig, enforcing test/policy.yaml
+	testPolicyConfig, _ = conf.LoadConfigFromArgs([]string{
+		"-debug=false",
+		"-output=test/",
+		"-manifests=" + ManifestsPath,
+		"-generation=unittest123",
+		"-config-repo=" + TestConfigBasePath,
+		"-policy=test/policy.yaml",
+	})
+	// testSopsConfig is testConfig, with keys to decrypt the SOPS sources in test/sources/sops
+	testSopsConfig, _ = conf.LoadConfigFromArgs([]string{
+		"-debug=false",
+		"-output=test/",
+		"-manifests=" + ManifestsPath,
+		"-generation=unittest123",
+		"-config-repo=" + TestConfigBasePath,
+		"-sops-keys=test/sops/age.key",
+	})
 	// all the test manifests to load
 	testManifests, _    = filepath.Glob(fmt.Sprintf("%s/*.yaml", ManifestsPath))
-	parseErrorManifests = map[string]string{
-		"test/manifests/parseerrors/1.yaml": "source files of glob format cannot specify a `output_file` field for projection",
-		"test/manifests/parseerrors/2.yaml": "unsupported output format; must be one of raw, yaml, or json",
-		"test/manifests/parseerrors/3.yaml": "unsupported source format; must be file, glob, yaml, or json",
-		"test/manifests/parseerrors/4.yaml": "you cannot use this output format without either `extract` or `field_extractions`",
-		"test/manifests/parseerrors/5.yaml": "output_file field required for this projection type",
-		"test/manifests/parseerrors/6.yaml": "absolute paths for `source` are not permitted",
-		"test/manifests/parseerrors/7.yaml": "name must only consist of lower case alphanumeric characters, -, and . and be 253 chars or less",
-		"test/manifests/parseerrors/8.yaml": "namespace must only consist of lower case alphanumeric characters, -, and . and be 253 chars or less",
+	parseErrorManifests = map[string]error{
+		"test/manifests/parseerrors/1.yaml": types.ErrFormatGlobRequiresNoOutputFile,
+		"test/manifests/parseerrors/2.yaml": types.ErrUnsupportedOutputFormat,
+		"test/manifests/parseerrors/3.yaml": types.ErrUnsupportedSourceFormat,
+		"test/manifests/parseerrors/4.yaml": types.ErrOutputFormatRequiresExtractors,
+		"test/manifests/parseerrors/5.yaml": types.ErrOutputFileRequired,
+		"test/manifests/parseerrors/6.yaml": types.ErrAbsolutePathSource,
+		"test/manifests/parseerrors/7.yaml": types.ErrInvalidName,
+		"test/manifests/parseerrors/8.yaml": types.ErrInvalidNamespace,
+	}
+	// where the first error in some of the parseErrorManifests files should be located
+	parseErrorLocations = map[string]string{
+		"test/manifests/parseerrors/1.yaml": "test/manifests/parseerrors/1.yaml:5:3: data[0].output_file",
+		"test/manifests/parseerrors/5.yaml": "test/manifests/parseerrors/5.yaml:5:3: data[0].output_file",
+		"test/manifests/parseerrors/6.yaml": "test/manifests/parseerrors/6.yaml:6:3: data[0].source",
+		"test/manifests/parseerrors/7.yaml": "test/manifests/parseerrors/7.yaml:2:1: name",
 	}
 )
 
@@ -57,22 +89,191 @@ func TestLoadManifestFromFile(t *testing.T) {
 }
 
 func TestLoadManifestFromFileWithErrors(t *testing.T) {
-	for f, errString := range parseErrorManifests {
+	for f, expected := range parseErrorManifests {
 		t.Logf("loading %s\n", f)
-		c, err := ioutil.ReadFile(f)
-		if err != nil {
-			t.Fatal(err)
-		}
-		_, err = LoadFromYAMLBytes(c, cfg)
+		_, err := LoadFromFile(f, cfg)
 		if err == nil {
-			t.Fatalf("Expected %s error, but got nothing", errString)
+			t.Fatalf("Expected %s error, but got nothing", expected)
+		}
+		if !errors.Is(err, expected) {
+			t.Fatalf("Expected %s error, but got %s", expected, err.Error())
+		}
+		var pe *types.ProjectionError
+		if !errors.As(err, &pe) {
+			t.Fatalf("Expected a ProjectionError, but got %#v", err)
+		}
+		if loc, ok := parseErrorLocations[f]; ok {
+			if actual := pe.Position() + ": " + pe.FieldPath(); actual != loc {
+				t.Fatalf("Expected error to be located at %s, but got %s", loc, actual)
+			}
+		}
+	}
+}
+
+func TestValidateAllCollectsEveryProblem(t *testing.T) {
+	m, err := ParseFile("test/manifests/parseerrors/6.yaml", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := m.ValidateAll()
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, but got %d: %v", len(errs), errs)
+	}
+	for i, err := range errs {
+		if !errors.Is(err, types.ErrAbsolutePathSource) {
+			t.Fatalf("Expected error %d to be %s, but got %s", i, types.ErrAbsolutePathSource, err)
+		}
+		var pe *types.ProjectionError
+		if !errors.As(err, &pe) || pe.DataSource != i || pe.Field != "source" {
+			t.Fatalf("Expected error %d to be for field source of datasource %d, but got %#v", i, i, err)
+		}
+	}
+}
+
+func TestValidateAllReportsFileDataSourceAndField(t *testing.T) {
+	f := "test/manifests/parseerrors/6.yaml"
+	m, err := ParseFile(f, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep := report.New()
+	for _, err := range m.ValidateAll() {
+		rep.Add(f, "unittest/no-absolute-sources", err)
+	}
+	buf := bytes.NewBuffer([]byte{})
+	if err := rep.Write(buf, report.FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	var decoded report.Report
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Problems) != 2 {
+		t.Fatalf("Expected 2 problems, but got %d: %v", len(decoded.Problems), decoded.Problems)
+	}
+	for i, p := range decoded.Problems {
+		if p.File != f || p.Line == 0 || p.DataSource == nil || *p.DataSource != i || p.Field != "source" || p.Message != types.ErrAbsolutePathSource.Error() {
+			t.Fatalf("Expected problem %d to be located at data[%d].source of %s, but got %#v", i, i, f, p)
 		}
-		if err.Error() != errString {
-			t.Fatalf("Expected %s error, but got %s", errString, err.Error())
+	}
+}
+
+func TestProjectionErrorCarriesJSONPath(t *testing.T) {
+	m, err := LoadFromYAMLBytes([]byte(`
+name: badpath
+namespace: test
+data:
+- source: test.json
+  output_file: missing
+  extract: "$.does.not.exist"
+`), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.Project()
+	var pe *types.ProjectionError
+	if !errors.As(err, &pe) {
+		t.Fatalf("Expected a ProjectionError, but got %#v", err)
+	}
+	if pe.DataSource != 0 || pe.Field != "extract" || pe.Source != "test.json" || pe.JSONPath != "$.does.not.exist" || pe.Line != 7 {
+		t.Fatalf("Expected error to be located at data[0].extract on line 7 with source and jsonpath, but got %s", err)
+	}
+}
+
+func TestPolicyEnforcedOnLoadAndProject(t *testing.T) {
+	// globs2 projects doods/*.php, which is allowed as written, but m.php is denied when the glob resolves
+	m, err := LoadFromFile("test/manifests/globs2.yaml", testPolicyConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Project(); !errors.Is(err, policy.ErrPolicyViolation) {
+		t.Fatalf("Expected projecting globs2 to violate the policy, but got %v", err)
+	}
+	violations := map[string]string{
+		// a.php isnt in allow_sources
+		"test/manifests/raw1.yaml": "source",
+		// yaml isnt in output_formats
+		"test/manifests/fieldextraction2.yaml": "output_format",
+	}
+	for f, field := range violations {
+		_, err := LoadFromFile(f, testPolicyConfig)
+		var pe *types.ProjectionError
+		if !errors.Is(err, policy.ErrPolicyViolation) || !errors.As(err, &pe) || pe.Field != field {
+			t.Fatalf("Expected loading %s to violate the policy on %s, but got %v", f, field, err)
 		}
 	}
 }
 
+func TestProjectSecretFromSopsSources(t *testing.T) {
+	m, err := LoadFromFile("test/manifests/secrets/sops1.yaml", testSopsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := m.ProjectSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"password":      "hunter2",
+		"port":          "5432",
+		"database.json": `{"hosts":["db-1.domain.tld","db-2.domain.tld"],"region":"us-east-1","tls":true,"user":"projector"}`,
+	}
+	for k, v := range expected {
+		if string(secret.Data[k]) != v {
+			t.Fatalf("Expected secret item %s to be %s, but got %s", k, v, secret.Data[k])
+		}
+	}
+	// a Secret manifest still cant be projected into a ConfigMap with decrypted values
+	if _, err := m.Project(); !errors.Is(err, types.ErrEncryptedSourceRequiresSecret) {
+		t.Fatalf("Expected %s, but got %v", types.ErrEncryptedSourceRequiresSecret, err)
+	}
+	// without keys, there is nothing to decrypt with
+	m, err = LoadFromFile("test/manifests/secrets/sops1.yaml", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ProjectSecret(); !errors.Is(err, types.ErrEncryptedSourceWithoutKeys) {
+		t.Fatalf("Expected %s, but got %v", types.ErrEncryptedSourceWithoutKeys, err)
+	}
+}
+
+func TestSopsSourcesRequireSecret(t *testing.T) {
+	m, err := LoadFromFile("test/manifests/secrets/sops2.yaml", testSopsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Project(); !errors.Is(err, types.ErrEncryptedSourceRequiresSecret) {
+		t.Fatalf("Expected %s, but got %v", types.ErrEncryptedSourceRequiresSecret, err)
+	}
+	if _, err := m.ProjectSecret(); !errors.Is(err, types.ErrUnsupportedResource) {
+		t.Fatalf("Expected %s, but got %v", types.ErrUnsupportedResource, err)
+	}
+}
+
+func TestDependsOn(t *testing.T) {
+	m, err := LoadFromFile("test/manifests/globs1.yaml", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for source, expected := range map[string]bool{
+		"a.php":       true,
+		"./new.php":   true,
+		"test.json":   false,
+		"doods/a.php": false,
+	} {
+		if m.DependsOn(source) != expected {
+			t.Fatalf("Expected DependsOn(%s) to be %v", source, expected)
+		}
+	}
+	m, err = LoadFromFile("test/manifests/raw1.yaml", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.DependsOn("test.json") || m.DependsOn("test.yaml") {
+		t.Fatal("Expected raw1 to depend on test.json, and not test.yaml")
+	}
+}
+
 func TestLoadManifestFromFileAndProject(t *testing.T) {
 	for _, f := range testManifests {
 		t.Logf("loading %s\n", f)
@@ -126,3 +327,100 @@ func TestLoadManifestFromFileAndProject(t *testing.T) {
 		t.Logf("OK! %s was projected successfully!\n", f)
 	}
 }
+
+func TestMatrixCombinations(t *testing.T) {
+	mx := Matrix{"region": {"us-east-1", "us-west-2"}, "env": {"production", "devel"}}
+	got := []string{}
+	for _, c := range mx.Combinations() {
+		got = append(got, FormatCombination(c))
+	}
+	expected := "env=production region=us-east-1,env=production region=us-west-2,env=devel region=us-east-1,env=devel region=us-west-2"
+	if strings.Join(got, ",") != expected {
+		t.Fatalf("Expected combinations %s, but got %s", expected, strings.Join(got, ","))
+	}
+	if err := (Matrix{"not-a-name": {"a"}}).Validate(); err == nil {
+		t.Fatal("Expected an invalid dimension name to be rejected")
+	}
+	if err := (Matrix{"env": {}}).Validate(); err == nil {
+		t.Fatal("Expected a dimension without values to be rejected")
+	}
+}
+
+func TestLoadVersionedManifests(t *testing.T) {
+	v1, err := LoadFromYAMLBytes([]byte(`
+apiVersion: projector.tumblr.com/v1
+kind: ConfigProjection
+name: versioned
+namespace: test
+data:
+- source: test.json
+  output_file: hostport
+  extract: $.hostport
+`), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := LoadFromYAMLBytes([]byte(`
+apiVersion: projector.tumblr.com/v2
+kind: ConfigProjection
+metadata:
+  name: versioned
+  namespace: test
+  labels:
+    team: notifications
+  annotations:
+    example.com/owner: notifications
+spec:
+  data:
+  - source: test.json
+    output_file: hostport
+    extract: $.hostport
+`), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v1.Data, v2.Data) || v1.Name != v2.Name || v1.Namespace != v2.Namespace {
+		t.Fatalf("Expected v1 and v2 manifests to convert to the same manifest, but got %+v and %+v", v1, v2)
+	}
+	cm, err := v2.Project()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cm.Labels["team"] != "notifications" || cm.Labels[cfg.LabelManagedKey()] != "true" || cm.Annotations["example.com/owner"] != "notifications" {
+		t.Fatalf("Expected the manifest's labels and annotations alongside the projector's, but got %v %v", cm.Labels, cm.Annotations)
+	}
+	if converted := v2.ToV2(); converted.Metadata.Labels["team"] != "notifications" || len(converted.Spec.Data) != 1 {
+		t.Fatalf("Expected the manifest to convert back to v2, but got %+v", converted)
+	}
+}
+
+func TestLoadVersionedManifestErrors(t *testing.T) {
+	cases := map[string]error{
+		"apiVersion: projector.tumblr.com/v3\nkind: ConfigProjection\nname: x\nnamespace: test\ndata: []\n":                                                                         types.ErrUnsupportedAPIVersion,
+		"apiVersion: projector.tumblr.com/v1\nkind: ConfigMap\nname: x\nnamespace: test\ndata: []\n":                                                                                types.ErrUnsupportedKind,
+		"apiVersion: projector.tumblr.com/v2\nkind: ConfigProjection\nmetadata: {name: app, namespace: test, labels: {" + cfg.LabelManagedKey() + ": 'false'}}\nspec: {data: []}\n": types.ErrReservedMetadata,
+		"apiVersion: projector.tumblr.com/v2\nkind: ConfigProjection\nmetadata: {name: app, namespace: test, labels: {team: 'not valid'}}\nspec: {data: []}\n":                      types.ErrInvalidLabel,
+		"apiVersion: projector.tumblr.com/v2\nkind: ConfigProjection\nmetadata: {name: App, namespace: test}\nspec: {data: []}\n":                                                   types.ErrInvalidName,
+	}
+	for raw, expected := range cases {
+		if _, err := LoadFromYAMLBytes([]byte(raw), cfg); !errors.Is(err, expected) {
+			t.Fatalf("Expected %q to fail with %s, but got %v", raw, expected, err)
+		}
+	}
+	// v2 fields arent v1 fields, and v1 fields arent v2 fields
+	for _, raw := range []string{
+		"name: app\nnamespace: test\nmetadata: {labels: {team: x}}\ndata: []\n",
+		"apiVersion: projector.tumblr.com/v2\nkind: ConfigProjection\nname: app\nmetadata: {name: app, namespace: test}\nspec: {data: []}\n",
+	} {
+		if _, err := LoadFromYAMLBytes([]byte(raw), cfg); err == nil {
+			t.Fatalf("Expected %q to be rejected", raw)
+		}
+	}
+	m, err := ParseFileBytes("v2.yaml", []byte("apiVersion: projector.tumblr.com/v2\nkind: ConfigProjection\nmetadata:\n  name: app\n  namespace: Not_Valid\nspec:\n  data: []\n"), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Validate(); err == nil || !strings.HasPrefix(err.Error(), "v2.yaml:5:3: namespace") {
+		t.Fatalf("Expected v2 problems to be located under metadata, but got %v", err)
+	}
+}
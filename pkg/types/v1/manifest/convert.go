@@ -0,0 +1,128 @@
+package manifest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tumblr/k8s-config-projector/pkg/types"
+	v2 "github.com/tumblr/k8s-config-projector/pkg/types/v2/manifest"
+	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// typeMeta is the apiVersion and kind of a manifest, which select the schema it is decoded with
+type typeMeta struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+}
+
+// decode unmarshals raw with the schema of its apiVersion, converting it to a ConfigProjectionManifest.
+// Manifests without an apiVersion are v1.
+func decode(raw []byte, pos positions) (ConfigProjectionManifest, error) {
+	var m ConfigProjectionManifest
+	var meta typeMeta
+	if err := yaml.Unmarshal(raw, &meta); err != nil {
+		// let the strict unmarshal describe the problem
+		return m, yaml.UnmarshalStrict(raw, &m)
+	}
+	if (meta.APIVersion != "" || meta.Kind != "") && meta.Kind != Kind {
+		return m, located(pos, "kind", types.ErrUnsupportedKind)
+	}
+	switch meta.APIVersion {
+	case "", APIVersion:
+		err := yaml.UnmarshalStrict(raw, &m)
+		return m, err
+	case v2.APIVersion:
+		var c v2.ConfigProjection
+		if err := yaml.UnmarshalStrict(raw, &c); err != nil {
+			return m, err
+		}
+		return FromV2(c), nil
+	}
+	return m, located(pos, "apiVersion", fmt.Errorf("%w: %s", types.ErrUnsupportedAPIVersion, meta.APIVersion))
+}
+
+// located returns err as a ProjectionError at field, for problems found before there is a manifest to locate them
+func located(pos positions, field string, err error) *types.ProjectionError {
+	pe := types.NewFieldError(field, err)
+	pos.locate(pe)
+	return pe
+}
+
+// FromV2 converts a v2 manifest to a ConfigProjectionManifest, which manifests of every version are
+// validated and projected as
+func FromV2(c v2.ConfigProjection) ConfigProjectionManifest {
+	return ConfigProjectionManifest{
+		APIVersion:  c.APIVersion,
+		Kind:        c.Kind,
+		Name:        c.Metadata.Name,
+		Namespace:   c.Metadata.Namespace,
+		Labels:      c.Metadata.Labels,
+		Annotations: c.Metadata.Annotations,
+		Resource:    c.Spec.Resource,
+		Targets:     c.Spec.Targets,
+		Matrix:      Matrix(c.Spec.Matrix),
+		Include:     c.Spec.Include,
+		Data:        c.Spec.Data,
+	}
+}
+
+// ToV2 converts the manifest to the v2 schema. Datasources included from the library are left out,
+// as the includes are kept.
+func (m *ConfigProjectionManifest) ToV2() v2.ConfigProjection {
+	return v2.ConfigProjection{
+		APIVersion: v2.APIVersion,
+		Kind:       v2.Kind,
+		Metadata: v2.Metadata{
+			Name:        m.Name,
+			Namespace:   m.Namespace,
+			Labels:      m.Labels,
+			Annotations: m.Annotations,
+		},
+		Spec: v2.Spec{
+			Resource: m.Resource,
+			Targets:  m.Targets,
+			Matrix:   m.Matrix,
+			Include:  m.Include,
+			Data:     m.Data[:len(m.Data)-len(m.included)],
+		},
+	}
+}
+
+// validateMetadata checks the labels and annotations are valid, and dont collide with the projector's own
+func (m *ConfigProjectionManifest) validateMetadata() []error {
+	reserved := map[string]bool{AnnotationConfigCommit: true}
+	if m.c != nil {
+		reserved[m.c.LabelVersionKey()] = true
+		reserved[m.c.LabelManagedKey()] = true
+	}
+	errs := []error{}
+	for _, k := range sortedKeys(m.Labels) {
+		field := "labels." + k
+		if reserved[k] {
+			errs = append(errs, types.NewFieldError(field, types.ErrReservedMetadata))
+		} else if problems := append(validation.IsQualifiedName(k), validation.IsValidLabelValue(m.Labels[k])...); len(problems) > 0 {
+			errs = append(errs, types.NewFieldError(field, fmt.Errorf("%w: %s", types.ErrInvalidLabel, strings.Join(problems, "; "))))
+		}
+	}
+	for _, k := range sortedKeys(m.Annotations) {
+		field := "annotations." + k
+		if reserved[k] {
+			errs = append(errs, types.NewFieldError(field, types.ErrReservedMetadata))
+		} else if problems := validation.IsQualifiedName(k); len(problems) > 0 {
+			errs = append(errs, types.NewFieldError(field, fmt.Errorf("%w: %s", types.ErrInvalidAnnotation, strings.Join(problems, "; "))))
+		}
+	}
+	return errs
+}
+
+// sortedKeys returns the keys of m, sorted
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,131 @@
+package manifest
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tumblr/k8s-config-projector/pkg/types"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// position is a line and column in a manifest's yaml
+type position struct {
+	line   int
+	column int
+}
+
+// positions indexes where fields are in a manifest's yaml, so errors can point at them.
+// Keys are field names; nested mapping keys are joined with `.` (i.e. field_extractions.hosts).
+// The empty key is the position of the node itself.
+type positions struct {
+	fields map[string]position
+	data   []map[string]position
+}
+
+// indexPositions walks the yaml in raw and records where each field is. This is best effort;
+// if raw cant be parsed, errors just wont have a line and column.
+func indexPositions(raw []byte) positions {
+	p := positions{fields: map[string]position{}}
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(raw, &doc); err != nil || len(doc.Content) == 0 {
+		return p
+	}
+	root := doc.Content[0]
+	if root.Kind != yamlv3.MappingNode {
+		return p
+	}
+	p.fields = indexMapping(root)
+	// v2 manifests nest the name, namespace, labels and annotations under metadata, and everything
+	// else under spec. Their fields are indexed like v1's
+	if spec := mappingValue(root, "spec"); spec != nil {
+		for _, n := range []*yamlv3.Node{mappingValue(root, "metadata"), spec} {
+			if n == nil {
+				continue
+			}
+			for field, pos := range indexMapping(n) {
+				if field != "" {
+					p.fields[field] = pos
+				}
+			}
+		}
+		root = spec
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i+1].Kind != yamlv3.SequenceNode {
+			continue
+		}
+		switch root.Content[i].Value {
+		case "data":
+			for _, item := range root.Content[i+1].Content {
+				p.data = append(p.data, indexMapping(item))
+			}
+		case "include":
+			// includes are fields, like include[0].params.pool
+			for j, item := range root.Content[i+1].Content {
+				for nested, pos := range indexMapping(item) {
+					key := fmt.Sprintf("include[%d]", j)
+					if nested != "" {
+						key += "." + nested
+					}
+					p.fields[key] = pos
+				}
+			}
+		}
+	}
+	return p
+}
+
+// mappingValue returns the value of key in the mapping n, if it is a mapping too
+func mappingValue(n *yamlv3.Node, key string) *yamlv3.Node {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key && n.Content[i+1].Kind == yamlv3.MappingNode {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// indexMapping records the position of n, and each of its keys (and their nested keys)
+func indexMapping(n *yamlv3.Node) map[string]position {
+	fields := map[string]position{"": {n.Line, n.Column}}
+	if n.Kind != yamlv3.MappingNode {
+		return fields
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		fields[k.Value] = position{k.Line, k.Column}
+		if v.Kind == yamlv3.MappingNode {
+			for nested, pos := range indexMapping(v) {
+				if nested != "" {
+					fields[k.Value+"."+nested] = pos
+				}
+			}
+		}
+	}
+	return fields
+}
+
+// locate fills in the line and column of pe's field. When the field isnt in the yaml (i.e. it is
+// required but missing), this falls back to its parent field, then the datasource itself.
+func (p positions) locate(pe *types.ProjectionError) {
+	fields := p.fields
+	if pe.DataSource != types.NoDataSource {
+		if pe.DataSource >= len(p.data) {
+			return
+		}
+		fields = p.data[pe.DataSource]
+	}
+	candidates := []string{pe.Field}
+	if i := strings.Index(pe.Field, "."); i > 0 {
+		candidates = append(candidates, pe.Field[:i])
+	}
+	if pe.DataSource != types.NoDataSource {
+		candidates = append(candidates, "")
+	}
+	for _, c := range candidates {
+		if pos, ok := fields[c]; ok {
+			pe.Line, pe.Column = pos.line, pos.column
+			return
+		}
+	}
+}
@@ -0,0 +1,63 @@
+// Package manifest is the v2 projection manifest schema. A v2 manifest is shaped like a Kubernetes
+// object, the same as a ConfigProjection resource (see docs/controller.md):
+//
+//	apiVersion: projector.tumblr.com/v2
+//	kind: ConfigProjection
+//	metadata:
+//	  name: notification
+//	  namespace: notification-production
+//	  labels:
+//	    team: notifications
+//	spec:
+//	  data:
+//	  - source: apps/us-east-1/production/notification.yaml
+//	    output_file: launch_flags
+//	    extract: $.launch_flags
+//
+// Datasources are unchanged from v1. Manifests of every version are converted to the v1
+// manifest.ConfigProjectionManifest to be validated and projected.
+package manifest
+
+import (
+	"github.com/tumblr/k8s-config-projector/pkg/library"
+	"github.com/tumblr/k8s-config-projector/pkg/targets"
+	ds "github.com/tumblr/k8s-config-projector/pkg/types/v1/datasource"
+)
+
+const (
+	// APIVersion is the apiVersion of v2 manifests
+	APIVersion = "projector.tumblr.com/v2"
+	// Kind is the kind of projection manifests
+	Kind = "ConfigProjection"
+)
+
+// ConfigProjection is a v2 projection manifest
+type ConfigProjection struct {
+	APIVersion string   `yaml:"apiVersion"`
+	Kind       string   `yaml:"kind"`
+	Metadata   Metadata `yaml:"metadata"`
+	Spec       Spec     `yaml:"spec"`
+}
+
+// Metadata is the projected resource's metadata
+type Metadata struct {
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace"`
+	// Labels are added to the projected resource, along with the projector's own
+	Labels map[string]string `yaml:"labels,omitempty"`
+	// Annotations are added to the projected resource, along with the projector's own
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// Spec is what is projected into the resource, and how
+type Spec struct {
+	// Resource is the kind of resource to project into: ConfigMap (default) or Secret
+	Resource string `yaml:"resource,omitempty"`
+	// Targets selects the targets (see --targets) this manifest is projected for; all of them if empty
+	Targets targets.Selector `yaml:"targets,omitempty"`
+	// Matrix expands the manifest into one manifest per combination of its dimensions' values
+	Matrix map[string][]string `yaml:"matrix,omitempty"`
+	// Include appends the datasources of library templates (see --library) to Data
+	Include []library.Include `yaml:"include,omitempty"`
+	Data    []*ds.DataSource  `yaml:"data"`
+}
@@ -0,0 +1,459 @@
+// Package watch reprojects manifests as they, or the sources they project, change
+package watch
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/ghodss/yaml"
+	"github.com/tumblr/k8s-config-projector/pkg/discover"
+	"github.com/tumblr/k8s-config-projector/pkg/library"
+	"github.com/tumblr/k8s-config-projector/pkg/output"
+	"github.com/tumblr/k8s-config-projector/pkg/projector"
+	"github.com/tumblr/k8s-config-projector/pkg/report"
+	"github.com/tumblr/k8s-config-projector/pkg/scan"
+	"github.com/tumblr/k8s-config-projector/pkg/types/v1/datasource"
+	"github.com/tumblr/k8s-config-projector/pkg/types/v1/manifest"
+)
+
+const (
+	// settleDelay is how long to wait for more changes before reprojecting; editors and git
+	// tend to touch several files (or the same file several times) per save
+	settleDelay = 200 * time.Millisecond
+)
+
+// Options configure a Watcher
+type Options struct {
+	// OutputDir is where projected resources are written (required)
+	OutputDir string
+	// Timestamp names output files for the whole session, so each manifest rewrites the same file
+	Timestamp int64
+	// ScanMode is the --secret-scan mode; findings are only problems when it is scan.ModeFail
+	ScanMode string
+	// Report is called with the problems found by each reprojection, if there are any. nil logs them.
+	Report func(rep *report.Report)
+}
+
+// Watcher reprojects manifests when their files, or the sources they project, change. The
+// manifest directory, config roots and datasource library are taken from the projector's options.
+type Watcher struct {
+	p    *projector.Projector
+	opts Options
+	// manifests are keyed by "namespace/name"
+	manifests projector.Manifests
+	// projected is the data last written for each manifest, to summarize what changed
+	projected   map[string]map[string]string
+	manifestDir string
+	configDir   string
+	outputDir   string
+	fsw         *fsnotify.Watcher
+	// watched are the directories watched for changes
+	watched []string
+	// roots are the named config roots, by name
+	roots map[string]string
+	// libraryDir is the directory of datasource templates, if any
+	libraryDir string
+	// ignore is the manifest directory's ignore file
+	ignore *discover.Ignore
+}
+
+// New returns a Watcher for manifests, loaded and projected by p. Nothing is projected until Run.
+func New(p *projector.Projector, manifests projector.Manifests, opts Options) (*Watcher, error) {
+	if opts.OutputDir == "" {
+		return nil, fmt.Errorf("an output directory is required")
+	}
+	popts := p.Options()
+	w := &Watcher{
+		p:         p,
+		opts:      opts,
+		manifests: manifests,
+		projected: map[string]map[string]string{},
+		roots:     map[string]string{},
+	}
+	var err error
+	if w.manifestDir, err = filepath.Abs(popts.ManifestDir); err != nil {
+		return nil, fmt.Errorf("unable to watch %s: %s", popts.ManifestDir, err.Error())
+	}
+	if w.outputDir, err = filepath.Abs(opts.OutputDir); err != nil {
+		return nil, fmt.Errorf("unable to watch %s: %s", opts.OutputDir, err.Error())
+	}
+	if w.ignore, err = discover.LoadIgnore(os.DirFS(w.manifestDir)); err != nil {
+		return nil, fmt.Errorf("unable to watch %s: %s", popts.ManifestDir, err.Error())
+	}
+	w.watched = []string{w.manifestDir}
+	if popts.ConfigFS == nil {
+		if w.configDir, err = filepath.Abs(popts.ConfigRoot); err != nil {
+			return nil, fmt.Errorf("unable to watch %s: %s", popts.ConfigRoot, err.Error())
+		}
+		w.watched = append(w.watched, w.configDir)
+	}
+	for name, root := range popts.ConfigRoots {
+		if w.roots[name], err = filepath.Abs(root); err != nil {
+			return nil, fmt.Errorf("unable to watch %s: %s", root, err.Error())
+		}
+		w.watched = append(w.watched, w.roots[name])
+	}
+	if l := popts.Library; l != nil {
+		if w.libraryDir, err = filepath.Abs(l.Dir()); err != nil {
+			return nil, fmt.Errorf("unable to watch %s: %s", l.Dir(), err.Error())
+		}
+		w.watched = append(w.watched, w.libraryDir)
+	}
+	if w.fsw, err = fsnotify.NewWatcher(); err != nil {
+		return nil, fmt.Errorf("unable to watch for changes: %s", err.Error())
+	}
+	for _, dir := range w.watched {
+		if err := w.add(dir); err != nil {
+			w.fsw.Close()
+			return nil, fmt.Errorf("unable to watch %s: %s", dir, err.Error())
+		}
+	}
+	return w, nil
+}
+
+// Run projects every manifest, then reprojects them as they change, until the Watcher is closed.
+// Problems are reported as they are found, and never stop it.
+func (w *Watcher) Run() {
+	w.project(w.manifests.Keys())
+	log.Printf("Watching %s for changes", strings.Join(w.watched, ", "))
+	w.run()
+}
+
+// Close stops watching for changes
+func (w *Watcher) Close() error {
+	return w.fsw.Close()
+}
+
+// add watches dir, and every directory under it
+func (w *Watcher) add(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") && path != dir {
+			// dont bother watching .git and friends
+			return filepath.SkipDir
+		}
+		return w.fsw.Add(path)
+	})
+}
+
+// run collects changed paths until they settle, then reprojects whatever they affect
+func (w *Watcher) run() {
+	changed := map[string]bool{}
+	var settled <-chan time.Time
+	for {
+		select {
+		case ev, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+			if ev.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+					if err := w.add(ev.Name); err != nil {
+						log.Printf("unable to watch %s: %s", ev.Name, err.Error())
+					}
+				}
+			}
+			changed[ev.Name] = true
+			settled = time.After(settleDelay)
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("error watching for changes: %s", err.Error())
+		case <-settled:
+			paths := make([]string, 0, len(changed))
+			for p := range changed {
+				paths = append(paths, p)
+			}
+			changed = map[string]bool{}
+			w.changed(paths)
+		}
+	}
+}
+
+// changed reloads changed manifest files, and reprojects every manifest that was changed,
+// or depends on a changed source
+func (w *Watcher) changed(paths []string) {
+	rep := report.New()
+	affected := map[string]bool{}
+	libraryChanged := false
+	for _, p := range paths {
+		if _, ok := within(w.outputDir, p); ok {
+			// our own writes, if the output directory is in a watched one
+			continue
+		}
+		if rel, ok := within(w.libraryDir, p); w.libraryDir != "" && ok && (discover.IsManifest(rel) || rel == discover.IgnoreFile) {
+			libraryChanged = true
+		}
+		if rel, ok := within(w.manifestDir, p); ok && rel == discover.IgnoreFile {
+			w.reloadIgnore(rep)
+		} else if ok && discover.IsManifest(rel) && !w.ignore.Ignored(rel) {
+			for _, key := range w.reload(p, rep) {
+				affected[key] = true
+			}
+		}
+		if rel, ok := within(w.configDir, p); ok {
+			w.dependents(rel, affected)
+		}
+		for name, root := range w.roots {
+			if rel, ok := within(root, p); ok {
+				w.dependents(datasource.JoinSource(name, rel), affected)
+			}
+		}
+	}
+	if libraryChanged {
+		for _, key := range w.reloadLibrary(rep) {
+			affected[key] = true
+		}
+	}
+	keys := make([]string, 0, len(affected))
+	for k := range affected {
+		if _, ok := w.manifests[k]; ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	w.projectWithReport(keys, rep)
+}
+
+// dependents adds the keys of manifests that project source to affected
+func (w *Watcher) dependents(source string, affected map[string]bool) {
+	for key, m := range w.manifests {
+		if m.DependsOn(source) {
+			affected[key] = true
+		}
+	}
+}
+
+// reload reloads the manifest file at path, returning the keys of manifests to reproject: the
+// manifest, or every manifest its matrix expands into. Manifests that were loaded from the file
+// but are gone now have their output removed.
+func (w *Watcher) reload(path string, rep *report.Report) []string {
+	previous := []string{}
+	for key, m := range w.manifests {
+		if abs, err := filepath.Abs(m.GetPath()); err == nil && abs == path {
+			previous = append(previous, key)
+		}
+	}
+	sort.Strings(previous)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		for _, key := range previous {
+			w.remove(key)
+		}
+		return nil
+	}
+	expanded, err := w.p.ExpandFile(path)
+	if err != nil {
+		rep.Add(path, strings.Join(previous, ","), err)
+		return nil
+	}
+	loaded := map[string]manifest.ConfigProjectionManifest{}
+	for _, m := range expanded {
+		key := fmt.Sprintf("%s/%s", m.Namespace, m.Name)
+		existing, ok := loaded[key]
+		if !ok {
+			if e, found := w.manifests[key]; found && !contains(previous, key) {
+				existing, ok = e, true
+			}
+		}
+		if ok {
+			rep.Add(path, key, fmt.Errorf("duplicate projection mapping found at namespace=%s name=%s file=%s (already loaded from %s)", m.Namespace, m.Name, m.Origin(), existing.Origin()))
+			return nil
+		}
+		loaded[key] = m
+	}
+	for _, key := range previous {
+		if _, ok := loaded[key]; !ok {
+			// the manifest was renamed, or left the matrix, so its old output is stale
+			w.remove(key)
+		}
+	}
+	keys := make([]string, 0, len(loaded))
+	for key, m := range loaded {
+		w.manifests[key] = m
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// reloadIgnore reloads the manifest directory's ignore file. Manifests it now ignores are left
+// loaded, but are no longer reloaded when they change
+func (w *Watcher) reloadIgnore(rep *report.Report) {
+	ignore, err := discover.LoadIgnore(os.DirFS(w.manifestDir))
+	if err != nil {
+		rep.Add(filepath.Join(w.manifestDir, discover.IgnoreFile), "", err)
+		return
+	}
+	w.ignore = ignore
+}
+
+// contains returns true if keys contains key
+func contains(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadLibrary reloads the datasource templates, then every manifest file including any of them,
+// returning the keys of manifests to reproject
+func (w *Watcher) reloadLibrary(rep *report.Report) []string {
+	l, err := library.Load(w.libraryDir)
+	if err != nil {
+		rep.Add(w.libraryDir, "", err)
+		return nil
+	}
+	opts := w.p.Options()
+	opts.Library = l
+	p, err := projector.New(opts)
+	if err != nil {
+		rep.Add(w.libraryDir, "", err)
+		return nil
+	}
+	w.p = p
+	paths := []string{}
+	for _, m := range w.manifests {
+		if abs, err := filepath.Abs(m.GetPath()); err == nil && len(m.Include) > 0 && !contains(paths, abs) {
+			paths = append(paths, abs)
+		}
+	}
+	sort.Strings(paths)
+	keys := []string{}
+	for _, path := range paths {
+		keys = append(keys, w.reload(path, rep)...)
+	}
+	return keys
+}
+
+// remove forgets the manifest, and deletes its output file
+func (w *Watcher) remove(key string) {
+	m := w.manifests[key]
+	fname := w.outputFile(m)
+	if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+		log.Printf("unable to remove %s: %s", fname, err.Error())
+	}
+	delete(w.manifests, key)
+	delete(w.projected, key)
+	log.Printf("%s: removed %s", key, fname)
+}
+
+func (w *Watcher) outputFile(m manifest.ConfigProjectionManifest) string {
+	return filepath.Join(w.outputDir, output.BuildFileOutputName(m.GetNamespace(), m.GetName(), w.opts.Timestamp))
+}
+
+// project reprojects the manifests, reporting any problems
+func (w *Watcher) project(keys []string) {
+	w.projectWithReport(keys, report.New())
+}
+
+func (w *Watcher) projectWithReport(keys []string, rep *report.Report) {
+	rep.Manifests = len(keys)
+	for _, key := range keys {
+		m := w.manifests[key]
+		result, err := w.p.Project(m)
+		if err != nil {
+			rep.Add(m.GetPath(), key, err)
+			continue
+		}
+		if !w.handleFindings(rep, m, result.Findings) {
+			continue
+		}
+		fname := w.outputFile(m)
+		if err := output.WriteFileAtomic(fname, []byte(result.YAML)); err != nil {
+			rep.Add(m.GetPath(), key, fmt.Errorf("unable to write config to %s: %s", fname, err.Error()))
+			continue
+		}
+		data, err := projectedData(result.YAML)
+		if err != nil {
+			log.Printf("%s: wrote %s", key, fname)
+			continue
+		}
+		log.Printf("%s: %s", key, summarize(w.projected[key], data))
+		w.projected[key] = data
+	}
+	if !rep.OK() {
+		w.report(rep)
+	}
+}
+
+// handleFindings logs secret scan findings, or when scanning fails on them, records them as
+// problems in rep. It returns false if the ConfigMap should not be written.
+func (w *Watcher) handleFindings(rep *report.Report, m manifest.ConfigProjectionManifest, findings []*scan.Finding) bool {
+	key := fmt.Sprintf("%s/%s", m.GetNamespace(), m.GetName())
+	for _, f := range findings {
+		if w.opts.ScanMode != scan.ModeFail {
+			log.Printf("WARNING: %s: %s", key, f.Error())
+			continue
+		}
+		rep.Add(m.GetPath(), key, f)
+	}
+	return len(findings) == 0 || w.opts.ScanMode != scan.ModeFail
+}
+
+// report hands rep to the Report option, or logs its problems
+func (w *Watcher) report(rep *report.Report) {
+	if w.opts.Report != nil {
+		w.opts.Report(rep)
+		return
+	}
+	for _, problem := range rep.Problems {
+		log.Printf("WARNING: %s", problem.String())
+	}
+}
+
+// projectedData returns the data of a projected ConfigMap or Secret, from its yaml
+func projectedData(cfgString string) (map[string]string, error) {
+	var obj struct {
+		Data map[string]string `json:"data"`
+	}
+	err := yaml.Unmarshal([]byte(cfgString), &obj)
+	return obj.Data, err
+}
+
+// summarize describes which data keys changed between two projections, like
+// `3 changed: +new.yaml ~config.json -old.yaml`
+func summarize(before map[string]string, after map[string]string) string {
+	changes := []string{}
+	for k, v := range after {
+		old, ok := before[k]
+		if !ok {
+			changes = append(changes, "+"+k)
+		} else if old != v {
+			changes = append(changes, "~"+k)
+		}
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			changes = append(changes, "-"+k)
+		}
+	}
+	if len(changes) == 0 {
+		return "unchanged"
+	}
+	// sort by key, not by the change marker
+	sort.Slice(changes, func(i, j int) bool { return changes[i][1:] < changes[j][1:] })
+	return fmt.Sprintf("%d changed: %s", len(changes), strings.Join(changes, " "))
+}
+
+// within returns path relative to dir, if it is inside dir
+func within(dir string, path string) (string, bool) {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
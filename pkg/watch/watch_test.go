@@ -0,0 +1,211 @@
+package watch
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	_ "github.com/tumblr/k8s-config-projector/internal/pkg/testing"
+	"github.com/tumblr/k8s-config-projector/pkg/library"
+	"github.com/tumblr/k8s-config-projector/pkg/output"
+	"github.com/tumblr/k8s-config-projector/pkg/projector"
+	"github.com/tumblr/k8s-config-projector/pkg/report"
+)
+
+const hostportManifest = `
+name: %s
+namespace: test
+data:
+- source: test.json
+  output_file: hostport
+  extract: $.hostport
+`
+
+func TestSummarize(t *testing.T) {
+	tests := []struct {
+		before   map[string]string
+		after    map[string]string
+		expected string
+	}{
+		{nil, map[string]string{}, "unchanged"},
+		{map[string]string{"a": "1"}, map[string]string{"a": "1"}, "unchanged"},
+		{nil, map[string]string{"a": "1"}, "1 changed: +a"},
+		{map[string]string{"a": "1"}, map[string]string{"a": "2"}, "1 changed: ~a"},
+		{map[string]string{"a": "1"}, nil, "1 changed: -a"},
+		{
+			map[string]string{"old.yaml": "1", "config.json": "1", "same": "1"},
+			map[string]string{"new.yaml": "1", "config.json": "2", "same": "1"},
+			"3 changed: ~config.json +new.yaml -old.yaml",
+		},
+	}
+	for _, test := range tests {
+		if got := summarize(test.before, test.after); got != test.expected {
+			t.Fatalf("Expected %v -> %v to be summarized as %q, but got %q", test.before, test.after, test.expected, got)
+		}
+	}
+}
+
+func TestWithin(t *testing.T) {
+	tests := []struct {
+		dir      string
+		path     string
+		rel      string
+		expected bool
+	}{
+		{"/a/b", "/a/b", ".", true},
+		{"/a/b", "/a/b/c.yaml", "c.yaml", true},
+		{"/a/b", "/a/b/c/d.yaml", "c/d.yaml", true},
+		{"/a/b", "/a/b/..c.yaml", "..c.yaml", true},
+		{"/a/b", "/a", "", false},
+		{"/a/b", "/a/bc/d.yaml", "", false},
+		{"/a/b", "/a/c/d.yaml", "", false},
+	}
+	for _, test := range tests {
+		rel, ok := within(test.dir, test.path)
+		if ok != test.expected || rel != test.rel {
+			t.Fatalf("Expected within(%q, %q) to be %q, %v, but got %q, %v", test.dir, test.path, test.rel, test.expected, rel, ok)
+		}
+	}
+}
+
+// newTestWatcher returns a Watcher for the manifests in a new manifest directory, writing to a new
+// output directory
+func newTestWatcher(t *testing.T, files map[string]string) (*Watcher, string) {
+	return newTestWatcherWithOptions(t, projector.Options{}, files)
+}
+
+// newTestWatcherWithOptions is newTestWatcher, with a projector made from opts
+func newTestWatcherWithOptions(t *testing.T, opts projector.Options, files map[string]string) (*Watcher, string) {
+	manifestDir := t.TempDir()
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(manifestDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	opts.ConfigRoot = "test/sources"
+	opts.ManifestDir = manifestDir
+	opts.Generation = "unittest123"
+	p, err := projector.New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep := report.New()
+	manifests, err := p.LoadDir(manifestDir, rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.OK() {
+		t.Fatalf("Expected manifests to load, but got %v", rep.Problems)
+	}
+	w, err := New(p, manifests, Options{OutputDir: t.TempDir(), Timestamp: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { w.Close() })
+	w.opts.Report = func(rep *report.Report) {
+		t.Fatalf("Expected no problems, but got %v", rep.Problems)
+	}
+	return w, manifestDir
+}
+
+func (w *Watcher) outputExists(name string) bool {
+	_, err := os.Stat(filepath.Join(w.outputDir, output.BuildFileOutputName("test", name, 1)))
+	return err == nil
+}
+
+func TestReloadRemovesRenamedManifests(t *testing.T) {
+	w, dir := newTestWatcher(t, map[string]string{"hostport.yaml": fmt.Sprintf(hostportManifest, "hostport")})
+	w.project(w.manifests.Keys())
+	if !w.outputExists("hostport") {
+		t.Fatal("Expected test/hostport to be projected")
+	}
+
+	path := filepath.Join(dir, "hostport.yaml")
+	if err := ioutil.WriteFile(path, []byte(fmt.Sprintf(hostportManifest, "renamed")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w.changed([]string{path})
+	if w.outputExists("hostport") {
+		t.Fatal("Expected the output of test/hostport to be removed once it was renamed")
+	}
+	if !w.outputExists("renamed") {
+		t.Fatal("Expected test/renamed to be projected")
+	}
+	if keys := w.manifests.Keys(); !reflect.DeepEqual(keys, []string{"test/renamed"}) {
+		t.Fatalf("Expected only test/renamed to be loaded, but got %v", keys)
+	}
+	if _, ok := w.projected["test/hostport"]; ok {
+		t.Fatal("Expected test/hostport to be forgotten")
+	}
+}
+
+func TestReloadRemovesDeletedManifests(t *testing.T) {
+	w, dir := newTestWatcher(t, map[string]string{
+		"hostport.yaml": fmt.Sprintf(hostportManifest, "hostport"),
+		"other.yaml":    fmt.Sprintf(hostportManifest, "other"),
+	})
+	w.project(w.manifests.Keys())
+
+	path := filepath.Join(dir, "hostport.yaml")
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	w.changed([]string{path})
+	if w.outputExists("hostport") {
+		t.Fatal("Expected the output of test/hostport to be removed once its manifest was deleted")
+	}
+	if !w.outputExists("other") {
+		t.Fatal("Expected the output of test/other to be left alone")
+	}
+	if keys := w.manifests.Keys(); !reflect.DeepEqual(keys, []string{"test/other"}) {
+		t.Fatalf("Expected only test/other to be loaded, but got %v", keys)
+	}
+}
+
+func TestChangedSourcesAreReprojected(t *testing.T) {
+	w, _ := newTestWatcher(t, map[string]string{"hostport.yaml": fmt.Sprintf(hostportManifest, "hostport")})
+	w.projected["test/hostport"] = map[string]string{"hostport": "stale"}
+	source, err := filepath.Abs("test/sources/test.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.changed([]string{source})
+	if !w.outputExists("hostport") {
+		t.Fatal("Expected test/hostport to be reprojected when test.json changed")
+	}
+	if w.projected["test/hostport"]["hostport"] == "stale" {
+		t.Fatal("Expected the projected data of test/hostport to be updated")
+	}
+}
+
+func TestChangedLibraryTemplatesAreReloaded(t *testing.T) {
+	libraryDir := t.TempDir()
+	template := filepath.Join(libraryDir, "hostport.yml")
+	writeTemplate := func(outputFile string) {
+		raw := fmt.Sprintf("data:\n- source: test.json\n  output_file: %s\n  extract: $.hostport\n", outputFile)
+		if err := ioutil.WriteFile(template, []byte(raw), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTemplate("hostport")
+	l, err := library.Load(libraryDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, _ := newTestWatcherWithOptions(t, projector.Options{Library: l}, map[string]string{
+		"hostport.yaml": "name: hostport\nnamespace: test\ninclude:\n- template: hostport\n",
+	})
+	w.project(w.manifests.Keys())
+	if _, ok := w.projected["test/hostport"]["hostport"]; !ok {
+		t.Fatalf("Expected the template to be projected, but got %v", w.projected["test/hostport"])
+	}
+
+	writeTemplate("renamed")
+	w.changed([]string{template})
+	if _, ok := w.projected["test/hostport"]["renamed"]; !ok {
+		t.Fatalf("Expected the .yml template to be reloaded, but got %v", w.projected["test/hostport"])
+	}
+}